@@ -4,8 +4,11 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
 
 	"github.com/vrischmann/envconfig"
 )
@@ -18,11 +21,17 @@ type LogConfig struct {
 	// use mozlog format
 	Mozlog bool `envconfig:"default=false"`
 
+	// indent mozlog JSON for reading during local development
+	Pretty bool `envconfig:"default=false"`
+
 	// Disable HTTP Logging
 	DisableHTTP bool `envconfig:"default=false"`
 
 	// Filter out all messages where errno=0
 	OnlyHTTPErrors bool `envconfig:"default=false"`
+
+	// log requests taking longer than this many milliseconds, 0 is disabled
+	SlowRequestMS int `envconfig:"default=0"`
 }
 
 // configures limits for web/SyncUserHandler
@@ -34,14 +43,48 @@ type UserHandlerConfig struct {
 	MaxTotalBytes         int `envconfig:"default=20971520"`
 	MaxBatchTTL           int `envconfig:"default=7200"`    // 2 hours
 	MaxRecordPayloadBytes int `envconfig:"default=2097152"` // 2MB
+
+	// max bytes of one record in an application/newlines POST
+	MaxRecordLineBytes int `envconfig:"default=2098176"` // 2MB + 1KB
+
+	// max ids in a GET or DELETE
+	MaxIdsPerRequest int `envconfig:"default=100"`
+
+	// max BSOs returned by a collection GET, 0 is unlimited
+	MaxBSOGetLimit int `envconfig:"default=0"`
+
+	// max body bytes of a full collection GET, 0 is unlimited
+	MaxResponseBytes int `envconfig:"default=0"`
+
+	// max total payload bytes per user, 0 disables quotas
+	QuotaBytes int `envconfig:"default=0"`
+
+	// milliseconds to wait for a user's other requests to finish, 0 waits forever
+	LockTimeout int `envconfig:"default=0"`
+
+	// max requests per user running or waiting, 0 is unlimited
+	MaxConcurrentRequests int `envconfig:"default=0"`
 }
 
 type PoolConfig struct {
-	Num           int `envconfig:"default=0"`
-	MaxSize       int `envconfig:"default=25"`
-	PurgeMinHours int `envconfig:"default=168"`
-	PurgeMaxHours int `envconfig:"default=336"`
-	VacuumKB      int `envconfig:"default=0"`
+	Num           int   `envconfig:"default=0"`
+	MaxSize       int   `envconfig:"default=25"`
+	Sizes         []int `envconfig:"optional"` // per pool MaxSize
+	PurgeMinHours int   `envconfig:"default=168"`
+	PurgeMaxHours int   `envconfig:"default=336"`
+	VacuumKB      int   `envconfig:"default=0"`
+
+	// how many recently active users to open at start up
+	PrewarmUsers int `envconfig:"default=0"`
+
+	// milliseconds to wait for a busy pool before sending a 503
+	AcquireTimeout int `envconfig:"default=0"`
+}
+
+// WriteLimit is a parsed COLLECTION_WRITE_LIMITS value
+type WriteLimit struct {
+	PerSecond float64
+	Burst     int
 }
 
 type SqliteConfig struct {
@@ -55,12 +98,21 @@ var Config struct {
 	Port     int
 	Secrets  []string
 	DataDir  string
-	Pool     *PoolConfig
-	Sqlite   *SqliteConfig
+
+	// Stripe databases across multiple data directories, e.g. one per
+	// disk. When set DATA_DIR is not used for databases. Users are
+	// assigned a directory by uid so do not reorder the list
+	DataDirs []string `envconfig:"optional"`
+
+	Pool   *PoolConfig
+	Sqlite *SqliteConfig
 
 	// Enable the pprof web endpoint /debug/pprof/
 	EnablePprof bool `envconfig:"default=false"`
 
+	// Enable the prometheus /metrics endpoint
+	EnableMetrics bool `envconfig:"default=false"`
+
 	// SyncUserHandler limits / configuration
 	// available as LIMIT_x
 	Limit *UserHandlerConfig
@@ -68,26 +120,128 @@ var Config struct {
 	// cache size in MB for /info/collections cache
 	InfoCacheSize int `envconfig:"default=0"`
 
+	// max size of request headers, larger requests get a 431
+	MaxHeaderBytes int `envconfig:"default=1048576"`
+
 	// max skew for hawk timestamps in seconds
 	HawkTimestampMaxSkew int `envconfig:"default=60"`
+
+	// number of hawk nonces remembered to reject replayed requests
+	HawkNonceCacheSize int `envconfig:"default=120000"`
+
+	// MAC algorithm of hawk requests, sha256 or sha1
+	HawkAlgorithm string `envconfig:"default=sha256"`
+
+	// Content-Type for BSO payloads fetched with ?raw=1
+	RawContentType string `envconfig:"default=application/octet-stream"`
+
+	// routes to turn off as name:status, e.g. collection_post:503
+	DisabledRoutes []string `envconfig:"optional"`
+
+	// per collection write limits as name:per_second:burst, e.g. tabs:0.5:10
+	CollectionWriteLimits []string `envconfig:"optional"`
+
+	// reject writes to collections that do not already exist
+	DisableAutoCreate bool `envconfig:"default=false"`
+
+	// generate ids for POSTed BSOs without one
+	AllowServerIds bool `envconfig:"default=false"`
+
+	// do not write sortindex only updates that do not change the value
+	SkipNoopSortIndex bool `envconfig:"default=false"`
+
+	// sortindex for new BSOs written without one as name:sortindex, e.g. history:100
+	DefaultSortIndexes []string `envconfig:"optional"`
+
+	// hours between purges of specific collections as name:hours, e.g. tabs:24
+	CollectionPurgeHours []string `envconfig:"optional"`
+
+	// store identical payloads once per user database
+	DedupPayloads bool `envconfig:"default=false"`
+
+	// seconds expired BSOs stay readable, 0 hides them right away
+	TTLGrace int `envconfig:"default=0"`
+
+	// lowercase and trim collection names
+	NormalizeCollectionNames bool `envconfig:"default=false"`
+
+	// 301 GETs for paths with a trailing slash instead of serving them
+	RedirectTrailingSlash bool `envconfig:"default=false"`
+
+	// max collections returned by the info endpoints, 0 is unlimited
+	MaxInfoCollections int `envconfig:"default=0"`
+
+	// collection GET offsets that get an X-Weave-Alert, 0 is disabled
+	OffsetAlertThreshold int `envconfig:"default=0"`
+
+	// seconds a request may take before a 503 is sent, 0 is unlimited
+	RequestTimeout int `envconfig:"default=0"`
+
+	// seconds sent in X-Weave-Backoff while it is turned on by the admin api
+	BackoffSeconds int `envconfig:"default=1800"`
+
+	// add a Server-Timing header to sync api responses
+	ServerTiming bool `envconfig:"default=false"`
+
+	// include a sortindex of 0 for BSOs that were written with one
+	ExplicitSortIndex bool `envconfig:"default=false"`
+
+	// append write operations to this file, disabled when blank
+	JournalFile string `envconfig:"optional"`
+
+	// serve the sync api under this path, e.g. /sync for /sync/1.5/...
+	PathPrefix string `envconfig:"optional"`
+
+	// also move / , /__heartbeat__ and /__version__ under PATH_PREFIX
+	PathPrefixInfo bool `envconfig:"default=false"`
+
+	// shared secret for the /__admin__/ and /__inspect__/ endpoints, disabled when blank
+	AdminSecret string `envconfig:"optional"`
 }
 
 // so we can use config.Port and not config.Config.Port
 var (
-	Hostname    string
-	Log         *LogConfig
-	Host        string
-	Port        int
-	DataDir     string
-	Secrets     []string
-	Pool        *PoolConfig
-	Sqlite      *SqliteConfig
-	EnablePprof bool
+	Hostname      string
+	Log           *LogConfig
+	Host          string
+	Port          int
+	DataDir       string
+	DataDirs      []string
+	Secrets       []string
+	Pool          *PoolConfig
+	Sqlite        *SqliteConfig
+	EnablePprof   bool
+	EnableMetrics bool
 
 	Limit *UserHandlerConfig
 
-	InfoCacheSize        int
-	HawkTimestampMaxSkew int
+	InfoCacheSize            int
+	MaxHeaderBytes           int
+	HawkTimestampMaxSkew     int
+	HawkNonceCacheSize       int
+	HawkAlgorithm            string
+	RawContentType           string
+	DisableAutoCreate        bool
+	AllowServerIds           bool
+	MaxInfoCollections       int
+	OffsetAlertThreshold     int
+	RequestTimeout           int
+	BackoffSeconds           int
+	ServerTiming             bool
+	ExplicitSortIndex        bool
+	NormalizeCollectionNames bool
+	RedirectTrailingSlash    bool
+	SkipNoopSortIndex        bool
+	DedupPayloads            bool
+	TTLGrace                 int
+	DisabledRoutes           map[string]int
+	CollectionWriteLimits    map[string]WriteLimit
+	DefaultSortIndexes       map[string]int
+	CollectionPurgeHours     map[string]int
+	JournalFile              string
+	PathPrefix               string
+	PathPrefixInfo           bool
+	AdminSecret              string
 )
 
 func init() {
@@ -99,28 +253,9 @@ func init() {
 		log.Fatal("Config.Error: PORT invalid")
 	}
 
-	if Config.DataDir != ":memory:" {
-		if _, err := os.Stat(Config.DataDir); os.IsNotExist(err) {
-			log.Fatal("Config Error: DATA_DIR does not exist")
-		}
-
-		stat, err := os.Stat(Config.DataDir)
-		if os.IsNotExist(err) {
-			log.Fatal("Config Error: DATA_DIR does not exist")
-		}
-		if !stat.IsDir() {
-			log.Fatal("Config Error: DATA_DIR is not a directory")
-		}
-
-		Config.DataDir = filepath.Clean(Config.DataDir)
-		testfile := Config.DataDir + string(os.PathSeparator) + "test.writable"
-		f, err := os.Create(testfile)
-		if err != nil {
-			log.Fatal("Config Error: DATA_DIR is not writable")
-		} else {
-			f.Close()
-			os.Remove(testfile)
-		}
+	Config.DataDir = checkDataDir("DATA_DIR", Config.DataDir)
+	for i, dir := range Config.DataDirs {
+		Config.DataDirs[i] = checkDataDir("DATA_DIRS", dir)
 	}
 
 	switch Config.Log.Level {
@@ -137,6 +272,17 @@ func init() {
 		Config.Pool.Num = runtime.NumCPU()
 	}
 
+	if len(Config.Pool.Sizes) > 0 {
+		if len(Config.Pool.Sizes) != Config.Pool.Num {
+			log.Fatal("POOL_SIZES must have POOL_NUM values")
+		}
+		for _, size := range Config.Pool.Sizes {
+			if size < 1 {
+				log.Fatal("POOL_SIZES values must be >= 1")
+			}
+		}
+	}
+
 	if Config.Limit.MaxPOSTRecords < 1 {
 		log.Fatal("LIMIT_MAX_POST_RECORDS must be >= 1")
 	}
@@ -155,11 +301,51 @@ func init() {
 	if Config.Limit.MaxRecordPayloadBytes < 1 {
 		log.Fatal("LIMIT_MAX_RECORD_PAYLOAD_BYTES must be >= 1")
 	}
+	if Config.Limit.MaxRecordLineBytes < 1 {
+		log.Fatal("LIMIT_MAX_RECORD_LINE_BYTES must be >= 1")
+	}
+	if Config.Limit.MaxIdsPerRequest < 1 || Config.Limit.MaxIdsPerRequest > 900 {
+		// sqlite limits the number of variables in a query to 999
+		log.Fatal("LIMIT_MAX_IDS_PER_REQUEST must be 1 to 900")
+	}
+	if Config.Limit.MaxResponseBytes < 0 {
+		log.Fatal("LIMIT_MAX_RESPONSE_BYTES must be >= 0")
+	}
+	if Config.Limit.QuotaBytes < 0 {
+		log.Fatal("LIMIT_QUOTA_BYTES must be >= 0")
+	}
+	if Config.Limit.LockTimeout < 0 {
+		log.Fatal("LIMIT_LOCK_TIMEOUT must be >= 0")
+	}
+
+	if Config.Log.SlowRequestMS < 0 {
+		log.Fatal("LOG_SLOW_REQUEST_MS must be >= 0")
+	}
+
+	if Config.OffsetAlertThreshold < 0 {
+		log.Fatal("OFFSET_ALERT_THRESHOLD must be >= 0")
+	}
+
+	if Config.RequestTimeout < 0 {
+		log.Fatal("REQUEST_TIMEOUT must be >= 0")
+	}
+
+	if Config.TTLGrace < 0 {
+		log.Fatal("TTL_GRACE must be >= 0")
+	}
 
 	if Config.InfoCacheSize < 0 {
 		log.Fatal("INFO_CACHE_SIZE must be >= 0")
 	}
 
+	if Config.Pool.PrewarmUsers < 0 {
+		log.Fatal("POOL_PREWARM_USERS must be >= 0")
+	}
+
+	if Config.Pool.AcquireTimeout < 0 {
+		log.Fatal("POOL_ACQUIRE_TIMEOUT must be >= 0")
+	}
+
 	if Config.Pool.VacuumKB < 0 {
 		log.Fatal("POOL_VACUUM_KB must be >= 0")
 	}
@@ -173,20 +359,165 @@ func init() {
 		log.Fatal("POOL_MAX_HOURS must be > POOL_MIN_HOURS")
 	}
 
+	if Config.MaxHeaderBytes < 1024 {
+		log.Fatal("MAX_HEADER_BYTES must be >= 1024")
+	}
+
+	DisabledRoutes = make(map[string]int)
+	for _, route := range Config.DisabledRoutes {
+		parts := strings.SplitN(route, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("DISABLED_ROUTES invalid value: %s, must be name:status", route)
+		}
+
+		status, err := strconv.Atoi(parts[1])
+		if err != nil || (status != 501 && status != 503) {
+			log.Fatalf("DISABLED_ROUTES invalid status for %s, must be 501 or 503", parts[0])
+		}
+
+		DisabledRoutes[parts[0]] = status
+	}
+
+	CollectionWriteLimits = make(map[string]WriteLimit)
+	for _, limit := range Config.CollectionWriteLimits {
+		parts := strings.Split(limit, ":")
+		if len(parts) != 3 {
+			log.Fatalf("COLLECTION_WRITE_LIMITS invalid value: %s, must be name:per_second:burst", limit)
+		}
+
+		perSecond, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || perSecond <= 0 {
+			log.Fatalf("COLLECTION_WRITE_LIMITS per_second for %s must be > 0", parts[0])
+		}
+
+		burst, err := strconv.Atoi(parts[2])
+		if err != nil || burst < 1 {
+			log.Fatalf("COLLECTION_WRITE_LIMITS burst for %s must be >= 1", parts[0])
+		}
+
+		CollectionWriteLimits[parts[0]] = WriteLimit{PerSecond: perSecond, Burst: burst}
+	}
+
+	DefaultSortIndexes = make(map[string]int)
+	for _, value := range Config.DefaultSortIndexes {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("DEFAULT_SORT_INDEXES invalid value: %s, must be name:sortindex", value)
+		}
+
+		sortIndex, err := strconv.Atoi(parts[1])
+		if err != nil || !syncstorage.SortIndexOk(sortIndex) {
+			log.Fatalf("DEFAULT_SORT_INDEXES invalid sortindex for %s", parts[0])
+		}
+
+		DefaultSortIndexes[parts[0]] = sortIndex
+	}
+
+	CollectionPurgeHours = make(map[string]int)
+	for _, value := range Config.CollectionPurgeHours {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("COLLECTION_PURGE_HOURS invalid value: %s, must be name:hours", value)
+		}
+
+		hours, err := strconv.Atoi(parts[1])
+		if err != nil || hours < 1 {
+			log.Fatalf("COLLECTION_PURGE_HOURS hours for %s must be >= 1", parts[0])
+		}
+
+		CollectionPurgeHours[parts[0]] = hours
+	}
+
+	if p := Config.PathPrefix; p != "" && (!strings.HasPrefix(p, "/") || strings.HasSuffix(p, "/")) {
+		log.Fatal("PATH_PREFIX must start with a / and not end with one")
+	}
+
 	if Config.HawkTimestampMaxSkew < 60 {
 		log.Fatal("HAWK_TIMESTAMP_MAX_SKEW must be >= 60")
 	}
 
+	if Config.HawkNonceCacheSize < 1 {
+		log.Fatal("HAWK_NONCE_CACHE_SIZE must be >= 1")
+	}
+
+	if Config.HawkAlgorithm != "sha256" && Config.HawkAlgorithm != "sha1" {
+		log.Fatal("HAWK_ALGORITHM must be sha256 or sha1")
+	}
+
+	if Config.MaxInfoCollections < 0 {
+		log.Fatal("MAX_INFO_COLLECTIONS must be >= 0")
+	}
+
+	if Config.BackoffSeconds < 1 {
+		log.Fatal("BACKOFF_SECONDS must be >= 1")
+	}
+
 	Hostname = Config.Hostname
 	Log = Config.Log
 	Host = Config.Host
 	Port = Config.Port
 	Secrets = Config.Secrets
 	DataDir = Config.DataDir
+	DataDirs = Config.DataDirs
 	Pool = Config.Pool
 	EnablePprof = Config.EnablePprof
+	EnableMetrics = Config.EnableMetrics
 	Limit = Config.Limit
 	Sqlite = Config.Sqlite
 	InfoCacheSize = Config.InfoCacheSize
+	MaxHeaderBytes = Config.MaxHeaderBytes
 	HawkTimestampMaxSkew = Config.HawkTimestampMaxSkew
+	HawkNonceCacheSize = Config.HawkNonceCacheSize
+	HawkAlgorithm = Config.HawkAlgorithm
+	RawContentType = Config.RawContentType
+	DisableAutoCreate = Config.DisableAutoCreate
+	AllowServerIds = Config.AllowServerIds
+
+	MaxInfoCollections = Config.MaxInfoCollections
+	NormalizeCollectionNames = Config.NormalizeCollectionNames
+	RedirectTrailingSlash = Config.RedirectTrailingSlash
+	SkipNoopSortIndex = Config.SkipNoopSortIndex
+	DedupPayloads = Config.DedupPayloads
+	TTLGrace = Config.TTLGrace
+	RequestTimeout = Config.RequestTimeout
+
+	BackoffSeconds = Config.BackoffSeconds
+	OffsetAlertThreshold = Config.OffsetAlertThreshold
+	ServerTiming = Config.ServerTiming
+	ExplicitSortIndex = Config.ExplicitSortIndex
+	JournalFile = Config.JournalFile
+	PathPrefix = Config.PathPrefix
+	PathPrefixInfo = Config.PathPrefixInfo
+	AdminSecret = Config.AdminSecret
+}
+
+// checkDataDir makes sure dir is a writable directory and returns
+// its cleaned path
+func checkDataDir(name, dir string) string {
+	if dir == ":memory:" {
+		return dir
+	}
+
+	stat, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		log.Fatalf("Config Error: %s %s does not exist", name, dir)
+	}
+	if err != nil {
+		log.Fatalf("Config Error: %s %s, %s", name, dir, err.Error())
+	}
+	if !stat.IsDir() {
+		log.Fatalf("Config Error: %s %s is not a directory", name, dir)
+	}
+
+	dir = filepath.Clean(dir)
+	testfile := dir + string(os.PathSeparator) + "test.writable"
+	f, err := os.Create(testfile)
+	if err != nil {
+		log.Fatalf("Config Error: %s %s is not writable", name, dir)
+	} else {
+		f.Close()
+		os.Remove(testfile)
+	}
+
+	return dir
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
@@ -44,34 +45,136 @@ func main() {
 	syncLimitConfig.MaxTotalRecords = config.Limit.MaxTotalRecords
 	syncLimitConfig.MaxBatchTTL = config.Limit.MaxBatchTTL * 1000
 	syncLimitConfig.MaxRecordPayloadBytes = config.Limit.MaxRecordPayloadBytes
+	syncLimitConfig.MaxRecordLineBytes = config.Limit.MaxRecordLineBytes
+	syncLimitConfig.MaxIdsPerRequest = config.Limit.MaxIdsPerRequest
+	syncLimitConfig.MaxBSOGetLimit = config.Limit.MaxBSOGetLimit
+	syncLimitConfig.MaxResponseBytes = config.Limit.MaxResponseBytes
+	syncLimitConfig.QuotaBytes = config.Limit.QuotaBytes
+	syncLimitConfig.LockTimeout = time.Duration(config.Limit.LockTimeout) * time.Millisecond
+	syncLimitConfig.MaxConcurrentRequests = config.Limit.MaxConcurrentRequests
+	syncLimitConfig.RawContentType = config.RawContentType
+	syncLimitConfig.DisabledRoutes = config.DisabledRoutes
+	syncLimitConfig.CollectionWriteLimits = make(map[string]web.RateLimit)
+	for name, limit := range config.CollectionWriteLimits {
+		syncLimitConfig.CollectionWriteLimits[name] = web.RateLimit{
+			PerSecond: limit.PerSecond,
+			Burst:     limit.Burst,
+		}
+	}
+	syncLimitConfig.CollectionPurgeIntervals = make(map[string]time.Duration)
+	for name, hours := range config.CollectionPurgeHours {
+		syncLimitConfig.CollectionPurgeIntervals[name] = time.Duration(hours) * time.Hour
+	}
+	syncLimitConfig.DisableAutoCreate = config.DisableAutoCreate
+	syncLimitConfig.AllowServerIds = config.AllowServerIds
+	syncLimitConfig.ServerTiming = config.ServerTiming
+	syncLimitConfig.ExplicitSortIndex = config.ExplicitSortIndex
+	syncLimitConfig.MaxInfoCollections = config.MaxInfoCollections
+	syncLimitConfig.OffsetAlertThreshold = config.OffsetAlertThreshold
+	syncLimitConfig.NormalizeCollectionNames = config.NormalizeCollectionNames
+	syncLimitConfig.RedirectTrailingSlash = config.RedirectTrailingSlash
+
+	if config.JournalFile != "" {
+		f, err := os.OpenFile(config.JournalFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("Could not open JOURNAL_FILE: %s", err.Error())
+		}
+		defer f.Close()
+		syncLimitConfig.Journal = web.NewJournal(f)
+	}
+
+	if config.EnableMetrics {
+		syncLimitConfig.PayloadSizes = web.NewHistogram("syncstorage_payload_bytes",
+			"Size of the BSO payloads written", web.PayloadSizeBuckets)
+	}
 
 	// The base functionality is the sync 1.5 api
+	dbConfig := &syncstorage.Config{
+		CacheSize:          config.Sqlite.CacheSize,
+		SkipNoopSortIndex:  config.SkipNoopSortIndex,
+		DedupPayloads:      config.DedupPayloads,
+		DefaultSortIndexes: config.DefaultSortIndexes,
+		TTLGrace:           time.Duration(config.TTLGrace) * time.Second,
+	}
+
+	// the recently active users are remembered across restarts in
+	// the data directory
+	var prewarmFile string
+	if config.DataDir != ":memory:" {
+		prewarmFile = filepath.Join(config.DataDir, "prewarm_uids")
+	}
+
 	poolHandler := web.NewSyncPoolHandler(&web.SyncPoolConfig{
 		Basepath:      config.DataDir,
+		Basepaths:     config.DataDirs,
 		NumPools:      config.Pool.Num,
 		MaxPoolSize:   config.Pool.MaxSize,
+		PoolSizes:     config.Pool.Sizes,
 		VacuumKB:      config.Pool.VacuumKB,
-		DBConfig:      &syncstorage.Config{config.Sqlite.CacheSize},
+		DBConfig:      dbConfig,
 		PurgeMinHours: config.Pool.PurgeMinHours,
 		PurgeMaxHours: config.Pool.PurgeMaxHours,
+		PrewarmUsers:  config.Pool.PrewarmUsers,
+		PrewarmFile:   prewarmFile,
+
+		AcquireTimeout: time.Duration(config.Pool.AcquireTimeout) * time.Millisecond,
 	}, syncLimitConfig)
 
 	var router http.Handler
 	router = poolHandler
 
+	var cacheHandler *web.CacheHandler
 	if config.InfoCacheSize > 0 {
-		router = web.NewCacheHandler(router, web.CacheConfig{MaxCacheSize: config.InfoCacheSize})
+		cacheHandler = web.NewCacheHandler(router, web.CacheConfig{MaxCacheSize: config.InfoCacheSize})
+		router = cacheHandler
 	}
 
 	// legacy weave hacks
 	router = web.NewWeaveHandler(router)
 
 	// All sync 1.5 access requires Hawk Authorization
-	router = web.NewHawkHandler(router, config.Secrets)
+	hawkHandler := web.NewHawkHandler(router, config.Secrets)
+	hawkHandler.Nonces = web.NewNonceLRU(config.HawkNonceCacheSize)
+	hawkHandler.Algorithm = config.HawkAlgorithm
+	router = hawkHandler
+
+	// Serve non sync 1.5 endpoints, by default at the root even when
+	// the api has a prefix so load balancer health checks do not change
+	if config.PathPrefix != "" && !config.PathPrefixInfo {
+		router = web.NewPrefixHandler(config.PathPrefix, router)
+	}
 
-	// Serve non sync 1.5 endpoints
 	router = web.NewInfoHandler(router)
 
+	if config.PathPrefix != "" && config.PathPrefixInfo {
+		router = web.NewPrefixHandler(config.PathPrefix, router)
+	}
+
+	// stop waiting for slow requests, admin requests are not limited
+	if config.RequestTimeout > 0 {
+		router = web.NewTimeoutHandler(router, time.Duration(config.RequestTimeout)*time.Second)
+	}
+
+	// asks clients to slow down when turned on with the admin api
+	backoffHandler := web.NewBackoffHandler(router, config.BackoffSeconds)
+	router = backoffHandler
+
+	// Operational endpoints, these bypass hawk
+	if config.AdminSecret != "" {
+		adminHandler := web.NewAdminHandler(router, poolHandler, config.AdminSecret)
+		adminHandler.Backoff = backoffHandler
+		adminHandler.Cache = cacheHandler
+		router = adminHandler
+	}
+
+	// a panic in one request returns a 500 instead of an empty response
+	router = web.NewRecoveryHandler(log.StandardLogger(), router)
+
+	if config.Log.SlowRequestMS > 0 {
+		router = web.NewSlowRequestHandler(log.StandardLogger(),
+			time.Duration(config.Log.SlowRequestMS)*time.Millisecond, router)
+	}
+
 	// Log all the things
 	if config.Log.DisableHTTP != true {
 		logHandler := web.NewLogHandler(log.StandardLogger(), router)
@@ -84,6 +187,12 @@ func main() {
 		router = logHandler
 	}
 
+	// scraped by prometheus, like pprof it bypasses logging
+	if config.EnableMetrics {
+		log.Info("Enabling metrics at /metrics")
+		router = web.NewMetricsHandler(router, syncLimitConfig.PayloadSizes)
+	}
+
 	if config.EnablePprof {
 		log.Info("Enabling pprof profile at /debug/pprof/")
 		router = web.NewPprofHandler(router)
@@ -93,12 +202,16 @@ func main() {
 	server := &http.Server{
 		Addr:    listenOn,
 		Handler: router,
+
+		// net/http responds with a 431 when this is exceeded
+		MaxHeaderBytes: config.MaxHeaderBytes,
 	}
 
 	if config.Log.Mozlog {
 		log.SetFormatter(&web.MozlogFormatter{
 			Hostname: config.Hostname,
 			Pid:      os.Getpid(),
+			Pretty:   config.Log.Pretty,
 		})
 	}
 
@@ -115,11 +228,17 @@ func main() {
 	log.WithFields(log.Fields{
 		"addr":                           listenOn,
 		"PID":                            os.Getpid(),
+		"LOG_SLOW_REQUEST_MS":            config.Log.SlowRequestMS,
+		"DATA_DIRS":                      config.DataDirs,
 		"POOL_NUM":                       config.Pool.Num,
 		"POOL_MAX_SIZE":                  config.Pool.MaxSize,
+		"POOL_SIZES":                     config.Pool.Sizes,
 		"POOL_VACUUM_KB":                 config.Pool.VacuumKB,
 		"POOL_PURGE_MIN_HOURS":           config.Pool.PurgeMinHours,
 		"POOL_PURGE_MAX_HOURS":           config.Pool.PurgeMaxHours,
+		"POOL_PREWARM_USERS":             config.Pool.PrewarmUsers,
+		"POOL_ACQUIRE_TIMEOUT":           fmt.Sprintf("%d ms", config.Pool.AcquireTimeout),
+		"COLLECTION_PURGE_HOURS":         config.CollectionPurgeHours,
 		"LIMIT_MAX_POST_RECORDS":         syncLimitConfig.MaxPOSTRecords,
 		"LIMIT_MAX_POST_BYTES":           syncLimitConfig.MaxPOSTBytes,
 		"LIMIT_MAX_TOTAL_RECORDS":        syncLimitConfig.MaxTotalRecords,
@@ -127,9 +246,40 @@ func main() {
 		"LIMIT_MAX_REQUEST_BYTES":        syncLimitConfig.MaxRequestBytes,
 		"LIMIT_MAX_BATCH_TTL":            fmt.Sprintf("%d seconds", syncLimitConfig.MaxBatchTTL/1000),
 		"LIMIT_MAX_RECORD_PAYLOAD_BYTES": syncLimitConfig.MaxRecordPayloadBytes,
+		"LIMIT_MAX_RECORD_LINE_BYTES":    syncLimitConfig.MaxRecordLineBytes,
+		"LIMIT_MAX_IDS_PER_REQUEST":      syncLimitConfig.MaxIdsPerRequest,
+		"LIMIT_MAX_BSO_GET_LIMIT":        syncLimitConfig.MaxBSOGetLimit,
+		"LIMIT_MAX_RESPONSE_BYTES":       syncLimitConfig.MaxResponseBytes,
+		"LIMIT_QUOTA_BYTES":              syncLimitConfig.QuotaBytes,
+		"LIMIT_MAX_CONCURRENT_REQUESTS":  syncLimitConfig.MaxConcurrentRequests,
+		"LIMIT_LOCK_TIMEOUT":             syncLimitConfig.LockTimeout.String(),
 		"SQLITE3_CACHE_SIZE":             config.Sqlite.CacheSize,
 		"INFO_CACHE_SIZE":                config.InfoCacheSize,
+		"MAX_HEADER_BYTES":               config.MaxHeaderBytes,
 		"HAWK_TIMESTAMP_MAX_SKEW":        hawk.MaxTimestampSkew.Seconds(),
+		"HAWK_ALGORITHM":                 config.HawkAlgorithm,
+		"RAW_CONTENT_TYPE":               config.RawContentType,
+		"DISABLED_ROUTES":                config.DisabledRoutes,
+		"COLLECTION_WRITE_LIMITS":        config.CollectionWriteLimits,
+		"DISABLE_AUTO_CREATE":            config.DisableAutoCreate,
+		"ALLOW_SERVER_IDS":               config.AllowServerIds,
+		"MAX_INFO_COLLECTIONS":           config.MaxInfoCollections,
+		"OFFSET_ALERT_THRESHOLD":         config.OffsetAlertThreshold,
+		"NORMALIZE_COLLECTION_NAMES":     config.NormalizeCollectionNames,
+		"REDIRECT_TRAILING_SLASH":        config.RedirectTrailingSlash,
+		"ENABLE_METRICS":                 config.EnableMetrics,
+		"SKIP_NOOP_SORTINDEX":            config.SkipNoopSortIndex,
+		"DEDUP_PAYLOADS":                 config.DedupPayloads,
+		"DEFAULT_SORT_INDEXES":           config.DefaultSortIndexes,
+		"TTL_GRACE":                      fmt.Sprintf("%d seconds", config.TTLGrace),
+		"SERVER_TIMING":                  config.ServerTiming,
+		"EXPLICIT_SORTINDEX":             config.ExplicitSortIndex,
+		"REQUEST_TIMEOUT":                fmt.Sprintf("%d seconds", config.RequestTimeout),
+		"BACKOFF_SECONDS":                fmt.Sprintf("%d seconds", config.BackoffSeconds),
+		"JOURNAL_FILE":                   config.JournalFile,
+		"PATH_PREFIX":                    config.PathPrefix,
+		"PATH_PREFIX_INFO":               config.PathPrefixInfo,
+		"ADMIN_ENABLED":                  config.AdminSecret != "",
 	}).Info("HTTP Listening at " + listenOn)
 
 	err := httpdown.ListenAndServe(server, hd)
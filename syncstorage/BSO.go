@@ -22,12 +22,44 @@ type BSO struct {
 	Payload   string
 	SortIndex int
 	TTL       int
+
+	// SortIndexSet is true when the BSO was written with a sortindex,
+	// even if it is 0. MarshalJSON only includes a sortindex of 0 when
+	// it is set
+	SortIndexSet bool
 }
 
 // MarshalJSON builds a custom json blob since there is no way good way of turning the
 // Modified int (in milliseconds) into seconds with two decimal places which the
 // api defines as the correct format. meh.
 func (b BSO) MarshalJSON() ([]byte, error) {
+	return b.marshalJSON(false, 0)
+}
+
+// MarshalJSONWithTTL is MarshalJSON with the remaining ttl in seconds
+// at now added. BSOs that never expire are written without one
+func (b BSO) MarshalJSONWithTTL(now int) ([]byte, error) {
+	return b.marshalJSON(true, now)
+}
+
+// RemainingTTL returns the seconds left at now before the BSO expires
+// or NoTTL when it was written without a TTL. BSOs kept readable by
+// the TTL grace period have 0 left
+func (b BSO) RemainingTTL(now int) int {
+	// BSOs written without a TTL get DEFAULT_BSO_TTL, an update keeps
+	// it so use a generous margin rather than an exact match
+	if b.TTL-now > DEFAULT_BSO_TTL/2 {
+		return NoTTL
+	}
+
+	if b.TTL <= now {
+		return 0
+	}
+
+	return (b.TTL - now) / 1000
+}
+
+func (b BSO) marshalJSON(withTTL bool, now int) ([]byte, error) {
 
 	buf := bsoBufferPool.Get().(*bytes.Buffer)
 	buf.Reset()
@@ -50,11 +82,18 @@ func (b BSO) MarshalJSON() ([]byte, error) {
 		return nil, err
 	}
 
-	if b.SortIndex != 0 {
+	if b.SortIndex != 0 || b.SortIndexSet {
 		buf.WriteString(`,"sortindex":`)
 		buf.WriteString(strconv.Itoa(b.SortIndex))
 	}
 
+	if withTTL {
+		if ttl := b.RemainingTTL(now); ttl != NoTTL {
+			buf.WriteString(`,"ttl":`)
+			buf.WriteString(strconv.Itoa(ttl))
+		}
+	}
+
 	buf.WriteString("}")
 	c := make([]byte, buf.Len())
 	copy(c, buf.Bytes())
@@ -31,6 +31,46 @@ func TestBSOtoJson(t *testing.T) {
 	}
 }
 
+func TestBSOtoJsonSortIndexSet(t *testing.T) {
+	assert := assert.New(t)
+
+	// a sortindex of 0 is left out unless it was set
+	b := BSO{Id: "b0", Modified: 1000, Payload: "x"}
+	j, err := json.Marshal(b)
+	if assert.NoError(err) {
+		assert.Equal(`{"id":"b0","modified":1.00,"payload":"x"}`, string(j))
+	}
+
+	b.SortIndexSet = true
+	j, err = json.Marshal(b)
+	if assert.NoError(err) {
+		assert.Equal(`{"id":"b0","modified":1.00,"payload":"x","sortindex":0}`, string(j))
+	}
+}
+
+func TestBSOtoJsonWithTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	b := BSO{Id: "b0", Modified: 1000, Payload: "x", TTL: 61000}
+	j, err := b.MarshalJSONWithTTL(1000)
+	if assert.NoError(err) {
+		assert.Equal(`{"id":"b0","modified":1.00,"payload":"x","ttl":60}`, string(j))
+	}
+
+	// never expiring BSOs have no ttl
+	b.TTL = 1000 + DEFAULT_BSO_TTL
+	j, err = b.MarshalJSONWithTTL(1000)
+	if assert.NoError(err) {
+		assert.Equal(`{"id":"b0","modified":1.00,"payload":"x"}`, string(j))
+	}
+
+	assert.Equal(NoTTL, b.RemainingTTL(1000))
+	assert.Equal(NoTTL, b.RemainingTTL(5000), "still never expires after an update")
+
+	b.TTL = 1000
+	assert.Equal(0, b.RemainingTTL(2000), "expired but within the grace period")
+}
+
 // abouts 2.5x slower than regular marshalling :\
 func BenchmarkBSOtoJson(b *testing.B) {
 	for i := 0; i < b.N; i++ {
@@ -1,7 +1,9 @@
 package syncstorage
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"strconv"
 	"strings"
@@ -32,6 +34,14 @@ var (
 	ErrInvalidLimit  = errors.New("Invalid LIMIT")
 	ErrInvalidOffset = errors.New("Invalid OFFSET")
 	ErrInvalidNewer  = errors.New("Invalid NEWER than")
+
+	// errUnchanged is returned by putBSO when an update was skipped
+	// because it would not change anything
+	errUnchanged = errors.New("BSO unchanged")
+
+	ErrOverQuota = errors.New("Over Quota")
+
+	ErrNotEmpty = errors.New("Database has data")
 )
 
 // dbTx allows passing of sql.DB or sql.Tx
@@ -53,9 +63,24 @@ const (
 	// which should be enough (in milliseconds)
 	DEFAULT_BSO_TTL = 100 * 365 * 24 * 60 * 60 * 1000
 
+	// NoTTL is the remaining TTL reported for BSOs that never expire
+	NoTTL = -1
+
 	STORAGE_LAST_MODIFIED = "Storage Last Modified"
 )
 
+// payloads smaller than this are always kept with the BSO since the
+// hash would take up most of the space saved
+const dedupMinPayloadSize = 256
+
+// payloadColumn selects a BSO's payload from wherever it is stored
+const payloadColumn = `CASE WHEN BSO.PayloadHash = '' THEN BSO.Payload
+	ELSE (SELECT Payloads.Payload FROM Payloads WHERE Payloads.Hash = BSO.PayloadHash) END`
+
+// sortIndexSetColumn selects if a BSO was written with a sortindex. BSOs
+// from before SCHEMA_4 only know that when it is not 0
+const sortIndexSetColumn = `(BSO.SortIndexSet OR BSO.SortIndex != 0)`
+
 type CollectionInfo struct {
 	Name     string
 	BSOs     int
@@ -104,6 +129,13 @@ func (g *GetResults) String() string {
 	return s
 }
 
+// GetIdsResults holds search results for BSO ids, this is what getBSOIds() returns
+type GetIdsResults struct {
+	Ids    []string
+	More   bool
+	Offset int
+}
+
 type DBPageStats struct {
 	Size  int
 	Total int
@@ -127,10 +159,34 @@ type DB struct {
 	Path string
 
 	db *sql.DB
+
+	skipNoopSortIndex  bool
+	dedupPayloads      bool
+	defaultSortIndexes map[string]int
+	ttlGrace           int // milliseconds
 }
 
 type Config struct {
 	CacheSize int
+
+	// SkipNoopSortIndex skips sortindex only updates that do not change
+	// the current value so the BSO's modified is not bumped. By default
+	// every update is written
+	SkipNoopSortIndex bool
+
+	// DedupPayloads stores identical payloads once and has BSOs refer to
+	// them. Reads work the same whether it is on or off
+	DedupPayloads bool
+
+	// DefaultSortIndexes maps collection names to the sortindex new BSOs
+	// get when they are written without one. Other collections use 0
+	DefaultSortIndexes map[string]int
+
+	// TTLGrace keeps expired BSOs readable for a while after their TTL
+	// ends so clients re-requesting a record that just expired do not get
+	// a 404. PurgeExpired waits for the grace period too. 0 hides them
+	// right away
+	TTLGrace time.Duration
 }
 
 func (d *DB) OpenWithConfig(conf *Config) (err error) {
@@ -155,6 +211,10 @@ func (d *DB) OpenWithConfig(conf *Config) (err error) {
 		}
 
 		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size=%d;", conf.CacheSize))
+		d.skipNoopSortIndex = conf.SkipNoopSortIndex
+		d.dedupPayloads = conf.DedupPayloads
+		d.defaultSortIndexes = conf.DefaultSortIndexes
+		d.ttlGrace = int(conf.TTLGrace / time.Millisecond)
 	}
 
 	for _, p := range pragmas {
@@ -170,60 +230,66 @@ func (d *DB) OpenWithConfig(conf *Config) (err error) {
 
 	// Initialize a new database with all the current schemas concatenated together
 	if schemaVersion == 0 {
-		tx, err := d.db.Begin()
-		if err != nil {
+		return d.applySchema(SCHEMA_0 + SCHEMA_1 + SCHEMA_2 + SCHEMA_3 + SCHEMA_4)
+	}
+
+	// Migrate schema to the latest version. Considering the rate of
+	// schema change, we can probably just keep it simple yet
+	// slightly more verbose using, `if userVersion == ...` statements
+	var userVersion int
+	if err := d.db.QueryRow("PRAGMA user_version;").Scan(&userVersion); err != nil {
+		return err
+	}
+
+	// SCHEMA_0 did not alter PRAGMA user_version so it defaults to 0
+	if userVersion == 0 {
+		if err := d.applySchema(SCHEMA_1); err != nil {
 			return err
 		}
 
-		if _, err := tx.Exec(SCHEMA_0 + SCHEMA_1); err != nil {
-			if rollbackErr := tx.Rollback(); rollbackErr != nil {
-				return rollbackErr
-			} else {
-				return err
-			}
-		} else {
-			if err := tx.Commit(); err != nil {
-				return err
-			}
-		}
-	} else {
-		// Migrate schema to the latest version. At the time of this
-		// comment there is only SCHEMA_1. Considering the rate of
-		// schema change, we can probably just keep it simple yet
-		// slightly more verbose using, `if userVersion == ...` statements
-		var userVersion int
-		if err := d.db.QueryRow("PRAGMA user_version;").Scan(&userVersion); err != nil {
+		// SCHEMA_1 sets PRAGMA user_version to 2 so the count
+		// of schemas applied is caught up and correct.
+		userVersion = 2
+	}
+
+	if userVersion == 2 {
+		if err := d.applySchema(SCHEMA_2); err != nil {
 			return err
 		}
+		userVersion = 3
+	}
 
-		// SCHEMA_0 did not alter PRAGMA user_version so it defaults to 0
-		if userVersion == 0 {
-			tx, err := d.db.Begin()
-			if err != nil {
-				return err
-			}
+	if userVersion == 3 {
+		if err := d.applySchema(SCHEMA_3); err != nil {
+			return err
+		}
+		userVersion = 4
+	}
 
-			if _, err := tx.Exec(SCHEMA_1); err != nil {
-				if rollbackErr := tx.Rollback(); rollbackErr != nil {
-					return rollbackErr
-				} else {
-					return err
-				}
-			} else {
-				if err := tx.Commit(); err != nil {
-					return err
-				}
-			}
+	if userVersion == 4 {
+		if err := d.applySchema(SCHEMA_4); err != nil {
+			return err
 		}
+	}
 
-		// SCHEMA_1 sets PRAGMA user_version to 2 so the count
-		// of schemas applied is caught up and correct.
-		// putting this here for posterity and next schema upgrade
+	return nil
+}
 
-		// if userVersion == 2 { ... }
+// applySchema runs schema in a transaction
+func (d *DB) applySchema(schema string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
 	}
 
-	return nil
+	if _, err := tx.Exec(schema); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (d *DB) Open() (err error) {
@@ -271,10 +337,17 @@ func (d *DB) LastModified() (int, error) {
 	return int(lastModInt64), nil
 }
 
+// GetCollectionId looks up a collection's id by name. It never creates
+// the collection and returns ErrNotFound when it does not exist, so it is
+// safe to use on read paths. Use CreateCollection to add one
 func (d *DB) GetCollectionId(name string) (id int, err error) {
 	d.Lock()
 	defer d.Unlock()
 
+	return d.getCollectionId(d.db, name)
+}
+
+func (d *DB) getCollectionId(tx dbTx, name string) (id int, err error) {
 	// return common collection id without touching the DB
 	// ew? yes, but it'll compile nice and fast
 	switch name {
@@ -311,7 +384,7 @@ func (d *DB) GetCollectionId(name string) (id int, err error) {
 		return
 	}
 
-	err = d.db.QueryRow("SELECT Id FROM Collections where Name=?", name).Scan(&id)
+	err = tx.QueryRow("SELECT Id FROM Collections where Name=?", name).Scan(&id)
 
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
@@ -331,6 +404,8 @@ func (d *DB) GetCollectionModified(cId int) (modified int, err error) {
 	return
 }
 
+// CreateCollection returns the id of a new collection or of the existing
+// one with the same name
 func (d *DB) CreateCollection(name string) (cId int, err error) {
 	d.Lock()
 	defer d.Unlock()
@@ -345,23 +420,25 @@ func (d *DB) CreateCollection(name string) (cId int, err error) {
 		return 0, err
 	}
 
-	modified := Now()
-	dml := "INSERT INTO Collections (Name, Modified) VALUES (?,?)"
-
-	results, err := tx.Exec(dml, name, modified)
-	if err != nil {
+	if cId, err = d.createCollection(tx, name, Now()); err != nil {
 		tx.Rollback()
 		return 0, err
 	}
 
-	cId64, err := results.LastInsertId()
-	if err != nil {
-		tx.Rollback()
-		return 0, err
+	return cId, tx.Commit()
+}
+
+func (d *DB) createCollection(tx dbTx, name string, modified int) (cId int, err error) {
+	// requests creating a collection on demand race between looking it
+	// up and creating it. The loser uses the winner's collection instead
+	// of failing on the UNIQUE Name
+	dml := "INSERT OR IGNORE INTO Collections (Name, Modified) VALUES (?,?)"
+	if _, err = tx.Exec(dml, name, modified); err != nil {
+		return
 	}
 
-	tx.Commit()
-	return int(cId64), nil
+	err = tx.QueryRow("SELECT Id FROM Collections WHERE Name=?", name).Scan(&cId)
+	return
 }
 
 func (d *DB) DeleteCollection(cId int) (int, error) {
@@ -410,6 +487,117 @@ func (d *DB) DeleteEverything() (err error) {
 	return
 }
 
+// CopyTo copies every collection and unexpired BSO into dst, keeping
+// their modified times and TTLs so clients see the same data. dst must
+// not have any BSOs, ErrNotEmpty is returned otherwise. Collection ids
+// are looked up by name since custom collections can have different ids.
+// It returns the number of BSOs copied
+func (d *DB) CopyTo(dst *DB) (copied int, err error) {
+	if d == dst {
+		return 0, errors.New("Can not copy a database to itself")
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	dst.Lock()
+	defer dst.Unlock()
+
+	tx, err := dst.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	copied, err = d.copyTo(dst, tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return copied, tx.Commit()
+}
+
+func (d *DB) copyTo(dst *DB, tx dbTx) (copied int, err error) {
+	var existing int
+	if err = tx.QueryRow("SELECT COUNT(*) FROM BSO").Scan(&existing); err != nil {
+		return
+	} else if existing > 0 {
+		return 0, ErrNotEmpty
+	}
+
+	type collection struct {
+		id       int
+		name     string
+		modified int
+	}
+
+	rows, err := d.db.Query("SELECT Id, Name, Modified FROM Collections WHERE Modified != 0")
+	if err != nil {
+		return
+	}
+
+	var collections []collection
+	for rows.Next() {
+		var c collection
+		if err = rows.Scan(&c.id, &c.name, &c.modified); err != nil {
+			rows.Close()
+			return
+		}
+		collections = append(collections, c)
+	}
+	rows.Close()
+
+	cutoff := d.ttlCutoff()
+	for _, c := range collections {
+		if _, err = tx.Exec("INSERT OR IGNORE INTO Collections (Name) VALUES (?)", c.name); err != nil {
+			return
+		}
+
+		var cId int
+		if err = tx.QueryRow("SELECT Id FROM Collections WHERE Name=?", c.name).Scan(&cId); err != nil {
+			return
+		}
+
+		rows, err = d.db.Query("SELECT BSO.Id, BSO.SortIndex, "+sortIndexSetColumn+", "+payloadColumn+", BSO.Modified, BSO.TTL "+
+			"FROM BSO WHERE CollectionId=? AND TTL > ?", c.id, cutoff)
+		if err != nil {
+			return
+		}
+
+		for rows.Next() {
+			var b BSO
+			if err = rows.Scan(&b.Id, &b.SortIndex, &b.SortIndexSet, &b.Payload, &b.Modified, &b.TTL); err != nil {
+				rows.Close()
+				return
+			}
+
+			// insertBSO takes the TTL relative to modified
+			if err = dst.insertBSO(tx, cId, b.Id, b.Modified, b.Payload, b.SortIndex, b.SortIndexSet, b.TTL-b.Modified); err != nil {
+				rows.Close()
+				return 0, errors.Wrapf(err, "Could not copy %s/%s", c.name, b.Id)
+			}
+			copied++
+		}
+
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return
+		}
+
+		if err = dst.touchCollection(tx, cId, c.modified); err != nil {
+			return
+		}
+	}
+
+	// the storage timestamp can be later than any collection's, e.g.
+	// after a collection was deleted
+	lastModified, err := getKey(d.db, STORAGE_LAST_MODIFIED)
+	if err != nil || lastModified == "" {
+		return
+	}
+
+	return copied, setKey(tx, STORAGE_LAST_MODIFIED, lastModified)
+}
+
 func (d *DB) TouchCollection(cId, modified int) (err error) {
 	d.Lock()
 	defer d.Unlock()
@@ -417,7 +605,8 @@ func (d *DB) TouchCollection(cId, modified int) (err error) {
 	return d.touchCollectionAndStorage(d.db, cId, modified)
 }
 
-// InfoCollections create a map of collection names to last modified times
+// InfoCollections create a map of collection names to last modified times.
+// The map is empty, never nil, when there is no data so it encodes as {}
 func (d *DB) InfoCollections() (map[string]int, error) {
 	d.Lock()
 	defer d.Unlock()
@@ -468,6 +657,8 @@ func (d *DB) InfoQuota() (used, quota int, err error) {
 	}
 }
 
+// InfoCollectionUsage maps collection names to their payload bytes. Like
+// InfoCollections the map is never nil
 func (d *DB) InfoCollectionUsage() (map[string]int, error) {
 	d.Lock()
 	defer d.Unlock()
@@ -496,13 +687,14 @@ func (d *DB) InfoCollectionUsage() (map[string]int, error) {
 	return results, nil
 }
 
+// InfoCollectionCounts maps collection names to their number of BSOs. Like
+// InfoCollections the map is never nil
 func (d *DB) InfoCollectionCounts() (map[string]int, error) {
 	d.Lock()
 	defer d.Unlock()
 
-	query := `SELECT c.Name, count(b.Id) count
-			  FROM BSO b, Collections C
-			  WHERE b.CollectionId=c.Id GROUP BY b.CollectionId`
+	// Count is kept up to date by triggers, see SCHEMA_3
+	query := "SELECT Name, Count FROM Collections WHERE Count > 0"
 
 	rows, err := d.db.Query(query)
 	if err != nil {
@@ -540,41 +732,158 @@ func NewPutBSOInput(id string, payload *string, sortIndex, ttl *int) *PutBSOInpu
 	return &PutBSOInput{Id: id, TTL: ttl, SortIndex: sortIndex, Payload: payload}
 }
 
+// PostBSOs writes all the BSOs in a single transaction, which is much
+// faster than calling PutBSO for each one. Results are reported per BSO id
 func (d *DB) PostBSOs(cId int, input PostBSOInput) (*PostResults, error) {
+	results, _, err := d.PostBSOsQuota(cId, input, 0)
+	return results, err
+}
+
+// PostBSOsQuota is like PostBSOs but limits the total bytes of payloads
+// stored for the user to quota. BSOs are accepted until one would exceed
+// the quota, it and the rest are failed with ErrOverQuota. When not even
+// the first BSO fits nothing is written and ErrOverQuota is returned.
+// Filling the quota exactly is allowed. remaining is the number of bytes
+// left after the POST, or before it when it is over quota. A quota <= 0
+// is unlimited.
+func (d *DB) PostBSOsQuota(cId int, input PostBSOInput, quota int) (results *PostResults, remaining int, err error) {
 	d.Lock()
 	defer d.Unlock()
 
 	tx, err := d.db.Begin()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+
+	var used int
+	if quota > 0 {
+		if used, err = d.payloadBytes(tx); err != nil {
+			tx.Rollback()
+			return nil, 0, err
+		}
 	}
 
 	modified := Now() // same modified timestamp for all INSERT/UPDATES
-	results := NewPostResults(modified)
+	results = NewPostResults(modified)
+	written, unchanged := 0, 0
+	usedBefore := used
+	overQuota := false
 
 	for _, data := range input {
+		// quota accounting has to happen as each BSO is written so
+		// the ones that fit are still accepted
+		delta := 0
+		if quota > 0 && !overQuota && data.Payload != nil {
+			size, err := d.bsoPayloadSize(tx, cId, data.Id)
+			if err != nil {
+				tx.Rollback()
+				return nil, 0, err
+			}
+
+			delta = len(*data.Payload) - size
+			if used+delta > quota {
+				overQuota = true
+			}
+		}
+
+		if overQuota {
+			results.AddFailure(data.Id, ErrOverQuota.Error())
+			continue
+		}
+
 		err := d.putBSO(tx, cId, data.Id, modified, data.Payload, data.SortIndex, data.TTL)
-		if err != nil {
+		if err == errUnchanged {
+			results.AddSuccess(data.Id)
+			unchanged++
+			continue
+		} else if err != nil {
 			results.AddFailure(data.Id, err.Error())
 			continue
 		} else {
 			results.AddSuccess(data.Id)
+			used += delta
+			written++
 		}
 	}
 
-	// update the collection
-	err = d.touchCollectionAndStorage(tx, cId, modified)
-	if err != nil {
+	if overQuota && len(results.Success) == 0 {
 		tx.Rollback()
-		return nil, err
+		return nil, quotaRemaining(usedBefore, quota), ErrOverQuota
+	}
+
+	if written == 0 && unchanged > 0 {
+		// only no-op updates, leave the collection's modified alone
+		err = tx.QueryRow("SELECT modified FROM Collections WHERE Id=?", cId).Scan(&results.Modified)
+		if err != nil {
+			tx.Rollback()
+			return nil, 0, err
+		}
+	} else {
+		// update the collection
+		err = d.touchCollectionAndStorage(tx, cId, modified)
+		if err != nil {
+			tx.Rollback()
+			return nil, 0, err
+		}
 	}
 
 	tx.Commit()
-	return results, nil
+
+	if overQuota {
+		return results, 0, nil
+	}
+
+	return results, quotaRemaining(used, quota), nil
+}
+
+// quotaRemaining returns the bytes left in quota, 0 when it is used up or
+// there is no quota
+func quotaRemaining(used, quota int) int {
+	if quota > 0 && used < quota {
+		return quota - used
+	}
+	return 0
+}
+
+// checkQuota returns how many bytes of quota will be left once a BSO's
+// payload is replaced, ErrOverQuota if it does not fit. A nil payload
+// leaves the stored one alone so it always fits
+func (d *DB) checkQuota(tx dbTx, cId int, bId string, payload *string, quota int) (remaining int, err error) {
+	if quota <= 0 {
+		return 0, nil
+	}
+
+	used, err := d.payloadBytes(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	if payload == nil {
+		return quotaRemaining(used, quota), nil
+	}
+
+	size, err := d.bsoPayloadSize(tx, cId, bId)
+	if err != nil {
+		return 0, err
+	}
+
+	if after := used - size + len(*payload); after > quota {
+		return quotaRemaining(used, quota), ErrOverQuota
+	} else {
+		return quotaRemaining(after, quota), nil
+	}
 }
 
 // PutBSO creates or updates a BSO
 func (d *DB) PutBSO(cId int, bId string, payload *string, sortIndex *int, ttl *int) (modified int, err error) {
+	modified, _, err = d.PutBSOQuota(cId, bId, payload, sortIndex, ttl, 0)
+	return
+}
+
+// PutBSOQuota is like PutBSO but fails with ErrOverQuota, without writing
+// anything, if the new payload would take the user's total over quota.
+// remaining is the number of bytes left. A quota <= 0 is unlimited
+func (d *DB) PutBSOQuota(cId int, bId string, payload *string, sortIndex *int, ttl *int, quota int) (modified, remaining int, err error) {
 	d.Lock()
 	defer d.Unlock()
 
@@ -583,9 +892,22 @@ func (d *DB) PutBSO(cId int, bId string, payload *string, sortIndex *int, ttl *i
 		return
 	}
 
+	if remaining, err = d.checkQuota(tx, cId, bId, payload, quota); err != nil {
+		tx.Rollback()
+		return
+	}
+
 	modified = Now()
 	err = d.putBSO(tx, cId, bId, modified, payload, sortIndex, ttl)
 
+	if err == errUnchanged {
+		// nothing was written, the BSO keeps its modified
+		query := "SELECT Modified FROM BSO WHERE CollectionId=? AND Id=?"
+		err = tx.QueryRow(query, cId, bId).Scan(&modified)
+		tx.Rollback()
+		return
+	}
+
 	if err != nil {
 		tx.Rollback()
 		return
@@ -602,6 +924,68 @@ func (d *DB) PutBSO(cId int, bId string, payload *string, sortIndex *int, ttl *i
 	return
 }
 
+// ReplaceBSO creates or overwrites a BSO. Unlike PutBSO, which leaves
+// the fields that are not given unchanged, missing fields are reset to what
+// a new BSO gets: an empty payload, the collection's default sortindex and
+// DEFAULT_BSO_TTL
+func (d *DB) ReplaceBSO(cId int, bId string, payload *string, sortIndex *int, ttl *int) (modified int, err error) {
+	modified, _, err = d.ReplaceBSOQuota(cId, bId, payload, sortIndex, ttl, 0)
+	return
+}
+
+// ReplaceBSOQuota is like ReplaceBSO but fails with ErrOverQuota, without
+// writing anything, if the new payload would take the user's total over
+// quota. remaining is the number of bytes left. A quota <= 0 is unlimited
+func (d *DB) ReplaceBSOQuota(cId int, bId string, payload *string, sortIndex *int, ttl *int, quota int) (modified, remaining int, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return
+	}
+
+	if payload == nil {
+		payload = String("")
+	}
+
+	if remaining, err = d.checkQuota(tx, cId, bId, payload, quota); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	// the default sortindex replaces the old one but is not recorded as
+	// set by the client
+	sortIndexSet := sortIndex != nil
+	if sortIndex == nil {
+		var s int
+		if s, err = d.defaultSortIndex(tx, cId); err != nil {
+			tx.Rollback()
+			return
+		}
+		sortIndex = &s
+	}
+
+	if ttl == nil {
+		t := DEFAULT_BSO_TTL
+		ttl = &t
+	}
+
+	modified = Now()
+	if err = d.writeBSO(tx, cId, bId, modified, payload, sortIndex, sortIndexSet, ttl); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	if err = d.touchCollectionAndStorage(tx, cId, modified); err != nil {
+		tx.Rollback()
+		return
+	}
+
+	tx.Commit()
+	return
+}
+
 func (d *DB) GetBSO(cId int, bId string) (b *BSO, err error) {
 	d.Lock()
 	defer d.Unlock()
@@ -611,11 +995,41 @@ func (d *DB) GetBSO(cId int, bId string) (b *BSO, err error) {
 	return
 }
 
+// GetBSOTTL returns the number of seconds until a BSO expires or NoTTL
+// when it was written without a TTL
+func (d *DB) GetBSOTTL(cId int, bId string) (int, error) {
+	if !BSOIdOk(bId) {
+		return 0, ErrInvalidBSOId
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	b := BSO{Id: bId}
+	err := d.db.QueryRow("SELECT TTL FROM BSO WHERE CollectionId=? and Id=? and TTL >= ?",
+		cId, bId, d.ttlCutoff()).Scan(&b.TTL)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+
+	return b.RemainingTTL(Now()), nil
+}
+
+// GetBSOs returns the BSOs in a collection. Both time bounds are
+// exclusive: only BSOs with newer < Modified < older are returned. A client
+// can pass the Modified of the last BSO it saw as newer to fetch the
+// records after it. When expiresBefore > 0 only BSOs whose TTL ends at
+// or before it are returned
 func (d *DB) GetBSOs(
 	cId int,
 	ids []string,
 	older int,
 	newer int,
+	expiresBefore int,
 
 	sort SortType,
 	limit int,
@@ -624,27 +1038,259 @@ func (d *DB) GetBSOs(
 	d.Lock()
 	defer d.Unlock()
 
-	r, err = d.getBSOs(d.db, cId, ids, older, newer, sort, limit, offset)
+	r, err = d.getBSOs(d.db, cId, ids, older, newer, expiresBefore, sort, limit, offset)
 
 	return
 }
 
-func (d *DB) GetBSOModified(cId int, bId string) (modified int, err error) {
+// ForEachBSO takes the same arguments as GetBSOs but calls fn with each
+// BSO as it is read instead of collecting them, so memory use does not
+// grow with the number of results. The database stays locked until it
+// returns. It stops at the first error from fn. more is true when there
+// are BSOs after limit
+func (d *DB) ForEachBSO(
+	cId int,
+	ids []string,
+	older int,
+	newer int,
+	expiresBefore int,
+
+	sort SortType,
+	limit int,
+	offset int,
+	fn func(*BSO) error) (more bool, err error) {
+
 	d.Lock()
 	defer d.Unlock()
-	err = d.db.QueryRow(`SELECT modified
-						 FROM BSO
-						 WHERE CollectionId=? and Id=? and TTL > ?`, cId, bId, Now()).Scan(&modified)
 
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return 0, ErrNotFound
-		}
+	return d.forEachBSO(d.db, cId, ids, older, newer, expiresBefore, d.ttlCutoff(), sort, limit, offset, fn)
+}
 
-		return 0, err
-	}
+// BSOPages reads the results of a GetBSOs query a page at a time. The DB
+// is only locked while a page is read so callers can write each one out,
+// e.g. to a slow client, without holding up other users of the DB. Every
+// page checks expiry against the time NewBSOPages was called so BSOs
+// expiring in between do not shift the pages or disagree with Total. The
+// pages are only consistent if the collection is not written to until
+// the last one is read
+type BSOPages struct {
+	// Total is the number of BSOs the query matches, ignoring limit
+	// and offset. It is counted in the same transaction as the first page
+	Total int
 
-	return
+	d      *DB
+	cutoff int
+
+	cId           int
+	ids           []string
+	older         int
+	newer         int
+	expiresBefore int
+	sort          SortType
+	limit         int
+	offset        int
+	pageSize      int
+
+	first []*BSO
+	read  int
+	done  bool
+}
+
+// NewBSOPages takes the same arguments as GetBSOs and the number of BSOs
+// to read for each page. The count and the first page are read right away
+func (d *DB) NewBSOPages(
+	cId int,
+	ids []string,
+	older int,
+	newer int,
+	expiresBefore int,
+
+	sort SortType,
+	limit int,
+	offset int,
+	pageSize int) (*BSOPages, error) {
+
+	if pageSize < 1 {
+		return nil, errors.New("pageSize must be > 0")
+	}
+
+	p := &BSOPages{
+		d:             d,
+		cutoff:        d.ttlCutoff(),
+		cId:           cId,
+		ids:           ids,
+		older:         older,
+		newer:         newer,
+		expiresBefore: expiresBefore,
+		sort:          sort,
+		limit:         limit,
+		offset:        offset,
+		pageSize:      pageSize,
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if p.Total, err = d.countBSOs(tx, cId, ids, older, newer, expiresBefore, p.cutoff); err != nil {
+		return nil, err
+	}
+
+	if p.first, err = p.readPage(tx); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Next returns the next page of BSOs. It is empty when there are no more
+func (p *BSOPages) Next() ([]*BSO, error) {
+	if p.first != nil {
+		page := p.first
+		p.first = nil
+		return page, nil
+	}
+
+	p.d.Lock()
+	defer p.d.Unlock()
+
+	return p.readPage(p.d.db)
+}
+
+func (p *BSOPages) readPage(tx dbTx) ([]*BSO, error) {
+	size := p.pageSize
+	if p.limit >= 0 && p.limit-p.read < size {
+		size = p.limit - p.read
+	}
+
+	if p.done || size == 0 {
+		p.done = true
+		return []*BSO{}, nil
+	}
+
+	page := make([]*BSO, 0, size)
+	more, err := p.d.forEachBSO(tx, p.cId, p.ids, p.older, p.newer, p.expiresBefore, p.cutoff,
+		p.sort, size, p.offset+p.read,
+		func(b *BSO) error {
+			page = append(page, b)
+			return nil
+		})
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.read += len(page)
+	p.done = !more
+	return page, nil
+}
+
+// GetBSOIds takes the same arguments as GetBSOs, with the same exclusive
+// time bounds, but only returns the ids of the matching BSOs
+func (d *DB) GetBSOIds(
+	cId int,
+	ids []string,
+	older int,
+	newer int,
+	expiresBefore int,
+
+	sort SortType,
+	limit int,
+	offset int) (r *GetIdsResults, err error) {
+
+	d.Lock()
+	defer d.Unlock()
+
+	r, err = d.getBSOIds(d.db, cId, ids, older, newer, expiresBefore, sort, limit, offset)
+
+	return
+}
+
+// GetBSOsAcrossCollections fetches specific BSOs from several collections
+// with a single query, e.g. meta/global and crypto/keys when a client
+// starts syncing. ids maps collection names to the BSO ids wanted from
+// them. The results are grouped by collection name and sorted by id.
+// Unknown collections and BSOs are left out
+func (d *DB) GetBSOsAcrossCollections(ids map[string][]string) (map[string][]*BSO, error) {
+	results := make(map[string][]*BSO)
+
+	var (
+		clauses []string
+		values  = []interface{}{d.ttlCutoff()}
+	)
+
+	for name, bIds := range ids {
+		if !CollectionNameOk(name) {
+			return nil, ErrInvalidCollectionName
+		}
+
+		if len(bIds) == 0 {
+			continue
+		}
+
+		values = append(values, name)
+		for _, bId := range bIds {
+			if !BSOIdOk(bId) {
+				return nil, ErrInvalidBSOId
+			}
+			values = append(values, bId)
+		}
+
+		clauses = append(clauses,
+			"(Collections.Name=? AND BSO.Id IN (?"+strings.Repeat(",?", len(bIds)-1)+"))")
+	}
+
+	if len(clauses) == 0 {
+		return results, nil
+	}
+
+	query := "SELECT Collections.Name, BSO.Id, BSO.SortIndex, " + sortIndexSetColumn + ", " + payloadColumn + ", BSO.Modified, BSO.TTL " +
+		"FROM BSO JOIN Collections ON Collections.Id = BSO.CollectionId " +
+		"WHERE BSO.TTL > ? AND (" + strings.Join(clauses, " OR ") + ") " +
+		"ORDER BY Collections.Name, BSO.Id"
+
+	d.Lock()
+	defer d.Unlock()
+
+	rows, err := d.db.Query(query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		b := &BSO{}
+		if err := rows.Scan(&name, &b.Id, &b.SortIndex, &b.SortIndexSet, &b.Payload, &b.Modified, &b.TTL); err != nil {
+			return nil, err
+		}
+		results[name] = append(results[name], b)
+	}
+
+	return results, rows.Err()
+}
+
+func (d *DB) GetBSOModified(cId int, bId string) (modified int, err error) {
+	d.Lock()
+	defer d.Unlock()
+	err = d.db.QueryRow(`SELECT modified
+						 FROM BSO
+						 WHERE CollectionId=? and Id=? and TTL > ?`, cId, bId, d.ttlCutoff()).Scan(&modified)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrNotFound
+		}
+
+		return 0, err
+	}
+
+	return
 }
 
 // DeleteBSO deletes a single BSO and returns the
@@ -700,13 +1346,28 @@ func (d *DB) DeleteBSOs(cId int, bIds ...string) (modified int, err error) {
 	return
 }
 
-// PurgeExpired removes all BSOs that have expired out
-func (d *DB) PurgeExpired() (removed int, err error) {
+// ttlCutoff returns the time BSOs must expire after to still be readable,
+// which is now less the grace period
+func (d *DB) ttlCutoff() int {
+	return Now() - d.ttlGrace
+}
+
+// PurgeExpired removes all BSOs that have expired out. BSOs in the
+// collections in skip are left for PurgeExpiredCollection
+func (d *DB) PurgeExpired(skip ...int) (removed int, err error) {
 	d.Lock()
 	defer d.Unlock()
 
 	dmlBSO := "DELETE FROM BSO WHERE TTL <= ?"
-	r, err := d.db.Exec(dmlBSO, Now())
+	values := []interface{}{d.ttlCutoff()}
+	if len(skip) > 0 {
+		dmlBSO += " AND CollectionId NOT IN (?" + strings.Repeat(",?", len(skip)-1) + ")"
+		for _, cId := range skip {
+			values = append(values, cId)
+		}
+	}
+
+	r, err := d.db.Exec(dmlBSO, values...)
 
 	if err != nil {
 		return 0, err
@@ -716,6 +1377,47 @@ func (d *DB) PurgeExpired() (removed int, err error) {
 	return int(purged), err
 }
 
+// PurgeExpiredCollection removes the expired BSOs in a single collection
+func (d *DB) PurgeExpiredCollection(cId int) (removed int, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	r, err := d.db.Exec("DELETE FROM BSO WHERE CollectionId=? AND TTL <= ?", cId, d.ttlCutoff())
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := r.RowsAffected()
+	return int(purged), err
+}
+
+// SetCollectionTTL makes every BSO in a collection expire within ttl
+// milliseconds. TTLs are only shortened, BSOs that already expire sooner
+// are left alone. With a ttl of 0 the BSOs can not be read any more, even
+// with a TTLGrace, and are removed by the next purge
+func (d *DB) SetCollectionTTL(cId int, ttl int) (updated int, err error) {
+	if !TTLOk(ttl) {
+		return 0, ErrInvalidTTL
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	// 0 is before any ttlCutoff
+	expires := 0
+	if ttl > 0 {
+		expires = Now() + ttl
+	}
+
+	r, err := d.db.Exec("UPDATE BSO SET TTL=? WHERE CollectionId=? AND TTL > ?", expires, cId, expires)
+	if err != nil {
+		return 0, err
+	}
+
+	changed, err := r.RowsAffected()
+	return int(changed), err
+}
+
 func (d *DB) Usage() (stats *DBPageStats, err error) {
 	d.Lock()
 	defer d.Unlock()
@@ -740,6 +1442,16 @@ func (d *DB) Usage() (stats *DBPageStats, err error) {
 	return
 }
 
+// SchemaVersion returns the version of the schema the database is
+// using, see schemas.go
+func (d *DB) SchemaVersion() (version int, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	err = d.db.QueryRow("PRAGMA user_version").Scan(&version)
+	return
+}
+
 // Optimize recovers disk space by removing empty db pages
 // if the number of free pages makes up more than `threshold`
 // percent of the total pages
@@ -788,11 +1500,15 @@ func getKey(tx dbTx, key string) (value string, err error) {
 
 // Vacuum recovers free disk pages and reduces fragmentation of the
 // data on disk. This could take a long time depending on the size
-// of the database
+// of the database. The WAL is checkpointed and truncated afterwards so
+// the space is returned to the filesystem
 func (d *DB) Vacuum() (err error) {
 	d.Lock()
 	defer d.Unlock()
-	_, err = d.db.Exec("VACUUM")
+	if _, err = d.db.Exec("VACUUM"); err != nil {
+		return
+	}
+	_, err = d.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
 	return
 }
 
@@ -831,6 +1547,20 @@ func (d *DB) putBSO(tx dbTx,
 	payload *string,
 	sortIndex *int,
 	ttl *int,
+) (err error) {
+	return d.writeBSO(tx, cId, bId, modified, payload, sortIndex, sortIndex != nil, ttl)
+}
+
+// writeBSO is putBSO but sortIndexSet says if a given sortIndex was sent
+// by the client or is a default
+func (d *DB) writeBSO(tx dbTx,
+	cId int,
+	bId string,
+	modified int,
+	payload *string,
+	sortIndex *int,
+	sortIndexSet bool,
+	ttl *int,
 ) (err error) {
 	if payload == nil && sortIndex == nil && ttl == nil {
 		err = ErrNothingToDo
@@ -859,12 +1589,26 @@ func (d *DB) putBSO(tx dbTx,
 
 	// Do an UPDATE or an INSERT
 	if exists == true {
+		if d.skipNoopSortIndex && payload == nil && ttl == nil && sortIndex != nil {
+			var current int
+			var currentSet bool
+			query := "SELECT SortIndex, SortIndexSet FROM BSO WHERE CollectionId=? AND Id=?"
+			if err = tx.QueryRow(query, cId, bId).Scan(&current, &currentSet); err != nil {
+				return
+			}
+
+			// a BSO without a sortindex still records one set to 0
+			if current == *sortIndex && (currentSet || current != 0) {
+				return errUnchanged
+			}
+		}
+
 		var t *int
 		if ttl != nil {
 			tmp := *ttl
 			t = &tmp
 		}
-		return d.updateBSO(tx, cId, bId, modified, payload, sortIndex, t)
+		return d.updateBSO(tx, cId, bId, modified, payload, sortIndex, sortIndexSet, t)
 	} else {
 		var p string
 		var s, t int
@@ -876,7 +1620,9 @@ func (d *DB) putBSO(tx dbTx,
 		}
 
 		if sortIndex == nil {
-			s = 0
+			if s, err = d.defaultSortIndex(tx, cId); err != nil {
+				return
+			}
 		} else {
 			s = *sortIndex
 		}
@@ -887,8 +1633,51 @@ func (d *DB) putBSO(tx dbTx,
 			t = *ttl
 		}
 
-		return d.insertBSO(tx, cId, bId, modified, p, s, t)
+		return d.insertBSO(tx, cId, bId, modified, p, s, sortIndexSet, t)
+	}
+}
+
+// defaultSortIndex is the sortindex for a new BSO written without one
+func (d *DB) defaultSortIndex(tx dbTx, cId int) (int, error) {
+	if len(d.defaultSortIndexes) == 0 {
+		return 0, nil
+	}
+
+	name, ok := standardCollections[cId]
+	if !ok {
+		err := tx.QueryRow("SELECT Name FROM Collections WHERE Id=?", cId).Scan(&name)
+		if err == sql.ErrNoRows {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	return d.defaultSortIndexes[name], nil
+}
+
+// payloadBytes returns the total size of all payloads stored
+func (d *DB) payloadBytes(tx dbTx) (int, error) {
+	var used sql.NullInt64
+	if err := tx.QueryRow("SELECT sum(PayloadSize) FROM BSO").Scan(&used); err != nil {
+		return 0, err
 	}
+
+	return int(used.Int64), nil
+}
+
+// bsoPayloadSize returns the size of an existing BSO's payload
+// or 0 if it does not exist
+func (d *DB) bsoPayloadSize(tx dbTx, cId int, bId string) (int, error) {
+	var size int
+	query := "SELECT PayloadSize FROM BSO WHERE CollectionId=? AND Id=?"
+	err := tx.QueryRow(query, cId, bId).Scan(&size)
+
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return size, err
 }
 
 // bsoExists checks if a BSO is in the database
@@ -908,45 +1697,45 @@ func (d *DB) bsoExists(tx dbTx, cId int, bId string) (bool, error) {
 	return true, nil
 }
 
-// getBSOs searches for bsos based on the api 1.5 criteria
-func (d *DB) getBSOs(
-	tx dbTx,
+// CountBSOs returns the number of BSOs GetBSOs would return without
+// a limit or offset
+func (d *DB) CountBSOs(cId int, ids []string, older, newer, expiresBefore int) (count int, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	count, err = d.countBSOs(d.db, cId, ids, older, newer, expiresBefore, d.ttlCutoff())
+	return
+}
+
+// getBSOsQuery builds the SELECT shared by getBSOs and getBSOIds. It
+// fetches an extra row past limit so callers can detect if there are more.
+// BSOs must expire after cutoff, usually ttlCutoff()
+func (d *DB) getBSOsQuery(
+	columns string,
 	cId int,
 	ids []string,
 	older int,
 	newer int,
+	expiresBefore int,
+	cutoff int,
 	sort SortType,
 	limit int,
-	offset int) (*GetResults, error) {
+	offset int) (string, []interface{}, error) {
 
 	if !OffsetOk(offset) {
-		return nil, ErrInvalidOffset
+		return "", nil, ErrInvalidOffset
 	}
 
 	if !LimitOk(limit) {
-		return nil, ErrInvalidLimit
+		return "", nil, ErrInvalidLimit
 	}
 
 	if !NewerOk(newer) {
-		return nil, ErrInvalidNewer
+		return "", nil, ErrInvalidNewer
 	}
 
-	cutOffTTL := Now()
-	query := "SELECT Id, SortIndex, Payload, Modified, TTL FROM BSO "
-	where := "WHERE CollectionId=? AND Modified < ? AND Modified > ? AND TTL > ?"
-	values := []interface{}{cId, older, newer, cutOffTTL}
-
-	if len(ids) > 0 {
-		// spec says only 100 ids at a time
-		if len(ids) > 100 {
-			ids = ids[0:100]
-		}
-
-		where += " AND Id IN (?" + strings.Repeat(",?", len(ids)-1) + ")"
-		for _, id := range ids {
-			values = append(values, id)
-		}
-	}
+	query := "SELECT " + columns + " FROM BSO "
+	where, values := d.getBSOsWhere(cId, ids, older, newer, expiresBefore, cutoff)
 
 	orderBy := ""
 	if sort == SORT_INDEX {
@@ -973,8 +1762,6 @@ func (d *DB) getBSOs(
 	}
 
 	resultQuery := fmt.Sprintf("%s %s %s %s", query, where, orderBy, limitStmt)
-	rows, err := tx.Query(resultQuery, values...)
-	defer rows.Close()
 
 	if log.GetLevel() == log.DebugLevel {
 		log.WithFields(log.Fields{
@@ -983,37 +1770,166 @@ func (d *DB) getBSOs(
 		}).Debug("db getBSOs")
 	}
 
+	return resultQuery, values, nil
+}
+
+// getBSOsWhere builds the WHERE clause matching unexpired BSOs in a
+// collection, shared by the BSO queries and countBSOs
+func (d *DB) getBSOsWhere(cId int, ids []string, older, newer, expiresBefore, cutoff int) (string, []interface{}) {
+	where := "WHERE CollectionId=? AND Modified < ? AND Modified > ? AND TTL > ?"
+	values := []interface{}{cId, older, newer, cutoff}
+
+	if expiresBefore > 0 {
+		where += " AND TTL <= ?"
+		values = append(values, expiresBefore)
+	}
+
+	if len(ids) > 0 {
+		where += " AND Id IN (?" + strings.Repeat(",?", len(ids)-1) + ")"
+		for _, id := range ids {
+			values = append(values, id)
+		}
+	}
+
+	return where, values
+}
+
+// countBSOs returns how many BSOs match, ignoring sorting and paging
+func (d *DB) countBSOs(tx dbTx, cId int, ids []string, older, newer, expiresBefore, cutoff int) (count int, err error) {
+	if !NewerOk(newer) {
+		return 0, ErrInvalidNewer
+	}
+
+	where, values := d.getBSOsWhere(cId, ids, older, newer, expiresBefore, cutoff)
+	err = tx.QueryRow("SELECT COUNT(*) FROM BSO "+where, values...).Scan(&count)
+	return
+}
+
+// getBSOs searches for bsos based on the api 1.5 criteria
+func (d *DB) getBSOs(
+	tx dbTx,
+	cId int,
+	ids []string,
+	older int,
+	newer int,
+	expiresBefore int,
+	sort SortType,
+	limit int,
+	offset int) (*GetResults, error) {
+
+	bsos := make([]*BSO, 0)
+	more, err := d.forEachBSO(tx, cId, ids, older, newer, expiresBefore, d.ttlCutoff(), sort, limit, offset,
+		func(b *BSO) error {
+			bsos = append(bsos, b)
+			return nil
+		})
+
 	if err != nil {
 		return nil, err
 	}
 
-	bsos := make([]*BSO, 0)
+	results := &GetResults{
+		BSOs: bsos,
+		More: more,
+	}
+
+	if more {
+		results.Offset = limit + offset
+	}
+
+	return results, nil
+}
+
+// forEachBSO calls fn with each BSO as it is read from the database. It
+// stops at the first error from fn. more is true when there are BSOs
+// after limit
+func (d *DB) forEachBSO(
+	tx dbTx,
+	cId int,
+	ids []string,
+	older int,
+	newer int,
+	expiresBefore int,
+	cutoff int,
+	sort SortType,
+	limit int,
+	offset int,
+	fn func(*BSO) error) (more bool, err error) {
+
+	query, values, err := d.getBSOsQuery("Id, SortIndex, "+sortIndexSetColumn+", "+payloadColumn+", Modified, TTL",
+		cId, ids, older, newer, expiresBefore, cutoff, sort, limit, offset)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := tx.Query(query, values...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	num := 0
 	for rows.Next() {
+		// getBSOsQuery fetches one extra row to detect more
+		if limit >= 0 && num == limit {
+			return true, nil
+		}
+
 		b := &BSO{}
-		if err := rows.Scan(&b.Id, &b.SortIndex, &b.Payload, &b.Modified, &b.TTL); err != nil {
-			return nil, err
-		} else {
-			bsos = append(bsos, b)
+		if err := rows.Scan(&b.Id, &b.SortIndex, &b.SortIndexSet, &b.Payload, &b.Modified, &b.TTL); err != nil {
+			return false, err
 		}
+
+		if err := fn(b); err != nil {
+			return false, err
+		}
+		num++
 	}
 
-	var more bool
-	var nextOffset int
-	num := len(bsos)
-	if limit >= 0 && num > limit {
-		bsos = bsos[:num-1]
-		more = true
-		nextOffset = limit + offset
+	return false, rows.Err()
+}
+
+// getBSOIds is like getBSOs but only reads the ids so payloads
+// are never loaded from disk
+func (d *DB) getBSOIds(
+	tx dbTx,
+	cId int,
+	ids []string,
+	older int,
+	newer int,
+	expiresBefore int,
+	sort SortType,
+	limit int,
+	offset int) (*GetIdsResults, error) {
+
+	query, values, err := d.getBSOsQuery("Id", cId, ids, older, newer, expiresBefore, d.ttlCutoff(), sort, limit, offset)
+	if err != nil {
+		return nil, err
 	}
 
-	results := &GetResults{
-		BSOs:   bsos,
-		More:   more,
-		Offset: nextOffset,
+	rows, err := tx.Query(query, values...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return results, nil
+	bIds := make([]string, 0)
+	for rows.Next() {
+		var bId string
+		if err := rows.Scan(&bId); err != nil {
+			return nil, err
+		}
+		bIds = append(bIds, bId)
+	}
+
+	results := &GetIdsResults{Ids: bIds}
+	if num := len(bIds); limit >= 0 && num > limit {
+		results.Ids = bIds[:num-1]
+		results.More = true
+		results.Offset = limit + offset
+	}
 
+	return results, nil
 }
 
 // getBSO is a simpler interface to getBSOs that returns a single BSO
@@ -1025,8 +1941,8 @@ func (d *DB) getBSO(tx dbTx, cId int, bId string) (*BSO, error) {
 
 	b := &BSO{Id: bId}
 
-	query := "SELECT SortIndex, Payload, Modified, TTL FROM BSO WHERE CollectionId=? and Id=? and TTL >= ?"
-	err := tx.QueryRow(query, cId, bId, Now()).Scan(&b.SortIndex, &b.Payload, &b.Modified, &b.TTL)
+	query := "SELECT SortIndex, " + sortIndexSetColumn + ", " + payloadColumn + ", Modified, TTL FROM BSO WHERE CollectionId=? and Id=? and TTL >= ?"
+	err := tx.QueryRow(query, cId, bId, d.ttlCutoff()).Scan(&b.SortIndex, &b.SortIndexSet, &b.Payload, &b.Modified, &b.TTL)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -1046,19 +1962,25 @@ func (d *DB) insertBSO(
 	modified int,
 	payload string,
 	sortIndex int,
+	sortIndexSet bool,
 	ttl int,
 ) (err error) {
+	inline, hash, err := d.storePayload(tx, payload)
+	if err != nil {
+		return
+	}
+
 	_, err = tx.Exec(`INSERT INTO BSO (
-			CollectionId, Id, SortIndex,
-			PayLoad, PayLoadSize,
+			CollectionId, Id, SortIndex, SortIndexSet,
+			PayLoad, PayLoadSize, PayloadHash,
 			Modified, TTL)
 			VALUES (
+				?,?,?,?,
 				?,?,?,
-				?,?,
 				?,?
 			)`,
-		cId, bId, sortIndex,
-		payload, len(payload),
+		cId, bId, sortIndex, sortIndexSet,
+		inline, len(payload), hash,
 		modified, modified+ttl)
 
 	if log.GetLevel() == log.DebugLevel {
@@ -1076,8 +1998,27 @@ func (d *DB) insertBSO(
 	return
 }
 
+// storePayload returns the values for a BSO's Payload and PayloadHash
+// columns. With dedup enabled larger payloads are saved in the Payloads
+// table and only referenced by their hash
+func (d *DB) storePayload(tx dbTx, payload string) (inline string, hash string, err error) {
+	if !d.dedupPayloads || len(payload) < dedupMinPayloadSize {
+		return payload, "", nil
+	}
+
+	sum := sha256.Sum256([]byte(payload))
+	hash = hex.EncodeToString(sum[:])
+
+	if _, err = tx.Exec("INSERT OR IGNORE INTO Payloads (Hash, Payload) VALUES (?, ?)", hash, payload); err != nil {
+		return "", "", errors.Wrap(err, "Could not store payload")
+	}
+
+	return "", hash, nil
+}
+
 // updateBSO updates a BSO. Values that are not provided (pointers)
-// are not updated in the SQL statement
+// are not updated in the SQL statement. sortIndexSet is recorded with
+// sortIndex
 func (d *DB) updateBSO(
 	tx dbTx,
 	cId int,
@@ -1085,6 +2026,7 @@ func (d *DB) updateBSO(
 	modified int,
 	payload *string,
 	sortIndex *int,
+	sortIndexSet bool,
 	ttl *int,
 ) (err error) {
 	if payload == nil && sortIndex == nil && ttl == nil {
@@ -1092,7 +2034,7 @@ func (d *DB) updateBSO(
 		return
 	}
 
-	var values = make([]interface{}, 7)
+	var values = make([]interface{}, 9)
 	i := 0
 	set := ""
 
@@ -1108,20 +2050,29 @@ func (d *DB) updateBSO(
 		if i != 0 {
 			set = set + ","
 		}
-		set = set + "Payload=?, PayloadSize=?"
-		values[i] = *payload
+		inline, hash, err := d.storePayload(tx, *payload)
+		if err != nil {
+			return err
+		}
+
+		set = set + "Payload=?, PayloadSize=?, PayloadHash=?"
+		values[i] = inline
 		i += 1
 		values[i] = len(*payload)
 		i += 1
+		values[i] = hash
+		i += 1
 	}
 
 	if sortIndex != nil {
 		if i != 0 {
 			set = set + ","
 		}
-		set = set + "SortIndex=?"
+		set = set + "SortIndex=?, SortIndexSet=?"
 		values[i] = *sortIndex
 		i += 1
+		values[i] = sortIndexSet
+		i += 1
 	}
 
 	if ttl != nil {
@@ -0,0 +1,138 @@
+package syncstorage
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+var ErrBarrierDone = errors.New("Write barrier already committed or rolled back")
+
+// WriteBarrier groups several changes to a DB into one transaction so
+// admin actions like moving a collection are applied completely or not
+// at all. The DB is locked from BeginWriteBarrier until Commit or
+// Rollback, nothing else can read or write it in between. Every change
+// uses the same modified timestamp
+type WriteBarrier struct {
+	d        *DB
+	tx       *sql.Tx
+	modified int
+	done     bool
+}
+
+// BeginWriteBarrier locks the database and starts a transaction. Commit
+// or Rollback must be called to unlock it
+func (d *DB) BeginWriteBarrier() (*WriteBarrier, error) {
+	d.Lock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		d.Unlock()
+		return nil, errors.Wrap(err, "Failed creating transaction")
+	}
+
+	return &WriteBarrier{d: d, tx: tx, modified: Now()}, nil
+}
+
+// Commit applies the changes and unlocks the database
+func (w *WriteBarrier) Commit() error {
+	if w.done {
+		return ErrBarrierDone
+	}
+
+	w.done = true
+	defer w.d.Unlock()
+
+	return errors.Wrap(w.tx.Commit(), "Failed commit")
+}
+
+// Rollback discards the changes and unlocks the database. It does nothing
+// after Commit so it can be deferred
+func (w *WriteBarrier) Rollback() error {
+	if w.done {
+		return nil
+	}
+
+	w.done = true
+	defer w.d.Unlock()
+
+	return w.tx.Rollback()
+}
+
+// Modified is the timestamp the changes are made at
+func (w *WriteBarrier) Modified() int {
+	return w.modified
+}
+
+func (w *WriteBarrier) GetCollectionId(name string) (int, error) {
+	return w.d.getCollectionId(w.tx, name)
+}
+
+// CreateCollection returns the id of a new collection or of the existing
+// one with the same name
+func (w *WriteBarrier) CreateCollection(name string) (int, error) {
+	if !CollectionNameOk(name) {
+		return 0, ErrInvalidCollectionName
+	}
+
+	return w.d.createCollection(w.tx, name, w.modified)
+}
+
+// CountBSOs returns the number of unexpired BSOs in a collection
+func (w *WriteBarrier) CountBSOs(cId int) (int, error) {
+	return w.d.countBSOs(w.tx, cId, nil, MaxTimestamp, 0, 0, w.d.ttlCutoff())
+}
+
+// PutBSO creates or updates a BSO and touches its collection
+func (w *WriteBarrier) PutBSO(cId int, bId string, payload *string, sortIndex *int, ttl *int) error {
+	err := w.d.putBSO(w.tx, cId, bId, w.modified, payload, sortIndex, ttl)
+	if err == errUnchanged {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return w.d.touchCollectionAndStorage(w.tx, cId, w.modified)
+}
+
+// MoveBSOs moves every BSO in a collection to another one, keeping their
+// modified times. It fails if a BSO with the same id is already in the
+// destination. Both collections are touched. The number of BSOs moved
+// is returned
+func (w *WriteBarrier) MoveBSOs(fromCid, toCid int) (int, error) {
+	result, err := w.tx.Exec("UPDATE BSO SET CollectionId=? WHERE CollectionId=?", toCid, fromCid)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed moving BSOs from %d to %d", fromCid, toCid)
+	}
+
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := w.d.touchCollection(w.tx, fromCid, w.modified); err != nil {
+		return 0, err
+	}
+
+	return int(moved), w.d.touchCollectionAndStorage(w.tx, toCid, w.modified)
+}
+
+// DeleteCollection removes the BSOs in a collection and resets its
+// modified so it is no longer listed in info/collections
+func (w *WriteBarrier) DeleteCollection(cId int) error {
+	if _, err := w.tx.Exec("DELETE FROM BSO WHERE CollectionId=?", cId); err != nil {
+		return errors.Wrapf(err, "Failed deleting collection: %d", cId)
+	}
+
+	if err := w.d.touchCollection(w.tx, cId, 0); err != nil {
+		return err
+	}
+
+	return w.d.touchStorage(w.tx, w.modified)
+}
+
+// TouchCollection sets a collection's and the storage's modified so
+// clients sync it again
+func (w *WriteBarrier) TouchCollection(cId int) error {
+	return w.d.touchCollectionAndStorage(w.tx, cId, w.modified)
+}
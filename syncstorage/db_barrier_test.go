@@ -0,0 +1,108 @@
+package syncstorage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteBarrierCommit(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := getTestDB()
+
+	from, _ := db.CreateCollection("from")
+	_, err := db.PostBSOs(from, PostBSOInput{
+		NewPutBSOInput("b0", String("0"), Int(1), nil),
+		NewPutBSOInput("b1", String("1"), Int(2), nil),
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	before, _ := db.GetBSO(from, "b0")
+
+	barrier, err := db.BeginWriteBarrier()
+	if !assert.NoError(err) {
+		return
+	}
+
+	to, err := barrier.CreateCollection("to")
+	if !assert.NoError(err) {
+		return
+	}
+
+	moved, err := barrier.MoveBSOs(from, to)
+	assert.NoError(err)
+	assert.Equal(2, moved)
+	assert.NoError(barrier.DeleteCollection(from))
+	assert.NoError(barrier.Commit())
+
+	// committing again or rolling back after a commit do nothing
+	assert.Equal(ErrBarrierDone, barrier.Commit())
+	assert.NoError(barrier.Rollback())
+
+	// BSOs keep their modified times
+	after, err := db.GetBSO(to, "b0")
+	if assert.NoError(err) {
+		assert.Equal(before, after)
+	}
+
+	info, _ := db.InfoCollections()
+	assert.Equal(map[string]int{"to": barrier.Modified()}, info)
+
+	counts, _ := db.InfoCollectionCounts()
+	assert.Equal(map[string]int{"to": 2}, counts)
+
+	modified, _ := db.LastModified()
+	assert.Equal(barrier.Modified(), modified)
+}
+
+func TestWriteBarrierRollback(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := getTestDB()
+
+	from, _ := db.CreateCollection("from")
+	to, _ := db.CreateCollection("to")
+	db.PutBSO(from, "b0", String("from"), nil, nil)
+	db.PutBSO(to, "b0", String("to"), nil, nil)
+
+	infoBefore, _ := db.InfoCollections()
+	countsBefore, _ := db.InfoCollectionCounts()
+	modifiedBefore, _ := db.LastModified()
+
+	barrier, err := db.BeginWriteBarrier()
+	if !assert.NoError(err) {
+		return
+	}
+
+	// make changes then fail part way through
+	assert.NoError(barrier.PutBSO(from, "b1", String("new"), nil, nil))
+	_, err = barrier.CreateCollection("created")
+	assert.NoError(err)
+
+	_, err = barrier.MoveBSOs(from, to) // b0 is in both
+	if !assert.Error(err) {
+		return
+	}
+	assert.NoError(barrier.Rollback())
+
+	// nothing was changed
+	infoAfter, _ := db.InfoCollections()
+	assert.Equal(infoBefore, infoAfter)
+
+	countsAfter, _ := db.InfoCollectionCounts()
+	assert.Equal(countsBefore, countsAfter)
+
+	modifiedAfter, _ := db.LastModified()
+	assert.Equal(modifiedBefore, modifiedAfter)
+
+	_, err = db.GetBSO(from, "b1")
+	assert.Equal(ErrNotFound, err)
+
+	_, err = db.GetCollectionId("created")
+	assert.Equal(ErrNotFound, err)
+
+	b, err := db.GetBSO(to, "b0")
+	if assert.NoError(err) {
+		assert.Equal("to", b.Payload)
+	}
+}
@@ -79,13 +79,22 @@ func (d *DB) BatchAppend(id, cId int, data string) (err error) {
 	return
 }
 
-// BatchExists checks if a batch exists without loading all the data from disk
-func (d *DB) BatchExists(id, cId int) (bool, error) {
+// BatchExists checks if a batch exists without loading all the data from disk.
+// Batches not modified in the last ttl milliseconds have expired and are not
+// found, even before BatchPurge removes them. A ttl <= 0 ignores their age
+func (d *DB) BatchExists(id, cId, ttl int) (bool, error) {
 	d.Lock()
 	defer d.Unlock()
 
+	query := "SELECT Id FROM Batches WHERE Id=? AND CollectionId=?"
+	values := []interface{}{id, cId}
+	if ttl > 0 {
+		query += " AND (? - Modified) < ?"
+		values = append(values, Now(), ttl)
+	}
+
 	var foundId int
-	err := d.db.QueryRow("SELECT Id FROM Batches WHERE Id=? AND CollectionId=?", id, cId).Scan(&foundId)
+	err := d.db.QueryRow(query, values...).Scan(&foundId)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
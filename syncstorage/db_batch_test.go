@@ -153,11 +153,26 @@ func TestBatchExists(t *testing.T) {
 		return
 	}
 
-	exists, err := db.BatchExists(batchId, 1)
+	exists, err := db.BatchExists(batchId, 1, 0)
 	assert.True(exists)
 	assert.NoError(err)
 
-	notExists, err := db.BatchExists(2, 1)
+	notExists, err := db.BatchExists(2, 1, 0)
 	assert.False(notExists)
 	assert.NoError(err)
+
+	{ // expired batches are not found but are left for BatchPurge
+		time.Sleep(20 * time.Millisecond)
+
+		exists, err := db.BatchExists(batchId, 1, 10)
+		assert.False(exists)
+		assert.NoError(err)
+
+		exists, err = db.BatchExists(batchId, 1, 60*1000)
+		assert.True(exists)
+		assert.NoError(err)
+
+		_, err = db.BatchLoad(batchId, 1)
+		assert.NoError(err)
+	}
 }
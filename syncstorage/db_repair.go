@@ -0,0 +1,195 @@
+package syncstorage
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// standardCollections are the collection ids baked into the schemas.
+// GetCollectionId returns these without looking at the database so
+// the Collections table must always agree with them
+var standardCollections = map[int]string{
+	1:  "clients",
+	2:  "crypto",
+	3:  "forms",
+	4:  "history",
+	5:  "keys",
+	6:  "meta",
+	7:  "bookmarks",
+	8:  "prefs",
+	9:  "tabs",
+	10: "passwords",
+	11: "addons",
+	12: "addresses",
+	13: "creditcards",
+	99: "-push-",
+}
+
+// insertRepairedCollection adds a missing collection with the count of
+// the BSOs already in it
+const insertRepairedCollection = `INSERT INTO Collections (Id, Name, Modified, Count)
+	VALUES (?, ?, ?, (SELECT count(*) FROM BSO WHERE CollectionId=?))`
+
+// RepairCollections reconciles the Collections table with the data
+// stored in BSO. Standard collections are restored to their fixed ids,
+// BSOs that reference a collection id without a name are given a
+// `recovered-<id>` name so they are reachable again and collection counts
+// are corrected. A description of each discrepancy fixed is returned.
+func (d *DB) RepairCollections() (fixed []string, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "RepairCollections: Failed creating transaction")
+	}
+
+	fixed, err = d.repairCollections(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "RepairCollections: Failed commit")
+	}
+
+	return fixed, nil
+}
+
+func (d *DB) repairCollections(tx dbTx) ([]string, error) {
+	fixed := make([]string, 0)
+
+	ids := make([]int, 0, len(standardCollections))
+	for cId := range standardCollections {
+		ids = append(ids, cId)
+	}
+	sort.Ints(ids)
+
+	for _, cId := range ids {
+		name := standardCollections[cId]
+
+		// another id has claimed a standard name, move it out of the way
+		var otherId int
+		err := tx.QueryRow("SELECT Id FROM Collections WHERE Name=? AND Id != ?", name, cId).Scan(&otherId)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, errors.Wrapf(err, "Failed looking up collection %s", name)
+		}
+
+		if err == nil {
+			fix, err := d.recoverCollection(tx, otherId)
+			if err != nil {
+				return nil, err
+			}
+			fixed = append(fixed, fix)
+		}
+
+		var current string
+		err = tx.QueryRow("SELECT Name FROM Collections WHERE Id=?", cId).Scan(&current)
+		switch {
+		case err == sql.ErrNoRows:
+			modified, err := d.maxBSOModified(tx, cId)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err := tx.Exec(insertRepairedCollection, cId, name, modified, cId); err != nil {
+				return nil, errors.Wrapf(err, "Failed restoring collection %d", cId)
+			}
+			fixed = append(fixed, fmt.Sprintf("restored %s (id=%d)", name, cId))
+		case err != nil:
+			return nil, errors.Wrapf(err, "Failed looking up collection %d", cId)
+		case current != name:
+			if _, err := tx.Exec("UPDATE Collections SET Name=? WHERE Id=?", name, cId); err != nil {
+				return nil, errors.Wrapf(err, "Failed renaming collection %d", cId)
+			}
+			fixed = append(fixed, fmt.Sprintf("renamed %s to %s (id=%d)", current, name, cId))
+		}
+	}
+
+	// BSOs whose collection id has no name can not be reached
+	rows, err := tx.Query(`SELECT DISTINCT CollectionId FROM BSO
+						   WHERE CollectionId NOT IN (SELECT Id FROM Collections)
+						   ORDER BY CollectionId`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed looking for orphaned BSOs")
+	}
+
+	orphans := make([]int, 0)
+	for rows.Next() {
+		var cId int
+		if err := rows.Scan(&cId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		orphans = append(orphans, cId)
+	}
+	rows.Close()
+
+	for _, cId := range orphans {
+		modified, err := d.maxBSOModified(tx, cId)
+		if err != nil {
+			return nil, err
+		}
+
+		name := fmt.Sprintf("recovered-%d", cId)
+		if _, err := tx.Exec(insertRepairedCollection, cId, name, modified, cId); err != nil {
+			return nil, errors.Wrapf(err, "Failed recovering collection %d", cId)
+		}
+		fixed = append(fixed, fmt.Sprintf("recovered orphaned BSOs as %s", name))
+	}
+
+	// the counts maintained by triggers are only wrong if something
+	// changed BSO without them, e.g. editing the database by hand
+	res, err := tx.Exec(`UPDATE Collections SET Count = (SELECT count(*) FROM BSO WHERE CollectionId = Collections.Id)
+						 WHERE Count != (SELECT count(*) FROM BSO WHERE CollectionId = Collections.Id)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed recounting collections")
+	}
+
+	if recounted, err := res.RowsAffected(); err != nil {
+		return nil, errors.Wrap(err, "Failed recounting collections")
+	} else if recounted > 0 {
+		fixed = append(fixed, fmt.Sprintf("recounted %d collections", recounted))
+	}
+
+	return fixed, nil
+}
+
+// recoverCollection renames a collection to `recovered-<id>`, or removes it
+// when it has no BSOs, freeing up its name
+func (d *DB) recoverCollection(tx dbTx, cId int) (string, error) {
+	var count int
+	if err := tx.QueryRow("SELECT count(*) FROM BSO WHERE CollectionId=?", cId).Scan(&count); err != nil {
+		return "", errors.Wrapf(err, "Failed counting BSOs in collection %d", cId)
+	}
+
+	if count == 0 {
+		if _, err := tx.Exec("DELETE FROM Collections WHERE Id=?", cId); err != nil {
+			return "", errors.Wrapf(err, "Failed removing collection %d", cId)
+		}
+		return fmt.Sprintf("removed empty collection id=%d", cId), nil
+	}
+
+	name := fmt.Sprintf("recovered-%d", cId)
+	if _, err := tx.Exec("UPDATE Collections SET Name=? WHERE Id=?", name, cId); err != nil {
+		return "", errors.Wrapf(err, "Failed renaming collection %d", cId)
+	}
+
+	return fmt.Sprintf("renamed collection id=%d to %s", cId, name), nil
+}
+
+// maxBSOModified returns the newest modified timestamp of the BSOs in a
+// collection or 0 if there are none
+func (d *DB) maxBSOModified(tx dbTx, cId int) (int, error) {
+	var modified sql.NullInt64
+	err := tx.QueryRow("SELECT max(Modified) FROM BSO WHERE CollectionId=?", cId).Scan(&modified)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed getting modified for collection %d", cId)
+	}
+
+	return int(modified.Int64), nil
+}
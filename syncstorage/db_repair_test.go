@@ -0,0 +1,127 @@
+package syncstorage
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepairCollections(t *testing.T) {
+	assert := assert.New(t)
+
+	db, _ := getTestDB()
+
+	{ // nothing to repair on a fresh database
+		fixed, err := db.RepairCollections()
+		if !assert.NoError(err) {
+			return
+		}
+		assert.Len(fixed, 0)
+	}
+
+	cId, err := db.CreateCollection("custom")
+	if !assert.NoError(err) {
+		return
+	}
+
+	modified, err := db.PutBSO(cId, "b0", String("custom data"), nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	claimId, err := db.CreateCollection("claimer")
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = db.PutBSO(claimId, "b0", String("claimer data"), nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = db.PutBSO(7, "b0", String("bookmark data"), nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// corrupt the mapping
+	_, err = db.db.Exec(`
+		DELETE FROM Collections WHERE Id IN (7, ?);
+		UPDATE Collections SET Name="tabs-old" WHERE Id=9;
+		INSERT INTO Collections (Id, Name, Modified) VALUES (500, "tabs", 1);
+		UPDATE Collections SET Name="bookmarks" WHERE Id=?;
+	`, cId, claimId)
+	if !assert.NoError(err) {
+		return
+	}
+
+	_, err = db.GetCollectionId("custom")
+	assert.Equal(ErrNotFound, err)
+
+	info, _ := db.InfoCollections()
+	assert.NotContains(info, "custom")
+
+	fixed, err := db.RepairCollections()
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(fixed, 5)
+
+	// GetCollectionId does not read the table for standard names so
+	// the custom collections' rows are checked directly
+	{ // the deleted row is restored with its count and modified time
+		var name string
+		var count, rowModified int
+		err := db.db.QueryRow("SELECT Name, Count, Modified FROM Collections WHERE Id=?", cId).
+			Scan(&name, &count, &rowModified)
+		if assert.NoError(err) {
+			assert.Equal("recovered-"+strconv.Itoa(cId), name)
+			assert.Equal(1, count)
+			assert.Equal(modified, rowModified)
+		}
+
+		id, err := db.GetCollectionId("recovered-" + strconv.Itoa(cId))
+		if assert.NoError(err) {
+			assert.Equal(cId, id)
+			b, err := db.GetBSO(id, "b0")
+			if assert.NoError(err) {
+				assert.Equal("custom data", b.Payload)
+			}
+		}
+	}
+
+	{ // the row that took a standard name is moved out of its way
+		var name string
+		if assert.NoError(db.db.QueryRow("SELECT Name FROM Collections WHERE Id=?", claimId).Scan(&name)) {
+			assert.Equal("recovered-"+strconv.Itoa(claimId), name)
+		}
+
+		var bookmarks int
+		if assert.NoError(db.db.QueryRow("SELECT count(*) FROM Collections WHERE Name='bookmarks'").Scan(&bookmarks)) {
+			assert.Equal(1, bookmarks)
+		}
+
+		b, err := db.GetBSO(claimId, "b0")
+		if assert.NoError(err) {
+			assert.Equal("claimer data", b.Payload)
+		}
+	}
+
+	// every name in the table should now agree with the static ids
+	for cId, name := range standardCollections {
+		var dbName string
+		if assert.NoError(db.db.QueryRow("SELECT Name FROM Collections WHERE Id=?", cId).Scan(&dbName)) {
+			assert.Equal(name, dbName)
+		}
+	}
+
+	info, _ = db.InfoCollections()
+	assert.Contains(info, "bookmarks")
+	assert.Contains(info, "recovered-"+strconv.Itoa(cId))
+	assert.Contains(info, "recovered-"+strconv.Itoa(claimId))
+
+	{ // running it again finds nothing
+		fixed, err := db.RepairCollections()
+		assert.NoError(err)
+		assert.Len(fixed, 0)
+	}
+}
@@ -146,7 +146,7 @@ func TestBsoExists(t *testing.T) {
 	sortIndex := 1
 	ttl := 1000
 
-	assert.NoError(db.insertBSO(tx, cId, bId, modified, payload, sortIndex, ttl))
+	assert.NoError(db.insertBSO(tx, cId, bId, modified, payload, sortIndex, true, ttl))
 
 	found, err = db.bsoExists(tx, cId, bId)
 	assert.NoError(err)
@@ -162,7 +162,7 @@ func TestUpdateBSOReturnsExpectedError(t *testing.T) {
 	cId := 1
 	bId := "testBSO"
 
-	err := db.updateBSO(tx, cId, bId, Now(), nil, nil, nil)
+	err := db.updateBSO(tx, cId, bId, Now(), nil, nil, false, nil)
 	assert.Equal(t, ErrNothingToDo, err)
 }
 
@@ -182,11 +182,11 @@ func TestPrivateUpdateBSOSuccessfullyUpdatesSingleValues(t *testing.T) {
 
 	var err error
 
-	assert.NoError(db.insertBSO(tx, cId, bId, modified, payload, sortIndex, ttl))
+	assert.NoError(db.insertBSO(tx, cId, bId, modified, payload, sortIndex, true, ttl))
 
 	payload = "Updated payload"
 	modified = Now()
-	err = db.updateBSO(tx, cId, bId, modified, &payload, nil, nil)
+	err = db.updateBSO(tx, cId, bId, modified, &payload, nil, false, nil)
 	if !assert.NoError(err) {
 		return
 	}
@@ -200,7 +200,7 @@ func TestPrivateUpdateBSOSuccessfullyUpdatesSingleValues(t *testing.T) {
 
 	sortIndex = 2
 	modified = Now()
-	err = db.updateBSO(tx, cId, bId, modified, nil, &sortIndex, nil)
+	err = db.updateBSO(tx, cId, bId, modified, nil, &sortIndex, true, nil)
 
 	bso, err = db.getBSO(tx, cId, bId)
 	if !assert.NoError(err) || !assert.NotNil(bso) {
@@ -210,7 +210,7 @@ func TestPrivateUpdateBSOSuccessfullyUpdatesSingleValues(t *testing.T) {
 	assert.True(bso.Modified == modified || bso.Payload == payload || bso.SortIndex == sortIndex || bso.TTL == modified+ttl)
 
 	modified = Now()
-	err = db.updateBSO(tx, cId, bId, modified, nil, nil, &ttl)
+	err = db.updateBSO(tx, cId, bId, modified, nil, nil, false, &ttl)
 	if !assert.NoError(err) {
 		return
 	}
@@ -237,14 +237,14 @@ func TestPrivateUpdateBSOModifiedNotChangedOnTTLTouch(t *testing.T) {
 	ttl := 10
 	modified := Now() - 100
 
-	err := db.insertBSO(tx, cId, bId, modified, payload, sortIndex, ttl)
+	err := db.insertBSO(tx, cId, bId, modified, payload, sortIndex, true, ttl)
 	if !assert.NoError(err) {
 		return
 	}
 
 	ttl = 15
 	updateModified := Now()
-	err = db.updateBSO(tx, cId, bId, updateModified, nil, nil, &ttl)
+	err = db.updateBSO(tx, cId, bId, updateModified, nil, nil, false, &ttl)
 	if !assert.NoError(err) {
 		return
 	}
@@ -312,14 +312,14 @@ func TestPrivateGetBSOsLimitOffset(t *testing.T) {
 		payload := "payload-" + id
 		sortIndex := i
 		modified := Now()
-		if err := db.insertBSO(tx, cId, id, modified, payload, sortIndex, DEFAULT_BSO_TTL); err != nil {
+		if err := db.insertBSO(tx, cId, id, modified, payload, sortIndex, true, DEFAULT_BSO_TTL); err != nil {
 			t.Fatal("Error inserting BSO #", i, ":", err)
 		}
 		time.Sleep(10 * time.Millisecond)
 	}
 
 	{ // make sure a limit of 0 returns no records but with the `more` bit set
-		results, err := db.getBSOs(tx, cId, nil, MaxTimestamp, 0, SORT_INDEX, 0, 0)
+		results, err := db.getBSOs(tx, cId, nil, MaxTimestamp, 0, 0, SORT_INDEX, 0, 0)
 		if !assert.NoError(err) {
 			return
 		}
@@ -330,7 +330,7 @@ func TestPrivateGetBSOsLimitOffset(t *testing.T) {
 	}
 
 	{ // make sure a limit of -1 returns all the records (unbounded)
-		results, err := db.getBSOs(tx, cId, nil, MaxTimestamp, 0, SORT_INDEX, -1, 0)
+		results, err := db.getBSOs(tx, cId, nil, MaxTimestamp, 0, 0, SORT_INDEX, -1, 0)
 		if !assert.NoError(err) {
 			return
 		}
@@ -345,12 +345,12 @@ func TestPrivateGetBSOsLimitOffset(t *testing.T) {
 	offset := 0
 
 	// make sure invalid values don't work for limit and offset
-	_, err := db.getBSOs(tx, cId, nil, MaxTimestamp, newer, SORT_INDEX, -2, offset)
+	_, err := db.getBSOs(tx, cId, nil, MaxTimestamp, newer, 0, SORT_INDEX, -2, offset)
 	assert.Equal(ErrInvalidLimit, err)
-	_, err = db.getBSOs(tx, cId, nil, MaxTimestamp, newer, SORT_INDEX, limit, -2)
+	_, err = db.getBSOs(tx, cId, nil, MaxTimestamp, newer, 0, SORT_INDEX, limit, -2)
 	assert.Equal(ErrInvalidOffset, err)
 
-	results, err := db.getBSOs(tx, cId, nil, MaxTimestamp, newer, SORT_NEWEST, limit, offset)
+	results, err := db.getBSOs(tx, cId, nil, MaxTimestamp, newer, 0, SORT_NEWEST, limit, offset)
 	assert.NoError(err)
 
 	if assert.NotNil(results) {
@@ -363,7 +363,7 @@ func TestPrivateGetBSOsLimitOffset(t *testing.T) {
 		assert.Equal("7", results.BSOs[4].Id, "Expected BSO w/ Id = 7")
 	}
 
-	results2, err := db.getBSOs(tx, cId, nil, MaxTimestamp, newer, SORT_INDEX, limit, results.Offset)
+	results2, err := db.getBSOs(tx, cId, nil, MaxTimestamp, newer, 0, SORT_INDEX, limit, results.Offset)
 	assert.NoError(err)
 	if assert.NotNil(results2) {
 		assert.Equal(5, len(results2.BSOs), "Expected 5 results")
@@ -375,7 +375,7 @@ func TestPrivateGetBSOsLimitOffset(t *testing.T) {
 		assert.Equal("2", results2.BSOs[4].Id, "Expected BSO w/ Id = 9")
 	}
 
-	results3, err := db.getBSOs(tx, cId, nil, MaxTimestamp, newer, SORT_INDEX, limit, results2.Offset)
+	results3, err := db.getBSOs(tx, cId, nil, MaxTimestamp, newer, 0, SORT_INDEX, limit, results2.Offset)
 	assert.NoError(err)
 	if assert.NotNil(results3) {
 		assert.Equal(2, len(results3.BSOs), "Expected 2 results")
@@ -402,14 +402,14 @@ func TestPrivateGetBSOsNewer(t *testing.T) {
 
 	modified := Now()
 
-	_, err := db.getBSOs(tx, cId, nil, MaxTimestamp, -1, SORT_NONE, 10, 0)
+	_, err := db.getBSOs(tx, cId, nil, MaxTimestamp, -1, 0, SORT_NONE, 10, 0)
 	assert.Equal(ErrInvalidNewer, err)
 
-	assert.Nil(db.insertBSO(tx, cId, "b2", modified-2, "a", 1, DEFAULT_BSO_TTL))
-	assert.Nil(db.insertBSO(tx, cId, "b1", modified-1, "a", 1, DEFAULT_BSO_TTL))
-	assert.Nil(db.insertBSO(tx, cId, "b0", modified, "a", 1, DEFAULT_BSO_TTL))
+	assert.Nil(db.insertBSO(tx, cId, "b2", modified-2, "a", 1, true, DEFAULT_BSO_TTL))
+	assert.Nil(db.insertBSO(tx, cId, "b1", modified-1, "a", 1, true, DEFAULT_BSO_TTL))
+	assert.Nil(db.insertBSO(tx, cId, "b0", modified, "a", 1, true, DEFAULT_BSO_TTL))
 
-	results, err := db.getBSOs(tx, cId, nil, MaxTimestamp, modified-3, SORT_NEWEST, 10, 0)
+	results, err := db.getBSOs(tx, cId, nil, MaxTimestamp, modified-3, 0, SORT_NEWEST, 10, 0)
 	assert.NoError(err)
 	if assert.NotNil(results) {
 		assert.Equal(3, len(results.BSOs))
@@ -418,24 +418,164 @@ func TestPrivateGetBSOsNewer(t *testing.T) {
 		assert.Equal("b2", results.BSOs[2].Id)
 	}
 
-	results, err = db.getBSOs(tx, cId, nil, MaxTimestamp, modified-2, SORT_NEWEST, 10, 0)
+	results, err = db.getBSOs(tx, cId, nil, MaxTimestamp, modified-2, 0, SORT_NEWEST, 10, 0)
 	assert.NoError(err)
 	if assert.NotNil(results) {
 		assert.Equal("b0", results.BSOs[0].Id)
 		assert.Equal("b1", results.BSOs[1].Id)
 	}
 
-	results, err = db.getBSOs(tx, cId, nil, MaxTimestamp, modified-1, SORT_NEWEST, 10, 0)
+	results, err = db.getBSOs(tx, cId, nil, MaxTimestamp, modified-1, 0, SORT_NEWEST, 10, 0)
 	assert.NoError(err)
 	if assert.NotNil(results) {
 		assert.Equal("b0", results.BSOs[0].Id)
 	}
 
-	results, err = db.getBSOs(tx, cId, nil, MaxTimestamp, modified, SORT_NEWEST, 10, 0)
+	results, err = db.getBSOs(tx, cId, nil, MaxTimestamp, modified, 0, SORT_NEWEST, 10, 0)
 	assert.NoError(err)
 	if assert.NotNil(results) {
+		assert.Len(results.BSOs, 0)
+	}
+
+}
+
+func TestSkipNoopSortIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := NewDB(":memory:", &Config{SkipNoopSortIndex: true})
+	if !assert.NoError(err) {
+		return
+	}
+
+	cId := 1
+	modified, err := db.PutBSO(cId, "b0", String("data"), Int(5), nil)
+	if !assert.NoError(err) {
+		return
+	}
+	cModified, _ := db.GetCollectionModified(cId)
+
+	time.Sleep(10 * time.Millisecond)
+
+	{ // PUT with the same sortindex
+		m, err := db.PutBSO(cId, "b0", nil, Int(5), nil)
+		if assert.NoError(err) {
+			assert.Equal(modified, m)
+		}
+
+		bso, _ := db.GetBSO(cId, "b0")
+		assert.Equal(modified, bso.Modified)
+	}
+
+	{ // POST with the same sortindex
+		results, err := db.PostBSOs(cId, PostBSOInput{&PutBSOInput{Id: "b0", SortIndex: Int(5)}})
+		if assert.NoError(err) {
+			assert.Equal([]string{"b0"}, results.Success)
+			assert.Equal(cModified, results.Modified)
+		}
+
+		bso, _ := db.GetBSO(cId, "b0")
+		assert.Equal(modified, bso.Modified)
+
+		m, _ := db.GetCollectionModified(cId)
+		assert.Equal(cModified, m)
+	}
+
+	{ // a different sortindex is still written
+		m, err := db.PutBSO(cId, "b0", nil, Int(6), nil)
+		if assert.NoError(err) {
+			assert.NotEqual(modified, m)
+		}
+
+		bso, _ := db.GetBSO(cId, "b0")
+		assert.Equal(6, bso.SortIndex)
+		assert.Equal(m, bso.Modified)
+	}
+
+	{ // by default every update is written
+		db, _ := getTestDB()
+		modified, _ := db.PutBSO(cId, "b0", String("data"), Int(5), nil)
+		time.Sleep(10 * time.Millisecond)
+		m, err := db.PutBSO(cId, "b0", nil, Int(5), nil)
+		if assert.NoError(err) {
+			assert.NotEqual(modified, m)
+		}
+	}
+}
+
+func TestCountBSOs(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := getTestDB()
+
+	cId := 1
+	modified := Now()
+	for i := 0; i < 5; i++ {
+		_, err := db.PutBSO(cId, "b"+strconv.Itoa(i), String("a"), nil, nil)
+		if !assert.NoError(err) {
+			return
+		}
+	}
+
+	count, err := db.CountBSOs(cId, nil, MaxTimestamp, 0, 0)
+	if assert.NoError(err) {
+		assert.Equal(5, count)
+	}
+
+	count, err = db.CountBSOs(cId, []string{"b0", "b1", "nope"}, MaxTimestamp, 0, 0)
+	if assert.NoError(err) {
+		assert.Equal(2, count)
+	}
+
+	{ // time bounds apply
+		tx, _ := db.db.Begin()
+		defer tx.Rollback()
+
+		assert.NoError(db.insertBSO(tx, 2, "b0", modified-2, "a", 1, true, DEFAULT_BSO_TTL))
+		assert.NoError(db.insertBSO(tx, 2, "b1", modified-1, "a", 1, true, DEFAULT_BSO_TTL))
+		assert.NoError(db.insertBSO(tx, 2, "b2", modified, "a", 1, true, DEFAULT_BSO_TTL))
+
+		count, err = db.countBSOs(tx, 2, nil, MaxTimestamp, modified-2, 0, db.ttlCutoff())
+		if assert.NoError(err) {
+			assert.Equal(2, count)
+		}
+
+		count, err = db.countBSOs(tx, 2, nil, modified, modified-2, 0, db.ttlCutoff())
+		if assert.NoError(err) {
+			assert.Equal(1, count)
+		}
+	}
+
+	_, err = db.CountBSOs(cId, nil, MaxTimestamp, -1, 0)
+	assert.Equal(ErrInvalidNewer, err)
+}
+
+func TestGetBSOsNewerExclusive(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := getTestDB()
+
+	cId := 1
+	modified, err := db.PutBSO(cId, "b0", String("a"), nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// a BSO modified exactly at newer is not included
+	results, err := db.GetBSOs(cId, nil, MaxTimestamp, modified, 0, SORT_NEWEST, 10, 0)
+	if assert.NoError(err) {
+		assert.Len(results.BSOs, 0)
+	}
+	idResults, err := db.GetBSOIds(cId, nil, MaxTimestamp, modified, 0, SORT_NEWEST, 10, 0)
+	if assert.NoError(err) {
+		assert.Len(idResults.Ids, 0)
 	}
 
+	results, err = db.GetBSOs(cId, nil, MaxTimestamp, modified-1, 0, SORT_NEWEST, 10, 0)
+	if assert.NoError(err) && assert.Len(results.BSOs, 1) {
+		assert.Equal("b0", results.BSOs[0].Id)
+	}
+	idResults, err = db.GetBSOIds(cId, nil, MaxTimestamp, modified-1, 0, SORT_NEWEST, 10, 0)
+	if assert.NoError(err) {
+		assert.Equal([]string{"b0"}, idResults.Ids)
+	}
 }
 
 func TestPrivateGetBSOsSort(t *testing.T) {
@@ -452,14 +592,14 @@ func TestPrivateGetBSOsSort(t *testing.T) {
 
 	modified := Now()
 
-	_, err := db.getBSOs(tx, cId, nil, MaxTimestamp, -1, SORT_NONE, 10, 0)
+	_, err := db.getBSOs(tx, cId, nil, MaxTimestamp, -1, 0, SORT_NONE, 10, 0)
 	assert.Equal(ErrInvalidNewer, err)
 
-	assert.Nil(db.insertBSO(tx, cId, "b2", modified-2, "a", 2, DEFAULT_BSO_TTL))
-	assert.Nil(db.insertBSO(tx, cId, "b1", modified-1, "a", 0, DEFAULT_BSO_TTL))
-	assert.Nil(db.insertBSO(tx, cId, "b0", modified, "a", 1, DEFAULT_BSO_TTL))
+	assert.Nil(db.insertBSO(tx, cId, "b2", modified-2, "a", 2, true, DEFAULT_BSO_TTL))
+	assert.Nil(db.insertBSO(tx, cId, "b1", modified-1, "a", 0, true, DEFAULT_BSO_TTL))
+	assert.Nil(db.insertBSO(tx, cId, "b0", modified, "a", 1, true, DEFAULT_BSO_TTL))
 
-	results, err := db.getBSOs(tx, cId, nil, MaxTimestamp, 0, SORT_NEWEST, 10, 0)
+	results, err := db.getBSOs(tx, cId, nil, MaxTimestamp, 0, 0, SORT_NEWEST, 10, 0)
 	assert.NoError(err)
 	if assert.NotNil(results) {
 		assert.Equal(3, len(results.BSOs))
@@ -468,7 +608,7 @@ func TestPrivateGetBSOsSort(t *testing.T) {
 		assert.Equal("b2", results.BSOs[2].Id)
 	}
 
-	results, err = db.getBSOs(tx, cId, nil, MaxTimestamp, 0, SORT_OLDEST, 10, 0)
+	results, err = db.getBSOs(tx, cId, nil, MaxTimestamp, 0, 0, SORT_OLDEST, 10, 0)
 	assert.NoError(err)
 	if assert.NotNil(results) {
 		assert.Equal(3, len(results.BSOs))
@@ -477,7 +617,7 @@ func TestPrivateGetBSOsSort(t *testing.T) {
 		assert.Equal("b0", results.BSOs[2].Id)
 	}
 
-	results, err = db.getBSOs(tx, cId, nil, MaxTimestamp, 0, SORT_INDEX, 10, 0)
+	results, err = db.getBSOs(tx, cId, nil, MaxTimestamp, 0, 0, SORT_INDEX, 10, 0)
 	assert.NoError(err)
 	if assert.NotNil(results) {
 		assert.Equal(3, len(results.BSOs))
@@ -586,6 +726,27 @@ func TestCreateCollection(t *testing.T) {
 	}
 }
 
+func TestCreateCollectionExisting(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+
+	cId, err := db.CreateCollection("NewCollection")
+	if !assert.NoError(err) {
+		return
+	}
+
+	// what a request losing the race to create a collection does
+	again, err := db.CreateCollection("NewCollection")
+	if assert.NoError(err) {
+		assert.Equal(cId, again)
+	}
+
+	bookmarks, err := db.CreateCollection("bookmarks")
+	if assert.NoError(err) {
+		assert.Equal(7, bookmarks)
+	}
+}
+
 func TestTouchCollection(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
@@ -851,6 +1012,61 @@ func TestPostBSOs(t *testing.T) {
 	assert.Equal(results2.Modified, cModified)
 }
 
+func TestReplaceBSO(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+
+	cId := 1
+	_, err := db.PutBSO(cId, "b0", String("original"), Int(10), Int(3600*1000))
+	if !assert.NoError(err) {
+		return
+	}
+
+	{ // PutBSO keeps the fields that are not given
+		_, err := db.PutBSO(cId, "b0", String("merged"), nil, nil)
+		assert.NoError(err)
+
+		b, err := db.GetBSO(cId, "b0")
+		if assert.NoError(err) {
+			assert.Equal("merged", b.Payload)
+			assert.Equal(10, b.SortIndex)
+		}
+
+		ttl, _ := db.GetBSOTTL(cId, "b0")
+		assert.NotEqual(NoTTL, ttl)
+	}
+
+	modified, err := db.ReplaceBSO(cId, "b0", String("replaced"), nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	b, err := db.GetBSO(cId, "b0")
+	if assert.NoError(err) {
+		assert.Equal("replaced", b.Payload)
+		assert.Equal(0, b.SortIndex)
+		assert.Equal(modified, b.Modified)
+	}
+
+	ttl, err := db.GetBSOTTL(cId, "b0")
+	if assert.NoError(err) {
+		assert.Equal(NoTTL, ttl)
+	}
+
+	{ // creates BSOs too
+		_, err := db.ReplaceBSO(cId, "b1", nil, Int(5), nil)
+		assert.NoError(err)
+		b, err := db.GetBSO(cId, "b1")
+		if assert.NoError(err) {
+			assert.Equal("", b.Payload)
+			assert.Equal(5, b.SortIndex)
+		}
+	}
+
+	_, err = db.ReplaceBSO(cId, "bad\tid", nil, nil, nil)
+	assert.Equal(ErrInvalidBSOId, err)
+}
+
 func TestGetBSO(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
@@ -877,6 +1093,49 @@ func TestGetBSO(t *testing.T) {
 	assert.Nil(bso)
 }
 
+func TestGetBSOSortIndexSet(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+
+	cId := 1
+	_, err := db.PutBSO(cId, "unset", String("a"), nil, nil)
+	assert.NoError(err)
+	_, err = db.PutBSO(cId, "zero", String("a"), Int(0), nil)
+	assert.NoError(err)
+	_, err = db.PutBSO(cId, "one", String("a"), Int(1), nil)
+	assert.NoError(err)
+
+	for bId, expected := range map[string]bool{"unset": false, "zero": true, "one": true} {
+		bso, err := db.GetBSO(cId, bId)
+		if assert.NoError(err) {
+			assert.Equal(expected, bso.SortIndexSet, bId)
+		}
+	}
+
+	// updating the sortindex sets it, even to 0
+	_, err = db.PutBSO(cId, "unset", nil, Int(0), nil)
+	assert.NoError(err)
+
+	results, err := db.GetBSOs(cId, nil, MaxTimestamp, 0, 0, SORT_NONE, 10, 0)
+	if assert.NoError(err) && assert.Len(results.BSOs, 3) {
+		for _, bso := range results.BSOs {
+			assert.True(bso.SortIndexSet, bso.Id)
+		}
+	}
+
+	// replacing without a sortindex resets it to the default, unset
+	for _, bId := range []string{"one", "new"} {
+		_, err = db.ReplaceBSO(cId, bId, String("b"), nil, nil)
+		assert.NoError(err)
+
+		bso, err := db.GetBSO(cId, bId)
+		if assert.NoError(err) {
+			assert.Equal(0, bso.SortIndex, bId)
+			assert.False(bso.SortIndexSet, bId)
+		}
+	}
+}
+
 func TestGetBSOs(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
@@ -912,7 +1171,7 @@ func TestGetBSOs(t *testing.T) {
 	}
 
 	// get these 3 and sort them in order of newest
-	results, err := db.GetBSOs(cId, []string{"b0", "b2", "b4"}, MaxTimestamp, 0, SORT_NEWEST, 10, 0)
+	results, err := db.GetBSOs(cId, []string{"b0", "b2", "b4"}, MaxTimestamp, 0, 0, SORT_NEWEST, 10, 0)
 	assert.NoError(err)
 	if assert.NotNil(results) {
 		assert.Equal("b0", results.BSOs[0].Id) // created last
@@ -920,7 +1179,7 @@ func TestGetBSOs(t *testing.T) {
 		assert.Equal("b4", results.BSOs[2].Id) // created first
 	}
 
-	results, err = db.GetBSOs(cId, nil, MaxTimestamp, 0, SORT_INDEX, 2, 0)
+	results, err = db.GetBSOs(cId, nil, MaxTimestamp, 0, 0, SORT_INDEX, 2, 0)
 	assert.NoError(err)
 	if assert.NotNil(results) {
 		assert.Equal(2, len(results.BSOs))
@@ -931,113 +1190,561 @@ func TestGetBSOs(t *testing.T) {
 	}
 }
 
-func TestGetBSOModified(t *testing.T) {
+func TestPostBSOsQuota(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
 
 	cId := 1
-	bId := "b0"
-	payload := "a"
+	payload := strings.Repeat("x", 100)
 
-	expected, err := db.PutBSO(cId, bId, String(payload), nil, nil)
-	if !assert.NoError(err) {
-		return
+	{ // fits in the quota
+		results, remaining, err := db.PostBSOsQuota(cId, PostBSOInput{
+			NewPutBSOInput("b0", &payload, nil, nil),
+			NewPutBSOInput("b1", &payload, nil, nil),
+		}, 350)
+		if assert.NoError(err) {
+			assert.Len(results.Success, 2)
+			assert.Len(results.Failed, 0)
+			assert.Equal(150, remaining)
+		}
 	}
 
-	// Make sure it returns the right BSO
-	modified, err := db.GetBSOModified(cId, bId)
-	if !assert.NoError(err) {
-		return
+	{ // updating an existing BSO only counts the difference
+		bigger := payload + "xx"
+		_, remaining, err := db.PostBSOsQuota(cId, PostBSOInput{
+			NewPutBSOInput("b0", &bigger, nil, nil),
+		}, 350)
+		if assert.NoError(err) {
+			assert.Equal(148, remaining)
+		}
 	}
 
-	assert.Equal(expected, modified)
+	{ // crosses the quota part way through
+		results, remaining, err := db.PostBSOsQuota(cId, PostBSOInput{
+			NewPutBSOInput("b2", &payload, nil, nil),
+			NewPutBSOInput("b3", &payload, nil, nil),
+			NewPutBSOInput("b4", String("x"), nil, nil),
+		}, 350)
+		if assert.NoError(err) {
+			assert.Equal([]string{"b2"}, results.Success)
+			assert.Equal([]string{ErrOverQuota.Error()}, results.Failed["b3"])
+			assert.Equal([]string{ErrOverQuota.Error()}, results.Failed["b4"])
+			assert.Equal(0, remaining)
+		}
+
+		_, err = db.GetBSO(cId, "b3")
+		assert.Equal(ErrNotFound, err)
+	}
+
+	{ // nothing fits, nothing is written
+		results, remaining, err := db.PostBSOsQuota(cId, PostBSOInput{
+			NewPutBSOInput("b3", &payload, nil, nil),
+			NewPutBSOInput("b4", String("x"), nil, nil),
+		}, 350)
+		assert.Equal(ErrOverQuota, err)
+		assert.Nil(results)
+		assert.Equal(48, remaining)
+
+		for _, bId := range []string{"b3", "b4"} {
+			_, err = db.GetBSO(cId, bId)
+			assert.Equal(ErrNotFound, err, bId)
+		}
+	}
+
+	{ // no quota
+		results, remaining, err := db.PostBSOsQuota(cId, PostBSOInput{
+			NewPutBSOInput("b3", &payload, nil, nil),
+		}, 0)
+		if assert.NoError(err) {
+			assert.Equal([]string{"b3"}, results.Success)
+			assert.Equal(0, remaining)
+		}
+	}
 }
 
-func TestDeleteBSO(t *testing.T) {
+func TestPostBSOsQuotaExactLimit(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
 
 	cId := 1
-	bId := "b0"
-	payload := String("a")
-	_, err := db.PutBSO(cId, bId, payload, nil, nil)
-	if !assert.NoError(err) {
-		return
+	payload := strings.Repeat("x", 100)
+
+	{ // reaching the quota exactly is allowed
+		results, remaining, err := db.PostBSOsQuota(cId, PostBSOInput{
+			NewPutBSOInput("b0", &payload, nil, nil),
+			NewPutBSOInput("b1", &payload, nil, nil),
+		}, 200)
+		if assert.NoError(err) {
+			assert.Equal([]string{"b0", "b1"}, results.Success)
+			assert.Len(results.Failed, 0)
+			assert.Equal(0, remaining)
+		}
 	}
 
-	_, err = db.DeleteBSO(cId, bId)
-	if !assert.NoError(err) {
-		return
+	{ // a single byte more is not
+		_, remaining, err := db.PostBSOsQuota(cId, PostBSOInput{
+			NewPutBSOInput("b2", String("x"), nil, nil),
+		}, 200)
+		assert.Equal(ErrOverQuota, err)
+		assert.Equal(0, remaining)
 	}
 
-	bso, err := db.GetBSO(cId, bId)
-	assert.Exactly(ErrNotFound, err)
-	assert.Nil(bso)
+	{ // replacing a payload with one the same size still fits
+		same := strings.Repeat("y", 100)
+		results, remaining, err := db.PostBSOsQuota(cId, PostBSOInput{
+			NewPutBSOInput("b0", &same, nil, nil),
+		}, 200)
+		if assert.NoError(err) {
+			assert.Equal([]string{"b0"}, results.Success)
+			assert.Equal(0, remaining)
+		}
+	}
+
+	used, _, err := db.InfoQuota()
+	if assert.NoError(err) {
+		assert.Equal(200, used)
+	}
 }
 
-func TestDeleteBSOs(t *testing.T) {
+func TestPostBSOsQuotaConcurrent(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
-	// create some testing data
-	cId := 1
-	create := PostBSOInput{
-		NewPutBSOInput("b0", String("payload 0"), Int(10), nil),
-		NewPutBSOInput("b1", String("payload 1"), Int(10), nil),
-		NewPutBSOInput("b2", String("payload 2"), Int(10), nil),
+
+	// each POST fits in the quota on its own but not together
+	payload := strings.Repeat("x", 100)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func(bId string) {
+			_, _, err := db.PostBSOsQuota(1, PostBSOInput{
+				NewPutBSOInput(bId, &payload, nil, nil),
+			}, 150)
+			errs <- err
+		}("b" + strconv.Itoa(i))
+	}
+
+	var overQuota int
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == ErrOverQuota {
+			overQuota++
+		} else {
+			assert.NoError(err)
+		}
 	}
+	assert.Equal(1, overQuota)
 
-	_, err := db.PostBSOs(cId, create)
-	if assert.NoError(err) {
+	used, _, _ := db.InfoQuota()
+	assert.Equal(100, used)
+}
 
-		_, err = db.DeleteBSO(cId, "b0")
-		assert.NoError(err)
+func TestPutBSOQuota(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
 
-		// deleting non existant bId returns no errors
-		_, err = db.DeleteBSO(cId, "bxi0")
-		assert.NoError(err)
+	cId := 1
+	payload := strings.Repeat("x", 100)
 
-		// deleting multiple bIds
-		_, err = db.DeleteBSOs(cId, "b1", "b2")
-		assert.NoError(err)
+	_, remaining, err := db.PutBSOQuota(cId, "b0", &payload, nil, nil, 150)
+	if assert.NoError(err) {
+		assert.Equal(50, remaining)
+	}
 
+	// only the difference from the stored payload counts
+	bigger := payload + strings.Repeat("x", 50)
+	_, remaining, err = db.PutBSOQuota(cId, "b0", &bigger, nil, nil, 150)
+	if assert.NoError(err) {
+		assert.Equal(0, remaining)
 	}
 
-	var b *BSO
-	b, err = db.GetBSO(cId, "b0")
-	assert.Nil(b)
-	assert.Exactly(ErrNotFound, err)
+	_, remaining, err = db.PutBSOQuota(cId, "b1", String("x"), nil, nil, 150)
+	assert.Equal(ErrOverQuota, err)
+	assert.Equal(0, remaining)
+	_, err = db.GetBSO(cId, "b1")
+	assert.Equal(ErrNotFound, err)
 
-	b, err = db.GetBSO(cId, "b1")
-	assert.Nil(b)
-	assert.Exactly(ErrNotFound, err)
+	// updates without a payload are allowed at the quota
+	_, _, err = db.PutBSOQuota(cId, "b0", nil, Int(5), nil, 150)
+	assert.NoError(err)
 
-	b, err = db.GetBSO(cId, "b2")
-	assert.Nil(b)
-	assert.Exactly(ErrNotFound, err)
+	// replacing with a smaller payload frees up space
+	_, remaining, err = db.ReplaceBSOQuota(cId, "b0", &payload, nil, nil, 150)
+	if assert.NoError(err) {
+		assert.Equal(50, remaining)
+	}
+
+	_, _, err = db.ReplaceBSOQuota(cId, "b1", &payload, nil, nil, 150)
+	assert.Equal(ErrOverQuota, err)
 }
 
-func TestUsageStats(t *testing.T) {
+func TestBSOPages(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
-	cId := 1
-	payload := strings.Repeat("x", 1024)
 
-	create := PostBSOInput{
-		NewPutBSOInput("b0", &payload, Int(10), nil),
-		NewPutBSOInput("b1", &payload, Int(10), nil),
-		NewPutBSOInput("b2", &payload, Int(10), nil),
+	cId := 1
+	for i := 0; i < 5; i++ {
+		_, err := db.PutBSO(cId, "b"+strconv.Itoa(i), String("Hello"), Int(i), nil)
+		if !assert.NoError(err) {
+			return
+		}
 	}
 
-	_, err := db.PostBSOs(cId, create)
-	if assert.NoError(err) {
-
+	readAll := func(pages *BSOPages) (sizes []int, ids []string) {
+		for {
+			page, err := pages.Next()
+			if !assert.NoError(err) || len(page) == 0 {
+				return
+			}
+
+			sizes = append(sizes, len(page))
+			for _, b := range page {
+				ids = append(ids, b.Id)
+			}
+
+			// the DB is not locked between pages
+			_, err = db.GetBSO(cId, "b0")
+			assert.NoError(err)
+		}
+	}
+
+	{ // no limit
+		pages, err := db.NewBSOPages(cId, nil, MaxTimestamp, 0, 0, SORT_INDEX, -1, 0, 2)
+		if assert.NoError(err) {
+			assert.Equal(5, pages.Total)
+			sizes, ids := readAll(pages)
+			assert.Equal([]int{2, 2, 1}, sizes)
+			assert.Equal([]string{"b4", "b3", "b2", "b1", "b0"}, ids)
+		}
+	}
+
+	{ // limit and offset, Total ignores both
+		pages, err := db.NewBSOPages(cId, nil, MaxTimestamp, 0, 0, SORT_INDEX, 3, 1, 2)
+		if assert.NoError(err) {
+			assert.Equal(5, pages.Total)
+			sizes, ids := readAll(pages)
+			assert.Equal([]int{2, 1}, sizes)
+			assert.Equal([]string{"b3", "b2", "b1"}, ids)
+		}
+	}
+
+	{ // nothing matches
+		pages, err := db.NewBSOPages(cId, []string{"nope"}, MaxTimestamp, 0, 0, SORT_INDEX, -1, 0, 2)
+		if assert.NoError(err) {
+			assert.Equal(0, pages.Total)
+			page, err := pages.Next()
+			assert.NoError(err)
+			assert.Len(page, 0)
+		}
+	}
+
+	_, err := db.NewBSOPages(cId, nil, MaxTimestamp, 0, 0, SORT_INDEX, -1, 0, 0)
+	assert.Error(err)
+}
+
+func TestGetBSOIds(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+
+	cId := 1
+	sortIndexes := []int{1, 3, 4, 2, 0}
+	for i := 4; i >= 0; i-- {
+		bId := "b" + strconv.Itoa(i)
+		_, err := db.PutBSO(cId, bId, String("Hello"), Int(sortIndexes[i]), nil)
+		if !assert.NoError(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	results, err := db.GetBSOIds(cId, []string{"b0", "b2", "b4"}, MaxTimestamp, 0, 0, SORT_NEWEST, 10, 0)
+	if assert.NoError(err) {
+		assert.Equal([]string{"b0", "b2", "b4"}, results.Ids)
+		assert.False(results.More)
+	}
+
+	results, err = db.GetBSOIds(cId, nil, MaxTimestamp, 0, 0, SORT_INDEX, 2, 0)
+	if assert.NoError(err) {
+		assert.Equal([]string{"b2", "b1"}, results.Ids)
+		assert.True(results.More)
+		assert.Equal(2, results.Offset)
+	}
+
+	// should match what GetBSOs finds
+	full, _ := db.GetBSOs(cId, nil, MaxTimestamp, 0, 0, SORT_OLDEST, -1, 0)
+	results, err = db.GetBSOIds(cId, nil, MaxTimestamp, 0, 0, SORT_OLDEST, -1, 0)
+	if assert.NoError(err) && assert.Len(results.Ids, len(full.BSOs)) {
+		for i, b := range full.BSOs {
+			assert.Equal(b.Id, results.Ids[i])
+		}
+	}
+}
+
+// benchmarkDB creates a collection with large payloads to compare
+// fetching ids only with fetching full BSOs
+func benchmarkDB(b *testing.B) (*DB, int) {
+	db, err := getTestDB()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	payload := strings.Repeat("x", 16*1024)
+	input := make(PostBSOInput, 0, 100)
+	for i := 0; i < 1000; i++ {
+		input = append(input, NewPutBSOInput("b"+strconv.Itoa(i), &payload, nil, nil))
+		if len(input) == 100 {
+			if _, err := db.PostBSOs(1, input); err != nil {
+				b.Fatal(err)
+			}
+			input = input[:0]
+		}
+	}
+
+	return db, 1
+}
+
+func BenchmarkGetBSOsFull(b *testing.B) {
+	db, cId := benchmarkDB(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.GetBSOs(cId, nil, MaxTimestamp, 0, 0, SORT_NEWEST, -1, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetBSOIds(b *testing.B) {
+	db, cId := benchmarkDB(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.GetBSOIds(cId, nil, MaxTimestamp, 0, 0, SORT_NEWEST, -1, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkInput creates 1000 BSOs to compare writing them one at a time
+// with writing them in a single transaction
+func benchmarkInput() PostBSOInput {
+	payload := strings.Repeat("x", 1024)
+	input := make(PostBSOInput, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		input = append(input, NewPutBSOInput("b"+strconv.Itoa(i), &payload, nil, nil))
+	}
+	return input
+}
+
+func BenchmarkPutBSOPerRecord(b *testing.B) {
+	input := benchmarkInput()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db, err := getTestDB()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		for _, bso := range input {
+			if _, err := db.PutBSO(1, bso.Id, bso.Payload, bso.SortIndex, bso.TTL); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkPostBSOsBatch(b *testing.B) {
+	input := benchmarkInput()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db, err := getTestDB()
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		if _, err := db.PostBSOs(1, input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkCollectionsDB creates a user with 50 modified collections
+func benchmarkCollectionsDB(b testing.TB) (*DB, []string) {
+	db, err := getTestDB()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	names := make([]string, 0, 50)
+	for i := 0; i < 50; i++ {
+		name := "col" + strconv.Itoa(i)
+		cId, err := db.CreateCollection(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := db.TouchCollection(cId, Now()+i); err != nil {
+			b.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	return db, names
+}
+
+func TestInfoCollectionsMany(t *testing.T) {
+	assert := assert.New(t)
+	db, names := benchmarkCollectionsDB(t)
+
+	results, err := db.InfoCollections()
+	if !assert.NoError(err) || !assert.Len(results, len(names)) {
+		return
+	}
+
+	for _, name := range names {
+		cId, err := db.GetCollectionId(name)
+		if !assert.NoError(err) {
+			return
+		}
+		modified, err := db.GetCollectionModified(cId)
+		if assert.NoError(err) {
+			assert.Equal(modified, results[name], name)
+		}
+	}
+}
+
+// BenchmarkInfoCollections reads every collection's modified time in a
+// single query, compare with BenchmarkInfoCollectionsPerCollection
+func BenchmarkInfoCollections(b *testing.B) {
+	db, _ := benchmarkCollectionsDB(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.InfoCollections(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInfoCollectionsPerCollection(b *testing.B) {
+	db, names := benchmarkCollectionsDB(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		results := make(map[string]int, len(names))
+		for _, name := range names {
+			cId, err := db.GetCollectionId(name)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if results[name], err = db.GetCollectionModified(cId); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestGetBSOModified(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+
+	cId := 1
+	bId := "b0"
+	payload := "a"
+
+	expected, err := db.PutBSO(cId, bId, String(payload), nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// Make sure it returns the right BSO
+	modified, err := db.GetBSOModified(cId, bId)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.Equal(expected, modified)
+}
+
+func TestDeleteBSO(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+
+	cId := 1
+	bId := "b0"
+	payload := String("a")
+	_, err := db.PutBSO(cId, bId, payload, nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	_, err = db.DeleteBSO(cId, bId)
+	if !assert.NoError(err) {
+		return
+	}
+
+	bso, err := db.GetBSO(cId, bId)
+	assert.Exactly(ErrNotFound, err)
+	assert.Nil(bso)
+}
+
+func TestDeleteBSOs(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+	// create some testing data
+	cId := 1
+	create := PostBSOInput{
+		NewPutBSOInput("b0", String("payload 0"), Int(10), nil),
+		NewPutBSOInput("b1", String("payload 1"), Int(10), nil),
+		NewPutBSOInput("b2", String("payload 2"), Int(10), nil),
+	}
+
+	_, err := db.PostBSOs(cId, create)
+	if assert.NoError(err) {
+
+		_, err = db.DeleteBSO(cId, "b0")
+		assert.NoError(err)
+
+		// deleting non existant bId returns no errors
+		_, err = db.DeleteBSO(cId, "bxi0")
+		assert.NoError(err)
+
+		// deleting multiple bIds
+		_, err = db.DeleteBSOs(cId, "b1", "b2")
+		assert.NoError(err)
+
+	}
+
+	var b *BSO
+	b, err = db.GetBSO(cId, "b0")
+	assert.Nil(b)
+	assert.Exactly(ErrNotFound, err)
+
+	b, err = db.GetBSO(cId, "b1")
+	assert.Nil(b)
+	assert.Exactly(ErrNotFound, err)
+
+	b, err = db.GetBSO(cId, "b2")
+	assert.Nil(b)
+	assert.Exactly(ErrNotFound, err)
+}
+
+func TestUsageStats(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+	cId := 1
+	payload := strings.Repeat("x", 1024)
+
+	create := PostBSOInput{
+		NewPutBSOInput("b0", &payload, Int(10), nil),
+		NewPutBSOInput("b1", &payload, Int(10), nil),
+		NewPutBSOInput("b2", &payload, Int(10), nil),
+	}
+
+	_, err := db.PostBSOs(cId, create)
+	if assert.NoError(err) {
+
 		_, err = db.DeleteBSOs(cId, "b0", "b1")
 		if assert.NoError(err) {
 			pageStats, err := db.Usage()
 			if assert.NoError(err) {
 
 				// numbers pulled from previous tests
-				assert.Equal(10, pageStats.Total)  // total pages in database
+				assert.Equal(13, pageStats.Total)  // total pages in database
 				assert.Equal(0, pageStats.Free)    // unused pages (from delete)
 				assert.Equal(4096, pageStats.Size) // bytes/page
 			}
@@ -1058,14 +1765,110 @@ func TestPurgeExpired(t *testing.T) {
 		NewPutBSOInput("b2", &payload, Int(10), Int(1)),
 	}
 
-	_, err := db.PostBSOs(cId, create)
-	if assert.NoError(err) {
-		time.Sleep(10 * time.Millisecond)
-		purged, err := db.PurgeExpired()
+	_, err := db.PostBSOs(cId, create)
+	if assert.NoError(err) {
+		time.Sleep(10 * time.Millisecond)
+		purged, err := db.PurgeExpired()
+		if assert.NoError(err) {
+			assert.Equal(3, purged)
+		}
+	}
+}
+
+func TestSetCollectionTTL(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+
+	payload := "x"
+	for _, cId := range []int{1, 2} {
+		_, err := db.PostBSOs(cId, PostBSOInput{
+			NewPutBSOInput("b0", &payload, nil, nil),
+			NewPutBSOInput("b1", &payload, nil, Int(10)), // expires sooner
+		})
+		if !assert.NoError(err) {
+			return
+		}
+	}
+
+	_, err := db.SetCollectionTTL(1, -1)
+	assert.Equal(ErrInvalidTTL, err)
+
+	{ // only shortens ttls
+		updated, err := db.SetCollectionTTL(1, 60*1000)
+		if assert.NoError(err) {
+			assert.Equal(1, updated)
+		}
+
+		ttl, err := db.GetBSOTTL(1, "b0")
+		if assert.NoError(err) {
+			assert.True(ttl > 0 && ttl <= 60, "ttl %d", ttl)
+		}
+	}
+
+	{ // 0 expires them immediately
+		updated, err := db.SetCollectionTTL(1, 0)
+		if assert.NoError(err) {
+			assert.Equal(2, updated)
+		}
+
+		results, err := db.GetBSOs(1, nil, MaxTimestamp, 0, 0, SORT_NONE, 10, 0)
+		if assert.NoError(err) {
+			assert.Len(results.BSOs, 0)
+		}
+
+		purged, err := db.PurgeExpiredCollection(1)
+		if assert.NoError(err) {
+			assert.Equal(2, purged)
+		}
+	}
+
+	// other collections are not changed
+	bso, err := db.GetBSO(2, "b0")
+	if assert.NoError(err) {
+		assert.Equal(DEFAULT_BSO_TTL, bso.TTL-bso.Modified)
+	}
+}
+
+func TestPurgeExpiredCollections(t *testing.T) {
+	db, _ := getTestDB()
+	assert := assert.New(t)
+
+	payload := "x"
+	for _, cId := range []int{1, 7, 9} {
+		_, err := db.PostBSOs(cId, PostBSOInput{
+			NewPutBSOInput("b0", &payload, nil, Int(1)),
+			NewPutBSOInput("b1", &payload, nil, nil),
+		})
+		if !assert.NoError(err) {
+			return
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	{ // only the expired BSO in the one collection
+		purged, err := db.PurgeExpiredCollection(9)
+		if assert.NoError(err) {
+			assert.Equal(1, purged)
+		}
+	}
+
+	{ // skipped collections are left alone
+		purged, err := db.PurgeExpired(7)
 		if assert.NoError(err) {
-			assert.Equal(3, purged)
+			assert.Equal(1, purged)
+		}
+
+		purged, err = db.PurgeExpiredCollection(7)
+		if assert.NoError(err) {
+			assert.Equal(1, purged)
 		}
 	}
+
+	for _, cId := range []int{1, 7, 9} {
+		_, err := db.GetBSO(cId, "b1")
+		assert.NoError(err)
+	}
 }
 
 func TestOptimize(t *testing.T) {
@@ -1088,8 +1891,8 @@ func TestOptimize(t *testing.T) {
 			assert.Equal(3, purged)
 			stats, err := db.Usage()
 			if assert.NoError(err) {
-				assert.Equal(23, stats.FreePercent()) // we know this from a previous test ;)
-				vac, err := db.Optimize(20)
+				assert.Equal(18, stats.FreePercent()) // we know this from a previous test ;)
+				vac, err := db.Optimize(15)
 				assert.NoError(err)
 				assert.True(vac)
 
@@ -1100,6 +1903,84 @@ func TestOptimize(t *testing.T) {
 	}
 }
 
+func TestCopyTo(t *testing.T) {
+	assert := assert.New(t)
+
+	src, _ := getTestDB()
+	dst, err := NewDB(":memory:", &Config{DedupPayloads: true})
+	if !assert.NoError(err) {
+		return
+	}
+
+	// a custom collection gets a different id in dst
+	if _, err := dst.CreateCollection("other"); !assert.NoError(err) {
+		return
+	}
+
+	big := strings.Repeat("x", 4096)
+	small := "y"
+	for _, name := range []string{"bookmarks", "custom"} {
+		cId, err := src.CreateCollection(name)
+		if !assert.NoError(err) {
+			return
+		}
+
+		_, err = src.PostBSOs(cId, PostBSOInput{
+			NewPutBSOInput("b0", &big, Int(5), nil),
+			NewPutBSOInput("b1", &small, nil, Int(60*1000)),
+			NewPutBSOInput("expired", &small, nil, Int(1)),
+		})
+		if !assert.NoError(err) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	copied, err := src.CopyTo(dst)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(4, copied)
+
+	srcInfo, _ := src.InfoCollections()
+	dstInfo, _ := dst.InfoCollections()
+	for name, modified := range srcInfo {
+		assert.Equal(modified, dstInfo[name], name)
+	}
+
+	srcModified, _ := src.LastModified()
+	dstModified, _ := dst.LastModified()
+	assert.Equal(srcModified, dstModified)
+
+	srcCounts, _ := src.InfoCollectionCounts()
+	dstCounts, _ := dst.InfoCollectionCounts()
+	assert.Equal(map[string]int{"bookmarks": 2, "custom": 2}, dstCounts)
+	assert.NotEqual(srcCounts, dstCounts) // src still has the expired ones
+
+	for _, name := range []string{"bookmarks", "custom"} {
+		srcId, _ := src.GetCollectionId(name)
+		dstId, _ := dst.GetCollectionId(name)
+
+		for _, bId := range []string{"b0", "b1"} {
+			a, err := src.GetBSO(srcId, bId)
+			if !assert.NoError(err) {
+				continue
+			}
+
+			b, err := dst.GetBSO(dstId, bId)
+			if assert.NoError(err, name+"/"+bId) {
+				assert.Equal(a, b)
+			}
+		}
+	}
+
+	_, err = src.CopyTo(dst)
+	assert.Equal(ErrNotEmpty, err)
+
+	_, err = src.CopyTo(src)
+	assert.Error(err)
+}
+
 func TestDeleteEverything(t *testing.T) {
 	db, _ := getTestDB()
 	assert := assert.New(t)
@@ -1156,7 +2037,7 @@ func TestSchemaUpgrades(t *testing.T) {
 	var err error
 
 	// create a new user db initalized manually with SCHEMA_0
-	// to test SCHEMA_0 => SCHEMA_1
+	// to test SCHEMA_0 => SCHEMA_1 => SCHEMA_2 => SCHEMA_3
 	now := strconv.FormatInt(time.Now().UnixNano(), 10)
 	path := "TestSchemaUpgrade." + now + ".db"
 	d := &DB{Path: path}
@@ -1201,26 +2082,37 @@ func TestSchemaUpgrades(t *testing.T) {
 		} else {
 			return
 		}
+
+		// existing BSOs are counted by the upgrade
+		_, err = d.db.Exec(`INSERT INTO BSO (CollectionId, Id, Modified, TTL) VALUES (4, "b0", 1, 1), (4, "b1", 1, 1)`)
+		if !assert.NoError(err) {
+			return
+		}
 	}
 	d.db.Close()
 
-	{ // Reopening the database should auto upgrade db to SCHEMA_1
+	{ // Reopening the database should auto upgrade db to SCHEMA_4
 		d, err := NewDB(path, nil)
 		defer d.Close()
 		if !assert.NoError(err) {
 			return
 		}
 
-		{ // make sure user_version=1
+		{ // make sure user_version=5
 			var val int
 			if err := d.db.QueryRow("PRAGMA user_version;").Scan(&val); assert.NoError(err) {
-				if !assert.Equal(2, val) {
+				if !assert.Equal(5, val) {
 					return
 				}
 			} else {
 				return
 			}
 		}
+
+		counts, err := d.InfoCollectionCounts()
+		if assert.NoError(err) {
+			assert.Equal(map[string]int{"history": 2}, counts)
+		}
 	}
 
 	{ // Reopening should result in no database changes
@@ -1230,10 +2122,10 @@ func TestSchemaUpgrades(t *testing.T) {
 			return
 		}
 
-		{ // make sure user_version=1
+		{ // make sure user_version=5
 			var val int
 			if err := d.db.QueryRow("PRAGMA user_version;").Scan(&val); assert.NoError(err) {
-				if !assert.Equal(2, val) {
+				if !assert.Equal(5, val) {
 					return
 				}
 			} else {
@@ -1242,3 +2134,433 @@ func TestSchemaUpgrades(t *testing.T) {
 		}
 	}
 }
+
+func TestDedupPayloads(t *testing.T) {
+	assert := assert.New(t)
+
+	payload := strings.Repeat("encrypted", 100)
+	numBSOs := 10
+
+	// writes the same payload to many BSOs and returns the bytes used
+	// to store payloads
+	write := func(db *DB) int {
+		for i := 0; i < numBSOs; i++ {
+			cId := 1 + i%2
+			if _, err := db.PutBSO(cId, "b"+strconv.Itoa(i), &payload, nil, nil); !assert.NoError(err) {
+				return 0
+			}
+		}
+
+		var inline, shared int
+		assert.NoError(db.db.QueryRow("SELECT sum(length(Payload)) FROM BSO").Scan(&inline))
+		assert.NoError(db.db.QueryRow("SELECT coalesce(sum(length(Payload)), 0) FROM Payloads").Scan(&shared))
+		return inline + shared
+	}
+
+	plain, _ := NewDB(":memory:", nil)
+	db, _ := NewDB(":memory:", &Config{DedupPayloads: true})
+
+	assert.Equal(numBSOs*len(payload), write(plain))
+	assert.Equal(len(payload), write(db))
+
+	{ // reads are reassembled
+		b, err := db.GetBSO(1, "b0")
+		if assert.NoError(err) {
+			assert.Equal(payload, b.Payload)
+		}
+
+		results, err := db.GetBSOs(2, nil, MaxTimestamp, 0, 0, SORT_NEWEST, -1, 0)
+		if assert.NoError(err) && assert.Len(results.BSOs, numBSOs/2) {
+			for _, b := range results.BSOs {
+				assert.Equal(payload, b.Payload)
+			}
+		}
+	}
+
+	{ // usage still counts every copy
+		usage, err := db.InfoCollectionUsage()
+		if assert.NoError(err) {
+			assert.Equal(numBSOs/2*len(payload), usage["clients"])
+		}
+	}
+
+	countShared := func() (n int) {
+		assert.NoError(db.db.QueryRow("SELECT count(*) FROM Payloads").Scan(&n))
+		return
+	}
+
+	{ // small payloads are kept with the BSO
+		_, err := db.PutBSO(1, "small", String("tiny"), nil, nil)
+		assert.NoError(err)
+		assert.Equal(1, countShared())
+	}
+
+	{ // changing a payload stores the new one and keeps the shared copy
+		changed := strings.Repeat("different", 100)
+		_, err := db.PutBSO(1, "b0", &changed, nil, nil)
+		assert.NoError(err)
+		assert.Equal(2, countShared())
+
+		b, err := db.GetBSO(1, "b0")
+		if assert.NoError(err) {
+			assert.Equal(changed, b.Payload)
+		}
+	}
+
+	{ // unreferenced payloads are removed
+		_, err := db.DeleteBSO(1, "b0")
+		assert.NoError(err)
+		assert.Equal(1, countShared())
+
+		assert.NoError(db.DeleteEverything())
+		assert.Equal(0, countShared())
+	}
+}
+
+func TestDefaultSortIndexes(t *testing.T) {
+	assert := assert.New(t)
+
+	db, _ := NewDB(":memory:", &Config{
+		DefaultSortIndexes: map[string]int{"history": 100, "custom": -5},
+	})
+
+	cId, err := db.CreateCollection("custom")
+	if !assert.NoError(err) {
+		return
+	}
+
+	sortIndex := func(cId int, bId string) int {
+		b, err := db.GetBSO(cId, bId)
+		if !assert.NoError(err) {
+			return 0
+		}
+		return b.SortIndex
+	}
+
+	{ // configured collections get their default on insert
+		_, err := db.PutBSO(4, "b0", String("-"), nil, nil)
+		assert.NoError(err)
+		assert.Equal(100, sortIndex(4, "b0"))
+
+		_, err = db.PutBSO(cId, "b0", String("-"), nil, nil)
+		assert.NoError(err)
+		assert.Equal(-5, sortIndex(cId, "b0"))
+
+		_, err = db.PostBSOs(cId, PostBSOInput{&PutBSOInput{Id: "b1", Payload: String("-")}})
+		assert.NoError(err)
+		assert.Equal(-5, sortIndex(cId, "b1"))
+	}
+
+	{ // others keep 0
+		_, err := db.PutBSO(7, "b0", String("-"), nil, nil)
+		assert.NoError(err)
+		assert.Equal(0, sortIndex(7, "b0"))
+	}
+
+	{ // an explicit value wins
+		_, err := db.PutBSO(4, "b1", String("-"), Int(3), nil)
+		assert.NoError(err)
+		assert.Equal(3, sortIndex(4, "b1"))
+	}
+
+	{ // updates without a sortindex keep the current one
+		_, err := db.PutBSO(4, "b1", String("changed"), nil, nil)
+		assert.NoError(err)
+		assert.Equal(3, sortIndex(4, "b1"))
+	}
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	payloads := map[string]string{
+		"empty":       "",
+		"one-byte":    "x",
+		"unicode":     "snow ☃ and \U0001F600",
+		"json":        `{"ciphertext":"abc\"def","IV":"AAAA\n=="}`,
+		"nul":         "before\x00after",
+		"below-dedup": strings.Repeat("a", dedupMinPayloadSize-1),
+		"at-dedup":    strings.Repeat("b", dedupMinPayloadSize),
+		"max-payload": strings.Repeat("c", 2*1024*1024), // web's default MaxRecordPayloadBytes
+		"padded":      "  padded  ",
+	}
+
+	for _, dedup := range []bool{false, true} {
+		db, _ := NewDB(":memory:", &Config{DedupPayloads: dedup})
+
+		for name, payload := range payloads {
+			payload := payload
+			if _, err := db.PutBSO(1, name, &payload, nil, nil); !assert.NoError(err, name) {
+				return
+			}
+
+			// written twice so shared payloads are reused
+			if _, err := db.PutBSO(2, name, &payload, nil, nil); !assert.NoError(err, name) {
+				return
+			}
+		}
+
+		for name, payload := range payloads {
+			b, err := db.GetBSO(1, name)
+			if assert.NoError(err, name) {
+				assert.True(payload == b.Payload, "dedup=%v %s", dedup, name)
+			}
+		}
+
+		results, err := db.GetBSOs(2, nil, MaxTimestamp, 0, 0, SORT_NEWEST, -1, 0)
+		if assert.NoError(err) && assert.Len(results.BSOs, len(payloads)) {
+			for _, b := range results.BSOs {
+				assert.True(payloads[b.Id] == b.Payload, "dedup=%v %s", dedup, b.Id)
+			}
+		}
+
+		var streamed int
+		_, err = db.ForEachBSO(2, nil, MaxTimestamp, 0, 0, SORT_NEWEST, -1, 0, func(b *BSO) error {
+			streamed++
+			assert.True(payloads[b.Id] == b.Payload, "dedup=%v %s", dedup, b.Id)
+			return nil
+		})
+		assert.NoError(err)
+		assert.Equal(len(payloads), streamed)
+	}
+}
+
+func TestCollectionCountsMaintained(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := getTestDB()
+
+	// compares the counts kept by the triggers with counting every row
+	check := func(msg string) {
+		rows, err := db.db.Query(`SELECT c.Name, count(b.Id) FROM BSO b, Collections c
+								  WHERE b.CollectionId=c.Id GROUP BY b.CollectionId`)
+		if !assert.NoError(err, msg) {
+			return
+		}
+		defer rows.Close()
+
+		expected := make(map[string]int)
+		for rows.Next() {
+			var name string
+			var count int
+			if assert.NoError(rows.Scan(&name, &count)) {
+				expected[name] = count
+			}
+		}
+
+		counts, err := db.InfoCollectionCounts()
+		if assert.NoError(err, msg) {
+			assert.Equal(expected, counts, msg)
+		}
+	}
+
+	cId, err := db.CreateCollection("custom")
+	if !assert.NoError(err) {
+		return
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err := db.PutBSO(cId, "b"+strconv.Itoa(i), String("-"), nil, nil)
+		assert.NoError(err)
+	}
+	check("put")
+
+	// updates do not change the count
+	_, err = db.PutBSO(cId, "b0", String("updated"), nil, nil)
+	assert.NoError(err)
+	check("update")
+
+	batch := PostBSOInput{
+		NewPutBSOInput("b4", String("-"), nil, nil), // exists
+		NewPutBSOInput("b5", String("-"), nil, nil),
+		NewPutBSOInput("b6", String("-"), nil, Int(1)),
+		NewPutBSOInput("b7", String("-"), nil, Int(1)),
+	}
+	_, err = db.PostBSOs(cId, batch)
+	assert.NoError(err)
+	_, err = db.PostBSOs(4, batch)
+	assert.NoError(err)
+	check("post")
+
+	_, err = db.DeleteBSOs(cId, "b0", "b1", "missing")
+	assert.NoError(err)
+	check("delete")
+
+	time.Sleep(10 * time.Millisecond)
+	removed, err := db.PurgeExpired()
+	assert.NoError(err)
+	assert.Equal(4, removed)
+	check("purge")
+
+	_, err = db.DeleteCollection(4)
+	assert.NoError(err)
+	check("delete collection")
+
+	counts, _ := db.InfoCollectionCounts()
+	assert.Equal(map[string]int{"custom": 4}, counts)
+
+	assert.NoError(db.DeleteEverything())
+	check("delete everything")
+
+	{ // counts that drifted are fixed by RepairCollections
+		_, err := db.PutBSO(cId, "b0", String("-"), nil, nil)
+		assert.NoError(err)
+		_, err = db.db.Exec("UPDATE Collections SET Count=10 WHERE Id=?", cId)
+		assert.NoError(err)
+
+		fixed, err := db.RepairCollections()
+		assert.NoError(err)
+		assert.Equal([]string{"recounted 1 collections"}, fixed)
+		check("repaired")
+	}
+}
+
+func TestTTLGrace(t *testing.T) {
+	assert := assert.New(t)
+
+	// b0 expired a second ago, b1 an hour ago
+	setup := func(db *DB) {
+		now := Now()
+		assert.NoError(db.insertBSO(db.db, 1, "b0", now-2000, "recent", 0, true, 1000))
+		assert.NoError(db.insertBSO(db.db, 1, "b1", now-2*3600*1000, "old", 0, true, 1000))
+	}
+
+	readable := func(db *DB) (ids []string) {
+		results, err := db.GetBSOs(1, nil, MaxTimestamp, 0, 0, SORT_NEWEST, -1, 0)
+		if assert.NoError(err) {
+			for _, b := range results.BSOs {
+				ids = append(ids, b.Id)
+			}
+		}
+		return
+	}
+
+	{ // without a grace period expired BSOs are hidden right away
+		db, _ := NewDB(":memory:", nil)
+		setup(db)
+
+		_, err := db.GetBSO(1, "b0")
+		assert.Equal(ErrNotFound, err)
+		assert.Len(readable(db), 0)
+	}
+
+	db, _ := NewDB(":memory:", &Config{TTLGrace: 10 * time.Minute})
+	setup(db)
+
+	{ // within the grace period
+		b, err := db.GetBSO(1, "b0")
+		if assert.NoError(err) {
+			assert.Equal("recent", b.Payload)
+		}
+
+		_, err = db.GetBSOModified(1, "b0")
+		assert.NoError(err)
+
+		assert.Equal([]string{"b0"}, readable(db))
+
+		count, err := db.CountBSOs(1, nil, MaxTimestamp, 0, 0)
+		assert.NoError(err)
+		assert.Equal(1, count)
+	}
+
+	{ // past it
+		_, err := db.GetBSO(1, "b1")
+		assert.Equal(ErrNotFound, err)
+	}
+
+	{ // purging waits for the grace period to end
+		removed, err := db.PurgeExpired()
+		assert.NoError(err)
+		assert.Equal(1, removed)
+		assert.Equal([]string{"b0"}, readable(db))
+	}
+}
+
+func TestGetBSOsAcrossCollections(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := getTestDB()
+
+	// meta=6, crypto=2
+	for _, put := range []struct {
+		cId     int
+		bId     string
+		payload string
+		ttl     *int
+	}{
+		{6, "global", "meta-global", nil},
+		{6, "other", "meta-other", nil},
+		{2, "keys", "crypto-keys", nil},
+		{2, "expired", "crypto-expired", Int(1)},
+		{1, "keys", "clients-keys", nil},
+	} {
+		if _, err := db.PutBSO(put.cId, put.bId, String(put.payload), nil, put.ttl); !assert.NoError(err) {
+			return
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	results, err := db.GetBSOsAcrossCollections(map[string][]string{
+		"meta":    {"global"},
+		"crypto":  {"keys", "expired", "missing"},
+		"unknown": {"keys"},
+		"tabs":    {},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+
+	if assert.Len(results, 2) && assert.Len(results["meta"], 1) && assert.Len(results["crypto"], 1) {
+		assert.Equal("global", results["meta"][0].Id)
+		assert.Equal("meta-global", results["meta"][0].Payload)
+		assert.Equal("keys", results["crypto"][0].Id)
+		assert.Equal("crypto-keys", results["crypto"][0].Payload)
+		assert.NotZero(results["crypto"][0].Modified)
+	}
+
+	_, err = db.GetBSOsAcrossCollections(map[string][]string{"meta": {"bad\tid"}})
+	assert.Equal(ErrInvalidBSOId, err)
+	_, err = db.GetBSOsAcrossCollections(map[string][]string{"bad\tname": {"global"}})
+	assert.Equal(ErrInvalidCollectionName, err)
+
+	results, err = db.GetBSOsAcrossCollections(nil)
+	if assert.NoError(err) {
+		assert.Len(results, 0)
+	}
+}
+
+func TestGetBSOTTL(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := getTestDB()
+
+	_, err := db.PutBSO(1, "b0", String("expires"), nil, Int(3600*1000))
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = db.PutBSO(1, "b1", String("forever"), nil, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	ttl, err := db.GetBSOTTL(1, "b0")
+	if assert.NoError(err) {
+		assert.True(ttl > 3590 && ttl <= 3600, "got %d", ttl)
+	}
+
+	ttl, err = db.GetBSOTTL(1, "b1")
+	if assert.NoError(err) {
+		assert.Equal(NoTTL, ttl)
+	}
+
+	{ // updating the payload keeps the BSO from expiring
+		_, err = db.PutBSO(1, "b1", String("still forever"), nil, nil)
+		assert.NoError(err)
+		ttl, err = db.GetBSOTTL(1, "b1")
+		if assert.NoError(err) {
+			assert.Equal(NoTTL, ttl)
+		}
+	}
+
+	_, err = db.GetBSOTTL(1, "nope")
+	assert.Equal(ErrNotFound, err)
+	_, err = db.GetBSOTTL(1, "bad\tid")
+	assert.Equal(ErrInvalidBSOId, err)
+}
@@ -73,3 +73,72 @@ const SCHEMA_1 = `
 	-- skip user_version=1 as that *should have been* set by 'SCHEMA_0'
 	PRAGMA user_version=2;
 `
+
+// shared storage for identical payloads, used when Config.DedupPayloads
+// is enabled. BSOs reference a payload by its hash instead of keeping
+// a copy. The triggers remove payloads once nothing references them
+const SCHEMA_2 = `
+	CREATE TABLE Payloads (
+		Hash    VARCHAR(64) NOT NULL,
+		Payload TEXT NOT NULL,
+		PRIMARY KEY (Hash)
+	);
+
+	-- blank when the payload is stored in BSO.Payload
+	ALTER TABLE BSO ADD COLUMN PayloadHash VARCHAR(64) NOT NULL DEFAULT '';
+	CREATE INDEX payload_hash ON BSO (PayloadHash) WHERE PayloadHash != '';
+
+	CREATE TRIGGER payload_delete AFTER DELETE ON BSO
+	WHEN old.PayloadHash != ''
+	BEGIN
+		DELETE FROM Payloads WHERE Hash = old.PayloadHash AND NOT EXISTS
+			(SELECT 1 FROM BSO WHERE PayloadHash != '' AND PayloadHash = old.PayloadHash);
+	END;
+
+	CREATE TRIGGER payload_update AFTER UPDATE OF PayloadHash ON BSO
+	WHEN old.PayloadHash != '' AND old.PayloadHash != new.PayloadHash
+	BEGIN
+		DELETE FROM Payloads WHERE Hash = old.PayloadHash AND NOT EXISTS
+			(SELECT 1 FROM BSO WHERE PayloadHash != '' AND PayloadHash = old.PayloadHash);
+	END;
+
+	PRAGMA user_version=3;
+`
+
+// keeps the number of BSOs in each collection in Collections.Count so
+// info/collection_counts does not have to count every row. The triggers
+// follow every insert and delete, including batches and TTL purges
+const SCHEMA_3 = `
+	ALTER TABLE Collections ADD COLUMN Count INTEGER NOT NULL DEFAULT 0;
+
+	UPDATE Collections SET Count =
+		(SELECT count(*) FROM BSO WHERE CollectionId = Collections.Id);
+
+	CREATE TRIGGER count_insert AFTER INSERT ON BSO
+	BEGIN
+		UPDATE Collections SET Count = Count + 1 WHERE Id = new.CollectionId;
+	END;
+
+	CREATE TRIGGER count_delete AFTER DELETE ON BSO
+	BEGIN
+		UPDATE Collections SET Count = Count - 1 WHERE Id = old.CollectionId;
+	END;
+
+	CREATE TRIGGER count_move AFTER UPDATE OF CollectionId ON BSO
+	WHEN old.CollectionId != new.CollectionId
+	BEGIN
+		UPDATE Collections SET Count = Count - 1 WHERE Id = old.CollectionId;
+		UPDATE Collections SET Count = Count + 1 WHERE Id = new.CollectionId;
+	END;
+
+	PRAGMA user_version=4;
+`
+
+// remembers which BSOs were written with a sortindex so ones that were
+// explicitly set to 0 can be told apart from ones that never had one.
+// Existing BSOs with a sortindex other than 0 are treated as set
+const SCHEMA_4 = `
+	ALTER TABLE BSO ADD COLUMN SortIndexSet INTEGER NOT NULL DEFAULT 0;
+
+	PRAGMA user_version=5;
+`
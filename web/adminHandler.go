@@ -0,0 +1,521 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultListUsersLimit = 1000
+	maxListUsersLimit     = 10000
+)
+
+// AdminHandler serves operational endpoints under /__admin__/ and /__inspect__/ that
+// work directly on a user's database. They are not part of the sync 1.5
+// api and are protected by a shared secret sent in the X-Admin-Secret header
+// instead of Hawk
+type AdminHandler struct {
+	router *mux.Router
+	pool   *SyncPoolHandler
+	secret string
+
+	// Backoff is toggled by /__admin__/backoff, which is not found
+	// when it is nil
+	Backoff *BackoffHandler
+
+	// Cache is cleared for users whose data is changed, it is nil
+	// when responses are not cached
+	Cache *CacheHandler
+}
+
+func NewAdminHandler(h http.Handler, pool *SyncPoolHandler, secret string) *AdminHandler {
+
+	r := mux.NewRouter()
+	server := &AdminHandler{
+		router: r,
+		pool:   pool,
+		secret: secret,
+	}
+
+	r.NotFoundHandler = h
+
+	admin := r.PathPrefix("/__admin__/").Subrouter()
+	admin.HandleFunc("/{uid:[0-9]+}/repair_collections", server.hRepairCollections).Methods("POST")
+	admin.HandleFunc("/{uid:[0-9]+}/vacuum", server.hVacuum).Methods("POST")
+	admin.HandleFunc("/{uid:[0-9]+}/collection_ttl", server.hCollectionTTL).Methods("POST")
+	admin.HandleFunc("/{uid:[0-9]+}/copy", server.hCopyUser).Methods("POST")
+	admin.HandleFunc("/{uid:[0-9]+}/move_collection", server.hMoveCollection).Methods("POST")
+	admin.HandleFunc("/users", server.hListUsers).Methods("GET")
+	admin.HandleFunc("/delete_everything", server.hDeleteEverything).Methods("POST")
+	admin.HandleFunc("/backoff", server.hBackoff).Methods("GET", "POST")
+
+	r.HandleFunc("/__inspect__/{uid:[0-9]+}", server.hInspect).Methods("GET")
+
+	return server
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.router.ServeHTTP(w, req)
+}
+
+// authorized checks the shared secret, writing an error if it is not valid
+func (h *AdminHandler) authorized(w http.ResponseWriter, r *http.Request) bool {
+	given := r.Header.Get("X-Admin-Secret")
+	if h.secret == "" || subtle.ConstantTimeCompare([]byte(given), []byte(h.secret)) != 1 {
+		sendRequestProblem(w, r, http.StatusUnauthorized, errors.New("Admin: invalid secret"))
+		return false
+	}
+
+	return true
+}
+
+// userHandler returns the handler for the uid in the URL
+func (h *AdminHandler) userHandler(w http.ResponseWriter, r *http.Request) (*SyncUserHandler, bool) {
+	uid := mux.Vars(r)["uid"]
+	handler, err := h.pool.getUserHandler(uid)
+	if err != nil {
+		h.poolError(w, r, uid, err)
+		return nil, false
+	}
+
+	return handler, true
+}
+
+// changed clears uid's cached responses and records an admin write in
+// the journal, like the sync handlers do for their writes
+func (h *AdminHandler) changed(uid, collection, op string, modified int) {
+	h.Cache.Invalidate(uid)
+	h.pool.userHandlerConfig.Journal.Record(uid, collection, op, modified)
+}
+
+// poolError writes the response for an error getting a pool element
+func (h *AdminHandler) poolError(w http.ResponseWriter, r *http.Request, uid string, err error) {
+	if err == errElementStopped {
+		sendRequestProblem(w, r, http.StatusConflict, errors.New("DB pool too busy"))
+	} else if err == errPoolTimeout {
+		poolTimeout(w, r, h.pool.config.AcquireTimeout)
+	} else {
+		storageUnavailable(w, r, uid, err)
+	}
+}
+
+func (h *AdminHandler) hRepairCollections(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	handler, ok := h.userHandler(w, r)
+	if !ok {
+		return
+	}
+
+	// the user's requests wait for the repair
+	fixed, err := func() ([]string, error) {
+		handler.lock(0)
+		defer handler.unlock()
+
+		if handler.IsStopped() {
+			return nil, errElementStopped
+		}
+
+		return handler.db.RepairCollections()
+	}()
+
+	if err == errElementStopped {
+		h.poolError(w, r, handler.uid, err)
+		return
+	} else if err != nil {
+		InternalError(w, r, errors.Wrap(err, "Could not repair collections"))
+		return
+	}
+
+	if len(fixed) > 0 {
+		h.Cache.Invalidate(handler.uid)
+
+		log.WithFields(log.Fields{
+			"uid":   handler.uid,
+			"fixed": fixed,
+		}).Warn("Admin: repaired collections")
+	}
+
+	JSON(w, r, http.StatusOK, map[string]interface{}{
+		"uid":   handler.uid,
+		"fixed": fixed,
+	})
+}
+
+func (h *AdminHandler) hVacuum(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	handler, ok := h.userHandler(w, r)
+	if !ok {
+		return
+	}
+
+	uid := handler.uid
+	start := time.Now()
+	beforeKB, afterKB, err := vacuumUser(handler)
+	if err == errElementStopped {
+		h.poolError(w, r, uid, err)
+		return
+	} else if err != nil {
+		InternalError(w, r, errors.Wrap(err, "Could not vacuum"))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"uid":       uid,
+		"before_kb": beforeKB,
+		"after_kb":  afterKB,
+		"t":         time.Since(start).Nanoseconds() / 1000 / 1000,
+	}).Info("Admin: vacuumed database")
+
+	JSON(w, r, http.StatusOK, map[string]interface{}{
+		"uid":       uid,
+		"before_kb": beforeKB,
+		"after_kb":  afterKB,
+	})
+}
+
+// hBackoff turns the X-Weave-Backoff header on every response on or off
+// with POST ?enabled=true|false. Both methods return the current state
+func (h *AdminHandler) hBackoff(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	if h.Backoff == nil {
+		sendRequestProblem(w, r, http.StatusNotFound, errors.New("Admin: backoff is not available"))
+		return
+	}
+
+	if r.Method == "POST" {
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid enabled, must be true or false"))
+			return
+		}
+
+		h.Backoff.SetEnabled(enabled)
+
+		log.WithFields(log.Fields{
+			"enabled": enabled,
+			"seconds": h.Backoff.BackoffSeconds,
+		}).Warn("Admin: set backoff")
+	}
+
+	JSON(w, r, http.StatusOK, map[string]interface{}{
+		"enabled": h.Backoff.Enabled(),
+		"seconds": h.Backoff.BackoffSeconds,
+	})
+}
+
+// hCollectionTTL force expires the BSOs in a collection, e.g. when a type
+// of data has to be removed. It takes the collection name and the ttl in
+// seconds, 0 to expire them immediately
+func (h *AdminHandler) hCollectionTTL(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	ttl, err := strconv.Atoi(r.URL.Query().Get("ttl"))
+	if err != nil || !syncstorage.TTLOk(ttl) {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid ttl, must be >= 0"))
+		return
+	}
+
+	name := r.URL.Query().Get("collection")
+	if name == "" {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Missing collection"))
+		return
+	}
+
+	// don't create a database for an unknown user
+	uid := mux.Vars(r)["uid"]
+	if err := h.pool.hasDatabase(uid); err == errNoDatabase {
+		sendRequestProblem(w, r, http.StatusNotFound, errors.Errorf("Admin: no database for %s", uid))
+		return
+	} else if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	handler, ok := h.userHandler(w, r)
+	if !ok {
+		return
+	}
+
+	cId, err := handler.db.GetCollectionId(name)
+	if err == syncstorage.ErrNotFound {
+		sendRequestProblem(w, r, http.StatusNotFound, errors.Errorf("Admin: no collection %s", name))
+		return
+	} else if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	updated, err := h.pool.SetCollectionTTL(handler.uid, cId, ttl)
+	if err != nil {
+		h.poolError(w, r, handler.uid, err)
+		return
+	}
+
+	h.changed(handler.uid, name, JournalCollectionTTL, syncstorage.Now())
+
+	log.WithFields(log.Fields{
+		"uid":        handler.uid,
+		"collection": name,
+		"ttl":        ttl,
+		"updated":    updated,
+	}).Warn("Admin: set collection ttl")
+
+	JSON(w, r, http.StatusOK, map[string]interface{}{
+		"uid":        handler.uid,
+		"collection": name,
+		"updated":    updated,
+	})
+}
+
+// hMoveCollection moves the BSOs in the from collection to the to
+// collection, which must not have any data, then deletes from. It is all
+// done in one write barrier so clients never see the BSOs in both or
+// neither collection
+func (h *AdminHandler) hMoveCollection(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if !syncstorage.CollectionNameOk(from) || !syncstorage.CollectionNameOk(to) || from == to {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid from or to, must be two collection names"))
+		return
+	}
+
+	uid := mux.Vars(r)["uid"]
+	barrier, err := h.pool.BeginWriteBarrier(uid)
+	if err != nil {
+		h.poolError(w, r, uid, err)
+		return
+	}
+	defer barrier.Rollback()
+
+	fromId, err := barrier.GetCollectionId(from)
+	if err == syncstorage.ErrNotFound {
+		sendRequestProblem(w, r, http.StatusNotFound, errors.Errorf("Admin: no collection %s", from))
+		return
+	} else if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	toId, err := barrier.CreateCollection(to)
+	if err != nil {
+		InternalError(w, r, errors.Wrap(err, "Could not create collection"))
+		return
+	}
+
+	if count, err := barrier.CountBSOs(toId); err != nil {
+		InternalError(w, r, err)
+		return
+	} else if count > 0 {
+		sendRequestProblem(w, r, http.StatusConflict, errors.Errorf("Admin: %s already has data", to))
+		return
+	}
+
+	// clear out expired BSOs that could have the same ids
+	if err := barrier.DeleteCollection(toId); err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	moved, err := barrier.MoveBSOs(fromId, toId)
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	if err := barrier.DeleteCollection(fromId); err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	if err := barrier.Commit(); err != nil {
+		InternalError(w, r, errors.Wrap(err, "Could not move collection"))
+		return
+	}
+
+	h.changed(uid, from, JournalMoveFrom, barrier.Modified())
+	h.changed(uid, to, JournalMoveTo, barrier.Modified())
+
+	log.WithFields(log.Fields{
+		"uid":   uid,
+		"from":  from,
+		"to":    to,
+		"moved": moved,
+	}).Warn("Admin: moved collection")
+
+	JSON(w, r, http.StatusOK, map[string]interface{}{
+		"uid":   uid,
+		"from":  from,
+		"to":    to,
+		"moved": moved,
+	})
+}
+
+// hCopyUser copies the user's data to the uid in the to parameter, which
+// must not have any data
+func (h *AdminHandler) hCopyUser(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	uid := mux.Vars(r)["uid"]
+	to := r.URL.Query().Get("to")
+	if !uidOk(to) || to == uid {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid to, must be another uid"))
+		return
+	}
+
+	start := time.Now()
+	copied, err := h.pool.CopyUser(uid, to)
+	switch {
+	case err == errNoDatabase:
+		sendRequestProblem(w, r, http.StatusNotFound, errors.Errorf("Admin: no database for %s", uid))
+		return
+	case err == syncstorage.ErrNotEmpty:
+		sendRequestProblem(w, r, http.StatusConflict, errors.Errorf("Admin: %s already has data", to))
+		return
+	case err == errElementStopped:
+		h.poolError(w, r, uid, err)
+		return
+	case err != nil:
+		InternalError(w, r, errors.Wrap(err, "Could not copy user"))
+		return
+	}
+
+	h.changed(to, "", JournalCopyUser, syncstorage.Now())
+
+	log.WithFields(log.Fields{
+		"uid":    uid,
+		"to":     to,
+		"copied": copied,
+		"t":      time.Since(start).Nanoseconds() / 1000 / 1000,
+	}).Warn("Admin: copied user")
+
+	JSON(w, r, http.StatusOK, map[string]interface{}{
+		"uid":    uid,
+		"to":     to,
+		"copied": copied,
+	})
+}
+
+// hInspect shows where a user's database is kept, its size, number of
+// collections and schema version
+func (h *AdminHandler) hInspect(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	uid := mux.Vars(r)["uid"]
+	info, err := h.pool.Inspect(uid)
+	switch {
+	case err == errNoDatabase:
+		sendRequestProblem(w, r, http.StatusNotFound, errors.Errorf("Admin: no database for %s", uid))
+	case err != nil:
+		h.poolError(w, r, uid, err)
+	default:
+		JSON(w, r, http.StatusOK, info)
+	}
+}
+
+// hListUsers pages through the uids with a database. It takes an optional
+// limit and after, the next value of the previous page
+func (h *AdminHandler) hListUsers(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	limit := defaultListUsersLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxListUsersLimit {
+			sendRequestProblem(w, r, http.StatusBadRequest,
+				errors.Errorf("Invalid limit, must be 1 to %d", maxListUsersLimit))
+			return
+		}
+	}
+
+	after := r.URL.Query().Get("after")
+	if after != "" && !uidOk(after) {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid after"))
+		return
+	}
+
+	uids, err := h.pool.ListUsers(after, limit)
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	// a full page means there may be more
+	next := ""
+	if len(uids) == limit {
+		next = uids[len(uids)-1]
+	}
+
+	if uids == nil {
+		uids = []string{}
+	}
+
+	JSON(w, r, http.StatusOK, map[string]interface{}{
+		"uids": uids,
+		"next": next,
+	})
+}
+
+// hDeleteEverything removes every user's database. The confirm parameter
+// must be DeleteEverythingConfirmation
+func (h *AdminHandler) hDeleteEverything(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(w, r) {
+		return
+	}
+
+	start := time.Now()
+	removed, err := h.pool.DeleteEverything(r.URL.Query().Get("confirm"))
+	if err == errNotConfirmed {
+		sendRequestProblem(w, r, http.StatusBadRequest,
+			errors.Errorf("Admin: confirm must be %q", DeleteEverythingConfirmation))
+		return
+	}
+
+	// some users may be gone before an error
+	modified := syncstorage.Now()
+	for _, uid := range removed {
+		h.changed(uid, "", JournalDeleteEverything, modified)
+	}
+
+	if err != nil {
+		InternalError(w, r, errors.Wrap(err, "Could not delete everything"))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"removed": len(removed),
+		"t":       time.Since(start).Nanoseconds() / 1000 / 1000,
+	}).Warn("Admin: deleted all users")
+
+	JSON(w, r, http.StatusOK, map[string]interface{}{
+		"removed": len(removed),
+	})
+}
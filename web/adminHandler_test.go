@@ -0,0 +1,726 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func adminrequest(method, path, secret string, h http.Handler) *http.Response {
+	header := make(http.Header)
+	if secret != "" {
+		header.Set("X-Admin-Secret", secret)
+	}
+
+	req, _ := http.NewRequest(method, "http://synchost"+path, nil)
+	req.Header = header
+	return sendrequest(req, h).Result()
+}
+
+// journalEntries parses the entries written to a Journal
+func journalEntries(buf *bytes.Buffer) []JournalEntry {
+	var entries []JournalEntry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e JournalEntry
+		if json.Unmarshal([]byte(line), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func TestAdminHandlerAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	handler := NewAdminHandler(EchoHandler, pool, "sekret")
+
+	uid := uniqueUID()
+	path := "/__admin__/" + uid + "/repair_collections"
+	assert.Equal(http.StatusUnauthorized, adminrequest("POST", path, "", handler).StatusCode)
+	assert.Equal(http.StatusUnauthorized, adminrequest("POST", path, "wrong", handler).StatusCode)
+	assert.Equal(http.StatusOK, adminrequest("POST", path, "sekret", handler).StatusCode)
+
+	// a blank secret disables the endpoints
+	handler = NewAdminHandler(EchoHandler, pool, "")
+	assert.Equal(http.StatusUnauthorized, adminrequest("POST", path, "", handler).StatusCode)
+
+	// everything else is passed through
+	resp := adminrequest("GET", "/something/else", "", handler)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestAdminHandlerRepairCollections(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	handler := NewAdminHandler(pool, pool, "sekret")
+
+	// the mapping corruption cases are covered in syncstorage, this makes
+	// sure the endpoint reaches the user's database
+	uid := uniqueUID()
+	userHandler, err := pool.getUserHandler(uid)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// it waits for the user's requests
+	userHandler.lock(0)
+	done := make(chan *http.Response)
+	go func() {
+		done <- adminrequest("POST", "/__admin__/"+uid+"/repair_collections", "sekret", handler)
+	}()
+
+	select {
+	case <-done:
+		assert.Fail("repair should wait for the request lock")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	userHandler.unlock()
+	resp := <-done
+	if !assert.Equal(http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	var results struct {
+		Uid   string
+		Fixed []string
+	}
+	if assert.NoError(json.NewDecoder(resp.Body).Decode(&results)) {
+		assert.Equal(uid, results.Uid)
+		assert.Len(results.Fixed, 0)
+	}
+}
+
+func TestAdminHandlerVacuum(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	config := NewDefaultSyncPoolConfig(tmpdir)
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+	handler := NewAdminHandler(pool, pool, "sekret")
+
+	uid0 := uniqueUID()
+	uid1 := uniqueUID()
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	payload := strings.Repeat("1234567890", 1024)
+	for _, uid := range []string{uid0, uid1} {
+		for i := 0; i < 20; i++ {
+			body := fmt.Sprintf(`{"payload":"%s"}`, payload)
+			url := syncurl(uid, fmt.Sprintf("storage/test/b%d", i))
+			resp := requestheaders("PUT", url, bytes.NewBufferString(body), header, pool)
+			if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+				return
+			}
+		}
+	}
+
+	// the databases use a WAL so include it in the size on disk
+	fileSize := func(uid string) (size int64) {
+		path, file := pool.pools[pool.poolIndex(uid)].PathAndFile(uid)
+		for _, name := range []string{file, file + "-wal"} {
+			if info, err := os.Stat(filepath.Join(path, name)); err == nil {
+				size += info.Size()
+			}
+		}
+		return
+	}
+
+	resp := request("DELETE", syncurl(uid0, "storage/test"), nil, pool)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	size0 := fileSize(uid0)
+	size1 := fileSize(uid1)
+
+	resp2 := adminrequest("POST", "/__admin__/"+uid0+"/vacuum", "sekret", handler)
+	if !assert.Equal(http.StatusOK, resp2.StatusCode) {
+		return
+	}
+
+	var results struct {
+		Uid      string
+		BeforeKB int `json:"before_kb"`
+		AfterKB  int `json:"after_kb"`
+	}
+	if assert.NoError(json.NewDecoder(resp2.Body).Decode(&results)) {
+		assert.Equal(uid0, results.Uid)
+		assert.True(results.AfterKB < results.BeforeKB)
+	}
+
+	assert.True(fileSize(uid0) < size0, "Expected uid0's database to shrink")
+	assert.Equal(size1, fileSize(uid1), "Expected uid1's database to be untouched")
+}
+
+func TestAdminHandlerVacuumUnavailable(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testSyncPoolConfig()
+	config.AcquireTimeout = 10 * time.Millisecond
+	pool := NewSyncPoolHandler(config, nil)
+	handler := NewAdminHandler(pool, pool, "sekret")
+
+	uid := uniqueUID()
+	path := "/__admin__/" + uid + "/vacuum"
+
+	// a busy pool is a 503, not an internal error
+	pool.pools[0].acquire <- struct{}{}
+	resp := adminrequest("POST", path, "sekret", handler)
+	<-pool.pools[0].acquire
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(strconv.Itoa(acquireTimeoutRetryAfter), resp.Header.Get("Retry-After"))
+
+	// the database is not used after it is closed
+	userHandler, err := pool.getUserHandler(uid)
+	if !assert.NoError(err) {
+		return
+	}
+	userHandler.StopHTTP()
+	_, _, err = vacuumUser(userHandler)
+	assert.Equal(errElementStopped, err)
+}
+
+func TestAdminHandlerCollectionTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	journal := new(bytes.Buffer)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.Journal = NewJournal(journal)
+
+	pool := NewSyncPoolHandler(testSyncPoolConfig(), conf)
+	cache := NewCacheHandler(pool, DefaultCacheHandlerConfig)
+	handler := NewAdminHandler(cache, pool, "sekret")
+	handler.Cache = cache
+
+	uid := uniqueUID()
+	for _, col := range []string{"forms", "history"} {
+		resp := jsonrequest("POST", syncurl(uid, "storage/"+col),
+			bytes.NewBufferString(`[{"id":"b0","payload":"0"},{"id":"b1","payload":"1"}]`), pool)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+	}
+
+	request("GET", syncurl(uid, "info/collections"), nil, cache)
+	if cached, _ := cache.cache.Get(uid); !assert.NotEmpty(cached) {
+		return
+	}
+
+	path := "/__admin__/" + uid + "/collection_ttl"
+	assert.Equal(http.StatusBadRequest, adminrequest("POST", path+"?collection=forms", "sekret", handler).StatusCode)
+	assert.Equal(http.StatusBadRequest, adminrequest("POST", path+"?collection=forms&ttl=-1", "sekret", handler).StatusCode)
+	assert.Equal(http.StatusBadRequest, adminrequest("POST", path+"?ttl=0", "sekret", handler).StatusCode)
+	assert.Equal(http.StatusNotFound, adminrequest("POST", path+"?collection=nope&ttl=0", "sekret", handler).StatusCode)
+
+	resp := adminrequest("POST", path+"?collection=forms&ttl=0", "sekret", handler)
+	if !assert.Equal(http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	var results struct {
+		Uid        string
+		Collection string
+		Updated    int
+	}
+	if assert.NoError(json.NewDecoder(resp.Body).Decode(&results)) {
+		assert.Equal(uid, results.Uid)
+		assert.Equal("forms", results.Collection)
+		assert.Equal(2, results.Updated)
+	}
+
+	cached, _ := cache.cache.Get(uid)
+	assert.Empty(cached, "cache should be cleared")
+
+	entries := journalEntries(journal)
+	if assert.NotEmpty(entries) {
+		last := entries[len(entries)-1]
+		assert.Equal(uid, last.Uid)
+		assert.Equal("forms", last.Collection)
+		assert.Equal(JournalCollectionTTL, last.Op)
+	}
+
+	// expired right away
+	{
+		resp := request("GET", syncurl(uid, "storage/forms"), nil, pool)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("[]", strings.TrimSpace(resp.Body.String()))
+
+		resp = request("GET", syncurl(uid, "storage/forms/b0"), nil, pool)
+		assert.Equal(http.StatusNotFound, resp.Code)
+	}
+
+	// other collections are left alone
+	{
+		resp := request("GET", syncurl(uid, "storage/history/b0"), nil, pool)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+}
+
+func TestAdminHandlerCollectionTTLNoDatabase(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	pool := NewSyncPoolHandler(NewDefaultSyncPoolConfig(tmpdir), nil)
+	defer pool.StopHTTP()
+	handler := NewAdminHandler(pool, pool, "sekret")
+
+	{ // unknown users are not created
+		uid := uniqueUID()
+		resp := adminrequest("POST", "/__admin__/"+uid+"/collection_ttl?collection=forms&ttl=0", "sekret", handler)
+		assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+		path, file := pool.pools[pool.poolIndex(uid)].PathAndFile(uid)
+		_, err := os.Stat(filepath.Join(path, file))
+		assert.True(os.IsNotExist(err))
+	}
+
+	{ // the database is not used after it is closed
+		uid := uniqueUID()
+		resp := jsonrequest("PUT", syncurl(uid, "storage/forms/b0"), bytes.NewBufferString(`{"payload":"-"}`), pool)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		userHandler, err := pool.getUserHandler(uid)
+		if !assert.NoError(err) {
+			return
+		}
+		userHandler.StopHTTP()
+
+		_, err = pool.SetCollectionTTL(uid, 3, 0)
+		assert.Equal(errElementStopped, err)
+	}
+}
+
+func TestAdminHandlerMoveCollection(t *testing.T) {
+	assert := assert.New(t)
+
+	journal := new(bytes.Buffer)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.Journal = NewJournal(journal)
+
+	pool := NewSyncPoolHandler(testSyncPoolConfig(), conf)
+	cache := NewCacheHandler(pool, DefaultCacheHandlerConfig)
+	handler := NewAdminHandler(cache, pool, "sekret")
+	handler.Cache = cache
+
+	uid := uniqueUID()
+	for _, col := range []string{"from", "full"} {
+		resp := jsonrequest("POST", syncurl(uid, "storage/"+col),
+			bytes.NewBufferString(`[{"id":"b0","payload":"0"},{"id":"b1","payload":"1"}]`), pool)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+	}
+
+	before := request("GET", syncurl(uid, "storage/from?full=1&sort=oldest"), nil, pool).Body.String()
+	path := "/__admin__/" + uid + "/move_collection"
+
+	assert.Equal(http.StatusBadRequest, adminrequest("POST", path+"?from=from", "sekret", handler).StatusCode)
+	assert.Equal(http.StatusBadRequest, adminrequest("POST", path+"?from=from&to=from", "sekret", handler).StatusCode)
+	assert.Equal(http.StatusNotFound, adminrequest("POST", path+"?from=nope&to=to", "sekret", handler).StatusCode)
+
+	{ // a failed move changes nothing
+		info := request("GET", syncurl(uid, "info/collections"), nil, cache).Body.String()
+
+		resp := adminrequest("POST", path+"?from=from&to=full", "sekret", handler)
+		assert.Equal(http.StatusConflict, resp.StatusCode)
+
+		assert.JSONEq(info, request("GET", syncurl(uid, "info/collections"), nil, pool).Body.String())
+		assert.Equal(before, request("GET", syncurl(uid, "storage/from?full=1&sort=oldest"), nil, pool).Body.String())
+	}
+
+	resp := adminrequest("POST", path+"?from=from&to=to", "sekret", handler)
+	if !assert.Equal(http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	var results struct {
+		Moved int
+	}
+	if assert.NoError(json.NewDecoder(resp.Body).Decode(&results)) {
+		assert.Equal(2, results.Moved)
+	}
+
+	// requests are not blocked once it is done
+	assert.Equal(before, request("GET", syncurl(uid, "storage/to?full=1&sort=oldest"), nil, pool).Body.String())
+	assert.Equal("[]", request("GET", syncurl(uid, "storage/from"), nil, pool).Body.String())
+
+	counts := request("GET", syncurl(uid, "info/collection_counts"), nil, pool)
+	assert.JSONEq(`{"full":2,"to":2}`, counts.Body.String())
+
+	// the cached info/collections is not stale
+	info := request("GET", syncurl(uid, "info/collections"), nil, cache)
+	assert.JSONEq(request("GET", syncurl(uid, "info/collections"), nil, pool).Body.String(), info.Body.String())
+	assert.Contains(info.Body.String(), `"to"`)
+
+	entries := journalEntries(journal)
+	if assert.True(len(entries) >= 2) {
+		modified := entries[len(entries)-1].Modified
+		assert.Equal([]JournalEntry{
+			{Uid: uid, Collection: "from", Op: JournalMoveFrom, Modified: modified},
+			{Uid: uid, Collection: "to", Op: JournalMoveTo, Modified: modified},
+		}, entries[len(entries)-2:])
+	}
+}
+
+func TestAdminHandlerCopyUser(t *testing.T) {
+	assert := assert.New(t)
+
+	// on disk so a user without a database can be told apart
+	tmpdir, err := ioutil.TempDir("", "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	journal := new(bytes.Buffer)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.Journal = NewJournal(journal)
+
+	pool := NewSyncPoolHandler(NewDefaultSyncPoolConfig(tmpdir), conf)
+	defer pool.StopHTTP()
+	cache := NewCacheHandler(pool, DefaultCacheHandlerConfig)
+	handler := NewAdminHandler(cache, pool, "sekret")
+	handler.Cache = cache
+
+	src := uniqueUID()
+	dst := uniqueUID()
+	for _, col := range []string{"bookmarks", "custom"} {
+		resp := jsonrequest("POST", syncurl(src, "storage/"+col),
+			bytes.NewBufferString(`[{"id":"b0","payload":"0","sortindex":2},{"id":"b1","payload":"1"}]`), pool)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+	}
+
+	// cache the destination's empty info/collections
+	assert.Equal("{}", request("GET", syncurl(dst, "info/collections"), nil, cache).Body.String())
+
+	path := "/__admin__/" + src + "/copy"
+	assert.Equal(http.StatusBadRequest, adminrequest("POST", path, "sekret", handler).StatusCode)
+	assert.Equal(http.StatusBadRequest, adminrequest("POST", path+"?to="+src, "sekret", handler).StatusCode)
+	assert.Equal(http.StatusNotFound, adminrequest("POST", "/__admin__/"+uniqueUID()+"/copy?to="+dst, "sekret", handler).StatusCode)
+
+	resp := adminrequest("POST", path+"?to="+dst, "sekret", handler)
+	if !assert.Equal(http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	var results struct {
+		Uid    string
+		To     string
+		Copied int
+	}
+	if assert.NoError(json.NewDecoder(resp.Body).Decode(&results)) {
+		assert.Equal(src, results.Uid)
+		assert.Equal(dst, results.To)
+		assert.Equal(4, results.Copied)
+	}
+
+	// the destination serves the same data
+	for _, path := range []string{
+		"info/collections",
+		"info/collection_counts",
+		"storage/bookmarks?full=1&sort=index",
+		"storage/custom?full=1&sort=index",
+	} {
+		a := request("GET", syncurl(src, path), nil, pool)
+		b := request("GET", syncurl(dst, path), nil, pool)
+		assert.JSONEq(a.Body.String(), b.Body.String(), path)
+		assert.Equal(a.Header().Get("X-Last-Modified"), b.Header().Get("X-Last-Modified"), path)
+	}
+
+	// the destination's cache was cleared
+	info := request("GET", syncurl(dst, "info/collections"), nil, cache)
+	assert.JSONEq(request("GET", syncurl(src, "info/collections"), nil, pool).Body.String(), info.Body.String())
+
+	entries := journalEntries(journal)
+	if assert.NotEmpty(entries) {
+		last := entries[len(entries)-1]
+		assert.Equal(dst, last.Uid)
+		assert.Equal(JournalCopyUser, last.Op)
+		assert.NotZero(last.Modified)
+	}
+
+	// it will not overwrite data
+	resp = adminrequest("POST", path+"?to="+dst, "sekret", handler)
+	assert.Equal(http.StatusConflict, resp.StatusCode)
+}
+
+func TestAdminHandlerInspect(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	config := NewDefaultSyncPoolConfig(tmpdir)
+	config.NumPools = 4
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+	handler := NewAdminHandler(pool, pool, "sekret")
+
+	uid := uniqueUID()
+	for _, path := range []string{"storage/col1/b0", "storage/col2/b0", "storage/bookmarks/b0"} {
+		resp := jsonrequest("PUT", syncurl(uid, path), bytes.NewBufferString(`{"payload":"-"}`), pool)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+	}
+
+	resp := adminrequest("GET", "/__inspect__/"+uid, "sekret", handler)
+	if !assert.Equal(http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	var info UserStorage
+	if assert.NoError(json.NewDecoder(resp.Body).Decode(&info)) {
+		index := pool.poolIndex(uid)
+		path, file := pool.pools[index].PathAndFile(uid)
+
+		assert.Equal(uid, info.Uid)
+		assert.Equal(int(index), info.Pool)
+		assert.Equal(filepath.Join(path, file), info.Path)
+		assert.Equal(3, info.Collections)
+		assert.Equal(5, info.SchemaVersion)
+
+		stat, err := os.Stat(info.Path)
+		if assert.NoError(err) {
+			assert.True(info.SizeBytes >= stat.Size())
+			assert.Equal(stat.Size(), info.Files[info.Path])
+		}
+	}
+
+	{ // unknown users are not created
+		other := uniqueUID()
+		resp := adminrequest("GET", "/__inspect__/"+other, "sekret", handler)
+		assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+		path, file := pool.pools[pool.poolIndex(other)].PathAndFile(other)
+		_, err := os.Stat(filepath.Join(path, file))
+		assert.True(os.IsNotExist(err))
+	}
+
+	assert.Equal(http.StatusUnauthorized, adminrequest("GET", "/__inspect__/"+uid, "", handler).StatusCode)
+	assert.Equal(http.StatusUnauthorized, adminrequest("GET", "/__inspect__/"+uid, "wrong", handler).StatusCode)
+}
+
+func TestAdminHandlerListUsers(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	config := NewDefaultSyncPoolConfig(tmpdir)
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+	handler := NewAdminHandler(pool, pool, "sekret")
+
+	uids := []string{"7", "42", "123", "4567", "98765", "1234567"}
+	for _, uid := range uids {
+		resp := jsonrequest("PUT", syncurl(uid, "storage/test/b0"), bytes.NewBufferString(`{"payload":"-"}`), pool)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+	}
+
+	// files that are not where PathAndFile expects are ignored
+	assert.NoError(ioutil.WriteFile(filepath.Join(tmpdir, "555.db"), nil, 0644))
+
+	type page struct {
+		Uids []string
+		Next string
+	}
+
+	list := func(query string) (p page) {
+		resp := adminrequest("GET", "/__admin__/users"+query, "sekret", handler)
+		if assert.Equal(http.StatusOK, resp.StatusCode) {
+			assert.NoError(json.NewDecoder(resp.Body).Decode(&p))
+		}
+		return
+	}
+
+	{
+		p := list("")
+		assert.Equal(uids, p.Uids)
+		assert.Equal("", p.Next)
+	}
+
+	{ // paginated
+		var listed []string
+		next := ""
+		for i := 0; i < len(uids); i++ {
+			p := list("?limit=4&after=" + next)
+			listed = append(listed, p.Uids...)
+			if p.Next == "" {
+				break
+			}
+			next = p.Next
+		}
+		assert.Equal(uids, listed)
+	}
+
+	assert.Equal(http.StatusBadRequest, adminrequest("GET", "/__admin__/users?limit=0", "sekret", handler).StatusCode)
+	assert.Equal(http.StatusBadRequest, adminrequest("GET", "/__admin__/users?after=abc", "sekret", handler).StatusCode)
+	assert.Equal(http.StatusUnauthorized, adminrequest("GET", "/__admin__/users", "", handler).StatusCode)
+}
+
+func TestAdminHandlerDeleteEverything(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	journal := new(bytes.Buffer)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.Journal = NewJournal(journal)
+
+	config := NewDefaultSyncPoolConfig(tmpdir)
+	config.NumPools = 2
+	pool := NewSyncPoolHandler(config, conf)
+	defer pool.StopHTTP()
+	cache := NewCacheHandler(pool, DefaultCacheHandlerConfig)
+	handler := NewAdminHandler(cache, pool, "sekret")
+	handler.Cache = cache
+
+	put := func(uid string) {
+		resp := jsonrequest("PUT", syncurl(uid, "storage/test/b0"), bytes.NewBufferString(`{"payload":"-"}`), pool)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	}
+
+	uids := []string{uniqueUID(), uniqueUID(), uniqueUID()}
+	for _, uid := range uids {
+		put(uid)
+		request("GET", syncurl(uid, "info/collections"), nil, cache)
+	}
+	journal.Reset()
+
+	{ // refuses without a confirmation
+		for _, query := range []string{"", "?confirm=yes"} {
+			resp := adminrequest("POST", "/__admin__/delete_everything"+query, "sekret", handler)
+			assert.Equal(http.StatusBadRequest, resp.StatusCode)
+		}
+
+		resp := adminrequest("POST", "/__admin__/delete_everything", "", handler)
+		assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+		listed, err := pool.ListUsers("", 100)
+		assert.NoError(err)
+		assert.Len(listed, len(uids))
+	}
+
+	confirm := strings.Replace(DeleteEverythingConfirmation, " ", "+", -1)
+	resp := adminrequest("POST", "/__admin__/delete_everything?confirm="+confirm, "sekret", handler)
+	if !assert.Equal(http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	var results struct{ Removed int }
+	if assert.NoError(json.NewDecoder(resp.Body).Decode(&results)) {
+		assert.Equal(len(uids), results.Removed)
+	}
+
+	for _, uid := range uids {
+		path, file := pool.pools[pool.poolIndex(uid)].PathAndFile(uid)
+		_, err := os.Stat(filepath.Join(path, file))
+		assert.True(os.IsNotExist(err), uid)
+	}
+
+	listed, err := pool.ListUsers("", 100)
+	assert.NoError(err)
+	assert.Len(listed, 0)
+
+	// every removed user is journaled and their cache cleared
+	var journaled []string
+	for _, e := range journalEntries(journal) {
+		assert.Equal(JournalDeleteEverything, e.Op)
+		journaled = append(journaled, e.Uid)
+	}
+	sort.Strings(journaled)
+	sort.Strings(uids)
+	assert.Equal(uids, journaled)
+
+	for _, uid := range uids {
+		assert.Equal("{}", request("GET", syncurl(uid, "info/collections"), nil, cache).Body.String(), uid)
+	}
+
+	// the server keeps working and users start over empty
+	resp2 := request("GET", syncurl(uids[1], "storage/test"), nil, pool)
+	assert.Equal(http.StatusOK, resp2.Code)
+	assert.Equal("[]", resp2.Body.String())
+	put(uids[0])
+}
+
+func TestAdminHandlerBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	backoff := NewBackoffHandler(pool, 60)
+	handler := NewAdminHandler(backoff, pool, "sekret")
+
+	// not found until a BackoffHandler is set
+	assert.Equal(http.StatusNotFound, adminrequest("GET", "/__admin__/backoff", "sekret", handler).StatusCode)
+	handler.Backoff = backoff
+
+	assert.Equal(http.StatusUnauthorized, adminrequest("POST", "/__admin__/backoff?enabled=true", "", handler).StatusCode)
+	assert.Equal(http.StatusBadRequest, adminrequest("POST", "/__admin__/backoff", "sekret", handler).StatusCode)
+	assert.Equal(http.StatusBadRequest, adminrequest("POST", "/__admin__/backoff?enabled=maybe", "sekret", handler).StatusCode)
+	assert.False(backoff.Enabled())
+
+	for _, enabled := range []bool{true, false} {
+		resp := adminrequest("POST", fmt.Sprintf("/__admin__/backoff?enabled=%t", enabled), "sekret", handler)
+		if !assert.Equal(http.StatusOK, resp.StatusCode) {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.JSONEq(fmt.Sprintf(`{"enabled":%t,"seconds":60}`, enabled), string(body))
+		assert.Equal(enabled, backoff.Enabled())
+
+		resp = adminrequest("GET", "/__admin__/backoff", "sekret", handler)
+		body, _ = ioutil.ReadAll(resp.Body)
+		assert.JSONEq(fmt.Sprintf(`{"enabled":%t,"seconds":60}`, enabled), string(body))
+	}
+
+	// sync api responses get the header while it is enabled
+	uid := uniqueUID()
+	handler.Backoff.SetEnabled(true)
+	resp := request("GET", syncurl(uid, "info/collections"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("60", resp.Header().Get("X-Weave-Backoff"))
+}
@@ -0,0 +1,50 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// BackoffHandler adds an X-Weave-Backoff header to every response while
+// it is enabled, asking clients to slow down when the server is under
+// pressure. Responses that already ask for a backoff, like a lock
+// timeout's, keep their own value
+type BackoffHandler struct {
+	handler http.Handler
+
+	// BackoffSeconds is sent in the X-Weave-Backoff header
+	BackoffSeconds int
+
+	enabled int32
+}
+
+func NewBackoffHandler(h http.Handler, seconds int) *BackoffHandler {
+	return &BackoffHandler{
+		handler:        h,
+		BackoffSeconds: seconds,
+	}
+}
+
+// SetEnabled turns the X-Weave-Backoff header on or off
+func (h *BackoffHandler) SetEnabled(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&h.enabled, v)
+}
+
+func (h *BackoffHandler) Enabled() bool {
+	return atomic.LoadInt32(&h.enabled) == 1
+}
+
+func (h *BackoffHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// set before the handler runs so it is sent with every response,
+	// handlers overwrite it when they need a different value
+	if h.Enabled() {
+		w.Header().Set("X-Weave-Backoff", strconv.Itoa(h.BackoffSeconds))
+	}
+
+	h.handler.ServeHTTP(w, req)
+}
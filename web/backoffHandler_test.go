@@ -0,0 +1,49 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewBackoffHandler(NewSyncUserHandler(uid, db, nil), 120)
+
+	// nothing is added until it is enabled
+	resp := request("GET", syncurl(uid, "info/collections"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("", resp.Header().Get("X-Weave-Backoff"))
+
+	handler.SetEnabled(true)
+	assert.True(handler.Enabled())
+
+	// successful and error responses both have it
+	resp = request("GET", syncurl(uid, "info/collections"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("120", resp.Header().Get("X-Weave-Backoff"))
+
+	resp = request("GET", syncurl(uid, "storage/nope/b0"), nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+	assert.Equal("120", resp.Header().Get("X-Weave-Backoff"))
+
+	// handlers asking for their own backoff keep their value
+	custom := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Weave-Backoff", strconv.Itoa(lockTimeoutBackoff))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	customHandler := NewBackoffHandler(custom, 120)
+	customHandler.SetEnabled(true)
+	resp = request("GET", "/", nil, customHandler)
+	assert.Equal(strconv.Itoa(lockTimeoutBackoff), resp.Header().Get("X-Weave-Backoff"))
+
+	handler.SetEnabled(false)
+	resp = request("GET", syncurl(uid, "info/collections"), nil, handler)
+	assert.Equal("", resp.Header().Get("X-Weave-Backoff"))
+}
@@ -67,7 +67,7 @@ func (s *CacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if session, ok := SessionFromContext(req.Context()); ok {
 		uid = session.Token.UidString()
 	} else {
-		sendRequestProblem(w, req, http.StatusBadRequest, errors.New("CacheHandler no UID"))
+		WeaveInvalidUser(w, req, errors.New("CacheHandler no UID"))
 		return
 	}
 
@@ -90,6 +90,17 @@ func (s *CacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Invalidate clears uid's cached info/collections. It is for changes made
+// to the user's data without going through the handler, e.g. by admin
+// actions. Calling it on a nil *CacheHandler does nothing
+func (s *CacheHandler) Invalidate(uid string) {
+	if s == nil {
+		return
+	}
+
+	s.cache.Set(uid, nil)
+}
+
 // for serialization of the json body and last modified header
 // values into one []byte. The X-Last-Modified timestamp is 13 bytes
 // ie: 1234567890.12.
@@ -128,8 +139,9 @@ func (s *CacheHandler) infoCollection(uid string, w http.ResponseWriter, req *ht
 	cacheWriter := newCacheResponseWriter(w)
 	s.handler.ServeHTTP(cacheWriter, req)
 
-	// cache the results for next time if successful response
-	if cacheWriter.code == http.StatusOK {
+	// cache the results for next time if successful response. Truncated
+	// results are not cached since the cache does not keep headers
+	if cacheWriter.code == http.StatusOK && w.Header().Get("X-Weave-Info-Truncated") == "" {
 		data := make([]byte, cacheWriter.Len()+lastModifiedBytes)
 
 		copy(data, w.Header().Get("X-Last-Modified"))
@@ -2,17 +2,18 @@ package web
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"crypto/sha256"
+	"hash"
 	"io/ioutil"
 	"mime"
 	"net/http"
+	"regexp"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/mozilla-services/go-syncstorage/token"
 	"github.com/pkg/errors"
-	"github.com/willf/bloom"
 	"go.mozilla.org/hawk"
 )
 
@@ -22,39 +23,52 @@ var (
 	ErrTokenExpired = errors.New("Token is expired")
 )
 
+// HawkAlgorithms are the MAC algorithms HawkHandler.Algorithm can be set to
+var HawkAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// hawkHeaderField matches the key="value" pairs of a Hawk header. Hawk
+// does not allow quotes in values so every pair is matched
+var hawkHeaderField = regexp.MustCompile(`([a-z]+)="([^"]*)"`)
+
+// headerAlgorithm returns the algorithm field of a Hawk Authorization
+// header or blank when there is not one
+func headerAlgorithm(header string) string {
+	for _, field := range hawkHeaderField.FindAllStringSubmatch(header, -1) {
+		if field[1] == "algorithm" {
+			return field[2]
+		}
+	}
+	return ""
+}
+
 type HawkHandler struct {
 	handler http.Handler
 
-	// bloom filters for nonce checking
-	bloomPrev *bloom.BloomFilter
-	bloomNow  *bloom.BloomFilter
+	// Nonces detects replayed requests. It defaults to a NonceLRU
+	// of DefaultNonceCacheSize
+	Nonces NonceCache
 
-	// use to control rotation of bloom filters
-	bloomHalflife time.Duration
-	lastRotate    time.Time
-	bloomLock     sync.Mutex
+	// Algorithm is the MAC algorithm tokens are used with, one of
+	// HawkAlgorithms. It defaults to sha256
+	Algorithm string
 
 	secrets []string
 }
 
 func NewHawkHandler(handler http.Handler, secrets []string) *HawkHandler {
-	// the m value for the bloom filter is likely larger than
-	// we need. It figures 60,000 requests/minute * 50 = 3,000,000 bits
-	// or ~2.8MB. The code rotates between two of them so about 5.6MB
-	// of memory for nonce checking.
-
-	m := uint(1000 * 60 * 50)
 	return &HawkHandler{
-		handler:       handler,
-		secrets:       secrets,
-		bloomPrev:     bloom.New(m, 5),
-		bloomNow:      bloom.New(m, 5),
-		bloomHalflife: 30 * time.Second,
-		lastRotate:    time.Now(),
+		handler:   handler,
+		secrets:   secrets,
+		Nonces:    NewNonceLRU(DefaultNonceCacheSize),
+		Algorithm: "sha256",
 	}
 }
 
 func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 
 	// Step 0: Create a session context. Added since sendRequestProblem
 	// stores errors to pass around in session.ErrorResult and if we 4xx
@@ -74,9 +88,12 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//
 	// Important: Hawk errors results in StatusBadRequest (HTTP 400). A StatusUnauthorized (HTTP 401)
 	// causes clients to fetch new tokens from the tokenserver. In practice most hawk errors
-	// can not be resolved with a new token, e.g: time skew too high, nonce replay, etc.
+	// can not be resolved with a new token, e.g: time skew too high, etc.
 	// there's no sense putting unnecessary load on the token service.
-	auth, err := hawk.NewAuthFromRequest(r, nil, h.hawkNonceNotFound)
+	//
+	// Nonces are checked after the request is validated so requests
+	// with a bad MAC can not use up nonces
+	auth, err := hawk.NewAuthFromRequest(r, nil, nil)
 	if err != nil {
 		if e, ok := err.(hawk.AuthFormatError); ok {
 			sendRequestProblem(w, r, http.StatusForbidden,
@@ -84,10 +101,6 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		} else if authError, ok := err.(hawk.AuthError); ok {
 			w.Header().Set("WWW-Authenticate", "Hawk")
 			switch authError {
-			case hawk.ErrReplay: // log the replay'd nonce
-				authInfo, _ := hawk.ParseRequestHeader(r.Header.Get("Authorization"))
-				sendRequestProblem(w, r, http.StatusForbidden,
-					errors.Errorf("Hawk: Replay nonce=%s", authInfo.Nonce))
 			case hawk.ErrNoAuth:
 				// send a 401 for no Authorization header issues to force clients to
 				// fetch a new token. See https://bugzilla.mozilla.org/show_bug.cgi?id=1318799
@@ -102,6 +115,25 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the algorithm is not usually sent since it comes with the token.
+	// Clients that do send one must use the configured algorithm
+	macHash, ok := HawkAlgorithms[h.Algorithm]
+	if !ok {
+		InternalError(w, r, errors.Errorf("Hawk: unknown algorithm %s", h.Algorithm))
+		return
+	}
+
+	if algorithm := headerAlgorithm(r.Header.Get("Authorization")); algorithm != "" && algorithm != h.Algorithm {
+		w.Header().Set("WWW-Authenticate", "Hawk")
+		sendRequestProblem(w, r, http.StatusUnauthorized,
+			errors.Errorf("Hawk: algorithm %s not allowed, must be %s", algorithm, h.Algorithm))
+		return
+	}
+
+	// clients sign the path they requested, including the prefix
+	// removed by PrefixHandler
+	auth.RequestURI = pathPrefixFromContext(r.Context()) + auth.RequestURI
+
 	// Step 2: Extract the Token
 	var (
 		parsedToken token.Token
@@ -122,7 +154,7 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// required to these manually so the auth.Valid()
 		// check has all the information it needs later
 		auth.Credentials.Key = parsedToken.DerivedSecret
-		auth.Credentials.Hash = sha256.New
+		auth.Credentials.Hash = macHash
 	}
 
 	// Step 3: Make sure it's valid...
@@ -183,43 +215,29 @@ func (h *HawkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		pHash.Write(content)
 		if !auth.ValidHash(pHash) {
 			w.Header().Set("WWW-Authenticate", "Hawk")
-			sendRequestProblem(w, r, http.StatusForbidden,
+			sendRequestProblem(w, r, http.StatusUnauthorized,
 				errors.New("Hawk: payload hash invalid"))
 			return
 		}
 	}
 
-	// Step 6: Update the session token and pass it on
-	session.Token = parsedToken.Payload
-	h.handler.ServeHTTP(w, r)
-
-}
-
-func (h *HawkHandler) hawkNonceNotFound(nonce string, t time.Time, creds *hawk.Credentials) bool {
-	// From the Docs:
-	//   The nonce is generated by the client, and is a string unique across all
-	//   requests with the same timestamp and key identifier combination.
-	var key string
-	if creds != nil {
-		key = nonce + t.String() + creds.ID
-	} else {
-		key = nonce + t.String()
-	}
-
-	// rotate the blooms?
-	h.bloomLock.Lock()
-	now := time.Now()
-	if now.Sub(h.lastRotate) > h.bloomHalflife {
-		h.bloomNow, h.bloomPrev = h.bloomPrev, h.bloomNow // switcheroo
-		h.bloomNow.ClearAll()
-		h.lastRotate = now
+	// Step 6: Reject replayed requests. Nonces are unique per token and
+	// timestamp, the uid is used instead of the much longer token id.
+	// Replays get a 401 so a client that did resend a request gets a new
+	// token and retries with a new nonce
+	if !auth.IsBewit {
+		nonce := parsedToken.Payload.UidString() + ":" + auth.Nonce
+		if h.Nonces.Seen(nonce, auth.Timestamp.Unix()) {
+			w.Header().Set("WWW-Authenticate", "Hawk")
+			sendRequestProblem(w, r, http.StatusUnauthorized,
+				errors.Errorf("Hawk: Replay nonce=%s", auth.Nonce))
+			return
+		}
 	}
-	h.bloomLock.Unlock()
 
-	if h.bloomNow.TestString(key) || h.bloomPrev.TestString(key) {
-		return false
-	}
+	// Step 7: Update the session token and pass it on
+	session.Token = parsedToken.Payload
+	session.AuthTime = time.Since(start)
+	h.handler.ServeHTTP(w, r)
 
-	h.bloomNow.AddString(key)
-	return true
 }
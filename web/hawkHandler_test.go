@@ -2,14 +2,17 @@ package web
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"crypto/sha256"
 	"io"
 	"io/ioutil"
 	"mime"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
-	"time"
 
 	"github.com/mozilla-services/go-syncstorage/syncstorage"
 	"github.com/mozilla-services/go-syncstorage/token"
@@ -117,6 +120,7 @@ func TestHawkNoAuthorizationError401(t *testing.T) {
 	// send an authenticated request
 	resp := request("GET", syncurl(uid, "info/collections"), nil, hawkH)
 	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.NotEqual(t, "", resp.Header().Get("X-Weave-Timestamp"))
 }
 
 func TestHawkMultiSecrets(t *testing.T) {
@@ -174,53 +178,118 @@ func TestHawkAuthPOST(t *testing.T) {
 	assert.Equal(payload, resp.Body.String())
 }
 
-func TestHawkNonceCheckFunc(t *testing.T) {
+func TestHawkAuthPUTPayloadHash(t *testing.T) {
+	t.Parallel()
 	assert := assert.New(t)
+
+	var uid uint64 = 12345
 	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+	tok := testtoken(hawkH.secrets[0], uid)
+
+	payload := `{"payload":"signed"}`
+	url := syncurl(uid, "storage/bookmarks/b0")
+
+	{ // correct hash, the body is still readable by the handler
+		req, auth := hawkrequestbody("PUT", url, tok, "application/json", bytes.NewBufferString(payload))
+		assert.NotEmpty(auth.Hash)
+
+		resp := sendrequest(req, hawkH)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal(payload, resp.Body.String())
+	}
 
-	// check replay
-	creds1 := &hawk.Credentials{ID: "bacon"}
-	ts := time.Now()
-	assert.True(hawkH.hawkNonceNotFound("t2", ts, creds1))
-	assert.False(hawkH.hawkNonceNotFound("t2", ts, creds1))
+	{ // the body is changed after it was signed
+		req, _ := hawkrequestbody("PUT", url, tok, "application/json", bytes.NewBufferString(payload))
+		req.Body = ioutil.NopCloser(strings.NewReader(`{"payload":"tampered"}`))
+
+		resp := sendrequest(req, hawkH)
+		assert.Equal(http.StatusUnauthorized, resp.Code)
+		assert.Equal("Hawk", resp.Header().Get("WWW-Authenticate"))
+		assert.NotContains(resp.Body.String(), "tampered")
+	}
+}
+
+type testNonceCache map[string]int64
+
+func (c testNonceCache) Seen(nonce string, ts int64) bool {
+	_, seen := c[nonce]
+	c[nonce] = ts
+	return seen
 }
 
-func TestHawkBloomRotate(t *testing.T) {
+func TestHawkAlgorithm(t *testing.T) {
 	assert := assert.New(t)
+
+	var uid uint64 = 12345
 	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+	tok := testtoken(hawkH.secrets[0], uid)
 
-	// use a very short halflife to not wait so long
-	// by default it is 30 seconds, to allow for 1 minute validity
-	// of hawk nonces
-	halfLife := 10 * time.Millisecond
+	// withAlgorithm adds an algorithm field to the Authorization header
+	withAlgorithm := func(algorithm string) *http.Request {
+		req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+		req.Header.Set("Authorization", req.Header.Get("Authorization")+`, algorithm="`+algorithm+`"`)
+		return req
+	}
 
-	hawkH.bloomHalflife = halfLife
-	creds := &hawk.Credentials{ID: "bacon"}
+	{ // the default, sha256, is allowed with or without the field
+		req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+		assert.Equal(http.StatusOK, sendrequest(req, hawkH).Code)
 
-	// test several rotations through
-	for i := 0; i < 3; i++ {
-		ts := time.Now()
+		resp := sendrequest(withAlgorithm("sha256"), hawkH)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	}
 
-		assert.True(hawkH.hawkNonceNotFound("nonce", ts, creds), "Expected nonce not to be found")
+	{ // other algorithms get a 401
+		resp := sendrequest(withAlgorithm("sha1"), hawkH)
+		assert.Equal(http.StatusUnauthorized, resp.Code)
+		assert.Equal("Hawk", resp.Header().Get("WWW-Authenticate"))
+		assert.Contains(resp.Body.String(), "Hawk: algorithm sha1 not allowed")
+	}
+
+	{ // configured for sha1
+		hawkH.Algorithm = "sha1"
 
-		time.Sleep(halfLife + time.Millisecond) // force a rotation
-		assert.False(hawkH.hawkNonceNotFound("nonce", ts, creds), "Expected nonce to be found")
+		req, _ := http.NewRequest("GET", syncurl(uid, "info/collections"), nil)
+		auth := hawk.NewRequestAuth(req, &hawk.Credentials{
+			ID:   tok.Token,
+			Key:  tok.DerivedSecret,
+			Hash: sha1.New,
+		}, 0)
+		req.Header.Set("Authorization", auth.RequestHeader()+`, algorithm="sha1"`)
+		resp := sendrequest(req, hawkH)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
 
-		time.Sleep(halfLife + time.Millisecond) // force another rotation
-		assert.True(hawkH.hawkNonceNotFound("nonce", ts, creds), "Expected nonce to be gone")
+		// sha256 MACs do not validate
+		req, _ = hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+		assert.Equal(http.StatusForbidden, sendrequest(req, hawkH).Code)
 
-		assert.False(hawkH.hawkNonceNotFound("nonce", ts, creds), "Expected nonce to be found")
+		resp = sendrequest(withAlgorithm("sha256"), hawkH)
+		assert.Equal(http.StatusUnauthorized, resp.Code)
 	}
 }
 
-func BenchmarkHawkNonceNotFound(b *testing.B) {
+func TestHawkHeaderAlgorithm(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("", headerAlgorithm(`Hawk id="abc", ts="1", nonce="x", mac="y"`))
+	assert.Equal("sha1", headerAlgorithm(`Hawk id="abc", algorithm="sha1", mac="y"`))
+	assert.Equal("", headerAlgorithm(`Hawk id="abc", ext="algorithm", mac="y"`))
+}
+
+func TestHawkNonceCache(t *testing.T) {
+	assert := assert.New(t)
+	nonces := make(testNonceCache)
 	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
-	creds := &hawk.Credentials{ID: "bacon"}
-	ts := time.Now()
+	hawkH.Nonces = nonces
 
-	for i := 0; i < b.N; i++ {
-		hawkH.hawkNonceNotFound("nonce", ts, creds)
-	}
+	var uid uint64 = 12345
+	tok := testtoken(hawkH.secrets[0], uid)
+	req, auth := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+
+	assert.Equal(http.StatusOK, sendrequest(req, hawkH).Code)
+	assert.Equal(testNonceCache{"12345:" + auth.Nonce: auth.Timestamp.Unix()}, nonces)
+
+	assert.Equal(http.StatusUnauthorized, sendrequest(req, hawkH).Code)
 }
 
 func TestHawkReplayNonce(t *testing.T) {
@@ -235,11 +304,58 @@ func TestHawkReplayNonce(t *testing.T) {
 	assert.Equal(http.StatusOK, resp1.Code)
 
 	resp2 := sendrequest(req1, hawkH)
-	assert.Equal(http.StatusForbidden, resp2.Code)
+	assert.Equal(http.StatusUnauthorized, resp2.Code)
+	assert.Equal("Hawk", resp2.Header().Get("WWW-Authenticate"))
 	assert.Contains(resp2.Body.String(), "Hawk: Replay nonce=")
 
 }
 
+func TestHawkReplayNonceConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+
+	var uid uint64 = 12345
+	tok := testtoken(hawkH.secrets[0], uid)
+	req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, _ := http.NewRequest("GET", req.URL.String(), nil)
+			r.Header.Set("Authorization", req.Header.Get("Authorization"))
+			codes <- sendrequest(r, hawkH).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := make(map[int]int)
+	for code := range codes {
+		counts[code]++
+	}
+
+	assert.Equal(map[int]int{http.StatusOK: 1, http.StatusUnauthorized: 19}, counts)
+}
+
+func TestHawkReplayNonceInvalidMAC(t *testing.T) {
+	assert := assert.New(t)
+	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
+
+	var uid uint64 = 12345
+	tok := testtoken(hawkH.secrets[0], uid)
+	req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+
+	// a request with a bad MAC does not use up the nonce
+	bad, _ := http.NewRequest("GET", req.URL.String()+"?tampered=1", nil)
+	bad.Header.Set("Authorization", req.Header.Get("Authorization"))
+	assert.Equal(http.StatusForbidden, sendrequest(bad, hawkH).Code)
+
+	assert.Equal(http.StatusOK, sendrequest(req, hawkH).Code)
+}
+
 func TestHawkAuthNonceRequest(t *testing.T) {
 	hawkH := NewHawkHandler(EchoHandler, []string{"sekret"})
 
@@ -263,3 +379,34 @@ func BenchmarkHawkAuth(b *testing.B) {
 		sendrequest(req, hawkH)
 	}
 }
+
+// TestHawkHandlerOversizedHeaders makes sure a huge Authorization header
+// gets a clean 431 when the server limits MaxHeaderBytes
+func TestHawkHandlerOversizedHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewHawkHandler(EchoHandler, []string{"sekret"})
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.MaxHeaderBytes = 1024
+	server.Start()
+	defer server.Close()
+
+	{
+		req, _ := http.NewRequest("GET", server.URL+"/1.5/123/info/collections", nil)
+		req.Header.Set("Authorization", "Hawk id=\""+strings.Repeat("x", 64*1024)+"\"")
+		resp, err := http.DefaultClient.Do(req)
+		if assert.NoError(err) {
+			resp.Body.Close()
+			assert.Equal(http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+		}
+	}
+
+	{ // normal sized headers reach the handler
+		req, _ := http.NewRequest("GET", server.URL+"/1.5/123/info/collections", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if assert.NoError(err) {
+			resp.Body.Close()
+			assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+}
@@ -23,9 +23,9 @@ func NewInfoHandler(h http.Handler) *InfoHandler {
 	}
 
 	r.NotFoundHandler = h
-	r.HandleFunc("/", server.handleRoot)
-	r.HandleFunc("/__heartbeat__", server.handleHeartbeat)
-	r.HandleFunc("/__version__", server.handleVersion)
+	r.HandleFunc("/", getOnly(server.handleRoot))
+	r.HandleFunc("/__heartbeat__", getOnly(server.handleHeartbeat))
+	r.HandleFunc("/__version__", getOnly(server.handleVersion))
 
 	return server
 }
@@ -34,6 +34,18 @@ func (h *InfoHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h.router.ServeHTTP(w, req)
 }
 
+// getOnly answers anything but GET and HEAD with a 405 so load balancer
+// checks can not be mistaken for other requests
+func getOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			WeaveMethodNotAllowed(w, req, "GET, HEAD")
+			return
+		}
+		h(w, req)
+	}
+}
+
 func (h *InfoHandler) handleRoot(w http.ResponseWriter, req *http.Request) {
 	OKResponse(w, "It Works!  SyncStorage is successfully running on this host.")
 }
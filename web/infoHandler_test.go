@@ -0,0 +1,35 @@
+package web
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInfoHandlerMethods(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := NewInfoHandler(EchoHandler)
+
+	for _, path := range []string{"/", "/__heartbeat__", "/__version__"} {
+		for _, method := range []string{"POST", "PUT", "DELETE"} {
+			resp := request(method, "http://synchost"+path, nil, handler)
+			assert.Equal(http.StatusMethodNotAllowed, resp.Code, method+" "+path)
+			assert.Equal("GET, HEAD", resp.Header().Get("Allow"))
+			assert.Equal("application/json", resp.Header().Get("Content-Type"))
+			assert.Equal(WEAVE_ILLEGAL_METH, resp.Body.String())
+		}
+	}
+
+	resp := request("GET", "http://synchost/__heartbeat__", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("OK", resp.Body.String())
+
+	resp = request("HEAD", "http://synchost/__heartbeat__", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	// other paths are passed through with any method
+	resp = request("POST", "http://synchost/__other__", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+}
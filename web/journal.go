@@ -0,0 +1,86 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Journal operations
+const (
+	JournalPut              = "put"
+	JournalPost             = "post"
+	JournalDelete           = "delete"
+	JournalDeleteCollection = "delete_collection"
+	JournalDeleteEverything = "delete_everything"
+
+	// admin operations
+	JournalMoveFrom      = "move_from"
+	JournalMoveTo        = "move_to"
+	JournalCopyUser      = "copy_user"
+	JournalCollectionTTL = "collection_ttl"
+)
+
+// JournalEntry is a single write operation. Payloads are never recorded
+type JournalEntry struct {
+	Uid        string `json:"uid"`
+	Collection string `json:"collection,omitempty"`
+	BsoId      string `json:"bso,omitempty"`
+	Op         string `json:"op"`
+	Modified   int    `json:"ts"`
+}
+
+// Journal is an append only log of write operations, one JSON object
+// per line. It helps reconstruct what happened when investigating data loss
+// reports. A nil *Journal is valid and records nothing.
+type Journal struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func NewJournal(w io.Writer) *Journal {
+	return &Journal{w: w}
+}
+
+// Record appends an entry for each bId. When no bIds are given a single
+// entry without a BSO id is written
+func (j *Journal) Record(uid, collection, op string, modified int, bIds ...string) {
+	if j == nil {
+		return
+	}
+
+	if len(bIds) == 0 {
+		bIds = []string{""}
+	}
+
+	buf := make([]byte, 0, 128*len(bIds))
+	for _, bId := range bIds {
+		line, err := json.Marshal(JournalEntry{
+			Uid:        uid,
+			Collection: collection,
+			BsoId:      bId,
+			Op:         op,
+			Modified:   modified,
+		})
+
+		if err != nil {
+			continue
+		}
+
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	if _, err := j.w.Write(buf); err != nil {
+		log.WithFields(log.Fields{
+			"uid": uid,
+			"op":  op,
+			"err": err.Error(),
+		}).Error("Journal: write failed")
+	}
+}
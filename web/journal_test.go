@@ -0,0 +1,80 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalNil(t *testing.T) {
+	var j *Journal
+	// should not panic
+	j.Record("123", "col", JournalPut, 1, "b0")
+}
+
+func TestJournalSyncUserHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := new(bytes.Buffer)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.Journal = NewJournal(buf)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, conf)
+
+	resp := jsonrequest("PUT", syncurl(uid, "storage/col/b0"),
+		bytes.NewBufferString(`{"payload":"secret stuff"}`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+	putModified, _ := ConvertTimestamp(resp.Header().Get("X-Last-Modified"))
+
+	resp = jsonrequest("POST", syncurl(uid, "storage/col"),
+		bytes.NewBufferString(`[{"id":"b1", "payload":"-"}, {"id":"b2", "payload":"-"}]`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	resp = request("DELETE", syncurl(uid, "storage/col/b0"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	resp = request("DELETE", syncurl(uid, "storage/col"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	// payloads are never journaled
+	assert.False(strings.Contains(buf.String(), "secret stuff"))
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var e JournalEntry
+		if assert.NoError(json.Unmarshal(scanner.Bytes(), &e), scanner.Text()) {
+			entries = append(entries, e)
+		}
+	}
+
+	if !assert.Len(entries, 5) {
+		return
+	}
+
+	assert.Equal(JournalEntry{Uid: uid, Collection: "col", BsoId: "b0", Op: JournalPut, Modified: putModified}, entries[0])
+	assert.Equal("b1", entries[1].BsoId)
+	assert.Equal(JournalPost, entries[1].Op)
+	assert.Equal("b2", entries[2].BsoId)
+	assert.Equal(JournalPost, entries[2].Op)
+	assert.Equal("b0", entries[3].BsoId)
+	assert.Equal(JournalDelete, entries[3].Op)
+	assert.Equal("", entries[4].BsoId)
+	assert.Equal(JournalDeleteCollection, entries[4].Op)
+}
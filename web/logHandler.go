@@ -125,6 +125,10 @@ type mozlog struct {
 type MozlogFormatter struct {
 	Hostname string
 	Pid      int
+
+	// Pretty indents the JSON over multiple lines. Production logs
+	// should be compact with one record per line
+	Pretty bool
 }
 
 var encoderPool = sync.Pool{
@@ -172,6 +176,9 @@ func (f *MozlogFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 
 	// encode the fields in there
 	enc := json.NewEncoder(b)
+	if f.Pretty {
+		enc.SetIndent("", "  ")
+	}
 	if err := enc.Encode(m); err != nil {
 		return nil, err
 	}
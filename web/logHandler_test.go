@@ -226,6 +226,39 @@ func TestLogHandlerMozlogFormatter(t *testing.T) {
 	}
 }
 
+func TestLogHandlerMozlogFormatterPretty(t *testing.T) {
+	assert := assert.New(t)
+
+	var compact, pretty bytes.Buffer
+	for _, out := range []struct {
+		buf    *bytes.Buffer
+		pretty bool
+	}{{&compact, false}, {&pretty, true}} {
+		logger := logrus.New()
+		logger.Out = out.buf
+		logger.Formatter = &MozlogFormatter{
+			Hostname: "test.localdomain",
+			Pid:      os.Getpid(),
+			Pretty:   out.pretty,
+		}
+		logger.WithFields(logrus.Fields{"uid": "123456", "errno": 0}).Info("hello")
+	}
+
+	// compact is a single line, pretty is indented over several
+	assert.Equal(1, strings.Count(compact.String(), "\n"))
+	assert.True(strings.Count(pretty.String(), "\n") > 1)
+	assert.Contains(pretty.String(), "\n  \"Fields\": {")
+
+	// the same record either way
+	var recordCompact, recordPretty mozlog
+	if assert.NoError(json.Unmarshal(compact.Bytes(), &recordCompact)) &&
+		assert.NoError(json.Unmarshal(pretty.Bytes(), &recordPretty)) {
+		assert.Equal(recordCompact.Fields, recordPretty.Fields)
+		assert.Equal(recordCompact.Severity, recordPretty.Severity)
+		assert.Equal("hello", recordPretty.Fields["msg"])
+	}
+}
+
 func BenchmarkMozlogFormatter(b *testing.B) {
 
 	entry := logrus.WithFields(logrus.Fields{
@@ -0,0 +1,110 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// PayloadSizeBuckets are the upper bounds, in bytes, of the payload size
+// histogram. The largest is the default MaxRecordPayloadBytes
+var PayloadSizeBuckets = []float64{
+	256, 1024, 4 * 1024, 16 * 1024, 64 * 1024, 256 * 1024, 1024 * 1024, 2 * 1024 * 1024,
+}
+
+// Histogram counts observations in buckets and writes them in the
+// Prometheus text format. A nil *Histogram is valid and records nothing.
+type Histogram struct {
+	sync.Mutex
+
+	name    string
+	help    string
+	buckets []float64
+
+	// counts has a count for each bucket, not cumulative, plus one
+	// for observations larger than the last bucket
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return &Histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+
+	i := 0
+	for ; i < len(h.buckets); i++ {
+		if v <= h.buckets[i] {
+			break
+		}
+	}
+
+	h.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.Unlock()
+}
+
+// Write writes the histogram in the Prometheus text exposition format
+func (h *Histogram) Write(w io.Writer) {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, strconv.FormatFloat(le, 'f', -1, 64), cumulative)
+	}
+
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(h.sum, 'f', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// MetricsHandler serves histograms at /metrics for Prometheus to scrape
+type MetricsHandler struct {
+	handler    http.Handler
+	histograms []*Histogram
+}
+
+func NewMetricsHandler(h http.Handler, histograms ...*Histogram) *MetricsHandler {
+	return &MetricsHandler{handler: h, histograms: histograms}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/metrics" {
+		h.handler.ServeHTTP(w, req)
+		return
+	}
+
+	if req.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, histogram := range h.histograms {
+		histogram.Write(w)
+	}
+}
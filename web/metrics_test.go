@@ -0,0 +1,100 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	assert := assert.New(t)
+
+	h := NewHistogram("test_bytes", "Test sizes", []float64{10, 100})
+	for _, v := range []float64{1, 10, 11, 50, 1000} {
+		h.Observe(v)
+	}
+
+	var buf bytes.Buffer
+	h.Write(&buf)
+	assert.Equal(`# HELP test_bytes Test sizes
+# TYPE test_bytes histogram
+test_bytes_bucket{le="10"} 2
+test_bytes_bucket{le="100"} 4
+test_bytes_bucket{le="+Inf"} 5
+test_bytes_sum 1072
+test_bytes_count 5
+`, buf.String())
+
+	// nil histograms are ignored
+	var nilHistogram *Histogram
+	nilHistogram.Observe(1)
+	nilHistogram.Write(&buf)
+}
+
+func TestMetricsHandlerPayloadSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.PayloadSizes = NewHistogram("syncstorage_payload_bytes", "Payload sizes", PayloadSizeBuckets)
+	handler := NewMetricsHandler(NewSyncUserHandler(uid, db, conf), conf.PayloadSizes)
+
+	// 100 bytes
+	resp := jsonrequest("PUT", syncurl(uid, "storage/col/b0"),
+		bytes.NewBufferString(fmt.Sprintf(`{"payload":"%s"}`, strings.Repeat("a", 100))), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	// only updating the sortindex does not write a payload
+	resp = jsonrequest("PUT", syncurl(uid, "storage/col/b0"), bytes.NewBufferString(`{"sortindex":1}`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	// 2000 and 10000 bytes
+	body := fmt.Sprintf(`[{"id":"b1","payload":"%s"},{"id":"b2","payload":"%s"}]`,
+		strings.Repeat("b", 2000), strings.Repeat("c", 10000))
+	resp = jsonrequest("POST", syncurl(uid, "storage/col"), bytes.NewBufferString(body), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	// 100000 bytes, counted when the batch is committed
+	body = fmt.Sprintf(`[{"id":"b3","payload":"%s"}]`, strings.Repeat("d", 100000))
+	resp = jsonrequest("POST", syncurl(uid, "storage/col?batch=true&commit=true"), bytes.NewBufferString(body), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	resp = request("GET", "http://synchost/metrics", nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	assert.Equal("text/plain; version=0.0.4", resp.Header().Get("Content-Type"))
+
+	metrics := resp.Body.String()
+	for _, line := range []string{
+		`syncstorage_payload_bytes_bucket{le="256"} 1`,
+		`syncstorage_payload_bytes_bucket{le="1024"} 1`,
+		`syncstorage_payload_bytes_bucket{le="4096"} 2`,
+		`syncstorage_payload_bytes_bucket{le="16384"} 3`,
+		`syncstorage_payload_bytes_bucket{le="65536"} 3`,
+		`syncstorage_payload_bytes_bucket{le="262144"} 4`,
+		`syncstorage_payload_bytes_bucket{le="+Inf"} 4`,
+		`syncstorage_payload_bytes_sum 112100`,
+		`syncstorage_payload_bytes_count 4`,
+	} {
+		assert.Contains(metrics, line+"\n")
+	}
+
+	resp = request("POST", "http://synchost/metrics", nil, handler)
+	assert.Equal(http.StatusMethodNotAllowed, resp.Code)
+}
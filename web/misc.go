@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"mime"
 	"net/http"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
@@ -38,6 +40,23 @@ func extractUID(path string) string {
 	}
 }
 
+// trimTrailingSlash returns the path and query the client requested
+// without the path's trailing slash. RequestURI is used so prefixes
+// removed by a PrefixHandler are kept
+func trimTrailingSlash(req *http.Request) string {
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+
+	path, query := uri, ""
+	if i := strings.Index(uri, "?"); i >= 0 {
+		path, query = uri[:i], uri[i:]
+	}
+
+	return strings.TrimSuffix(path, "/") + query
+}
+
 // catchBadCrypto addresses Bug 1349170 and this commit to pysync:
 // https://github.com/mozilla-services/server-syncstorage/commit/c2a5f70
 func catchBadCrypto(next http.HandlerFunc) http.HandlerFunc {
@@ -74,7 +93,9 @@ type PostResults struct {
 }
 
 // MarshalJSON manually creates the JSON string since the modified needs to be
-// converted in the python (ugh) timeformat required for sync 1.5. Which means no quotes
+// converted in the python (ugh) timeformat required for sync 1.5. Which means no quotes.
+// The output is stable: success keeps the order BSOs were sent in and failed
+// is sorted by id, which encoding/json does for maps
 func (p *PostResults) MarshalJSON() ([]byte, error) {
 	buf := new(bytes.Buffer)
 
@@ -184,6 +205,13 @@ func parseIntoBSO(jsonData json.RawMessage, bso *syncstorage.PutBSOInput) *parse
 	}
 
 	if r, ok := bkeys["payload"]; ok {
+		// encoding/json silently replaces invalid UTF-8 with U+FFFD so
+		// the payload could never be read back as it was sent. Reject it
+		// instead of storing something different
+		if !utf8.Valid(r) {
+			return &parseError{bId: bId, field: "payload", msg: "Invalid UTF-8"}
+		}
+
 		var payload string
 		err := json.Unmarshal(r, &payload)
 		if err != nil {
@@ -306,7 +334,10 @@ func JSON(w http.ResponseWriter, r *http.Request, statusCode int, val interface{
 	if err != nil {
 		InternalError(w, r, err)
 	} else {
+		// the whole response is in memory so clients and proxies don't
+		// need chunked encoding
 		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(js)))
 		w.WriteHeader(statusCode)
 		w.Write(js)
 	}
@@ -332,13 +363,17 @@ type jsonerr struct {
 
 func JSONError(w http.ResponseWriter, msg string, code int) {
 	w.Header().Set("Content-Type", "application/json")
+	ensureWeaveTimestamp(w.Header())
 	w.WriteHeader(code)
 	js, _ := json.Marshal(jsonerr{msg})
 	w.Write(js)
 }
 
 // ConvertTimestamp converts the sync decimal time in seconds to
-// a time in milliseconds
+// a time in milliseconds. It is rounded to the hundredths of a second
+// the server keeps so 123.4, 123.40 and 123.400001 all compare equal
+// to a stored 123.40, and float error can not make it a millisecond
+// off, e.g. 2.01 * 1000 = 2009.9999
 func ConvertTimestamp(ts string) (int, error) {
 
 	f, err := strconv.ParseFloat(ts, 64)
@@ -346,7 +381,7 @@ func ConvertTimestamp(ts string) (int, error) {
 		return 0, err
 	}
 
-	return int(f * 1000), nil
+	return int(math.Round(f*100)) * 10, nil
 }
 
 // AcceptHeaderOk checks the Accept header is
@@ -384,6 +419,30 @@ func AcceptHeaderOk(w http.ResponseWriter, r *http.Request) bool {
 	return false
 }
 
+// formatParamOk lets clients that can not set the Accept header pick the
+// response format with ?format=json or ?format=newlines. The Accept header
+// is replaced so the request is handled as if it was sent. An unknown
+// format writes an error and returns false
+func formatParamOk(w http.ResponseWriter, r *http.Request) bool {
+	formats, ok := r.URL.Query()["format"]
+	if !ok {
+		return true
+	}
+
+	switch formats[0] {
+	case "json":
+		r.Header.Set("Accept", "application/json")
+	case "newlines":
+		r.Header.Set("Accept", "application/newlines")
+	default:
+		sendRequestProblem(w, r, http.StatusBadRequest,
+			errors.Errorf("Invalid format: %s, must be json or newlines", formats[0]))
+		return false
+	}
+
+	return true
+}
+
 // OKResponse writes a 200 response with a simple string body
 func OKResponse(w http.ResponseWriter, s string) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -94,6 +94,21 @@ func TestJSONError(t *testing.T) {
 		JSONError(w, "testing", http.StatusBadRequest)
 		assert.Equal(http.StatusBadRequest, w.Code)
 		assert.Equal(`{"err":"testing"}`, w.Body.String())
+		assert.NotEqual("", w.Header().Get("X-Weave-Timestamp"))
+	}
+
+	{ // X-Last-Modified is used for the timestamp when it is set
+		w := httptest.NewRecorder()
+		w.Header().Set("X-Last-Modified", "1234.56")
+		JSONError(w, "testing", http.StatusBadRequest)
+		assert.Equal("1234.56", w.Header().Get("X-Weave-Timestamp"))
+	}
+
+	{ // an existing timestamp is left alone
+		w := httptest.NewRecorder()
+		w.Header().Set("X-Weave-Timestamp", "1234.56")
+		JSONError(w, "testing", http.StatusBadRequest)
+		assert.Equal("1234.56", w.Header().Get("X-Weave-Timestamp"))
 	}
 
 	{ // make sure string is properly encoded
@@ -188,6 +203,17 @@ func TestParseIntoBSO(t *testing.T) {
 		}
 	}
 
+	{ // invalid UTF-8 in the payload is rejected, escaped characters are fine
+		var bso syncstorage.PutBSOInput
+		err := parseIntoBSO(json.RawMessage("{\"id\":\"x\", \"payload\":\"bad \xff\xfe\"}"), &bso)
+		if assert.NotNil(err) {
+			assert.Equal("x", err.bId)
+			assert.Equal("payload", err.field)
+		}
+
+		assert.Nil(parseIntoBSO(json.RawMessage(`{"id":"x", "payload":"\u00ff \u2603"}`), &bso))
+	}
+
 	{ // test malformed json explodes
 		tests := []string{
 			`{"id":[]}`,
@@ -220,3 +246,24 @@ func TestParseIntoBSO(t *testing.T) {
 		}
 	}
 }
+
+func TestConvertTimestamp(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, ts := range []string{"123.4", "123.40", "123.400", "123.4000001", "123.39999", "1.234e2"} {
+		modified, err := ConvertTimestamp(ts)
+		if assert.NoError(err, ts) {
+			assert.Equal(123400, modified, ts)
+		}
+	}
+
+	// would be 2009 without rounding
+	modified, _ := ConvertTimestamp("2.01")
+	assert.Equal(2010, modified)
+
+	modified, _ = ConvertTimestamp("123")
+	assert.Equal(123000, modified)
+
+	_, err := ConvertTimestamp("abc")
+	assert.Error(err)
+}
@@ -0,0 +1,76 @@
+package web
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultNonceCacheSize is enough for about 1,000 requests/second with
+// the default 60 second hawk timestamp skew
+const DefaultNonceCacheSize = 120000
+
+// NonceCache remembers hawk nonces so replayed requests can be rejected.
+// Seen returns true if the nonce was already seen with the same
+// timestamp, otherwise it remembers it and returns false. It must be
+// safe for concurrent use so when requests share a nonce exactly one of
+// them gets a false
+type NonceCache interface {
+	Seen(nonce string, ts int64) bool
+}
+
+type nonceKey struct {
+	nonce string
+	ts    int64
+}
+
+// NonceLRU is an in memory NonceCache that holds up to size nonces and
+// forgets the least recently seen first. Requests older than the hawk
+// timestamp skew are rejected anyway, so it only has to hold the nonces
+// seen within that window
+type NonceLRU struct {
+	sync.Mutex
+
+	size   int
+	lru    *list.List
+	nonces map[nonceKey]*list.Element
+}
+
+func NewNonceLRU(size int) *NonceLRU {
+	if size < 1 {
+		size = 1
+	}
+
+	return &NonceLRU{
+		size:   size,
+		lru:    list.New(),
+		nonces: make(map[nonceKey]*list.Element),
+	}
+}
+
+func (c *NonceLRU) Seen(nonce string, ts int64) bool {
+	key := nonceKey{nonce, ts}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.nonces[key]; ok {
+		c.lru.MoveToFront(e)
+		return true
+	}
+
+	c.nonces[key] = c.lru.PushFront(key)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.nonces, oldest.Value.(nonceKey))
+	}
+
+	return false
+}
+
+// Len returns how many nonces are remembered
+func (c *NonceLRU) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.lru.Len()
+}
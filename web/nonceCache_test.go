@@ -0,0 +1,68 @@
+package web
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonceLRU(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewNonceLRU(2)
+	assert.False(c.Seen("a", 1))
+	assert.True(c.Seen("a", 1))
+
+	// the same nonce with another timestamp is a different request
+	assert.False(c.Seen("a", 2))
+	assert.Equal(2, c.Len())
+
+	// "a", 1 was used most recently so "a", 2 is forgotten
+	assert.True(c.Seen("a", 1))
+	assert.False(c.Seen("b", 1))
+	assert.Equal(2, c.Len())
+	assert.True(c.Seen("a", 1))
+	assert.False(c.Seen("a", 2))
+}
+
+func TestNonceLRUConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewNonceLRU(1000)
+	var (
+		wg     sync.WaitGroup
+		lock   sync.Mutex
+		unseen = make(map[string]int)
+	)
+
+	// each nonce is tried by 10 goroutines, only one of them sees it first
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				nonce := strconv.Itoa(n)
+				if !c.Seen(nonce, 1) {
+					lock.Lock()
+					unseen[nonce]++
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(unseen, 100)
+	for nonce, count := range unseen {
+		assert.Equal(1, count, nonce)
+	}
+}
+
+func BenchmarkNonceLRU(b *testing.B) {
+	c := NewNonceLRU(DefaultNonceCacheSize)
+	for i := 0; i < b.N; i++ {
+		c.Seen(strconv.Itoa(i), 1)
+	}
+}
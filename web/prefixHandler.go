@@ -0,0 +1,58 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type prefixKey int
+
+const pKey prefixKey = 0
+
+// PrefixHandler serves the handlers it wraps under a path prefix, e.g.
+// /sync/1.5/... when a proxy routes requests by path without rewriting
+// them. The prefix is removed before the request is passed on so the
+// rest of the server only sees /1.5/... paths. Requests outside of the
+// prefix get a 404
+type PrefixHandler struct {
+	prefix  string
+	handler http.Handler
+}
+
+// NewPrefixHandler returns a PrefixHandler. prefix must start with a /
+// and not end with one
+func NewPrefixHandler(prefix string, h http.Handler) *PrefixHandler {
+	return &PrefixHandler{
+		prefix:  prefix,
+		handler: h,
+	}
+}
+
+func (h *PrefixHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p := req.URL.Path
+	if p != h.prefix && !strings.HasPrefix(p, h.prefix+"/") {
+		sendRequestProblem(w, req, http.StatusNotFound, errors.Errorf("Path not under %s", h.prefix))
+		return
+	}
+
+	u := *req.URL
+	u.Path = strings.TrimPrefix(p, h.prefix)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawPath = strings.TrimPrefix(u.RawPath, h.prefix)
+
+	r := req.WithContext(context.WithValue(req.Context(), pKey, h.prefix))
+	r.URL = &u
+	h.handler.ServeHTTP(w, r)
+}
+
+// pathPrefixFromContext returns the prefix a PrefixHandler removed from
+// the request's path. Hawk needs it since clients sign the full path
+func pathPrefixFromContext(ctx context.Context) string {
+	prefix, _ := ctx.Value(pKey).(string)
+	return prefix
+}
@@ -0,0 +1,68 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12345
+	pool := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	handler := NewPrefixHandler("/sync", pool)
+
+	prefixed := strings.Replace(syncurl(uid, "info/collections"), "/1.5/", "/sync/1.5/", 1)
+	resp := request("GET", prefixed, nil, handler)
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	assert.Equal("application/json", resp.Header().Get("Content-Type"))
+
+	// the api is no longer served at the root
+	resp = request("GET", syncurl(uid, "info/collections"), nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+
+	// the prefix has to be a whole path segment
+	resp = request("GET", "http://synchost/syncing/1.5/12345/info/collections", nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+
+	{ // info endpoints can stay at the root
+		handler := NewInfoHandler(NewPrefixHandler("/sync", pool))
+		resp := request("GET", "http://synchost/__heartbeat__", nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+
+		resp = request("GET", prefixed, nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+
+	{ // or move under the prefix
+		handler := NewPrefixHandler("/sync", NewInfoHandler(pool))
+		resp := request("GET", "http://synchost/sync/__heartbeat__", nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+
+		resp = request("GET", "http://synchost/__heartbeat__", nil, handler)
+		assert.Equal(http.StatusNotFound, resp.Code)
+	}
+}
+
+func TestPrefixHandlerHawk(t *testing.T) {
+	assert := assert.New(t)
+
+	var uid uint64 = 12345
+	tok := testtoken("sekret", uid)
+	handler := NewPrefixHandler("/sync", NewHawkHandler(EchoHandler, []string{"sekret"}))
+
+	// clients sign the full path, including the prefix
+	prefixed := strings.Replace(syncurl(uid, "info/collections"), "/1.5/", "/sync/1.5/", 1)
+	req, _ := hawkrequest("GET", prefixed, tok)
+	resp := sendrequest(req, handler)
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+	// a signature for the path without the prefix is not valid
+	req, _ = hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+	req.URL.Path = "/sync" + req.URL.Path
+	resp = sendrequest(req, handler)
+	assert.Equal(http.StatusForbidden, resp.Code)
+}
@@ -0,0 +1,50 @@
+package web
+
+import (
+	"math"
+	"time"
+)
+
+// RateLimit allows Burst requests at once which are refilled
+// at PerSecond
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+// tokenBucket is a simple token bucket rate limiter. It is not
+// safe for concurrent use
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	return &tokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+	}
+}
+
+// take removes a token from the bucket. When the bucket is empty it
+// returns false and how long until the next token is available
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	if !b.last.IsZero() {
+		elapsed := now.Sub(b.last).Seconds()
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.PerSecond)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	if b.limit.PerSecond <= 0 {
+		return false, time.Hour
+	}
+
+	wait := (1 - b.tokens) / b.limit.PerSecond
+	return false, time.Duration(wait * float64(time.Second))
+}
@@ -0,0 +1,36 @@
+package web
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newTokenBucket(RateLimit{PerSecond: 2, Burst: 2})
+	now := time.Now()
+
+	ok, _ := b.take(now)
+	assert.True(ok)
+	ok, _ = b.take(now)
+	assert.True(ok)
+	ok, wait := b.take(now)
+	assert.False(ok)
+	assert.Equal(500*time.Millisecond, wait)
+
+	// refilled after waiting
+	ok, _ = b.take(now.Add(wait))
+	assert.True(ok)
+
+	// never more than burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		ok, _ = b.take(now)
+		assert.True(ok)
+	}
+	ok, _ = b.take(now)
+	assert.False(ok)
+}
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// NewRecoveryHandler returns a http.Handler that recovers from panics in h.
+// The panic and a stack trace are logged and a 500 is returned so one bad
+// request does not end with an empty response
+func NewRecoveryHandler(l logrus.FieldLogger, h http.Handler) http.Handler {
+	return &RecoveryHandler{logger: l, handler: h}
+}
+
+type RecoveryHandler struct {
+	logger  logrus.FieldLogger
+	handler http.Handler
+}
+
+func (h *RecoveryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer func() {
+		rec := recover()
+		if rec == nil {
+			return
+		}
+
+		// let net/http deal with aborted handlers
+		if rec == http.ErrAbortHandler {
+			panic(rec)
+		}
+
+		reason := fmt.Errorf("panic: %v", rec)
+		h.logger.WithFields(logrus.Fields{
+			"method": req.Method,
+			"path":   req.URL.EscapedPath(),
+			"stack":  string(debug.Stack()),
+		}).Error(reason.Error())
+
+		if session, ok := SessionFromContext(req.Context()); ok {
+			session.ErrorResult = reason
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		ensureWeaveTimestamp(w.Header())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(WEAVE_UNKNOWN_ERROR))
+	}()
+
+	h.handler.ServeHTTP(w, req)
+}
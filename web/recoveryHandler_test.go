@@ -0,0 +1,54 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryHandler(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &MozlogFormatter{
+		Hostname: "test.localdomain",
+		Pid:      os.Getpid(),
+	}
+
+	panicker := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("something broke")
+	})
+
+	handler := NewRecoveryHandler(logger, panicker)
+	resp := request("GET", "/1.5/12345/info/collections", nil, handler)
+
+	assert.Equal(http.StatusInternalServerError, resp.Code)
+	assert.Equal("application/json", resp.Header().Get("Content-Type"))
+	assert.Equal(WEAVE_UNKNOWN_ERROR, resp.Body.String())
+	assert.NotEqual("", resp.Header().Get("X-Weave-Timestamp"))
+
+	var record mozlog
+	if !assert.NoError(json.Unmarshal(buf.Bytes(), &record), buf.String()) {
+		return
+	}
+
+	assert.Equal("panic: something broke", record.Fields["msg"])
+	assert.Equal("GET", record.Fields["method"])
+	assert.Equal(uint8(3), record.Severity)
+	if stack, ok := record.Fields["stack"].(string); assert.True(ok) {
+		assert.Contains(stack, "TestRecoveryHandler")
+	}
+
+	{ // requests that do not panic are untouched
+		handler := NewRecoveryHandler(logger, EchoHandler)
+		resp := request("GET", "/1.5/12345/info/collections", nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+	}
+}
@@ -0,0 +1,54 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// serverTimingWriter adds a Server-Timing header reporting how long a
+// request waited for the user's lock and how long it spent in the
+// storage layer before the response started. A nil *serverTimingWriter
+// is valid and does nothing
+type serverTimingWriter struct {
+	http.ResponseWriter
+
+	lockWait time.Duration
+	dbStart  time.Time
+	sent     bool
+}
+
+// startDB marks when the request starts using the database
+func (t *serverTimingWriter) startDB() {
+	if t == nil {
+		return
+	}
+	t.dbStart = time.Now()
+}
+
+func (t *serverTimingWriter) setHeader() {
+	if t.sent {
+		return
+	}
+	t.sent = true
+
+	value := fmt.Sprintf("lock;dur=%.2f", durationMS(t.lockWait))
+	if !t.dbStart.IsZero() {
+		value += fmt.Sprintf(", db;dur=%.2f", durationMS(time.Since(t.dbStart)))
+	}
+	t.Header().Set("Server-Timing", value)
+}
+
+func (t *serverTimingWriter) WriteHeader(code int) {
+	t.setHeader()
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *serverTimingWriter) Write(p []byte) (int, error) {
+	t.setHeader()
+	return t.ResponseWriter.Write(p)
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
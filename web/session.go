@@ -2,6 +2,7 @@ package web
 
 import (
 	"context"
+	"time"
 
 	"github.com/mozilla-services/go-syncstorage/token"
 )
@@ -13,6 +14,9 @@ var sKey sessionKey = 0
 type Session struct {
 	Token       token.TokenPayload
 	ErrorResult error
+
+	// AuthTime is how long the HawkHandler took to authenticate the request
+	AuthTime time.Duration
 }
 
 func NewSessionContext(ctx context.Context, ses *Session) context.Context {
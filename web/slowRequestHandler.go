@@ -0,0 +1,59 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// SlowRequestHandler logs requests that take longer than a threshold at
+// WARN level. The total time is broken down into the time spent on hawk
+// authentication and the time spent after it, when the request was
+// authenticated
+type SlowRequestHandler struct {
+	logger    logrus.FieldLogger
+	threshold time.Duration
+	handler   http.Handler
+}
+
+func NewSlowRequestHandler(l logrus.FieldLogger, threshold time.Duration, h http.Handler) *SlowRequestHandler {
+	return &SlowRequestHandler{
+		logger:    l,
+		threshold: threshold,
+		handler:   h,
+	}
+}
+
+func (h *SlowRequestHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// the HawkHandler records how long it took in the session
+	session, ok := SessionFromContext(req.Context())
+	if !ok {
+		session = &Session{}
+		req = req.WithContext(NewSessionContext(req.Context(), session))
+	}
+
+	logger := makeLogger(w)
+	start := time.Now()
+	h.handler.ServeHTTP(logger, req)
+	took := time.Since(start)
+
+	if took < h.threshold {
+		return
+	}
+
+	fields := logrus.Fields{
+		"method": req.Method,
+		"path":   req.URL.Path,
+		"code":   logger.Status(),
+		"t":      int(took / time.Millisecond),
+		"uid":    extractUID(req.URL.Path),
+	}
+
+	if session.AuthTime > 0 {
+		fields["auth_t"] = int(session.AuthTime / time.Millisecond)
+		fields["handler_t"] = int((took - session.AuthTime) / time.Millisecond)
+	}
+
+	h.logger.WithFields(fields).Warn("Slow request")
+}
@@ -0,0 +1,83 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowRequestHandler(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &MozlogFormatter{
+		Hostname: "test.localdomain",
+		Pid:      os.Getpid(),
+	}
+
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	{ // fast requests are not logged
+		handler := NewSlowRequestHandler(logger, time.Second, slow)
+		request("GET", "/1.5/12345/info/collections", nil, handler)
+		assert.Equal(0, buf.Len())
+	}
+
+	handler := NewSlowRequestHandler(logger, 20*time.Millisecond, slow)
+
+	{
+		request("GET", "/1.5/12345/info/collections", nil, handler)
+
+		var record mozlog
+		if !assert.NoError(json.Unmarshal(buf.Bytes(), &record), buf.String()) {
+			return
+		}
+
+		assert.Equal(uint8(4), record.Severity)
+		assert.Equal("Slow request", record.Fields["msg"])
+		assert.Equal("GET", record.Fields["method"])
+		assert.Equal("/1.5/12345/info/collections", record.Fields["path"])
+		assert.Equal("12345", record.Fields["uid"])
+		assert.Equal(float64(http.StatusTeapot), record.Fields["code"])
+		assert.True(record.Fields["t"].(float64) >= 30)
+
+		// no breakdown without hawk
+		assert.NotContains(record.Fields, "auth_t")
+		assert.NotContains(record.Fields, "handler_t")
+	}
+
+	{ // hawk authenticated requests have a breakdown
+		buf.Reset()
+
+		var uid uint64 = 12345
+		tok := testtoken("sekret", uid)
+		handler := NewSlowRequestHandler(logger, 20*time.Millisecond, NewHawkHandler(slow, []string{"sekret"}))
+
+		req, _ := hawkrequest("GET", syncurl(uid, "info/collections"), tok)
+		resp := sendrequest(req, handler)
+		if !assert.Equal(http.StatusTeapot, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		var record mozlog
+		if !assert.NoError(json.Unmarshal(buf.Bytes(), &record), buf.String()) {
+			return
+		}
+
+		assert.Contains(record.Fields, "auth_t")
+		if assert.Contains(record.Fields, "handler_t") {
+			assert.True(record.Fields["handler_t"].(float64) >= 30)
+		}
+	}
+}
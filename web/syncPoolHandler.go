@@ -4,7 +4,12 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -15,6 +20,9 @@ import (
 const (
 	conflictAttempts = 3
 	conflictSleep    = 250 * time.Millisecond
+
+	// seconds clients are asked to wait after an AcquireTimeout
+	acquireTimeoutRetryAfter = 10
 )
 
 type SyncPoolHandler struct {
@@ -30,15 +38,40 @@ type SyncPoolHandler struct {
 }
 
 type SyncPoolConfig struct {
-	Basepath    string
+	Basepath string
+
+	// Basepaths optionally stripes databases across multiple data
+	// directories, e.g. one per disk. When set Basepath is ignored.
+	// Users are assigned a directory by their uid so the list must
+	// not be reordered once it has data
+	Basepaths []string
+
 	NumPools    int
 	TTL         time.Duration
 	MaxPoolSize int
 
+	// PoolSizes optionally sets the max size of each pool so busier
+	// pools can be given more open files. It must have NumPools
+	// entries, otherwise every pool uses MaxPoolSize
+	PoolSizes []int
+
 	VacuumKB      int
 	PurgeMinHours int
 	PurgeMaxHours int
 
+	// PrewarmUsers is how many of the most recently active users have
+	// their databases opened at start up, 0 disables it. The users are
+	// saved to PrewarmFile when the handler is stopped
+	PrewarmUsers   int
+	PrewarmFile    string
+	PrewarmTimeout time.Duration
+
+	// AcquireTimeout is how long a request waits for other requests
+	// opening or closing databases in its pool, e.g. when the pool is
+	// full and has to close the least recently used ones. A 503 is
+	// returned when it takes longer. 0 waits forever
+	AcquireTimeout time.Duration
+
 	DBConfig *syncstorage.Config
 }
 
@@ -61,11 +94,21 @@ func NewSyncPoolHandler(config *SyncPoolConfig, userHandlerConfig *SyncUserHandl
 		userHandlerConfig = NewDefaultSyncUserHandlerConfig()
 	}
 
+	basepaths := config.Basepaths
+	if len(basepaths) == 0 {
+		basepaths = []string{config.Basepath}
+	}
+
 	pools := make([]*handlerPool, config.NumPools, config.NumPools)
 	for i := 0; i < config.NumPools; i++ {
+		maxPoolSize := config.MaxPoolSize
+		if len(config.PoolSizes) == config.NumPools {
+			maxPoolSize = config.PoolSizes[i]
+		}
+
 		pools[i] = newHandlerPool(
-			config.Basepath,
-			config.MaxPoolSize,
+			basepaths,
+			maxPoolSize,
 			config.DBConfig,
 			userHandlerConfig)
 	}
@@ -76,6 +119,8 @@ func NewSyncPoolHandler(config *SyncPoolConfig, userHandlerConfig *SyncUserHandl
 		userHandlerConfig: userHandlerConfig,
 	}
 
+	server.prewarm()
+
 	return server
 }
 
@@ -94,51 +139,64 @@ func (s *SyncPoolHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	var (
-		uid        string
-		element    *poolElement
-		newElement bool
-		err        error
-	)
-
+	var uid string
 	if session, ok := SessionFromContext(req.Context()); ok {
 		uid = session.Token.UidString()
 	}
 
 	if uid == "" {
-		sendRequestProblem(w, req, http.StatusBadRequest, errors.New("Pool: No UID"))
+		WeaveInvalidUser(w, req, errors.New("Pool: No UID"))
+		return
+	}
+
+	handler, err := s.getUserHandler(uid)
+	if err != nil {
+		if err == errElementStopped {
+			w.Header().Add("Retry-After", strconv.Itoa(60))
+			sendRequestProblem(w, req, http.StatusConflict,
+				errors.New("DB pool too busy"))
+		} else if err == errPoolTimeout {
+			poolTimeout(w, req, s.config.AcquireTimeout)
+		} else {
+			storageUnavailable(w, req, uid, err)
+		}
 		return
 	}
 
+	// pass it on
+	handler.ServeHTTP(w, req)
+}
+
+// getUserHandler returns the SyncUserHandler for uid. If the handler
+// is being cleaned up/closing it retries a few times before returning
+// errElementStopped
+func (s *SyncPoolHandler) getUserHandler(uid string) (*SyncUserHandler, error) {
+	var (
+		element    *poolElement
+		newElement bool
+		err        error
+	)
+
 	poolId := s.poolIndex(uid)
 
-	// if a request comes in while an element is being
-	// cleaned up/closing, we retry a few times before failing
 	for i := 1; i <= conflictAttempts; i++ {
-		element, newElement, err = s.pools[poolId].getElement(uid)
-		if err != nil {
-			if err == errElementStopped {
-
-				log.WithFields(log.Fields{
-					"uid":     uid,
-					"attempt": i,
-				}).Info("pool.getElement conflict")
-
-				if i == conflictAttempts {
-					w.Header().Add("Retry-After", strconv.Itoa(60))
-					sendRequestProblem(w, req, http.StatusConflict,
-						errors.New("DB pool too busy"))
-					return
-				}
-
-				time.Sleep(conflictSleep)
-			} else {
-				InternalError(w, req, errors.Wrap(err, "Could not get Pool Element"))
-				return
-			}
-		} else {
+		element, newElement, err = s.pools[poolId].getElementTimeout(uid, s.config.AcquireTimeout)
+		if err != errElementStopped {
 			break
 		}
+
+		log.WithFields(log.Fields{
+			"uid":     uid,
+			"attempt": i,
+		}).Info("pool.getElement conflict")
+
+		if i < conflictAttempts {
+			time.Sleep(conflictSleep)
+		}
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
 	if newElement {
@@ -148,8 +206,498 @@ func (s *SyncPoolHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			s.config.VacuumKB)
 	}
 
-	// pass it on
-	element.handler.ServeHTTP(w, req)
+	return element.handler, nil
+}
+
+// Vacuum compacts a single user's database on demand, e.g. after a
+// large delete. It returns the size of the database before and after
+// in kilobytes
+func (s *SyncPoolHandler) Vacuum(uid string) (beforeKB, afterKB int, err error) {
+	handler, err := s.getUserHandler(uid)
+	if err != nil {
+		return
+	}
+
+	return vacuumUser(handler)
+}
+
+// vacuumUser is Vacuum for a handler from the pool. The user's requests
+// wait until it is done
+func vacuumUser(handler *SyncUserHandler) (beforeKB, afterKB int, err error) {
+	handler.lock(0)
+	defer handler.unlock()
+
+	if handler.IsStopped() {
+		return 0, 0, errElementStopped
+	}
+
+	before, err := handler.db.Usage()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "Could not get usage before vacuum")
+	}
+
+	if err = handler.db.Vacuum(); err != nil {
+		return 0, 0, errors.Wrap(err, "Could not vacuum")
+	}
+
+	after, err := handler.db.Usage()
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "Could not get usage after vacuum")
+	}
+
+	return before.Total * before.Size / 1024, after.Total * after.Size / 1024, nil
+}
+
+// IterateBSOs calls fn with every unexpired BSO in one of uid's
+// collections, in no particular order. Rows are read as fn is called so
+// large collections are never loaded into memory at once. The user's
+// requests wait until it returns so fn must not make any. It stops at and
+// returns the first error from fn. Meant for tools like migrations and
+// integrity checks
+func (s *SyncPoolHandler) IterateBSOs(uid string, cId int, fn func(*syncstorage.BSO) error) error {
+	handler, err := s.getUserHandler(uid)
+	if err != nil {
+		return err
+	}
+
+	handler.lock(0)
+	defer handler.unlock()
+
+	if handler.IsStopped() {
+		return errElementStopped
+	}
+
+	_, err = handler.db.ForEachBSO(cId, nil, syncstorage.MaxTimestamp, 0, 0,
+		syncstorage.SORT_NONE, -1, 0, fn)
+	return err
+}
+
+// SetCollectionTTL makes all of uid's BSOs in a collection expire within
+// ttl seconds so the next purge removes them. They can not be read any
+// more when ttl is 0. It returns how many BSOs were changed
+func (s *SyncPoolHandler) SetCollectionTTL(uid string, cId int, ttl int) (int, error) {
+	handler, err := s.getUserHandler(uid)
+	if err != nil {
+		return 0, err
+	}
+
+	handler.lock(0)
+	defer handler.unlock()
+
+	if handler.IsStopped() {
+		return 0, errElementStopped
+	}
+
+	return handler.db.SetCollectionTTL(cId, ttl*1000)
+}
+
+// LastAccess returns when uid last made a request, the zero time if they
+// never have. Looking it up does not count as an access. Users without
+// a database get errNoDatabase
+func (s *SyncPoolHandler) LastAccess(uid string) (time.Time, error) {
+	if err := s.hasDatabase(uid); err != nil {
+		return time.Time{}, err
+	}
+
+	handler, err := s.getUserHandler(uid)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return handler.LastAccess()
+}
+
+// CopyUser copies all of srcUid's collections and BSOs to dstUid, keeping
+// their modified times, e.g. when moving a user to a new uid. dstUid must
+// not have any data, syncstorage.ErrNotEmpty is returned otherwise. Both
+// users' requests wait until the copy is done. It returns the number of
+// BSOs copied
+func (s *SyncPoolHandler) CopyUser(srcUid, dstUid string) (int, error) {
+	if !uidOk(srcUid) || !uidOk(dstUid) {
+		return 0, errors.New("Invalid uid")
+	}
+
+	if srcUid == dstUid {
+		return 0, errors.New("Can not copy a user to themselves")
+	}
+
+	if err := s.hasDatabase(srcUid); err != nil {
+		return 0, err
+	}
+
+	src, err := s.getUserHandler(srcUid)
+	if err != nil {
+		return 0, err
+	}
+
+	dst, err := s.getUserHandler(dstUid)
+	if err != nil {
+		return 0, err
+	}
+
+	// always lock in the same order so copies between the same two
+	// users in both directions can not deadlock
+	first, second := src, dst
+	if dstUid < srcUid {
+		first, second = dst, src
+	}
+
+	first.lock(0)
+	defer first.unlock()
+	second.lock(0)
+	defer second.unlock()
+
+	if src.IsStopped() || dst.IsStopped() {
+		return 0, errElementStopped
+	}
+
+	return src.db.CopyTo(dst.db)
+}
+
+// WriteBarrier is a syncstorage.WriteBarrier that also holds the user's
+// requests until it is committed or rolled back
+type WriteBarrier struct {
+	*syncstorage.WriteBarrier
+
+	handler *SyncUserHandler
+	release sync.Once
+}
+
+// Commit applies the changes and lets the user's requests continue
+func (w *WriteBarrier) Commit() error {
+	defer w.release.Do(w.handler.unlock)
+	return w.WriteBarrier.Commit()
+}
+
+// Rollback discards the changes and lets the user's requests continue.
+// It does nothing after Commit so it can be deferred
+func (w *WriteBarrier) Rollback() error {
+	defer w.release.Do(w.handler.unlock)
+	return w.WriteBarrier.Rollback()
+}
+
+// BeginWriteBarrier groups changes to uid's data into one transaction,
+// for admin actions that must not be seen half done. The user's requests
+// wait until Commit or Rollback is called
+func (s *SyncPoolHandler) BeginWriteBarrier(uid string) (*WriteBarrier, error) {
+	handler, err := s.getUserHandler(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	handler.lock(0)
+	if handler.IsStopped() {
+		handler.unlock()
+		return nil, errElementStopped
+	}
+
+	barrier, err := handler.db.BeginWriteBarrier()
+	if err != nil {
+		handler.unlock()
+		return nil, err
+	}
+
+	return &WriteBarrier{WriteBarrier: barrier, handler: handler}, nil
+}
+
+// UserStorage describes where a user's database is kept
+type UserStorage struct {
+	Uid           string           `json:"uid"`
+	Pool          int              `json:"pool"`
+	Path          string           `json:"path"`
+	SizeBytes     int64            `json:"size_bytes"`
+	Files         map[string]int64 `json:"files,omitempty"`
+	Collections   int              `json:"collections"`
+	SchemaVersion int              `json:"schema_version"`
+	LastAccess    string           `json:"last_access,omitempty"`
+}
+
+// DiskUsage is how much space a user's database takes on disk. This
+// includes sqlite's overhead, unlike the payload sizes in
+// info/collection_usage
+type DiskUsage struct {
+	Total int64
+	Files map[string]int64 // size of each file by its path
+}
+
+// DiskUsage returns the size of uid's database file and, when they
+// exist, its WAL and shared memory files. The database is not opened so
+// this is cheap enough to call for many users. errNoDatabase is returned
+// when the user does not have a database
+func (s *SyncPoolHandler) DiskUsage(uid string) (*DiskUsage, error) {
+	pool := s.pools[s.poolIndex(uid)]
+	if pool.inMemory() {
+		return nil, errors.New("Databases are in memory")
+	}
+
+	path, file := pool.PathAndFile(uid)
+	dbFile := filepath.Join(path, file)
+
+	usage := &DiskUsage{Files: make(map[string]int64)}
+	for _, name := range []string{dbFile, dbFile + "-wal", dbFile + "-shm"} {
+		stat, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			if name == dbFile {
+				return nil, errNoDatabase
+			}
+			continue
+		} else if err != nil {
+			return nil, errors.Wrap(err, "Could not stat database")
+		}
+
+		usage.Files[name] = stat.Size()
+		usage.Total += stat.Size()
+	}
+
+	return usage, nil
+}
+
+var errNoDatabase = errors.New("No database")
+
+// hasDatabase returns errNoDatabase when uid does not have a database
+// file yet. In memory databases are created as needed so they always exist
+func (s *SyncPoolHandler) hasDatabase(uid string) error {
+	pool := s.pools[s.poolIndex(uid)]
+	if pool.inMemory() {
+		return nil
+	}
+
+	path, file := pool.PathAndFile(uid)
+	if _, err := os.Stat(filepath.Join(path, file)); os.IsNotExist(err) {
+		return errNoDatabase
+	} else if err != nil {
+		return errors.Wrap(err, "Could not stat database")
+	}
+
+	return nil
+}
+
+// Inspect returns where uid's database is and some details about it.
+// errNoDatabase is returned instead of creating a database that does
+// not exist yet. SizeBytes is the DiskUsage total, 0 for in memory databases
+func (s *SyncPoolHandler) Inspect(uid string) (*UserStorage, error) {
+	index := s.poolIndex(uid)
+	pool := s.pools[index]
+
+	info := &UserStorage{Uid: uid, Pool: int(index)}
+
+	if err := s.hasDatabase(uid); err != nil {
+		return nil, err
+	}
+
+	inMemory := pool.inMemory()
+	if inMemory {
+		info.Path = ":memory:"
+	} else {
+		path, file := pool.PathAndFile(uid)
+		info.Path = filepath.Join(path, file)
+	}
+
+	handler, err := s.getUserHandler(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	// LastAccess takes the lock itself so it is only held for these
+	err = func() error {
+		handler.lock(0)
+		defer handler.unlock()
+
+		if handler.IsStopped() {
+			return errElementStopped
+		}
+
+		counts, err := handler.db.InfoCollectionCounts()
+		if err != nil {
+			return errors.Wrap(err, "Could not count collections")
+		}
+		info.Collections = len(counts)
+
+		if info.SchemaVersion, err = handler.db.SchemaVersion(); err != nil {
+			return errors.Wrap(err, "Could not get schema version")
+		}
+
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	lastAccess, err := handler.LastAccess()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get last access")
+	}
+	if !lastAccess.IsZero() {
+		info.LastAccess = lastAccess.UTC().Format(time.RFC3339)
+	}
+
+	if !inMemory {
+		usage, err := s.DiskUsage(uid)
+		if err != nil {
+			return nil, err
+		}
+		info.SizeBytes = usage.Total
+		info.Files = usage.Files
+	}
+
+	return info, nil
+}
+
+// ListUsers returns up to limit uids, in numeric order, that have a
+// database and come after the uid after. Pass the last uid returned to get
+// the next page. Only files in the location PathAndFile expects are listed.
+// The data directories are walked for every page but at most 2*limit uids
+// are kept in memory
+func (s *SyncPoolHandler) ListUsers(after string, limit int) ([]string, error) {
+	if limit < 1 {
+		return nil, errors.New("limit must be > 0")
+	}
+
+	pool := s.pools[0]
+	if pool.inMemory() {
+		return nil, errors.New("Databases are in memory")
+	}
+
+	uidLess := func(a, b string) bool {
+		return len(a) < len(b) || (len(a) == len(b) && a < b)
+	}
+
+	var uids []string
+	trim := func() {
+		sort.Slice(uids, func(i, j int) bool { return uidLess(uids[i], uids[j]) })
+		if len(uids) > limit {
+			uids = uids[:limit]
+		}
+	}
+
+	for _, base := range pool.bases {
+		root := string(os.PathSeparator) + filepath.Join(base...)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if info.IsDir() || !strings.HasSuffix(info.Name(), ".db") {
+				return nil
+			}
+
+			uid := strings.TrimSuffix(info.Name(), ".db")
+			if !uidOk(uid) || !uidLess(after, uid) {
+				return nil
+			}
+
+			if dir, _ := pool.PathAndFile(uid); dir != filepath.Dir(path) {
+				return nil
+			}
+
+			uids = append(uids, uid)
+			if len(uids) >= 2*limit {
+				trim()
+			}
+			return nil
+		})
+
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not list users")
+		}
+	}
+
+	trim()
+	return uids, nil
+}
+
+// DeleteEverythingConfirmation must be passed to DeleteEverything
+const DeleteEverythingConfirmation = "delete all users"
+
+var errNotConfirmed = errors.New("Not confirmed")
+
+// DeleteEverything removes every user's database. It is meant for resetting
+// test and staging servers and refuses to run unless confirm is
+// DeleteEverythingConfirmation. Requests made while it runs may recreate
+// some databases so traffic should be stopped first. It returns the uids
+// of the users removed, including the ones removed before an error
+func (s *SyncPoolHandler) DeleteEverything(confirm string) (removed []string, err error) {
+	if confirm != DeleteEverythingConfirmation {
+		return nil, errNotConfirmed
+	}
+
+	// close all the open databases, in memory ones are gone after this
+	inMemory := s.pools[0].inMemory()
+	for _, p := range s.pools {
+		if inMemory {
+			p.Lock()
+			for e := p.lru.Front(); e != nil; e = e.Next() {
+				removed = append(removed, e.Value.(*poolElement).uid)
+			}
+			p.Unlock()
+		}
+		p.stopHandlers()
+	}
+
+	if inMemory {
+		return removed, nil
+	}
+
+	// every page is removed so always list from the start
+	for {
+		uids, err := s.ListUsers("", 1000)
+		if err != nil {
+			return removed, err
+		}
+
+		if len(uids) == 0 {
+			return removed, nil
+		}
+
+		for _, uid := range uids {
+			path, file := s.pools[s.poolIndex(uid)].PathAndFile(uid)
+			for _, suffix := range []string{"", "-wal", "-shm"} {
+				err := os.Remove(filepath.Join(path, file+suffix))
+				if err != nil && !os.IsNotExist(err) {
+					return removed, errors.Wrapf(err, "Could not remove database for %s", uid)
+				}
+			}
+			removed = append(removed, uid)
+		}
+	}
+}
+
+// uidOk checks that uid is only digits
+func uidOk(uid string) bool {
+	if uid == "" {
+		return false
+	}
+	for _, c := range uid {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// storageUnavailable is sent when a uid's database can not be opened,
+// e.g. its data directory is unavailable. Only uids using that storage
+// are affected so a 503 is returned instead of failing the whole server
+func storageUnavailable(w http.ResponseWriter, r *http.Request, uid string, err error) {
+	log.WithFields(log.Fields{
+		"uid":   uid,
+		"cause": errors.Cause(err).Error(),
+	}).Errorf("Pool: storage unavailable: %s", err.Error())
+
+	w.Header().Set("Retry-After", strconv.Itoa(60))
+	sendRequestProblem(w, r, http.StatusServiceUnavailable,
+		errors.New("Storage unavailable"))
+}
+
+// poolTimeout is sent when a request waited longer than AcquireTimeout
+// for the user's pool, failing fast instead of piling up requests
+func poolTimeout(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(acquireTimeoutRetryAfter))
+	sendRequestProblem(w, r, http.StatusServiceUnavailable,
+		errors.Wrapf(errPoolTimeout, "Waited more than %s", timeout))
 }
 
 // Stop immediately stops serving web requests and then it
@@ -160,6 +708,13 @@ func (s *SyncPoolHandler) StopHTTP() {
 	}
 
 	s.StoppableHandler.StopHTTP()
+
+	if err := s.savePrewarmList(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err.Error(),
+		}).Error("Pool: could not save prewarm list")
+	}
+
 	for _, p := range s.pools {
 		p.stopHandlers()
 	}
@@ -2,6 +2,8 @@ package web
 
 import (
 	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -16,6 +18,10 @@ import (
 
 var (
 	errElementStopped = errors.New("handler is Stopped")
+
+	// errPoolTimeout is returned when a pool is busy opening or closing
+	// databases for longer than SyncPoolConfig.AcquireTimeout
+	errPoolTimeout = errors.New("Timed out waiting for the pool")
 )
 
 func init() {
@@ -35,7 +41,9 @@ type poolElement struct {
 type handlerPool struct {
 	sync.Mutex
 
-	base     []string
+	// bases are the data directories databases are striped across,
+	// split into path components
+	bases    [][]string
 	elements map[string]*poolElement
 
 	// lru keeps a list with the recently used elements in Front and the
@@ -46,19 +54,25 @@ type handlerPool struct {
 	// the max size of the pool
 	maxPoolSize int
 
+	// acquire is held with the mutex while getting an element so
+	// waiting for it, unlike the mutex, can time out
+	acquire chan struct{}
+
 	// Configurations
 	dbConfig          *syncstorage.Config
 	userHandlerConfig *SyncUserHandlerConfig
 }
 
-func newHandlerPool(basepath string, maxPoolSize int, dbConfig *syncstorage.Config, userHandlerConfig *SyncUserHandlerConfig) *handlerPool {
+func newHandlerPool(basepaths []string, maxPoolSize int, dbConfig *syncstorage.Config, userHandlerConfig *SyncUserHandlerConfig) *handlerPool {
 
-	var path []string
+	bases := make([][]string, len(basepaths))
+	for i, basepath := range basepaths {
+		// support in-memory only sqlite3 databases for testing
+		if basepath == ":memory:" {
+			bases[i] = []string{":memory:"}
+			continue
+		}
 
-	// support in-memory only sqlite3 databases for testing
-	if basepath == ":memory:" {
-		path = []string{":memory:"}
-	} else {
 		newBasePath, err := filepath.Abs(basepath)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -67,18 +81,19 @@ func newHandlerPool(basepath string, maxPoolSize int, dbConfig *syncstorage.Conf
 			}).Panic("Could not determine absolute basepath")
 		}
 
-		path = strings.Split(
+		bases[i] = strings.Split(
 			filepath.Clean(newBasePath),
 			string(os.PathSeparator),
 		)
 	}
 
 	pool := &handlerPool{
-		base:              path,
+		bases:             bases,
 		elements:          make(map[string]*poolElement),
 		lru:               list.New(),
 		lrumap:            make(map[string]*list.Element),
 		maxPoolSize:       maxPoolSize,
+		acquire:           make(chan struct{}, 1),
 		dbConfig:          dbConfig,
 		userHandlerConfig: userHandlerConfig,
 	}
@@ -111,22 +126,62 @@ func (p *handlerPool) stopHandlers() {
 	p.cleanupHandlers(p.lru.Len())
 }
 
+// lock holds the pool's mutex. It returns false if other requests held
+// it for longer than timeout. A timeout of 0 waits forever
+func (p *handlerPool) lock(timeout time.Duration) bool {
+	if timeout <= 0 {
+		p.acquire <- struct{}{}
+	} else {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case p.acquire <- struct{}{}:
+		case <-timer.C:
+			return false
+		}
+	}
+
+	p.Lock()
+	return true
+}
+
+func (p *handlerPool) unlock() {
+	p.Unlock()
+	<-p.acquire
+}
+
 // getElement returns the requested poolElement and if it had to create a new one
 // to fulfill the request
 func (p *handlerPool) getElement(uid string) (*poolElement, bool, error) {
+	return p.getElementTimeout(uid, 0)
+}
+
+// getElementTimeout is getElement but returns errPoolTimeout when it has
+// to wait longer than timeout for other requests opening databases in
+// the pool. 0 waits forever
+func (p *handlerPool) getElementTimeout(uid string, timeout time.Duration) (*poolElement, bool, error) {
 	var (
 		element *poolElement
 		ok      bool
 		dbFile  string
 	)
 
-	p.Lock()
-	defer p.Unlock()
+	if !p.lock(timeout) {
+		return nil, false, errPoolTimeout
+	}
+
+	locked := true
+	defer func() {
+		if locked {
+			p.unlock()
+		}
+	}()
 
 	elementCreated := false
 
 	if element, ok = p.elements[uid]; !ok {
-		if len(p.base) == 1 && p.base[0] == ":memory:" {
+		if p.inMemory() {
 			dbFile = ":memory:"
 		} else {
 			storageDir, filename := p.PathAndFile(uid)
@@ -144,10 +199,17 @@ func (p *handlerPool) getElement(uid string) (*poolElement, bool, error) {
 
 		if p.lru.Len() > p.maxPoolSize {
 			// nasty, kinda low level locking. Since p.cleanuphandlers also
-			// locks, unlock/lock here to avoid deadlocks
-			p.Unlock()
+			// locks, unlock/lock here to avoid deadlocks. It also keeps
+			// lookups of open databases from waiting on slow evictions
+			p.unlock()
+			locked = false
+
 			p.cleanupHandlers(1 + p.maxPoolSize/10) // clean up ~10%
-			p.Lock()
+
+			if !p.lock(timeout) {
+				return nil, false, errPoolTimeout
+			}
+			locked = true
 		}
 
 		db, err := syncstorage.NewDB(dbFile, p.dbConfig)
@@ -177,16 +239,36 @@ func (p *handlerPool) getElement(uid string) (*poolElement, bool, error) {
 	return element, elementCreated, nil
 }
 
+// inMemory checks if the pool's databases are in memory instead of files
+func (p *handlerPool) inMemory() bool {
+	return len(p.bases) == 1 && p.bases[0][0] == ":memory:"
+}
+
 func (p *handlerPool) PathAndFile(uid string) (path string, file string) {
+	base := p.bases[dataDirIndex(uid, len(p.bases))]
 	path = string(os.PathSeparator) +
 		filepath.Join(
-			append(p.base, TwoLevelPath(uid)...)...,
+			append(append([]string{}, base...), TwoLevelPath(uid)...)...,
 		)
 
 	file = uid + ".db"
 	return
 }
 
+// dataDirIndex picks which of n data directories a uid's database lives
+// in. It only depends on the uid so a database never moves when the number
+// of pools changes. Changing the number of data directories does move them.
+func dataDirIndex(uid string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+
+	// use different bytes of the sum than poolIndex so the two
+	// are independent of each other
+	h := sha1.Sum([]byte(uid))
+	return int(binary.BigEndian.Uint32(h[:4]) % uint32(n))
+}
+
 // TwoLevelPath creates a reverse sub-directory path structure
 // e.g. uid:123456 => DATA_ROOT/65/43/123456.db
 func TwoLevelPath(uid string) []string {
@@ -3,6 +3,8 @@ package web
 import (
 	"fmt"
 	"io/ioutil"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -29,7 +31,7 @@ func TestTwoLevelPath(t *testing.T) {
 
 func TestHandlerPoolPathAndFile(t *testing.T) {
 	assert := assert.New(t)
-	handler := newHandlerPool("/tmp", 1, nil, nil)
+	handler := newHandlerPool([]string{"/tmp"}, 1, nil, nil)
 
 	{
 		path, filename := (handler.PathAndFile("12345"))
@@ -52,7 +54,7 @@ func TestHandlerPoolGetElement(t *testing.T) {
 		return
 	}
 
-	handler := newHandlerPool(tmpdir, 1, nil, nil)
+	handler := newHandlerPool([]string{tmpdir}, 1, nil, nil)
 	el, created, err := handler.getElement("123456")
 	if assert.NoError(err) {
 		assert.NotEmpty(el)
@@ -64,7 +66,7 @@ func TestHandlerPoolGetElementParallel(t *testing.T) {
 	t.Parallel()
 
 	assert := assert.New(t)
-	handler := newHandlerPool(":memory:", 2, nil, nil)
+	handler := newHandlerPool([]string{":memory:"}, 2, nil, nil)
 
 	stop := make(chan struct{})
 	errChan := make(chan error)
@@ -121,3 +123,42 @@ func TestHandlerPoolGetElementParallel(t *testing.T) {
 	}
 
 }
+
+func TestHandlerPoolDataDirs(t *testing.T) {
+	assert := assert.New(t)
+
+	dirs := []string{"/data0", "/data1", "/data2", "/data3"}
+	handler := newHandlerPool(dirs, 1, nil, nil)
+
+	// a fresh pool, e.g. after a restart, puts users in the same place
+	handler2 := newHandlerPool(dirs, 1, nil, nil)
+
+	numUsers := 10000
+	counts := make(map[string]int)
+	for i := 0; i < numUsers; i++ {
+		uid := strconv.Itoa(100000 + i)
+		path, _ := handler.PathAndFile(uid)
+
+		path2, _ := handler2.PathAndFile(uid)
+		if !assert.Equal(path, path2) {
+			return
+		}
+
+		dir := "/" + strings.Split(path, "/")[1]
+		counts[dir]++
+	}
+
+	// should be roughly even across every directory
+	if assert.Len(counts, len(dirs)) {
+		expected := numUsers / len(dirs)
+		for dir, count := range counts {
+			assert.InDelta(expected, count, float64(expected)/10, dir)
+		}
+	}
+
+	{ // still uses the two level sharding under each data dir
+		path, filename := handler.PathAndFile("12345")
+		assert.Equal(dirs[dataDirIndex("12345", len(dirs))]+"/54/32", path)
+		assert.Equal("12345.db", filename)
+	}
+}
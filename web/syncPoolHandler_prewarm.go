@@ -0,0 +1,119 @@
+package web
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// defaultPrewarmTimeout is used when SyncPoolConfig.PrewarmTimeout is 0
+const defaultPrewarmTimeout = 10 * time.Second
+
+// recentUids returns up to max uids with an open database, the most
+// recently used first. The pools are interleaved so each one's most
+// recent users come before any pool's older ones
+func (s *SyncPoolHandler) recentUids(max int) []string {
+	lists := make([][]string, len(s.pools))
+	for i, p := range s.pools {
+		p.Lock()
+		for e := p.lru.Front(); e != nil && len(lists[i]) < max; e = e.Next() {
+			lists[i] = append(lists[i], e.Value.(*poolElement).uid)
+		}
+		p.Unlock()
+	}
+
+	uids := make([]string, 0, max)
+	for i := 0; len(uids) < max; i++ {
+		added := false
+		for _, list := range lists {
+			if i < len(list) && len(uids) < max {
+				uids = append(uids, list[i])
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+
+	return uids
+}
+
+// savePrewarmList writes the most recently active uids to
+// config.PrewarmFile, one per line, so the next start can open them
+func (s *SyncPoolHandler) savePrewarmList() error {
+	if s.config.PrewarmUsers <= 0 || s.config.PrewarmFile == "" {
+		return nil
+	}
+
+	uids := s.recentUids(s.config.PrewarmUsers)
+
+	// write then rename so a crash does not leave a partial list
+	tmp := s.config.PrewarmFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(uids, "\n")), 0644); err != nil {
+		return errors.Wrap(err, "Could not write prewarm list")
+	}
+
+	return errors.Wrap(os.Rename(tmp, s.config.PrewarmFile), "Could not replace prewarm list")
+}
+
+// prewarm opens the databases of the users in config.PrewarmFile so the
+// first requests after a start do not have to. Users without a database
+// are skipped. It gives up after config.PrewarmTimeout so a long list
+// or slow disks do not hold up starting the server
+func (s *SyncPoolHandler) prewarm() {
+	// in memory databases do not outlive the server, there is nothing to open
+	if s.config.PrewarmUsers <= 0 || s.config.PrewarmFile == "" || s.pools[0].inMemory() {
+		return
+	}
+
+	data, err := ioutil.ReadFile(s.config.PrewarmFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithFields(log.Fields{
+				"err": err.Error(),
+			}).Warn("Pool: could not read prewarm list")
+		}
+		return
+	}
+
+	timeout := s.config.PrewarmTimeout
+	if timeout <= 0 {
+		timeout = defaultPrewarmTimeout
+	}
+
+	start := time.Now()
+	opened := 0
+	for _, uid := range strings.Split(string(data), "\n") {
+		if opened >= s.config.PrewarmUsers || time.Since(start) > timeout {
+			break
+		}
+
+		if !uidOk(uid) {
+			continue
+		}
+
+		// don't create databases for users that have been purged
+		if err := s.hasDatabase(uid); err != nil {
+			continue
+		}
+
+		if _, err := s.getUserHandler(uid); err != nil {
+			log.WithFields(log.Fields{
+				"uid": uid,
+				"err": err.Error(),
+			}).Warn("Pool: could not prewarm database")
+			continue
+		}
+		opened++
+	}
+
+	log.WithFields(log.Fields{
+		"opened": opened,
+		"t":      time.Since(start).Nanoseconds() / 1000 / 1000,
+	}).Info("Pool: prewarmed databases")
+}
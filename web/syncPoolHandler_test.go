@@ -1,9 +1,19 @@
 package web
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -44,6 +54,84 @@ func TestSyncPoolHandlerStatusConflict(t *testing.T) {
 	assert.NotEqual("", retryAfter)
 }
 
+func TestSyncPoolHandlerAcquireTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	config := testSyncPoolConfig()
+	config.AcquireTimeout = 20 * time.Millisecond
+	handler := NewSyncPoolHandler(config, nil)
+
+	// simulate another request busy opening or closing databases
+	handler.pools[0].acquire <- struct{}{}
+
+	start := time.Now()
+	url := syncurl(uid, "info/collections")
+	resp := request("GET", url, nil, handler)
+	assert.Equal(http.StatusServiceUnavailable, resp.Code, resp.Body.String())
+	assert.Equal(strconv.Itoa(acquireTimeoutRetryAfter), resp.Header().Get("Retry-After"))
+	assert.True(time.Since(start) < time.Second, "should fail fast")
+
+	_, err := handler.getUserHandler(uid)
+	assert.Equal(errPoolTimeout, err)
+
+	// works once the pool is free again
+	<-handler.pools[0].acquire
+	resp = request("GET", url, nil, handler)
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+}
+
+func TestSyncPoolHandlerAcquireDuringEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	config := testSyncPoolConfig()
+	config.MaxPoolSize = 2
+	config.AcquireTimeout = 100 * time.Millisecond
+	handler := NewSyncPoolHandler(config, nil)
+	pool := handler.pools[0]
+
+	oldest := uniqueUID()
+	cached := uniqueUID()
+	pool.getElement(oldest)
+	pool.getElement(uniqueUID())
+	pool.getElement(cached)
+	assert.Equal(3, pool.lru.Len())
+
+	// make evicting the oldest handler slow by holding its request lock
+	oldestElement, _, err := pool.getElement(oldest)
+	if !assert.NoError(err) {
+		return
+	}
+	pool.lru.MoveToBack(pool.lrumap[oldest])
+	oldestElement.handler.lock(0)
+
+	done := make(chan struct{})
+	go func() {
+		pool.getElementTimeout(uniqueUID(), 0) // pool is full, evicts oldest
+		close(done)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	// an open database is found without waiting for the eviction
+	start := time.Now()
+	el, created, err := pool.getElementTimeout(cached, config.AcquireTimeout)
+	assert.NoError(err)
+	assert.False(created)
+	assert.Equal(cached, el.uid)
+	assert.True(time.Since(start) < config.AcquireTimeout, "should not wait for eviction")
+
+	select {
+	case <-done:
+		assert.Fail("eviction should still be blocked")
+	default:
+	}
+
+	oldestElement.handler.unlock()
+	<-done
+	assert.True(oldestElement.handler.IsStopped())
+}
+
 func TestSyncPoolHandlerStop(t *testing.T) {
 	assert := assert.New(t)
 	handler := NewSyncPoolHandler(testSyncPoolConfig(), nil)
@@ -75,6 +163,24 @@ func TestSyncPoolHandlerStop(t *testing.T) {
 	}
 }
 
+func TestSyncPoolHandlerNoUID(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+
+	// without hawk there is no session to get the uid from
+	for _, handler := range []http.Handler{pool, NewCacheHandler(pool, DefaultCacheHandlerConfig)} {
+		req, _ := http.NewRequest("GET", syncurl(uniqueUID(), "info/collections"), nil)
+		resp := sendrequest(req, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code)
+		assert.Equal("application/json", resp.Header().Get("Content-Type"))
+		assert.Equal(WEAVE_INVALID_USER, resp.Body.String())
+	}
+
+	// and the request did not reach a user's database
+	assert.Len(pool.pools[0].elements, 0)
+}
+
 func TestSyncPoolHandlerLRU(t *testing.T) {
 	assert := assert.New(t)
 
@@ -145,3 +251,397 @@ func TestSyncPoolPassesConfigToUserHandler(t *testing.T) {
 	assert.Equal(el.handler.config.MaxBatchTTL, 6)
 	assert.Equal(el.handler.config.MaxRecordPayloadBytes, 7)
 }
+
+func TestSyncPoolHandlerPoolSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	{ // default, every pool gets MaxPoolSize
+		config := testSyncPoolConfig()
+		config.NumPools = 3
+		handler := NewSyncPoolHandler(config, nil)
+		for _, p := range handler.pools {
+			assert.Equal(config.MaxPoolSize, p.maxPoolSize)
+		}
+	}
+
+	{ // wrong number of sizes is ignored
+		config := testSyncPoolConfig()
+		config.NumPools = 3
+		config.PoolSizes = []int{1, 2}
+		handler := NewSyncPoolHandler(config, nil)
+		for _, p := range handler.pools {
+			assert.Equal(config.MaxPoolSize, p.maxPoolSize)
+		}
+	}
+
+	config := testSyncPoolConfig()
+	config.NumPools = 2
+	config.PoolSizes = []int{2, 8}
+	handler := NewSyncPoolHandler(config, nil)
+
+	if !assert.Equal(2, handler.pools[0].maxPoolSize) || !assert.Equal(8, handler.pools[1].maxPoolSize) {
+		return
+	}
+
+	// open a lot of users in each pool
+	opened := []int{0, 0}
+	for opened[0] < 20 || opened[1] < 20 {
+		uid := uniqueUID()
+		resp := request("GET", syncurl(uid, "info/collections"), nil, handler)
+		if !assert.Equal(http.StatusOK, resp.Code) {
+			return
+		}
+		opened[handler.poolIndex(uid)]++
+	}
+
+	// pools clean up once they grow past their max size
+	for i, size := range config.PoolSizes {
+		assert.True(handler.pools[i].lru.Len() <= size+1,
+			"pool %d has %d open", i, handler.pools[i].lru.Len())
+	}
+	assert.True(handler.pools[1].lru.Len() > handler.pools[0].lru.Len())
+}
+
+func TestSyncPoolHandlerPoolUnavailable(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// a regular file where a data directory is expected makes
+	// creating the user's directory fail
+	broken := filepath.Join(tmpdir, "broken")
+	if !assert.NoError(ioutil.WriteFile(broken, nil, 0644)) {
+		return
+	}
+
+	config := NewDefaultSyncPoolConfig(tmpdir)
+	config.NumPools = 2
+	handler := NewSyncPoolHandler(config, nil)
+	defer handler.StopHTTP()
+	handler.pools[1] = newHandlerPool([]string{broken}, config.MaxPoolSize, config.DBConfig, nil)
+
+	var healthyUid, brokenUid string
+	for healthyUid == "" || brokenUid == "" {
+		uid := uniqueUID()
+		if handler.poolIndex(uid) == 0 {
+			healthyUid = uid
+		} else {
+			brokenUid = uid
+		}
+	}
+
+	resp := request("GET", syncurl(healthyUid, "info/collections"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+	resp = request("GET", syncurl(brokenUid, "info/collections"), nil, handler)
+	assert.Equal(http.StatusServiceUnavailable, resp.Code)
+	assert.NotEqual("", resp.Header().Get("Retry-After"))
+
+	// the healthy pool keeps working after the failure
+	resp = request("GET", syncurl(healthyUid, "info/collections"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+}
+
+func TestSyncPoolHandlerDiskUsage(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	pool := NewSyncPoolHandler(NewDefaultSyncPoolConfig(tmpdir), nil)
+	defer pool.StopHTTP()
+
+	uid := uniqueUID()
+	_, err = pool.DiskUsage(uid)
+	assert.Equal(errNoDatabase, err)
+
+	// 100 BSOs with 10KB payloads
+	dataSize := int64(100 * 10 * 1024)
+	payload := strings.Repeat("1234567890", 1024)
+	for i := 0; i < 100; i++ {
+		body := bytes.NewBufferString(fmt.Sprintf(`{"payload":"%s"}`, payload))
+		resp := jsonrequest("PUT", syncurl(uid, fmt.Sprintf("storage/test/b%d", i)), body, pool)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+	}
+
+	usage, err := pool.DiskUsage(uid)
+	if !assert.NoError(err) {
+		return
+	}
+
+	var sum int64
+	for _, size := range usage.Files {
+		sum += size
+	}
+	assert.Equal(usage.Total, sum)
+
+	// the data plus sqlite's overhead. The WAL is only checkpointed
+	// every 1000 pages so it can hold a few MB on its own
+	walLimit := int64(1000 * 4096)
+	assert.True(usage.Total > dataSize, "%d <= %d", usage.Total, dataSize)
+	assert.True(usage.Total < dataSize+2*walLimit, "%d too large", usage.Total)
+
+	path, file := pool.pools[pool.poolIndex(uid)].PathAndFile(uid)
+	assert.Contains(usage.Files, filepath.Join(path, file))
+
+	_, err = NewSyncPoolHandler(testSyncPoolConfig(), nil).DiskUsage(uid)
+	assert.Error(err)
+}
+
+func TestSyncPoolHandlerIterateBSOs(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	uid := uniqueUID()
+
+	handler, err := pool.getUserHandler(uid)
+	if !assert.NoError(err) {
+		return
+	}
+
+	cId, err := handler.db.CreateCollection("large")
+	if !assert.NoError(err) {
+		return
+	}
+
+	numBSOs := 5000
+	payload := "payload"
+	for i := 0; i < numBSOs; i += 100 {
+		input := make(syncstorage.PostBSOInput, 0, 100)
+		for j := i; j < i+100; j++ {
+			input = append(input, syncstorage.NewPutBSOInput(fmt.Sprintf("b%d", j), &payload, nil, nil))
+		}
+		if _, err := handler.db.PostBSOs(cId, input); !assert.NoError(err) {
+			return
+		}
+	}
+
+	seen := make(map[string]bool)
+	err = pool.IterateBSOs(uid, cId, func(b *syncstorage.BSO) error {
+		seen[b.Id] = true
+		assert.Equal(payload, b.Payload)
+		return nil
+	})
+	if assert.NoError(err) {
+		assert.Len(seen, numBSOs)
+	}
+
+	{ // stops at the first error
+		stop := errors.New("stop")
+		count := 0
+		err := pool.IterateBSOs(uid, cId, func(b *syncstorage.BSO) error {
+			count++
+			if count == 10 {
+				return stop
+			}
+			return nil
+		})
+		assert.Equal(stop, err)
+		assert.Equal(10, count)
+	}
+
+	{ // the user's requests wait for it
+		done := make(chan struct{})
+		started := false
+		err := pool.IterateBSOs(uid, cId, func(b *syncstorage.BSO) error {
+			if !started {
+				started = true
+				go func() {
+					request("GET", syncurl(uid, "info/collections"), nil, pool)
+					close(done)
+				}()
+				time.Sleep(20 * time.Millisecond)
+				select {
+				case <-done:
+					assert.Fail("request should wait")
+				default:
+				}
+			}
+			return nil
+		})
+		assert.NoError(err)
+		<-done
+	}
+
+	{ // a stopped handler's database is not used
+		handler.StopHTTP()
+		err := pool.IterateBSOs(uid, cId, func(b *syncstorage.BSO) error { return nil })
+		assert.Equal(errElementStopped, err)
+	}
+}
+
+func TestSyncPoolHandlerPrewarm(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	config := NewDefaultSyncPoolConfig(tmpdir)
+	config.NumPools = 1
+	config.PrewarmUsers = 3
+	config.PrewarmFile = filepath.Join(tmpdir, "prewarm_uids")
+
+	uids := []string{uniqueUID(), uniqueUID(), uniqueUID(), uniqueUID()}
+
+	{ // nothing to prewarm on the first start
+		pool := NewSyncPoolHandler(config, nil)
+		assert.Len(pool.pools[0].elements, 0)
+
+		for _, uid := range uids {
+			resp := request("GET", syncurl(uid, "info/collections"), nil, pool)
+			if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+				return
+			}
+		}
+
+		pool.StopHTTP()
+	}
+
+	data, err := ioutil.ReadFile(config.PrewarmFile)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// the most recently active users first
+	assert.Equal([]string{uids[3], uids[2], uids[1]}, strings.Split(string(data), "\n"))
+
+	// users without a database are not created
+	missing := uniqueUID()
+	data = append([]byte(missing+"\n"), data...)
+	if !assert.NoError(ioutil.WriteFile(config.PrewarmFile, data, 0644)) {
+		return
+	}
+
+	pool := NewSyncPoolHandler(config, nil)
+	defer pool.StopHTTP()
+
+	// opened before the first request
+	elements := pool.pools[0].elements
+	assert.Len(elements, 3)
+	for _, uid := range uids[1:] {
+		assert.Contains(elements, uid)
+	}
+	assert.NotContains(elements, uids[0])
+	assert.NotContains(elements, missing)
+
+	_, err = pool.DiskUsage(missing)
+	assert.Equal(errNoDatabase, err)
+}
+
+func TestSyncPoolHandlerLastAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	tmpdir, err := ioutil.TempDir("", "")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	config := NewDefaultSyncPoolConfig(tmpdir)
+	userConfig := NewDefaultSyncUserHandlerConfig()
+	userConfig.LastAccessInterval = time.Hour
+
+	uid := uniqueUID()
+	pool := NewSyncPoolHandler(config, userConfig)
+
+	_, err = pool.LastAccess(uid)
+	assert.Equal(errNoDatabase, err)
+
+	before := time.Now()
+	resp := request("GET", syncurl(uid, "info/collections"), nil, pool)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	first, err := pool.LastAccess(uid)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.False(first.Before(before))
+
+	time.Sleep(5 * time.Millisecond)
+	resp = request("GET", syncurl(uid, "info/collections"), nil, pool)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	second, err := pool.LastAccess(uid)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(second.After(first), "%s not after %s", second, first)
+
+	// only the first request was written within the interval
+	handler, _ := pool.getUserHandler(uid)
+	saved, _ := handler.db.GetKey(lastAccessKey)
+	assert.Equal(first.UTC().Format(time.RFC3339Nano), saved)
+
+	info, err := pool.Inspect(uid)
+	if assert.NoError(err) {
+		assert.Equal(second.UTC().Format(time.RFC3339), info.LastAccess)
+	}
+
+	// the latest is saved when the database is closed
+	pool.StopHTTP()
+	pool = NewSyncPoolHandler(config, userConfig)
+	defer pool.StopHTTP()
+
+	reopened, err := pool.LastAccess(uid)
+	if assert.NoError(err) {
+		assert.True(second.Equal(reopened), "%s != %s", second, reopened)
+	}
+}
+
+func TestSyncPoolHandlerWriteBarrier(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	uid := uniqueUID()
+
+	barrier, err := pool.BeginWriteBarrier(uid)
+	if !assert.NoError(err) {
+		return
+	}
+
+	cId, _ := barrier.CreateCollection("col")
+	assert.NoError(barrier.PutBSO(cId, "b0", syncstorage.String("grouped"), nil, nil))
+
+	// the user's requests wait for the barrier
+	done := make(chan string)
+	go func() {
+		done <- request("GET", syncurl(uid, "storage/col"), nil, pool).Body.String()
+	}()
+
+	select {
+	case <-done:
+		assert.Fail("request was not blocked")
+		return
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(barrier.Commit())
+	assert.Equal(`["b0"]`, <-done)
+
+	// a rollback releases the user too
+	barrier, err = pool.BeginWriteBarrier(uid)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(barrier.DeleteCollection(cId))
+	assert.NoError(barrier.Rollback())
+	assert.NoError(barrier.Rollback())
+
+	assert.Equal(`["b0"]`, request("GET", syncurl(uid, "storage/col"), nil, pool).Body.String())
+}
@@ -4,13 +4,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"net/http"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -20,6 +22,30 @@ import (
 	"github.com/mozilla-services/go-syncstorage/syncstorage"
 )
 
+// seconds clients are asked to back off when a request times out
+// waiting for the user's request lock
+const lockTimeoutBackoff = 30
+
+// committedBatchesKept is how many recently committed batch ids are
+// remembered to tell a repeated commit from an unknown batch
+const committedBatchesKept = 20
+
+// offsetAlert is sent in X-Weave-Alert when a collection GET uses an
+// offset above config.OffsetAlertThreshold
+const offsetAlert = "Paging with large offsets is deprecated, use sort=oldest with newer set to the last modified seen"
+
+// seconds clients are asked to wait when they have too many requests
+// in flight, see SyncUserHandlerConfig.MaxConcurrentRequests
+const concurrencyBackoff = 5
+
+// number of BSOs read from the database at a time when streaming full
+// results, see streamBSOs
+const streamPageSize = 100
+
+// lastAccessKey is the KeyValues key the time of the user's last request
+// is saved under
+const lastAccessKey = "LAST_ACCESS"
+
 type SyncUserHandlerConfig struct {
 	// API Limits
 	MaxRequestBytes       int
@@ -29,6 +55,105 @@ type SyncUserHandlerConfig struct {
 	MaxTotalBytes         int
 	MaxBatchTTL           int
 	MaxRecordPayloadBytes int // largest BSO payload
+	MaxRecordLineBytes    int // longest record in an application/newlines body
+
+	// MaxIdsPerRequest is the most ids a GET or DELETE can list with ids=,
+	// or in the body with ids_in_body=1. 0 is unlimited
+	MaxIdsPerRequest int
+
+	// OffsetAlertThreshold adds an X-Weave-Alert header to collection GETs
+	// with an offset at or above it, steering clients away from offset
+	// paging. The request is still served. 0 is disabled
+	OffsetAlertThreshold int
+
+	// MaxBSOGetLimit caps how many BSOs a collection GET returns, with
+	// or without full. Clients page through the rest with the
+	// X-Weave-Next-Offset header. 0 is unlimited
+	MaxBSOGetLimit int
+
+	// MaxResponseBytes bounds the body of a full collection GET. BSOs
+	// that would go over it are left for the next page, found with
+	// X-Weave-Next-Offset. At least one BSO is always returned. The
+	// response is buffered instead of streamed when it is set. 0 is
+	// unlimited
+	MaxResponseBytes int
+
+	// QuotaBytes is the max total payload bytes a user can store.
+	// 0 disables quotas
+	QuotaBytes int
+
+	// LockTimeout is how long a request waits for another request
+	// for the same user to finish. A 503 is returned when it takes
+	// longer. 0 waits forever
+	LockTimeout time.Duration
+
+	// MaxConcurrentRequests limits how many requests for the user can be
+	// in flight, running or waiting for the request lock. Requests over
+	// the limit get a 429 instead of queuing. 0 is unlimited
+	MaxConcurrentRequests int
+
+	// RawContentType is the Content-Type used when a BSO's payload
+	// is requested with ?raw=1
+	RawContentType string
+
+	// DisabledRoutes maps route names, see NewSyncUserHandler, to
+	// the status code they return instead of being handled. Use 503
+	// for routes that are temporarily disabled and 501 for ones that
+	// are not implemented
+	DisabledRoutes map[string]int
+
+	// CollectionWriteLimits rate limits writes (POST, PUT, DELETE) to
+	// specific collections, e.g. tabs. Requests over the limit get a 429
+	CollectionWriteLimits map[string]RateLimit
+
+	// Journal records write operations when set
+	Journal *Journal
+
+	// PayloadSizes records the size of the payloads written by PUTs,
+	// POSTs and batch commits when set
+	PayloadSizes *Histogram
+
+	// DisableAutoCreate stops writes from creating collections that do
+	// not already exist. They get a 404 instead
+	DisableAutoCreate bool
+
+	// AllowServerIds generates a unique id for POSTed BSOs that do
+	// not have one instead of failing them
+	AllowServerIds bool
+
+	// NormalizeCollectionNames lowercases and trims collection names
+	// from the URL so Bookmarks and bookmarks are the same collection
+	NormalizeCollectionNames bool
+
+	// RedirectTrailingSlash sends GET and HEAD requests for paths ending
+	// in a / a 301 to the path without it. Otherwise, and for writes,
+	// the path is served as if it had no trailing slash
+	RedirectTrailingSlash bool
+
+	// MaxInfoCollections limits how many collections the info/collections,
+	// info/collection_usage and info/collection_counts endpoints return.
+	// 0 is unlimited
+	MaxInfoCollections int
+
+	// CollectionPurgeIntervals purges expired BSOs from specific
+	// collections on their own schedule, e.g. more often for tabs. The
+	// regular purge skips them
+	CollectionPurgeIntervals map[string]time.Duration
+
+	// LastAccessInterval is how often the time of the user's last
+	// request is saved to their database. It is always saved when the
+	// database is closed
+	LastAccessInterval time.Duration
+
+	// ServerTiming adds a Server-Timing header with how long the request
+	// waited for the user's lock and spent in the database. It is meant
+	// for debugging and should be off in production
+	ServerTiming bool
+
+	// ExplicitSortIndex includes the sortindex of BSOs that were written
+	// with one even when it is 0, so clients can tell them apart from
+	// BSOs that never had one. Otherwise a sortindex of 0 is left out
+	ExplicitSortIndex bool
 }
 
 func NewDefaultSyncUserHandlerConfig() *SyncUserHandlerConfig {
@@ -40,9 +165,15 @@ func NewDefaultSyncUserHandlerConfig() *SyncUserHandlerConfig {
 		MaxTotalRecords:       10000,
 		MaxTotalBytes:         100 * 1024 * 1024,
 		MaxRecordPayloadBytes: 1024 * 1024 * 2,
+		MaxRecordLineBytes:    1024*1024*2 + 1024,
+		MaxIdsPerRequest:      100,
 
 		// batches older than this are likely to be purged
 		MaxBatchTTL: 2 * 60 * 60 * 1000, // 2 hours in milliseconds
+
+		RawContentType: "application/octet-stream",
+
+		LastAccessInterval: time.Minute,
 	}
 }
 
@@ -51,7 +182,14 @@ func NewDefaultSyncUserHandlerConfig() *SyncUserHandlerConfig {
 // to make it easy to wrap it in other http.Handler.
 type SyncUserHandler struct {
 	StoppableHandler
-	requestLock sync.Mutex
+
+	// requestLock serializes requests for the user. It is a channel
+	// instead of a sync.Mutex so waiting for it can time out
+	requestLock chan struct{}
+
+	// inflight holds a slot for each request being served or waiting
+	// for requestLock. It is nil when there is no limit
+	inflight chan struct{}
 
 	router *mux.Router
 	uid    string
@@ -64,6 +202,19 @@ type SyncUserHandler struct {
 	// need to be synchronized
 	lastChange time.Time
 
+	// write rate limiters for collections in config.CollectionWriteLimits
+	writeLimiters map[string]*tokenBucket
+
+	// committedBatches are the ids of the most recently committed batches.
+	// Like the write limiters it is protected by requestLock
+	committedBatches []int
+
+	// lastAccess is when the user last made a request. It is saved to
+	// the database at most every config.LastAccessInterval, at
+	// lastAccessSaved. Both are protected by requestLock
+	lastAccess      time.Time
+	lastAccessSaved time.Time
+
 	config *SyncUserHandlerConfig
 }
 
@@ -77,38 +228,109 @@ func NewSyncUserHandler(uid string, db *syncstorage.DB, config *SyncUserHandlerC
 	}
 
 	server := &SyncUserHandler{
-		uid:    uid,
-		router: r,
-		db:     db,
-		config: config,
+		uid:         uid,
+		router:      r,
+		db:          db,
+		config:      config,
+		requestLock: make(chan struct{}, 1),
+
+		writeLimiters: make(map[string]*tokenBucket),
+	}
+
+	if config.MaxConcurrentRequests > 0 {
+		server.inflight = make(chan struct{}, config.MaxConcurrentRequests)
 	}
 
 	// top level deletions for the user and their storage
 	// Note: not part of the sub-routers since since they don't end with a `/`
-	r.HandleFunc("/1.5/"+uid, server.hDeleteEverything).Methods("DELETE")
-	r.HandleFunc("/1.5/"+uid+"/storage", server.hDeleteEverything).Methods("DELETE")
+	r.HandleFunc("/1.5/"+uid, server.route("delete_everything", server.hDeleteEverything)).Methods("DELETE")
+	r.HandleFunc("/1.5/"+uid+"/storage", server.route("delete_everything", server.hDeleteEverything)).Methods("DELETE")
+	r.HandleFunc("/1.5/"+uid+"/storage", server.route("storage_get", server.hStorageGET)).Methods("GET")
 
 	v := r.PathPrefix("/1.5/" + uid + "/").Subrouter()
 
 	info := v.PathPrefix("/info/").Subrouter()
-	info.HandleFunc("/collections", server.hInfoCollections).Methods("GET")
-	info.HandleFunc("/collection_usage", server.hInfoCollectionUsage).Methods("GET")
-	info.HandleFunc("/collection_counts", server.hInfoCollectionCounts).Methods("GET")
-	info.HandleFunc("/configuration", server.hInfoConfiguration).Methods("GET")
-	info.HandleFunc("/quota", server.hInfoQuota).Methods("GET")
+	info.HandleFunc("/collections", server.route("info_collections", server.hInfoCollections)).Methods("GET")
+	info.HandleFunc("/collection_usage", server.route("info_collection_usage", server.hInfoCollectionUsage)).Methods("GET")
+	info.HandleFunc("/collection_counts", server.route("info_collection_counts", server.hInfoCollectionCounts)).Methods("GET")
+	info.HandleFunc("/configuration", server.route("info_configuration", server.hInfoConfiguration)).Methods("GET")
+	info.HandleFunc("/quota", server.route("info_quota", server.hInfoQuota)).Methods("GET")
+	info.HandleFunc("/all", server.route("info_all", server.hInfoAll)).Methods("GET")
 
 	storage := v.PathPrefix("/storage/").Subrouter()
 
-	storage.HandleFunc("/{collection}", server.hCollectionGET).Methods("GET")
-	storage.HandleFunc("/{collection}", catchBadCrypto(server.hCollectionPOST)).Methods("POST")
-	storage.HandleFunc("/{collection}", server.hCollectionDELETE).Methods("DELETE")
-	storage.HandleFunc("/{collection}/{bsoId}", server.hBsoGET).Methods("GET")
-	storage.HandleFunc("/{collection}/{bsoId}", catchBadCrypto(server.hBsoPUT)).Methods("PUT")
-	storage.HandleFunc("/{collection}/{bsoId}", server.hBsoDELETE).Methods("DELETE")
+	storage.HandleFunc("/{collection}", server.route("collection_get", server.hCollectionGET)).Methods("GET")
+	storage.HandleFunc("/{collection}", server.route("collection_get", server.hCollectionHEAD)).Methods("HEAD")
+	storage.HandleFunc("/{collection}", server.route("collection_post", server.writeLimit(catchBadCrypto(server.hCollectionPOST)))).Methods("POST")
+	storage.HandleFunc("/{collection}", server.route("collection_delete", server.writeLimit(server.hCollectionDELETE))).Methods("DELETE")
+	storage.HandleFunc("/{collection}/{bsoId}", server.route("bso_get", server.hBsoGET)).Methods("GET")
+	storage.HandleFunc("/{collection}/{bsoId}", server.route("bso_put", server.writeLimit(catchBadCrypto(server.hBsoPUT)))).Methods("PUT")
+	storage.HandleFunc("/{collection}/{bsoId}", server.route("bso_delete", server.writeLimit(server.hBsoDELETE))).Methods("DELETE")
+
+	storage.HandleFunc("/{collection}", allowMethods("GET", "HEAD", "POST", "DELETE")).Methods("OPTIONS")
+	storage.HandleFunc("/{collection}/{bsoId}", allowMethods("GET", "PUT", "DELETE")).Methods("OPTIONS")
 
 	return server
 }
 
+// allowMethods responds to OPTIONS requests with the methods a
+// resource supports
+func allowMethods(methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// route wraps h so it can be turned off with config.DisabledRoutes
+func (s *SyncUserHandler) route(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code, disabled := s.config.DisabledRoutes[name]
+		if !disabled {
+			h(w, r)
+			return
+		}
+
+		if code == http.StatusServiceUnavailable {
+			sendRequestProblem(w, r, code, errors.Errorf("%s is temporarily disabled", name))
+		} else {
+			sendRequestProblem(w, r, code, errors.Errorf("%s is not implemented", name))
+		}
+	}
+}
+
+// writeLimit wraps h to rate limit writes to the collections in
+// config.CollectionWriteLimits. Requests are already serialized by
+// requestLock so the limiters do not need their own locking
+func (s *SyncUserHandler) writeLimit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collection := s.collectionName(r)
+		limit, ok := s.config.CollectionWriteLimits[collection]
+		if !ok {
+			h(w, r)
+			return
+		}
+
+		bucket, ok := s.writeLimiters[collection]
+		if !ok || bucket.limit != limit {
+			bucket = newTokenBucket(limit)
+			s.writeLimiters[collection] = bucket
+		}
+
+		if allowed, wait := bucket.take(time.Now()); !allowed {
+			retry := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			sendRequestProblem(w, r, http.StatusTooManyRequests,
+				errors.Errorf("Too many writes to %s", collection))
+			return
+		}
+
+		h(w, r)
+	}
+}
+
 // TidyUp will purge expired BSOs and Batches. When the database has exceeded
 // vacuumKB (in kilobytes) it will be optimized. This could
 // potentially be a long operation as the database vacuumed needs to rewrite
@@ -117,6 +339,10 @@ func (s *SyncUserHandler) TidyUp(minPurge, maxPurge time.Duration, vacuumKB int)
 	// Purge Expired BSOs
 	start := time.Now()
 
+	// collections with their own schedule are purged even when the
+	// rest of the database is not due
+	scheduled := s.purgeCollections()
+
 	nextStr, err := s.db.GetKey("NEXT_PURGE")
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -159,7 +385,7 @@ func (s *SyncUserHandler) TidyUp(minPurge, maxPurge time.Duration, vacuumKB int)
 
 	{ // purge bsos and batches
 		purgeStart := time.Now()
-		numBSOPurged, err := s.db.PurgeExpired()
+		numBSOPurged, err := s.db.PurgeExpired(scheduled...)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"uid": s.uid,
@@ -252,15 +478,125 @@ func (s *SyncUserHandler) TidyUp(minPurge, maxPurge time.Duration, vacuumKB int)
 	return
 }
 
+// purgeCollections purges the collections in CollectionPurgeIntervals
+// that are due. It returns the ids of all of them that exist so the
+// regular purge can skip them
+func (s *SyncUserHandler) purgeCollections() (cIds []int) {
+	for name, interval := range s.config.CollectionPurgeIntervals {
+		cId, err := s.db.GetCollectionId(name)
+		if err != nil {
+			if err != syncstorage.ErrNotFound {
+				log.WithFields(log.Fields{
+					"uid":        s.uid,
+					"collection": name,
+					"err":        err.Error(),
+				}).Error("SyncUserHandler - Error fetching collection to purge")
+			}
+			continue
+		}
+
+		cIds = append(cIds, cId)
+
+		key := "NEXT_PURGE_" + name
+		nextStr, err := s.db.GetKey(key)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"uid":        s.uid,
+				"collection": name,
+				"err":        err.Error(),
+			}).Error("SyncUserHandler - Error fetching next collection purge time")
+			continue
+		}
+
+		// like the regular purge the first run only schedules one
+		if nextStr != "" {
+			next, err := time.Parse(time.RFC3339Nano, nextStr)
+			if err == nil && time.Now().Before(next) {
+				continue
+			}
+
+			purgeStart := time.Now()
+			purged, err := s.db.PurgeExpiredCollection(cId)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"uid":        s.uid,
+					"collection": name,
+					"err":        err.Error(),
+				}).Error("SyncUserHandler - Error purging expired collection BSOs")
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"uid":        s.uid,
+				"collection": name,
+				"purge_bso":  purged,
+				"t":          time.Since(purgeStart).Nanoseconds() / 1000 / 1000,
+			}).Info("SyncUserHandler - Purged collection")
+		}
+
+		if err := s.db.SetKey(key, time.Now().Add(interval).Format(time.RFC3339Nano)); err != nil {
+			log.WithFields(log.Fields{
+				"uid":        s.uid,
+				"collection": name,
+				"err":        err.Error(),
+			}).Error("SyncUserHandler - Error Setting Next Collection Purge Key")
+		}
+	}
+
+	return
+}
+
 func (s *SyncUserHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	s.requestLock.Lock()
-	defer s.requestLock.Unlock()
+	if path := req.URL.Path; len(path) > 1 && strings.HasSuffix(path, "/") {
+		if s.config.RedirectTrailingSlash && (req.Method == "GET" || req.Method == "HEAD") {
+			http.Redirect(w, req, trimTrailingSlash(req), http.StatusMovedPermanently)
+			return
+		}
+
+		// route /storage/ like /storage. The request is copied so
+		// the handlers wrapping this one, e.g. logging, see the
+		// path the client sent
+		u := *req.URL
+		u.Path = strings.TrimSuffix(path, "/")
+		req = req.WithContext(req.Context())
+		req.URL = &u
+	}
+
+	if s.inflight != nil {
+		select {
+		case s.inflight <- struct{}{}:
+			defer func() { <-s.inflight }()
+		default:
+			w.Header().Set("Retry-After", strconv.Itoa(concurrencyBackoff))
+			sendRequestProblem(w, req, http.StatusTooManyRequests,
+				errors.New("Too many concurrent requests"))
+			return
+		}
+	}
+
+	start := time.Now()
+	if !s.lock(s.config.LockTimeout) {
+		w.Header().Set("Retry-After", strconv.Itoa(lockTimeoutBackoff))
+		w.Header().Set("X-Weave-Backoff", strconv.Itoa(lockTimeoutBackoff))
+		sendRequestProblem(w, req, http.StatusServiceUnavailable,
+			errors.New("Timed out waiting for another request to finish"))
+		return
+	}
+	defer s.unlock()
+
+	var timing *serverTimingWriter
+	if s.config.ServerTiming {
+		timing = &serverTimingWriter{ResponseWriter: w, lockWait: time.Since(start)}
+		w = timing
+	}
 
 	if s.IsStopped() {
 		s.StoppableHandler.ServeHTTP(w, req)
 		return
 	}
 
+	s.touch(time.Now())
+
 	switch req.Method {
 	case "POST", "PUT", "DELETE":
 		// make sure all X-Last-Modified values are unique we sleep for a bit
@@ -286,9 +622,11 @@ func (s *SyncUserHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			}
 			time.Sleep(toSleep)
 		}
+		timing.startDB()
 		s.router.ServeHTTP(w, req)
 		s.lastChange = time.Now()
 	default:
+		timing.startDB()
 		s.router.ServeHTTP(w, req)
 	}
 }
@@ -296,14 +634,18 @@ func (s *SyncUserHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 // Stop immediately prevents handling web requests then purges
 // expired BSOs before closing the DB.
 func (s *SyncUserHandler) StopHTTP() {
-	s.requestLock.Lock()
-	defer s.requestLock.Unlock()
+	s.lock(0)
+	defer s.unlock()
 
 	if s.IsStopped() {
 		return
 	}
 
 	s.StoppableHandler.StopHTTP()
+
+	if s.lastAccess.After(s.lastAccessSaved) {
+		s.saveLastAccess()
+	}
 	s.db.Close()
 
 	if log.GetLevel() == log.DebugLevel {
@@ -313,10 +655,90 @@ func (s *SyncUserHandler) StopHTTP() {
 	}
 }
 
+// touch records a request at now, saving it to the database when the
+// last save is older than config.LastAccessInterval. Must be called with
+// requestLock held
+func (s *SyncUserHandler) touch(now time.Time) {
+	s.lastAccess = now
+	if now.Sub(s.lastAccessSaved) >= s.config.LastAccessInterval {
+		s.saveLastAccess()
+	}
+}
+
+func (s *SyncUserHandler) saveLastAccess() {
+	err := s.db.SetKey(lastAccessKey, s.lastAccess.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uid": s.uid,
+			"err": err.Error(),
+		}).Warn("SyncUserHandler: could not save last access")
+		return
+	}
+
+	s.lastAccessSaved = s.lastAccess
+}
+
+// LastAccess returns when the user last made a request, the zero time if
+// they never have. It waits for the user's current request to finish
+func (s *SyncUserHandler) LastAccess() (time.Time, error) {
+	s.lock(0)
+	defer s.unlock()
+
+	if !s.lastAccess.IsZero() {
+		return s.lastAccess, nil
+	}
+
+	if s.IsStopped() {
+		return time.Time{}, errElementStopped
+	}
+
+	value, err := s.db.GetKey(lastAccessKey)
+	if err != nil || value == "" {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// lock acquires the request lock. It returns false if it could not be
+// acquired within timeout. A timeout of 0 waits forever
+func (s *SyncUserHandler) lock(timeout time.Duration) bool {
+	if timeout <= 0 {
+		s.requestLock <- struct{}{}
+		return true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case s.requestLock <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (s *SyncUserHandler) unlock() {
+	<-s.requestLock
+}
+
+// collectionName returns the collection name from the URL, normalized
+// when config.NormalizeCollectionNames is set
+func (s *SyncUserHandler) collectionName(r *http.Request) string {
+	collection := mux.Vars(r)["collection"]
+	if s.config.NormalizeCollectionNames {
+		collection = strings.ToLower(strings.TrimSpace(collection))
+	}
+	return collection
+}
+
 // getcid looks up a collection by name and returns its id. If it doesn't
-// exist it will create it if automake is true
+// exist it will create it if automake is true and auto creation is not
+// disabled in the config. Only writes should pass automake, reads return
+// syncstorage.ErrNotFound instead
 func (s *SyncUserHandler) getcid(r *http.Request, automake bool) (cId int, err error) {
-	collection := mux.Vars(r)["collection"]
+	collection := s.collectionName(r)
 
 	if !syncstorage.CollectionNameOk(collection) {
 		err = syncstorage.ErrInvalidCollectionName
@@ -329,16 +751,16 @@ func (s *SyncUserHandler) getcid(r *http.Request, automake bool) (cId int, err e
 		return
 	}
 
-	if err == syncstorage.ErrNotFound && automake {
+	if err == syncstorage.ErrNotFound && automake && !s.config.DisableAutoCreate {
 		cId, err = s.db.CreateCollection(collection)
 	}
 
 	return
 }
 
-// hInfoQuota calculates the total disk space used by the user by calculating
-// it based on the number of DB pages used * size of each page.
-// TODO actually implement quotas in the system.
+// hInfoQuota sends the total size of the user's payloads and, when
+// quotas are enabled, how much of the quota is left, both in KB. Without
+// a quota the second value is null
 func (s *SyncUserHandler) hInfoQuota(w http.ResponseWriter, r *http.Request) {
 	results, err := s.db.InfoCollectionUsage()
 	if err != nil {
@@ -366,7 +788,16 @@ func (s *SyncUserHandler) hInfoQuota(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// 8 decimals of precision cause python's test_quota functional test
-	w.Write([]byte(fmt.Sprintf("[%0.8f,null]", float64(used)/1024)))
+	remaining := "null"
+	if s.config.QuotaBytes > 0 {
+		left := 0
+		if used < s.config.QuotaBytes {
+			left = s.config.QuotaBytes - used
+		}
+		remaining = fmt.Sprintf("%0.8f", float64(left)/1024)
+	}
+
+	w.Write([]byte(fmt.Sprintf("[%0.8f,%s]", float64(used)/1024, remaining)))
 }
 
 func (s *SyncUserHandler) hInfoCollections(w http.ResponseWriter, r *http.Request) {
@@ -391,19 +822,26 @@ func (s *SyncUserHandler) hInfoCollections(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	info = s.truncateInfo(w, info)
+
 	m := syncstorage.ModifiedToString(modified)
 	w.Header().Set("X-Last-Modified", m)
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, "{")
+
+	var buf bytes.Buffer
+	buf.WriteString("{")
 	num := len(info)
 	for name, modified := range info {
-		fmt.Fprintf(w, `"%s":%s`, name, syncstorage.ModifiedToString(modified))
+		fmt.Fprintf(&buf, `"%s":%s`, name, syncstorage.ModifiedToString(modified))
 		num--
 		if num != 0 {
-			fmt.Fprint(w, ",")
+			buf.WriteString(",")
 		}
 	}
-	fmt.Fprint(w, "}")
+	buf.WriteString("}")
+
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	buf.WriteTo(w)
 }
 
 func (s *SyncUserHandler) hInfoCollectionUsage(w http.ResponseWriter, r *http.Request) {
@@ -425,6 +863,8 @@ func (s *SyncUserHandler) hInfoCollectionUsage(w http.ResponseWriter, r *http.Re
 		InternalError(w, r, err)
 		return
 	} else {
+		results = s.truncateInfo(w, results)
+
 		// the sync 1.5 api says data should be in KB
 		resultsKB := make(map[string]float64)
 		for name, bytes := range results {
@@ -440,12 +880,39 @@ func (s *SyncUserHandler) hInfoCollectionCounts(w http.ResponseWriter, r *http.R
 	if !AcceptHeaderOk(w, r) {
 		return
 	}
+
+	// check the conditional headers before counting anything
+	modified, err := s.db.LastModified()
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	if sentNotModified(w, r, modified) {
+		return
+	}
+
 	results, err := s.db.InfoCollectionCounts()
 	if err != nil {
 		InternalError(w, r, err)
 		return
 	}
 
+	results = s.truncateInfo(w, results)
+
+	m := syncstorage.ModifiedToString(modified)
+	w.Header().Set("X-Last-Modified", m)
+	JsonNewline(w, r, results)
+}
+
+// hInfoAll combines info/collections, info/collection_usage and
+// info/collection_counts so polling clients need a single request. Like
+// them it sends a 304 when nothing changed since X-If-Modified-Since
+func (s *SyncUserHandler) hInfoAll(w http.ResponseWriter, r *http.Request) {
+	if !AcceptHeaderOk(w, r) {
+		return
+	}
+
 	modified, err := s.db.LastModified()
 	if err != nil {
 		InternalError(w, r, err)
@@ -456,9 +923,76 @@ func (s *SyncUserHandler) hInfoCollectionCounts(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	m := syncstorage.ModifiedToString(modified)
-	w.Header().Set("X-Last-Modified", m)
-	JsonNewline(w, r, results)
+	collections, err := s.db.InfoCollections()
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	usage, err := s.db.InfoCollectionUsage()
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	counts, err := s.db.InfoCollectionCounts()
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	collections = s.truncateInfo(w, collections)
+	usage = s.truncateInfo(w, usage)
+	counts = s.truncateInfo(w, counts)
+
+	// timestamps keep the same two decimal format as info/collections
+	modifieds := make(map[string]json.Number, len(collections))
+	for name, cmodified := range collections {
+		modifieds[name] = json.Number(syncstorage.ModifiedToString(cmodified))
+	}
+
+	usageKB := make(map[string]float64, len(usage))
+	for name, bytes := range usage {
+		usageKB[name] = float64(bytes) / 1024
+	}
+
+	w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(modified))
+	JsonNewline(w, r, map[string]interface{}{
+		"collections":       modifieds,
+		"collection_usage":  usageKB,
+		"collection_counts": counts,
+	})
+}
+
+// truncateInfo limits info to config.MaxInfoCollections, keeping the
+// collections with the largest values, i.e. the most recently modified or
+// the biggest. When collections are dropped the X-Weave-Info-Truncated
+// header is set to the total number of collections
+func (s *SyncUserHandler) truncateInfo(w http.ResponseWriter, info map[string]int) map[string]int {
+	max := s.config.MaxInfoCollections
+	if max <= 0 || len(info) <= max {
+		return info
+	}
+
+	names := make([]string, 0, len(info))
+	for name := range info {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if info[names[i]] != info[names[j]] {
+			return info[names[i]] > info[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	truncated := make(map[string]int, max)
+	for _, name := range names[:max] {
+		truncated[name] = info[name]
+	}
+
+	w.Header().Set("X-Weave-Info-Truncated", strconv.Itoa(len(info)))
+	return truncated
 }
 
 func (s *SyncUserHandler) hInfoConfiguration(w http.ResponseWriter, r *http.Request) {
@@ -479,12 +1013,158 @@ func (s *SyncUserHandler) hInfoConfiguration(w http.ResponseWriter, r *http.Requ
 	)
 }
 
-func (s *SyncUserHandler) hCollectionGET(w http.ResponseWriter, r *http.Request) {
+// setLimitHeaders is used when a POST goes over one of the limits in
+// info/configuration. X-Weave-Limit-Exceeded names the limit so clients
+// can tell too many records from too many bytes and the X-Weave-* headers
+// have the configured limits so they know how to split their uploads
+func (s *SyncUserHandler) setLimitHeaders(w http.ResponseWriter, limit string) {
+	w.Header().Set("X-Weave-Limit-Exceeded", limit)
+	w.Header().Set("X-Weave-Records", strconv.Itoa(s.config.MaxPOSTRecords))
+	w.Header().Set("X-Weave-Bytes", strconv.Itoa(s.config.MaxPOSTBytes))
+	w.Header().Set("X-Weave-Total-Records", strconv.Itoa(s.config.MaxTotalRecords))
+	w.Header().Set("X-Weave-Total-Bytes", strconv.Itoa(s.config.MaxTotalBytes))
+}
+
+// idsOk checks that a request did not send more ids than
+// config.MaxIdsPerRequest, sending the weave size limit error if it did
+func (s *SyncUserHandler) idsOk(w http.ResponseWriter, r *http.Request, num int) bool {
+	if max := s.config.MaxIdsPerRequest; max > 0 && num > max {
+		WeaveSizeLimitExceeded(w, r,
+			errors.Errorf("Too many ids (%d), max %d", num, s.config.MaxIdsPerRequest))
+		return false
+	}
+	return true
+}
 
+// bsoIdsOk trims the whitespace around each id in ids and checks they
+// are valid BSO ids, sending a 400 if one is not
+func bsoIdsOk(w http.ResponseWriter, r *http.Request, ids []string) bool {
+	for i, id := range ids {
+		id = strings.TrimSpace(id)
+		if !syncstorage.BSOIdOk(id) {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.Errorf("Invalid bso id %s", id))
+			return false
+		}
+		ids[i] = id
+	}
+	return true
+}
+
+// hStorageGET fetches BSOs from several collections in one request. ids
+// is a comma separated list of collection/id, e.g.
+// ?ids=meta/global,crypto/keys. The response maps each requested
+// collection to its BSOs that were found
+func (s *SyncUserHandler) hStorageGET(w http.ResponseWriter, r *http.Request) {
 	if !AcceptHeaderOk(w, r) {
 		return
 	}
 
+	v := r.URL.Query().Get("ids")
+	if v == "" {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("ids is required"))
+		return
+	}
+
+	pairs := strings.Split(v, ",")
+	if !s.idsOk(w, r, len(pairs)) {
+		return
+	}
+
+	ids := make(map[string][]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "/", 2)
+		if len(parts) != 2 {
+			sendRequestProblem(w, r, http.StatusBadRequest,
+				errors.Errorf("Invalid id %q, must be collection/id", pair))
+			return
+		}
+
+		collection := parts[0]
+		if s.config.NormalizeCollectionNames {
+			collection = strings.ToLower(strings.TrimSpace(collection))
+		}
+		ids[collection] = append(ids[collection], parts[1])
+	}
+
+	modified, err := s.db.LastModified()
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	if sentNotModified(w, r, modified) {
+		return
+	}
+
+	found, err := s.db.GetBSOsAcrossCollections(ids)
+	if err != nil {
+		if err == syncstorage.ErrInvalidCollectionName || err == syncstorage.ErrInvalidBSOId {
+			sendRequestProblem(w, r, http.StatusBadRequest, err)
+		} else {
+			InternalError(w, r, err)
+		}
+		return
+	}
+
+	results := make(map[string][]*syncstorage.BSO, len(ids))
+	for collection := range ids {
+		results[collection] = make([]*syncstorage.BSO, 0)
+		if bsos, ok := found[collection]; ok {
+			for _, b := range bsos {
+				s.outputBSO(b)
+			}
+			results[collection] = bsos
+		}
+	}
+
+	w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(modified))
+	JSON(w, r, http.StatusOK, results)
+}
+
+// hCollectionHEAD is a cheap way to poll a single collection. It only
+// sends the X-Last-Modified and X-Weave-Records headers
+func (s *SyncUserHandler) hCollectionHEAD(w http.ResponseWriter, r *http.Request) {
+	var modified, count int
+
+	cId, err := s.getcid(r, false)
+	if err == nil {
+		modified, err = s.db.GetCollectionModified(cId)
+		if err != nil {
+			InternalError(w, r, err)
+			return
+		}
+
+		if sentNotModified(w, r, modified) {
+			return
+		}
+
+		count, err = s.db.CountBSOs(cId, nil, syncstorage.MaxTimestamp, 0, 0)
+		if err != nil {
+			InternalError(w, r, err)
+			return
+		}
+	} else if err != syncstorage.ErrNotFound {
+		InternalError(w, r, err)
+		return
+	}
+
+	// like GET a collection that does not exist is empty
+	w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(modified))
+	w.Header().Set("X-Weave-Records", strconv.Itoa(count))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *SyncUserHandler) hCollectionGET(w http.ResponseWriter, r *http.Request) {
+
+	// the response is JSON or newlines depending on Accept, and may be
+	// compressed in front of the server, so caches must key on both
+	w.Header().Set("Vary", "Accept, Accept-Encoding")
+
+	if !formatParamOk(w, r) || !AcceptHeaderOk(w, r) {
+		return
+	}
+
 	// query params that control searching
 	var (
 		err    error
@@ -495,6 +1175,9 @@ func (s *SyncUserHandler) hCollectionGET(w http.ResponseWriter, r *http.Request)
 		limit  int
 		offset int
 		sort   = syncstorage.SORT_NEWEST
+
+		// only BSOs with a TTL ending before this, 0 is no limit
+		expiresBefore int
 	)
 
 	cId, err := s.getcid(r, false)
@@ -518,21 +1201,9 @@ func (s *SyncUserHandler) hCollectionGET(w http.ResponseWriter, r *http.Request)
 	if v := r.Form.Get("ids"); v != "" {
 		ids = strings.Split(v, ",")
 
-		if len(ids) > 100 {
-			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Too many ids provided"))
+		if !s.idsOk(w, r, len(ids)) || !bsoIdsOk(w, r, ids) {
 			return
 		}
-
-		for i, id := range ids {
-			id = strings.TrimSpace(id)
-			if syncstorage.BSOIdOk(id) {
-				ids[i] = id
-			} else {
-				sendRequestProblem(w, r, http.StatusBadRequest, errors.Errorf("Invalid bso id %s", id))
-				return
-			}
-		}
-
 	}
 
 	// we expect to get sync's two decimal timestamps, these need
@@ -544,118 +1215,418 @@ func (s *SyncUserHandler) hCollectionGET(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
-		older = int(floatNew * 1000)
-		if !syncstorage.NewerOk(newer) {
-			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid older value"))
-			return
+		older = int(floatNew * 1000)
+		if !syncstorage.NewerOk(newer) {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid older value"))
+			return
+		}
+	} else {
+		older = syncstorage.MaxTimestamp
+	}
+
+	if v := r.Form.Get("newer"); v != "" {
+		floatNew, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.Wrap(err, "Invalid newer param format"))
+			return
+		}
+
+		newer = int(floatNew * 1000)
+		if !syncstorage.NewerOk(newer) {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid newer value"))
+			return
+		}
+	}
+
+	// expiring_within is in seconds from now
+	if v := r.Form.Get("expiring_within"); v != "" {
+		within, err := strconv.Atoi(v)
+		if err != nil || within < 0 {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid expiring_within value"))
+			return
+		}
+		expiresBefore = syncstorage.Now() + within*1000
+	}
+
+	// any value for full, including 0 or false, returns whole BSOs.
+	// Only a missing or empty full returns just ids
+	if v := r.Form.Get("full"); v != "" {
+		full = true
+	}
+
+	// ?ttl=1 adds the seconds left before each BSO expires to full results
+	var withTTL bool
+	switch r.Form.Get("ttl") {
+	case "1", "true":
+		withTTL = true
+	}
+
+	if v := r.Form.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			errMessage := "Invalid limit value"
+			if err != nil {
+				err = errors.Wrap(err, errMessage)
+			} else {
+				err = errors.New(errMessage)
+			}
+			sendRequestProblem(w, r, http.StatusBadRequest, err)
+			return
+		}
+	} else {
+		// in sqlite a negative value for LIMIT results in
+		// no upper bound, ref: http://sqlite.org/lang_select.html#limitoffset
+		limit = -1
+	}
+
+	if max := s.config.MaxBSOGetLimit; max > 0 && (limit < 0 || limit > max) {
+		limit = max
+	}
+
+	if v := r.Form.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || !syncstorage.OffsetOk(offset) {
+			errMessage := "Invalid offset value"
+			if err != nil {
+				err = errors.Wrap(err, errMessage)
+			} else {
+				err = errors.New(errMessage)
+			}
+			sendRequestProblem(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if t := s.config.OffsetAlertThreshold; t > 0 && offset >= t {
+			w.Header().Set("X-Weave-Alert", offsetAlert)
+		}
+	}
+
+	// cursor based paging with after is not supported. A client sending
+	// it with offset can not be sure which one is used so it is rejected
+	// rather than silently ignored
+	if r.Form.Get("offset") != "" && r.Form.Get("after") != "" {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("offset and after can not be used together"))
+		return
+	}
+
+	if v := r.Form.Get("sort"); v != "" {
+		switch v {
+		case "newest", "modified": // modified is an alias some tools use
+			sort = syncstorage.SORT_NEWEST
+		case "oldest":
+			sort = syncstorage.SORT_OLDEST
+		case "index":
+			sort = syncstorage.SORT_INDEX
+		default:
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid sort value"))
+			return
+		}
+	}
+
+	// this is way down here since IO is more expensive
+	// than parsing if the GET params are valid
+	cmodified, err := s.db.GetCollectionModified(cId)
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	} else if sentNotModified(w, r, cmodified) {
+		return
+	}
+
+	m := syncstorage.ModifiedToString(cmodified)
+
+	// ?count=1 adds the total number of matching BSOs, ignoring limit
+	// and offset. It is optional since it costs an extra query
+	var countRequested bool
+	switch r.Form.Get("count") {
+	case "1", "true":
+		countRequested = true
+	}
+
+	// full results are streamed a page at a time so the headers are sent
+	// before most BSOs are read. Paging is worked out from the count which
+	// is read with the first page so the two always agree
+	bounded := full && s.config.MaxResponseBytes > 0
+	var pages *syncstorage.BSOPages
+	var total int
+	if full && !bounded {
+		pages, err = s.db.NewBSOPages(cId, ids, older, newer, expiresBefore, sort, limit, offset, streamPageSize)
+		if err != nil {
+			InternalError(w, r, err)
+			return
+		}
+		total = pages.Total
+	} else if countRequested {
+		total, err = s.db.CountBSOs(cId, ids, older, newer, expiresBefore)
+		if err != nil {
+			InternalError(w, r, err)
+			return
+		}
+	}
+
+	if countRequested {
+		w.Header().Set("X-Weave-Total-Records", strconv.Itoa(total))
+	}
+
+	if bounded {
+		s.boundedBSOs(w, r, m, cId, ids, older, newer, expiresBefore, sort, limit, offset, withTTL)
+	} else if full {
+		records := total - offset
+		if records < 0 {
+			records = 0
+		}
+		if limit >= 0 && records > limit {
+			records = limit
+			w.Header().Set("X-Weave-Next-Offset", strconv.Itoa(limit+offset))
+		}
+
+		w.Header().Set("X-Last-Modified", m)
+		w.Header().Set("X-Weave-Records", strconv.Itoa(records))
+		s.streamBSOs(w, r, pages, withTTL)
+	} else {
+		// only ids are required, avoid loading payloads
+		results, err := s.db.GetBSOIds(cId, ids, older, newer, expiresBefore, sort, limit, offset)
+		if err != nil {
+			InternalError(w, r, err)
+			return
+		}
+
+		w.Header().Set("X-Last-Modified", m)
+		w.Header().Set("X-Weave-Records", strconv.Itoa(len(results.Ids)))
+		if results.More {
+			w.Header().Set("X-Weave-Next-Offset", strconv.Itoa(results.Offset))
+		}
+
+		JsonNewline(w, r, results.Ids)
+	}
+}
+
+// streamBSOs writes BSOs to w a page at a time so the first bytes go out
+// quickly and large collections never have to fit in memory. The database
+// is not locked while a page is written so a slow client does not hold up
+// the user's other requests. Headers must be set before calling it
+func (s *SyncUserHandler) streamBSOs(
+	w http.ResponseWriter,
+	r *http.Request,
+	pages *syncstorage.BSOPages,
+	withTTL bool) {
+
+	newlines := strings.Contains(r.Header.Get("Accept"), "application/newlines")
+	if newlines {
+		w.Header().Set("Content-Type", "application/newlines")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	var wrote bool
+	now := syncstorage.Now()
+	writePage := func(page []*syncstorage.BSO) error {
+		for _, b := range page {
+			raw, err := s.marshalBSO(b, withTTL, now)
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case newlines:
+			case !wrote:
+				w.Write([]byte("["))
+			default:
+				w.Write([]byte(","))
+			}
+			wrote = true
+
+			// stop reading pages once the client has gone away
+			if _, err := w.Write(raw); err != nil {
+				return err
+			}
+
+			if newlines {
+				w.Write([]byte("\n"))
+			}
+		}
+		return nil
+	}
+
+	var err error
+	for {
+		// a request deadline, see TimeoutHandler, is checked between
+		// pages since the response is not buffered
+		if err = r.Context().Err(); err != nil {
+			if !wrote {
+				sendTimeout(w, r, errors.Wrap(err, "Stopped before streaming BSOs"))
+				return
+			}
+			break
+		}
+
+		var page []*syncstorage.BSO
+		if page, err = pages.Next(); err != nil || len(page) == 0 {
+			break
+		}
+
+		if err = writePage(page); err != nil {
+			break
 		}
-	} else {
-		older = syncstorage.MaxTimestamp
 	}
 
-	if v := r.Form.Get("newer"); v != "" {
-		floatNew, err := strconv.ParseFloat(v, 64)
-		if err != nil {
-			sendRequestProblem(w, r, http.StatusBadRequest, errors.Wrap(err, "Invalid newer param format"))
+	if err != nil {
+		if !wrote {
+			InternalError(w, r, err)
 			return
 		}
 
-		newer = int(floatNew * 1000)
-		if !syncstorage.NewerOk(newer) {
-			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid newer value"))
-			return
+		// the status has already been sent. Abort the response so it
+		// can not be mistaken for a complete one
+		log.WithFields(log.Fields{
+			"uid": s.uid,
+			"err": err.Error(),
+		}).Error("SyncUserHandler: could not finish streaming BSOs")
+		panic(http.ErrAbortHandler)
+	}
+
+	if !newlines {
+		if !wrote {
+			w.Write([]byte("["))
 		}
+		w.Write([]byte("]"))
 	}
+}
 
-	if v := r.Form.Get("full"); v != "" {
-		full = true
+// errResponseFull stops boundedBSOs reading rows
+var errResponseFull = errors.New("Response full")
+
+// boundedBSOs writes BSOs to w until the body would be larger than
+// config.MaxResponseBytes. The response is built in memory, at most
+// MaxResponseBytes, so the X-Weave-* headers can say where it stopped.
+// Unlike streamBSOs it sets the X-Last-Modified and X-Weave-* headers
+func (s *SyncUserHandler) boundedBSOs(
+	w http.ResponseWriter,
+	r *http.Request,
+	modified string,
+	cId int,
+	ids []string,
+	older int,
+	newer int,
+	expiresBefore int,
+	sort syncstorage.SortType,
+	limit int,
+	offset int,
+	withTTL bool) {
+
+	newlines := strings.Contains(r.Header.Get("Accept"), "application/newlines")
+
+	// read one more row than the limit to know if there is another page
+	readLimit := limit
+	if limit >= 0 {
+		readLimit = limit + 1
 	}
 
-	if v := r.Form.Get("limit"); v != "" {
-		limit, err = strconv.Atoi(v)
-		if err != nil || limit < 0 {
-			errMessage := "Invalid limit value"
-			if err != nil {
-				err = errors.Wrap(err, errMessage)
-			} else {
-				err = errors.New(errMessage)
+	var (
+		buf     bytes.Buffer
+		records int
+		more    bool
+	)
+
+	now := syncstorage.Now()
+	_, err := s.db.ForEachBSO(cId, ids, older, newer, expiresBefore, sort, readLimit, offset,
+		func(b *syncstorage.BSO) error {
+			if err := r.Context().Err(); err != nil {
+				return err
 			}
-			sendRequestProblem(w, r, http.StatusBadRequest, err)
-			return
-		}
-	} else {
-		// in sqlite a negative value for LIMIT results in
-		// no upper bound, ref: http://sqlite.org/lang_select.html#limitoffset
-		limit = -1
-	}
 
-	if v := r.Form.Get("offset"); v != "" {
-		offset, err = strconv.Atoi(v)
-		if err != nil || !syncstorage.OffsetOk(offset) {
-			errMessage := "Invalid offset value"
+			if records == limit {
+				more = true
+				return errResponseFull
+			}
+
+			raw, err := s.marshalBSO(b, withTTL, now)
 			if err != nil {
-				err = errors.Wrap(err, errMessage)
-			} else {
-				err = errors.New(errMessage)
+				return err
 			}
-			sendRequestProblem(w, r, http.StatusBadRequest, err)
-			return
+
+			// the separator or newline, plus the closing ]
+			if records > 0 && buf.Len()+len(raw)+2 > s.config.MaxResponseBytes {
+				more = true
+				return errResponseFull
+			}
+
+			switch {
+			case newlines:
+			case records == 0:
+				buf.WriteString("[")
+			default:
+				buf.WriteString(",")
+			}
+
+			buf.Write(raw)
+			if newlines {
+				buf.WriteString("\n")
+			}
+
+			records++
+			return nil
+		})
+
+	if err != nil && err != errResponseFull {
+		if err == r.Context().Err() {
+			sendTimeout(w, r, errors.Wrap(err, "Stopped reading BSOs"))
+		} else {
+			InternalError(w, r, err)
 		}
+		return
 	}
 
-	if v := r.Form.Get("sort"); v != "" {
-		switch v {
-		case "newest":
-			sort = syncstorage.SORT_NEWEST
-		case "oldest":
-			sort = syncstorage.SORT_OLDEST
-		case "index":
-			sort = syncstorage.SORT_INDEX
-		default:
-			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Invalid sort value"))
-			return
+	if !newlines {
+		if records == 0 {
+			buf.WriteString("[")
 		}
+		buf.WriteString("]")
 	}
 
-	// this is way down here since IO is more expensive
-	// than parsing if the GET params are valid
-	cmodified, err := s.db.GetCollectionModified(cId)
-	if err != nil {
-		InternalError(w, r, err)
-		return
-	} else if sentNotModified(w, r, cmodified) {
-		return
+	if newlines {
+		w.Header().Set("Content-Type", "application/newlines")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
 	}
 
-	results, err := s.db.GetBSOs(cId, ids, older, newer, sort, limit, offset)
-	if err != nil {
-		InternalError(w, r, err)
-		return
+	w.Header().Set("X-Last-Modified", modified)
+	w.Header().Set("X-Weave-Records", strconv.Itoa(records))
+	if more {
+		w.Header().Set("X-Weave-Next-Offset", strconv.Itoa(offset+records))
 	}
-	m := syncstorage.ModifiedToString(cmodified)
-	w.Header().Set("X-Last-Modified", m)
 
-	w.Header().Set("X-Weave-Records", strconv.Itoa(len(results.BSOs)))
-	if results.More {
-		w.Header().Set("X-Weave-Next-Offset", strconv.Itoa(results.Offset))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	buf.WriteTo(w)
+}
+
+// outputBSO prepares a BSO from the database to be sent to a client
+func (s *SyncUserHandler) outputBSO(b *syncstorage.BSO) {
+	if !s.config.ExplicitSortIndex {
+		b.SortIndexSet = false
 	}
+}
 
-	if full {
-		JsonNewline(w, r, results.BSOs)
-	} else {
-		bsoIds := make([]string, len(results.BSOs))
-		for i, b := range results.BSOs {
-			bsoIds[i] = b.Id
-		}
-		JsonNewline(w, r, bsoIds)
+// marshalBSO encodes a BSO for a collection GET
+func (s *SyncUserHandler) marshalBSO(b *syncstorage.BSO, withTTL bool, now int) ([]byte, error) {
+	s.outputBSO(b)
+	if withTTL {
+		return b.MarshalJSONWithTTL(now)
 	}
+	return b.MarshalJSON()
 }
 
 func (s *SyncUserHandler) hCollectionPOST(w http.ResponseWriter, r *http.Request) {
+	// ?batch=<id>&abort=1 discards an open batch. Any body is ignored
+	if _, abort := r.URL.Query()["abort"]; abort {
+		s.hCollectionPOSTBatchAbort(w, r)
+		return
+	}
+
 	// accept text/plain from old (broken) clients
 	ct := getMediaType(r.Header.Get("Content-Type"))
 	if ct != "application/json" && ct != "text/plain" && ct != "application/newlines" {
-		sendRequestProblem(w, r, http.StatusUnsupportedMediaType, errors.Errorf("Not acceptable Content-Type: %s", ct))
+		WeaveUnsupportedMediaType(w, r, errors.Errorf("Not acceptable Content-Type: %s", ct))
 		return
 	}
 
@@ -663,6 +1634,8 @@ func (s *SyncUserHandler) hCollectionPOST(w http.ResponseWriter, r *http.Request
 	if err != nil {
 		if err == syncstorage.ErrInvalidCollectionName {
 			sendRequestProblem(w, r, http.StatusBadRequest, errors.Wrap(err, "Invalid collection name"))
+		} else if err == syncstorage.ErrNotFound {
+			sendRequestProblem(w, r, http.StatusNotFound, errors.Wrap(err, "Collection does not exist"))
 		} else {
 			InternalError(w, r, err)
 		}
@@ -689,17 +1662,40 @@ func (s *SyncUserHandler) hCollectionPOST(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// setQuotaRemaining sends X-Weave-Quota-Remaining, in KB, when
+// quotas are enabled
+func (s *SyncUserHandler) setQuotaRemaining(w http.ResponseWriter, remaining int) {
+	if s.config.QuotaBytes > 0 {
+		w.Header().Set("X-Weave-Quota-Remaining", strconv.Itoa(remaining/1024))
+	}
+}
+
 // hCollectionPOSTClassic is the historical POST handling logic prior to
 // the addition of atomic commits from multiple POST requests
 func (s *SyncUserHandler) hCollectionPOSTClassic(collectionId int, w http.ResponseWriter, r *http.Request) {
 
-	bsoToBeProcessed, results, err := RequestToPostBSOInput(r, s.config.MaxRecordPayloadBytes)
+	if r.ContentLength > 0 && r.ContentLength > int64(s.config.MaxPOSTBytes) {
+		s.setLimitHeaders(w, "max_post_bytes")
+		WeaveSizeLimitExceeded(w, r,
+			errors.Errorf("MaxPOSTBytes exceeded in request.ContentLength(%d) > %d",
+				r.ContentLength, s.config.MaxPOSTBytes))
+		return
+	}
+
+	bsoToBeProcessed, results, err := s.requestToPostBSOInput(w, r)
 	if err != nil {
-		WeaveInvalidWBOError(w, r, errors.Wrap(err, "Failed turning POST body into BSO work list"))
 		return
 	}
 
+	if s.config.AllowServerIds {
+		if err := AssignServerIds(bsoToBeProcessed); err != nil {
+			InternalError(w, r, err)
+			return
+		}
+	}
+
 	if len(bsoToBeProcessed) > s.config.MaxPOSTRecords {
+		s.setLimitHeaders(w, "max_post_records")
 		sendRequestProblem(w, r, http.StatusRequestEntityTooLarge,
 			errors.Errorf("Exceed %d BSO per request", s.config.MaxPOSTRecords))
 		return
@@ -707,11 +1703,19 @@ func (s *SyncUserHandler) hCollectionPOSTClassic(collectionId int, w http.Respon
 
 	// Send the changes to the database and merge
 	// with `results` above
-	postResults, err := s.db.PostBSOs(collectionId, bsoToBeProcessed)
+	postResults, remaining, err := s.db.PostBSOsQuota(collectionId, bsoToBeProcessed, s.config.QuotaBytes)
 
-	if err != nil {
+	if err == syncstorage.ErrOverQuota {
+		s.setQuotaRemaining(w, remaining)
+		WeaveOverQuota(w, r, errors.Errorf("POST would exceed quota of %d bytes", s.config.QuotaBytes))
+	} else if err != nil {
 		InternalError(w, r, err)
 	} else {
+		s.setQuotaRemaining(w, remaining)
+		s.config.Journal.Record(s.uid, s.collectionName(r), JournalPost,
+			postResults.Modified, postResults.Success...)
+		s.observePayloads(bsoToBeProcessed)
+
 		for bsoId, failMessage := range postResults.Failed {
 			results.Failed[bsoId] = failMessage
 		}
@@ -725,6 +1729,106 @@ func (s *SyncUserHandler) hCollectionPOSTClassic(collectionId int, w http.Respon
 	}
 }
 
+// requestToPostBSOInput reads the BSOs in a POST body, sending the error
+// response when it can not
+func (s *SyncUserHandler) requestToPostBSOInput(w http.ResponseWriter, r *http.Request) (
+	syncstorage.PostBSOInput, *syncstorage.PostResults, error) {
+
+	bsos, results, err := RequestToPostBSOInput(r, s.config.MaxRecordPayloadBytes, s.config.MaxRecordLineBytes)
+	if errors.Cause(err) == ErrRecordTooLong {
+		WeaveSizeLimitExceeded(w, r, err)
+	} else if err != nil {
+		WeaveInvalidWBOError(w, r, errors.Wrap(err, "Failed turning POST body into BSO work list"))
+	}
+
+	return bsos, results, err
+}
+
+// observePayloads records the size of the payloads written by a POST or
+// batch commit. BSOs that only update the sortindex or ttl are skipped
+func (s *SyncUserHandler) observePayloads(bsos syncstorage.PostBSOInput) {
+	for _, bso := range bsos {
+		if bso.Payload != nil {
+			s.config.PayloadSizes.Observe(float64(len(*bso.Payload)))
+		}
+	}
+}
+
+// batchCommitted checks if batch id was recently committed
+func (s *SyncUserHandler) batchCommitted(id int) bool {
+	for _, committed := range s.committedBatches {
+		if committed == id {
+			return true
+		}
+	}
+	return false
+}
+
+// batchCommitDone remembers that batch id was committed
+func (s *SyncUserHandler) batchCommitDone(id int) {
+	if len(s.committedBatches) >= committedBatchesKept {
+		s.committedBatches = s.committedBatches[1:]
+	}
+	s.committedBatches = append(s.committedBatches, id)
+}
+
+// hCollectionPOSTBatchAbort removes a batch that a client will not commit
+// instead of waiting for it to expire
+func (s *SyncUserHandler) hCollectionPOSTBatchAbort(w http.ResponseWriter, r *http.Request) {
+	batchFound, batchId, batchCommit := GetBatchIdAndCommit(r)
+	if !batchFound || batchId == "true" {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Batch ID expected with abort"))
+		return
+	}
+
+	if batchCommit {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.New("Batch can not be committed and aborted"))
+		return
+	}
+
+	id, err := batchIdInt(batchId)
+	if err != nil {
+		sendRequestProblem(w, r, http.StatusBadRequest, errors.Wrap(err, "Invalid Batch ID Format"))
+		return
+	}
+
+	notFound := errors.Errorf("Batch id: %s does not exist", batchId)
+
+	cId, err := s.getcid(r, false)
+	if err != nil {
+		if err == syncstorage.ErrInvalidCollectionName {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.Wrap(err, "Invalid collection name"))
+		} else if err == syncstorage.ErrNotFound {
+			sendRequestProblem(w, r, http.StatusBadRequest, notFound)
+		} else {
+			InternalError(w, r, err)
+		}
+		return
+	}
+
+	if found, err := s.db.BatchExists(id, cId, s.config.MaxBatchTTL); err != nil {
+		InternalError(w, r, err)
+		return
+	} else if !found {
+		sendRequestProblem(w, r, http.StatusBadRequest, notFound)
+		return
+	}
+
+	if err := s.db.BatchRemove(id); err != nil {
+		InternalError(w, r, errors.Wrap(err, "Failed removing batch"))
+		return
+	}
+
+	modified, err := s.db.GetCollectionModified(cId)
+	if err != nil {
+		InternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(modified))
+	JSON(w, r, http.StatusOK, map[string]string{"batch": batchId})
+}
+
 // hCollectionPOSTBatch handles batch=? requests. It is called internally by hCollectionPOST
 // to handle batch request logic
 func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.ResponseWriter, r *http.Request) {
@@ -735,19 +1839,20 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 	for _, headerName := range []string{"X-Weave-Total-Records", "X-Weave-Total-Bytes", "X-Weave-Records", "X-Weave-Bytes"} {
 		if strVal := r.Header.Get(headerName); strVal != "" {
 			if intVal, err := strconv.Atoi(strVal); err == nil {
-				max := 0
+				max, limit := 0, ""
 				switch headerName {
 				case "X-Weave-Total-Records":
-					max = s.config.MaxTotalRecords
+					max, limit = s.config.MaxTotalRecords, "max_total_records"
 				case "X-Weave-Total-Bytes":
-					max = s.config.MaxTotalBytes
+					max, limit = s.config.MaxTotalBytes, "max_total_bytes"
 				case "X-Weave-Bytes":
-					max = s.config.MaxPOSTBytes
+					max, limit = s.config.MaxPOSTBytes, "max_post_bytes"
 				case "X-Weave-Records":
-					max = s.config.MaxPOSTRecords
+					max, limit = s.config.MaxPOSTRecords, "max_post_records"
 				}
 
 				if intVal > max {
+					s.setLimitHeaders(w, limit)
 					WeaveSizeLimitExceeded(w, r,
 						errors.Errorf("Limit %s exceed. %d/%d", headerName, intVal, max))
 					return
@@ -763,6 +1868,7 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 	// CHECK the POST size, if possible from client supplied data
 	// hopefully shortcut a fail if this exceeds limits
 	if r.ContentLength > 0 && r.ContentLength > int64(s.config.MaxPOSTBytes) {
+		s.setLimitHeaders(w, "max_post_bytes")
 		WeaveSizeLimitExceeded(w, r,
 			errors.Errorf("MaxPOSTBytes exceeded in request.ContentLength(%d) > %d",
 				r.ContentLength, s.config.MaxPOSTBytes))
@@ -770,14 +1876,21 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 	}
 
 	// EXTRACT actual data to check
-	bsoToBeProcessed, results, err := RequestToPostBSOInput(r, s.config.MaxRecordPayloadBytes)
+	bsoToBeProcessed, results, err := s.requestToPostBSOInput(w, r)
 	if err != nil {
-		WeaveInvalidWBOError(w, r, errors.Wrap(err, "Failed turning POST body into BSO work list"))
 		return
 	}
 
+	if s.config.AllowServerIds {
+		if err := AssignServerIds(bsoToBeProcessed); err != nil {
+			InternalError(w, r, err)
+			return
+		}
+	}
+
 	// CHECK actual BSOs sent to see if they exceed limits
 	if len(bsoToBeProcessed) > s.config.MaxPOSTRecords {
+		s.setLimitHeaders(w, "max_post_records")
 		sendRequestProblem(w, r, http.StatusRequestEntityTooLarge,
 			errors.Errorf("Exceeded %d BSO per request", s.config.MaxPOSTRecords))
 		return
@@ -811,11 +1924,21 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 			return
 		}
 
-		if found, err := s.db.BatchExists(id, collectionId); err != nil {
+		// TidyUp only purges expired batches every so often, until then
+		// they are not found so they can not be appended to or committed
+		if found, err := s.db.BatchExists(id, collectionId, s.config.MaxBatchTTL); err != nil {
 			InternalError(w, r, err)
+			return
+		} else if !found && s.batchCommitted(id) {
+			// requests are serialized so a commit sent twice at once, e.g. by
+			// a client retrying too quickly, only applies the BSOs once
+			sendRequestProblem(w, r, http.StatusConflict,
+				errors.Errorf("Batch id: %s was already committed", batchId))
+			return
 		} else if !found {
 			sendRequestProblem(w, r, http.StatusBadRequest,
 				errors.Errorf("Batch id: %s does not exist", batchId))
+			return
 		}
 	}
 
@@ -913,12 +2036,19 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 			return
 		}
 
-		rawJSON := ReadNewlineJSON(bytes.NewBufferString(batchRecord.BSOS))
+		// the records were checked when they were appended. The server
+		// encoded them so escaping can make them longer than they were sent
+		rawJSON, err := ReadNewlineJSON(bytes.NewBufferString(batchRecord.BSOS), 0)
+		if err != nil {
+			InternalError(w, r, errors.Wrap(err, "Could not read batch data"))
+			return
+		}
 
 		// CHECK final data before committing it to the database
 		numInBatch := len(rawJSON)
 		if numInBatch > s.config.MaxTotalRecords {
 			s.db.BatchRemove(dbBatchId)
+			s.setLimitHeaders(w, "max_total_records")
 			WeaveSizeLimitExceeded(w, r,
 				errors.Errorf("Too many BSOs (%d) in Batch(%d)", numInBatch, dbBatchId))
 			return
@@ -946,6 +2076,7 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 			sum := sum + len(*bso.Payload)
 			if sum > s.config.MaxTotalBytes {
 				s.db.BatchRemove(dbBatchId)
+				s.setLimitHeaders(w, "max_total_bytes")
 				WeaveSizeLimitExceeded(w, r,
 					errors.Errorf("Batch size(%d) exceeded MaxTotalBytes limit(%d)",
 						sum, s.config.MaxTotalBytes))
@@ -954,12 +2085,22 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 			}
 		}
 
-		postResults, err := s.db.PostBSOs(collectionId, postData)
-		if err != nil {
+		postResults, remaining, err := s.db.PostBSOsQuota(collectionId, postData, s.config.QuotaBytes)
+		if err == syncstorage.ErrOverQuota {
+			s.db.BatchRemove(dbBatchId)
+			s.setQuotaRemaining(w, remaining)
+			WeaveOverQuota(w, r, errors.Errorf("Batch commit would exceed quota of %d bytes", s.config.QuotaBytes))
+			return
+		} else if err != nil {
 			InternalError(w, r, err)
 			return
 		}
 
+		s.setQuotaRemaining(w, remaining)
+		s.config.Journal.Record(s.uid, s.collectionName(r), JournalPost,
+			postResults.Modified, postResults.Success...)
+		s.observePayloads(postData)
+
 		// merge failures
 		for key, reasons := range postResults.Failed {
 			if failures[key] == nil {
@@ -971,6 +2112,7 @@ func (s *SyncUserHandler) hCollectionPOSTBatch(collectionId int, w http.Response
 
 		// DELETE the batch from the DB
 		s.db.BatchRemove(dbBatchId)
+		s.batchCommitDone(dbBatchId)
 
 		w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(postResults.Modified))
 
@@ -1020,13 +2162,56 @@ func (s *SyncUserHandler) hCollectionDELETE(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	var bidlist []string
 	bids, idExists := r.URL.Query()["ids"]
-	var modified int
 	if idExists {
-		bidlist := strings.Split(bids[0], ",")
-		if len(bidlist) > s.config.MaxPOSTRecords {
+		bidlist = strings.Split(bids[0], ",")
+	}
+
+	// ?ids_in_body=1 takes the ids as a JSON array in the body so
+	// long lists do not run into URL length limits
+	switch r.URL.Query().Get("ids_in_body") {
+	case "1", "true":
+		if idExists {
+			sendRequestProblem(w, r, http.StatusBadRequest,
+				errors.New("ids and ids_in_body can not be used together"))
+			return
+		}
+
+		if ct := getMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+			WeaveUnsupportedMediaType(w, r, errors.Errorf("Not acceptable Content-Type: %s", ct))
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&bidlist); err != nil {
 			sendRequestProblem(w, r, http.StatusBadRequest,
-				errors.New("Exceeded max allowed records"))
+				errors.Wrap(err, "Could not decode ids, expected a JSON array of strings"))
+			return
+		}
+
+		if len(bidlist) == 0 {
+			sendRequestProblem(w, r, http.StatusBadRequest, errors.New("No ids to delete"))
+			return
+		}
+		idExists = true
+	}
+
+	var modified int
+	if idExists {
+		if !s.idsOk(w, r, len(bidlist)) {
+			return
+		}
+
+		// trimming would turn "b1\t" into b1, deleting a BSO
+		// the client did not ask for
+		for _, id := range bidlist {
+			if strings.Contains(id, "\t") {
+				sendRequestProblem(w, r, http.StatusBadRequest, errors.Errorf("Invalid bso id %q", id))
+				return
+			}
+		}
+
+		if !bsoIdsOk(w, r, bidlist) {
 			return
 		}
 
@@ -1035,12 +2220,14 @@ func (s *SyncUserHandler) hCollectionDELETE(w http.ResponseWriter, r *http.Reque
 			InternalError(w, r, err)
 			return
 		}
+		s.config.Journal.Record(s.uid, s.collectionName(r), JournalDelete, modified, bidlist...)
 	} else {
 		modified, err = s.db.DeleteCollection(cId)
 		if err != nil {
 			InternalError(w, r, err)
 			return
 		}
+		s.config.Journal.Record(s.uid, s.collectionName(r), JournalDeleteCollection, modified)
 	}
 
 	m := syncstorage.ModifiedToString(modified)
@@ -1050,7 +2237,14 @@ func (s *SyncUserHandler) hCollectionDELETE(w http.ResponseWriter, r *http.Reque
 }
 func (s *SyncUserHandler) hBsoGET(w http.ResponseWriter, r *http.Request) {
 
-	if !AcceptHeaderOk(w, r) {
+	// ?raw=1 returns just the payload so the Accept header does not apply
+	raw := false
+	switch r.URL.Query().Get("raw") {
+	case "1", "true":
+		raw = true
+	}
+
+	if !raw && !AcceptHeaderOk(w, r) {
 		return
 	}
 
@@ -1083,6 +2277,23 @@ func (s *SyncUserHandler) hBsoGET(w http.ResponseWriter, r *http.Request) {
 		}
 		m := syncstorage.ModifiedToString(bso.Modified)
 		w.Header().Set("X-Last-Modified", m)
+
+		// lets clients budget bandwidth before reading the body
+		w.Header().Set("X-Weave-Payload-Size", strconv.Itoa(len(bso.Payload)))
+
+		if raw {
+			contentType := s.config.RawContentType
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(bso.Payload)))
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, bso.Payload)
+			return
+		}
+
+		s.outputBSO(bso)
 		JsonNewline(w, r, bso)
 	} else {
 		if err == syncstorage.ErrNotFound {
@@ -1101,7 +2312,7 @@ func (s *SyncUserHandler) hBsoPUT(w http.ResponseWriter, r *http.Request) {
 	// accept text/plain from old (broken) clients
 	ct := getMediaType(r.Header.Get("Content-Type"))
 	if ct != "application/json" && ct != "text/plain" && ct != "application/newlines" {
-		sendRequestProblem(w, r, http.StatusUnsupportedMediaType, errors.Errorf("Not acceptable Content-Type: %s", ct))
+		WeaveUnsupportedMediaType(w, r, errors.Errorf("Not acceptable Content-Type: %s", ct))
 		return
 	}
 
@@ -1119,34 +2330,79 @@ func (s *SyncUserHandler) hBsoPUT(w http.ResponseWriter, r *http.Request) {
 
 	cId, err = s.getcid(r, true)
 	if err != nil {
-		InternalError(w, r, err)
+		if err == syncstorage.ErrNotFound {
+			sendRequestProblem(w, r, http.StatusNotFound, errors.Wrap(err, "Collection does not exist"))
+		} else {
+			InternalError(w, r, err)
+		}
 		return
 	}
 
+	exists := true
 	modified, err = s.db.GetBSOModified(cId, bId)
 	if err != nil {
 		if err != syncstorage.ErrNotFound {
 			InternalError(w, r, errors.Wrap(err, "Could not get Modified ts"))
 			return
 		}
+		exists = false
 	}
 
 	if sentNotModified(w, r, modified) {
 		return
 	}
 
+	// If-None-Match: * only creates the BSO, an existing one is not
+	// overwritten. Requests are serialized so it can not be created
+	// between here and the write
+	if exists && r.Header.Get("If-None-Match") == "*" {
+		w.Header().Set("X-Last-Modified", syncstorage.ModifiedToString(modified))
+		sendRequestProblem(w, r, http.StatusPreconditionFailed,
+			errors.Errorf("BSO %s already exists", bId))
+		return
+	}
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		InternalError(w, r, errors.New("PUT could not read JSON body"))
 		return
 	}
 
+	// All fields in the body are optional. The id, when provided, must
+	// match the one in the URL. Missing fields leave an existing BSO's values
+	// unchanged, unless it is replaced, or use the defaults for a new BSO
 	var bso syncstorage.PutBSOInput
 	if err := parseIntoBSO(body, &bso); err != nil {
 		WeaveInvalidWBOError(w, r, errors.Wrap(err, "Could not parse body into BSO"))
 		return
 	}
 
+	if bso.Id != "" && bso.Id != bId {
+		WeaveInvalidWBOError(w, r, errors.Errorf("BSO id in body (%s) does not match URL (%s)", bso.Id, bId))
+		return
+	}
+
+	// ?replace=1 overwrites the whole BSO, missing fields are reset to
+	// their defaults instead of being left unchanged
+	var replace bool
+	switch r.URL.Query().Get("replace") {
+	case "1", "true":
+		replace = true
+	}
+
+	if bso.Payload == nil && bso.SortIndex == nil && bso.TTL == nil {
+		if exists && !replace {
+			// nothing to change
+			m := syncstorage.ModifiedToString(modified)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Last-Modified", m)
+			w.Write([]byte(m))
+			return
+		}
+
+		bso.Payload = syncstorage.String("")
+	}
+
 	if bso.Payload != nil && len(*bso.Payload) > s.config.MaxRecordPayloadBytes {
 		sendRequestProblem(w, r,
 			http.StatusRequestEntityTooLarge,
@@ -1161,12 +2417,27 @@ func (s *SyncUserHandler) hBsoPUT(w http.ResponseWriter, r *http.Request) {
 		bso.TTL = &tmp
 	}
 
-	modified, err = s.db.PutBSO(cId, bId, bso.Payload, bso.SortIndex, bso.TTL)
+	var remaining int
+	if replace {
+		modified, remaining, err = s.db.ReplaceBSOQuota(cId, bId, bso.Payload, bso.SortIndex, bso.TTL, s.config.QuotaBytes)
+	} else {
+		modified, remaining, err = s.db.PutBSOQuota(cId, bId, bso.Payload, bso.SortIndex, bso.TTL, s.config.QuotaBytes)
+	}
 
-	if err != nil {
+	if err == syncstorage.ErrOverQuota {
+		WeaveOverQuota(w, r, errors.Errorf("PUT would exceed quota of %d bytes", s.config.QuotaBytes))
+		return
+	} else if err != nil {
 		sendRequestProblem(w, r, http.StatusBadRequest, err)
 		return
 	}
+
+	s.setQuotaRemaining(w, remaining)
+	s.config.Journal.Record(s.uid, s.collectionName(r), JournalPut, modified, bId)
+	if bso.Payload != nil {
+		s.config.PayloadSizes.Observe(float64(len(*bso.Payload)))
+	}
+
 	m := syncstorage.ModifiedToString(modified)
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Last-Modified", m)
@@ -1213,6 +2484,7 @@ func (s *SyncUserHandler) hBsoDELETE(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		InternalError(w, r, err)
 	} else {
+		s.config.Journal.Record(s.uid, s.collectionName(r), JournalDelete, modified, bso.Id)
 		m := syncstorage.ModifiedToString(modified)
 		w.Header().Set("Content-Type", "text/plain")
 		w.Header().Set("X-Last-Modified", m)
@@ -1225,7 +2497,10 @@ func (s *SyncUserHandler) hDeleteEverything(w http.ResponseWriter, r *http.Reque
 	if err != nil {
 		InternalError(w, r, err)
 	} else {
-		m := syncstorage.ModifiedToString(syncstorage.Now())
+		modified := syncstorage.Now()
+		s.config.Journal.Record(s.uid, "", JournalDeleteEverything, modified)
+
+		m := syncstorage.ModifiedToString(modified)
 		w.Header().Set("Content-Type", "text/plain")
 		w.Header().Set("X-Last-Modified", m)
 		w.Write([]byte(m))
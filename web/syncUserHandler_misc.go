@@ -2,21 +2,29 @@ package web
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"strconv"
-	"strings"
 	"sync"
 
 	"github.com/mozilla-services/go-syncstorage/syncstorage"
 	"github.com/pkg/errors"
 )
 
+// ErrRecordTooLong is returned when a line of application/newlines data
+// is longer than the limit
+var ErrRecordTooLong = errors.New("Record too long")
+
 // RequestToPostBSOInput extracts and unmarshals request.Body into a syncstorage.PostBSOInput. It
-// returns a PostResults as well since it also validates BSOs
-func RequestToPostBSOInput(r *http.Request, maxPayloadSize int) (
+// returns a PostResults as well since it also validates BSOs. Lines of
+// application/newlines bodies longer than maxLineSize fail with ErrRecordTooLong
+func RequestToPostBSOInput(r *http.Request, maxPayloadSize, maxLineSize int) (
 	syncstorage.PostBSOInput,
 	*syncstorage.PostResults,
 	error,
@@ -36,7 +44,10 @@ func RequestToPostBSOInput(r *http.Request, maxPayloadSize int) (
 			return nil, nil, errors.Wrap(err, "Could not unmarshal Request body")
 		}
 	} else { // deal with application/newlines
-		raw = ReadNewlineJSON(r.Body)
+		var err error
+		if raw, err = ReadNewlineJSON(r.Body, maxLineSize); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	for _, rawJSON := range raw {
@@ -70,9 +81,30 @@ func RequestToPostBSOInput(r *http.Request, maxPayloadSize int) (
 	return bsoToBeProcessed, results, nil
 }
 
+// AssignServerIds gives BSOs without an id a new random one. The ids
+// are 12 URL safe base64 characters like the ones clients generate
+func AssignServerIds(bsos syncstorage.PostBSOInput) error {
+	for _, b := range bsos {
+		if b.Id != "" {
+			continue
+		}
+
+		buf := make([]byte, 9)
+		if _, err := rand.Read(buf); err != nil {
+			return errors.Wrap(err, "Could not generate BSO id")
+		}
+
+		b.Id = base64.RawURLEncoding.EncodeToString(buf)
+	}
+
+	return nil
+}
+
 const (
+	// scannerTokenSize is the size of the pooled scanner buffers. Longer
+	// lines, up to the max line length, grow a new buffer.
 	// why 257KB?
-	// - 256 KB for BSO payload max size
+	// - 256 KB for a typical large BSO payload
 	// -   1 KB for json bits, key names, and other values
 	scannerTokenSize = 257 * 1024
 )
@@ -83,21 +115,57 @@ var scannerPool = sync.Pool{
 	},
 }
 
+// scanRecords is a bufio.SplitFunc like bufio.ScanLines that also
+// treats a lone \r as the end of a line. JSON strings can not contain
+// raw newlines so any of \n, \r\n or \r separates records
+func scanRecords(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	// request more data
+	return 0, nil, nil
+}
+
 // ReadNewlineDelimitedJSON takes newline separate JSON and produces
-// produces an array of json.RawMessage
-func ReadNewlineJSON(data io.Reader) []json.RawMessage {
+// produces an array of json.RawMessage. A line longer than maxLine bytes
+// stops reading with ErrRecordTooLong so a stream without newlines is
+// not buffered without limit. A maxLine <= 0 is unlimited, only for data
+// the server wrote itself
+func ReadNewlineJSON(data io.Reader, maxLine int) ([]json.RawMessage, error) {
 
 	raw := []json.RawMessage{}
 
 	buf := scannerPool.Get().([]byte)
+	defer scannerPool.Put(buf)
+
+	if maxLine <= 0 {
+		maxLine = math.MaxInt32
+	}
+
+	// the scanner allows tokens as large as its initial buffer, and
+	// needs one more byte to find the end of a line
+	initial := buf
+	if maxLine < len(initial) {
+		initial = initial[: maxLine+1 : maxLine+1]
+	}
 
 	scanner := bufio.NewScanner(data)
-	scanner.Buffer(buf, scannerTokenSize)
+	scanner.Buffer(initial, maxLine+1)
+	scanner.Split(scanRecords)
 	for scanner.Scan() {
-		bsoBytes := scanner.Bytes()
+		bsoBytes := bytes.TrimSpace(scanner.Bytes())
 
 		// ignore empty lines
-		if len(strings.TrimSpace(string(bsoBytes))) == 0 {
+		if len(bsoBytes) == 0 {
 			continue
 		}
 
@@ -107,8 +175,13 @@ func ReadNewlineJSON(data io.Reader) []json.RawMessage {
 		raw = append(raw, c)
 	}
 
-	scannerPool.Put(buf)
-	return raw
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		return nil, errors.Wrapf(ErrRecordTooLong, "Line longer than %d bytes", maxLine)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Could not read newline JSON")
+	}
+
+	return raw, nil
 }
 
 func GetBatchIdAndCommit(r *http.Request) (batchFound bool, batchId string, batchCommit bool) {
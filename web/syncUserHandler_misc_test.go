@@ -11,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -70,7 +71,10 @@ func TestReadNewlineJSON(t *testing.T) {
 		buf.WriteByte('\n')
 	}
 
-	rawJSON := ReadNewlineJSON(buf)
+	rawJSON, err := ReadNewlineJSON(buf, scannerTokenSize)
+	if !assert.NoError(err) {
+		return
+	}
 	if !assert.Equal(numBSOs, len(rawJSON)) {
 		return
 	}
@@ -86,6 +90,51 @@ func TestReadNewlineJSON(t *testing.T) {
 	}
 }
 
+func TestReadNewlineJSONSeparators(t *testing.T) {
+	assert := assert.New(t)
+
+	body := "\r\n" +
+		"{\"id\":\"lf\"}\n" +
+		"  {\"id\":\"crlf\"}  \r\n" +
+		"\r\n\t\r\n" +
+		"{\"id\":\"cr\"}\r" +
+		"{\"id\":\"last\"}"
+
+	raw, err := ReadNewlineJSON(strings.NewReader(body), 100)
+	if !assert.NoError(err) {
+		return
+	}
+	if !assert.Len(raw, 4) {
+		return
+	}
+
+	for i, id := range []string{"lf", "crlf", "cr", "last"} {
+		assert.Equal(`{"id":"`+id+`"}`, string(raw[i]))
+	}
+}
+
+func TestReadNewlineJSONMaxLine(t *testing.T) {
+	assert := assert.New(t)
+
+	// exactly the max with each kind of line ending, or at the end
+	line := `{"id":"` + strings.Repeat("x", 91) + `"}`
+	for _, end := range []string{"\n", "\r\n", "\r", ""} {
+		raw, err := ReadNewlineJSON(strings.NewReader(`{"id":"a"}`+"\n"+line+end), 100)
+		if assert.NoError(err) {
+			assert.Len(raw, 2)
+		}
+	}
+
+	// one byte more is refused
+	_, err := ReadNewlineJSON(strings.NewReader(`{"id":"a"}`+"\n"+line+" \n"), 100)
+	assert.Equal(ErrRecordTooLong, errors.Cause(err))
+
+	// longer than the pooled buffer too
+	long := strings.NewReader(strings.Repeat("x", scannerTokenSize*3))
+	_, err = ReadNewlineJSON(long, scannerTokenSize*2)
+	assert.Equal(ErrRecordTooLong, errors.Cause(err))
+}
+
 func TestRequestToPostBSOInput(t *testing.T) {
 	assert := assert.New(t)
 	uid := "123456"
@@ -98,7 +147,7 @@ func TestRequestToPostBSOInput(t *testing.T) {
 	]`)
 		req, _ := http.NewRequest("POST", url, body)
 		req.Header.Add("Content-Type", "application/json")
-		pInput, pResults, err := RequestToPostBSOInput(req, 256*1024)
+		pInput, pResults, err := RequestToPostBSOInput(req, 256*1024, 257*1024)
 		if assert.NoError(err) {
 			if assert.NotNil(pInput) {
 				assert.Equal(2, len(pInput))
@@ -116,7 +165,7 @@ func TestRequestToPostBSOInput(t *testing.T) {
 		`)
 		req, _ := http.NewRequest("POST", url, body)
 		req.Header.Add("Content-Type", "application/newline")
-		pInput, pResults, err := RequestToPostBSOInput(req, 256*1024)
+		pInput, pResults, err := RequestToPostBSOInput(req, 256*1024, 257*1024)
 		if assert.NoError(err) {
 			if assert.NotNil(pInput) {
 				assert.Equal(2, len(pInput))
@@ -135,7 +184,7 @@ func TestRequestToPostBSOInput(t *testing.T) {
 
 		req, _ := http.NewRequest("POST", url, body)
 		req.Header.Add("Content-Type", "application/newline")
-		pInput, pResults, err := RequestToPostBSOInput(req, 5)
+		pInput, pResults, err := RequestToPostBSOInput(req, 5, 257*1024)
 		if assert.NoError(err) {
 			if assert.NotNil(pInput) {
 				assert.Equal(1, len(pInput))
@@ -170,7 +219,7 @@ func BenchmarkReadNewlineJSON(b *testing.B) {
 	// make a ReadSeeker out of it
 	reader := bytes.NewReader(buf.Bytes())
 	for i := 0; i < b.N; i++ {
-		ReadNewlineJSON(reader)
+		ReadNewlineJSON(reader, scannerTokenSize)
 		reader.Seek(0, io.SeekStart)
 	}
 }
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,6 +24,7 @@ type jsonBSO struct {
 	Modified  float64 `json:"modified"`
 	Payload   string  `json:"payload"`
 	SortIndex int     `json:"sortindex"`
+	TTL       *int    `json:"ttl"`
 }
 
 func TestSyncUserHandlerStopPurgeClose(t *testing.T) {
@@ -64,6 +68,7 @@ func TestSyncUserHandlerInfoCollections(t *testing.T) {
 
 	resp := request("GET", syncurl(uid, "info/collections"), nil, handler)
 	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal(strconv.Itoa(resp.Body.Len()), resp.Header().Get("Content-Length"))
 	results := make(map[string]float32)
 	if err := json.Unmarshal(resp.Body.Bytes(), &results); !assert.NoError(err) {
 		return
@@ -80,6 +85,66 @@ func TestSyncUserHandlerInfoCollections(t *testing.T) {
 	}
 }
 
+func TestSyncUserHandlerMaxInfoCollections(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxInfoCollections = 5
+	handler := NewSyncUserHandler(uid, db, config)
+
+	for i := 0; i < 20; i++ {
+		cId, err := db.CreateCollection(fmt.Sprintf("col%02d", i))
+		if !assert.NoError(err) {
+			return
+		}
+		_, err = db.PutBSO(cId, "b0", syncstorage.String("data"), nil, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		db.TouchCollection(cId, (i+1)*1000)
+	}
+
+	{ // the most recently modified collections are kept
+		resp := request("GET", syncurl(uid, "info/collections"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("20", resp.Header().Get("X-Weave-Info-Truncated"))
+
+		results := make(map[string]float64)
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+			assert.Len(results, 5)
+			assert.Contains(results, "col19")
+			assert.NotContains(results, "col00")
+		}
+	}
+
+	for _, endpoint := range []string{"info/collection_counts", "info/collection_usage"} {
+		resp := request("GET", syncurl(uid, endpoint), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code, endpoint)
+		assert.Equal("20", resp.Header().Get("X-Weave-Info-Truncated"), endpoint)
+
+		results := make(map[string]float64)
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results), endpoint) {
+			assert.Len(results, 5, endpoint)
+		}
+	}
+
+	{ // users under the limit are not affected
+		uid := uniqueUID()
+		db, _ := syncstorage.NewDB(":memory:", nil)
+		handler := NewSyncUserHandler(uid, db, config)
+		_, err := db.PutBSO(1, "b0", syncstorage.String("data"), nil, nil)
+		if !assert.NoError(err) {
+			return
+		}
+
+		resp := request("GET", syncurl(uid, "info/collections"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("", resp.Header().Get("X-Weave-Info-Truncated"))
+	}
+}
+
 func TestSyncUserHandlerInfoCollectionCounts(t *testing.T) {
 	assert := assert.New(t)
 
@@ -100,6 +165,7 @@ func TestSyncUserHandlerInfoCollectionCounts(t *testing.T) {
 	resp := request("GET", syncurl(uid, "info/collection_counts"), nil, handler)
 	assert.Equal(http.StatusOK, resp.Code)
 	assert.Equal(`{"bookmarks":1,"history":1,"passwords":1}`, resp.Body.String())
+	assert.Equal(strconv.Itoa(resp.Body.Len()), resp.Header().Get("Content-Length"))
 }
 
 func TestSyncUserHandlerInfoCollectionUsage(t *testing.T) {
@@ -221,6 +287,52 @@ func TestSyncUserHandlerInfoConfiguration(t *testing.T) {
 	}
 }
 
+func TestSyncUserHandlerMaxRecordPayloadBytes(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+
+	// a deployment with a smaller limit than the default
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxRecordPayloadBytes = 10
+	handler := NewSyncUserHandler(uid, db, config)
+
+	{ // clients are told about it
+		resp := request("GET", syncurl(uid, "info/configuration"), nil, handler)
+		jdata := make(map[string]int)
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &jdata)) {
+			assert.Equal(10, jdata["max_record_payload_bytes"])
+		}
+	}
+
+	atLimit := strings.Repeat("x", 10)
+	overLimit := atLimit + "x"
+
+	{ // POST fails only the BSOs over the limit
+		body := fmt.Sprintf(`[{"id":"ok", "payload":"%s"}, {"id":"big", "payload":"%s"}]`, atLimit, overLimit)
+		resp := jsonrequest("POST", syncurl(uid, "storage/test"), bytes.NewBufferString(body), handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		var results PostResults
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+			assert.Equal([]string{"ok"}, results.Success)
+			assert.Equal([]string{"Payload too large"}, results.Failed["big"])
+		}
+	}
+
+	{ // PUT
+		resp := jsonrequest("PUT", syncurl(uid, "storage/test/ok"),
+			bytes.NewBufferString(`{"payload":"`+atLimit+`"}`), handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+		resp = jsonrequest("PUT", syncurl(uid, "storage/test/big"),
+			bytes.NewBufferString(`{"payload":"`+overLimit+`"}`), handler)
+		assert.Equal(http.StatusRequestEntityTooLarge, resp.Code, resp.Body.String())
+	}
+}
+
 // TestSyncUserHandlerPOST tests that POSTs behave correctly
 func TestSyncUserHandlerPOST(t *testing.T) {
 	t.Parallel()
@@ -240,6 +352,8 @@ func TestSyncUserHandlerPOST(t *testing.T) {
 		if !assert.Equal(http.StatusUnsupportedMediaType, resp.Code) {
 			return
 		}
+		assert.Equal("application/json", resp.Header().Get("Content-Type"))
+		assert.Equal(WEAVE_ILLEGAL_METH, resp.Body.String())
 	}
 
 	// Make sure INSERT works first
@@ -361,6 +475,163 @@ func TestSyncUserHandlerPOST(t *testing.T) {
 }
 
 // TestSyncUserHandlerPOSTBatch tests that a batch can be created, appended to and commited
+func TestSyncUserHandlerPOSTServerIds(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+	url := syncurl(uid, "storage/bookmarks")
+
+	{ // by default an id is required
+		handler := NewSyncUserHandler(uid, db, nil)
+		body := bytes.NewBufferString(`[{"payload":"no id"}]`)
+		resp := requestheaders("POST", url, body, header, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+		var results PostResults
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+			assert.Len(results.Success, 0)
+			assert.Len(results.Failed, 1)
+		}
+	}
+
+	config := NewDefaultSyncUserHandlerConfig()
+	config.AllowServerIds = true
+	handler := NewSyncUserHandler(uid, db, config)
+
+	body := bytes.NewBufferString(`[{"payload":"no id"}, {"id":"bso1", "payload":"has id"}]`)
+	resp := requestheaders("POST", url, body, header, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	var results PostResults
+	if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+		return
+	}
+	assert.Len(results.Failed, 0)
+	if !assert.Len(results.Success, 2) {
+		return
+	}
+
+	generated := results.Success[0]
+	if generated == "bso1" {
+		generated = results.Success[1]
+	}
+	assert.True(syncstorage.BSOIdOk(generated))
+	assert.Len(generated, 12)
+
+	cId, _ := db.GetCollectionId("bookmarks")
+	bso, err := db.GetBSO(cId, generated)
+	if assert.NoError(err) {
+		assert.Equal("no id", bso.Payload)
+	}
+}
+
+func TestSyncUserHandlerPOSTResultsOrder(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxRecordPayloadBytes = 1
+	handler := NewSyncUserHandler(uid, db, config)
+
+	body := `[
+		{"id":"z", "payload":"too big"},
+		{"id":"s2", "payload":"-"},
+		{"id":"m", "payload":"too big"},
+		{"id":"s1", "payload":"-"},
+		{"id":"a", "sortindex":"bad"},
+		{"id":"s3", "payload":"-"}
+	]`
+
+	var first string
+	for i := 0; i < 10; i++ {
+		resp := jsonrequest("POST", syncurl(uid, "storage/test"), bytes.NewBufferString(body), handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		// modified changes with every POST
+		result := resp.Body.String()
+		result = result[strings.Index(result, `"success"`):]
+		if i == 0 {
+			first = result
+			assert.Equal(`"success":["s2","s1","s3"],`+
+				`"failed":{"a":["invalid sortindex"],"m":["Payload too large"],"z":["Payload too large"]}}`,
+				strings.TrimSpace(result))
+		} else {
+			assert.Equal(first, result)
+		}
+	}
+}
+
+func TestSyncUserHandlerPOSTNewlinesCRLF(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	body := bytes.NewBufferString("{\"id\":\"b0\", \"payload\":\"a\"}\r\n" +
+		"{\"id\":\"b1\", \"payload\":\"b\"}\r\n\r\n" +
+		"{\"id\":\"b2\", \"payload\":\"c\"}\r" +
+		"{\"id\":\"b3\", \"payload\":\"d\"}\r\n")
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/newlines")
+	resp := requestheaders("POST", syncurl(uid, "storage/test"), body, header, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	var results PostResults
+	if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+		assert.Equal([]string{"b0", "b1", "b2", "b3"}, results.Success)
+		assert.Len(results.Failed, 0)
+	}
+
+	cId, err := db.GetCollectionId("test")
+	if !assert.NoError(err) {
+		return
+	}
+
+	for i, payload := range []string{"a", "b", "c", "d"} {
+		b, err := db.GetBSO(cId, "b"+strconv.Itoa(i))
+		if assert.NoError(err) {
+			assert.Equal(payload, b.Payload)
+		}
+	}
+}
+
+func TestSyncUserHandlerPOSTNewlinesLineTooLong(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.MaxRecordLineBytes = 64 * 1024
+	handler := NewSyncUserHandler(uid, db, conf)
+
+	for _, path := range []string{"storage/test", "storage/test?batch=true"} {
+		// a record followed by 1MB without a newline
+		body := io.MultiReader(
+			strings.NewReader(`{"id":"b0", "payload":"a"}`+"\n"),
+			strings.NewReader(strings.Repeat("x", 1024*1024)),
+		)
+
+		header := make(http.Header)
+		header.Set("Content-Type", "application/newlines")
+		resp := requestheaders("POST", syncurl(uid, path), body, header, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, path)
+		assert.Equal(WEAVE_SIZE_LIMIT_EXCEEDED, resp.Body.String(), path)
+	}
+
+	// nothing was written
+	resp := request("GET", syncurl(uid, "info/collection_counts"), nil, handler)
+	assert.Equal("{}", resp.Body.String())
+}
+
 func TestSyncUserHandlerPOSTBatch(t *testing.T) {
 
 	assert := assert.New(t)
@@ -650,6 +921,284 @@ func TestSyncUserHandlerBatchLimits(t *testing.T) {
 	}
 }
 
+func TestSyncUserHandlerBatchAbort(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	uid := "123456"
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+
+	url := syncurl(uid, "storage/col")
+	body := bytes.NewBufferString(`[{"id":"b0","payload":"x"},{"id":"b1","payload":"x"}]`)
+	resp := requestheaders("POST", url+"?batch=true", body, header, handler)
+	if !assert.Equal(http.StatusAccepted, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	var createResults PostResults
+	if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &createResults)) {
+		return
+	}
+	batchId := createResults.Batch
+
+	{ // bad requests
+		for _, query := range []string{
+			"?abort=1",
+			"?batch=true&abort=1",
+			"?batch=" + batchId + "&commit=1&abort=1",
+			"?batch=b999&abort=1",
+			"?batch=nope&abort=1",
+		} {
+			resp := request("POST", url+query, nil, handler)
+			assert.Equal(http.StatusBadRequest, resp.Code, query)
+		}
+
+		// batches belong to a collection
+		resp := request("POST", syncurl(uid, "storage/other?abort=1&batch="+batchId), nil, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code)
+	}
+
+	// no body or content type is needed
+	resp = request("POST", url+"?abort=1&batch="+batchId, nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	cId, _ := db.GetCollectionId("col")
+	id, _ := batchIdInt(batchId)
+	found, err := db.BatchExists(id, cId, 0)
+	if assert.NoError(err) {
+		assert.False(found)
+	}
+
+	// the batch can not be aborted again, appended to or committed
+	resp = request("POST", url+"?abort=1&batch="+batchId, nil, handler)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+
+	body = bytes.NewBufferString(`[{"id":"b2","payload":"x"}]`)
+	resp = requestheaders("POST", url+"?commit=1&batch="+batchId, body, header, handler)
+	assert.Equal(http.StatusBadRequest, resp.Code, resp.Body.String())
+
+	// nothing was written
+	resp = request("GET", url, nil, handler)
+	assert.Equal("[]", resp.Body.String())
+}
+
+func TestSyncUserHandlerBatchExpired(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	uid := "123456"
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxBatchTTL = 50
+	handler := NewSyncUserHandler(uid, db, config)
+
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+
+	url := syncurl(uid, "storage/col")
+	body := bytes.NewBufferString(`[{"id":"b0","payload":"x"}]`)
+	resp := requestheaders("POST", url+"?batch=true", body, header, handler)
+	if !assert.Equal(http.StatusAccepted, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	var createResults PostResults
+	if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &createResults)) {
+		return
+	}
+	batchId := createResults.Batch
+
+	// appending keeps the batch alive
+	body = bytes.NewBufferString(`[{"id":"b1","payload":"x"}]`)
+	resp = requestheaders("POST", url+"?batch="+batchId, body, header, handler)
+	if !assert.Equal(http.StatusAccepted, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	for _, query := range []string{"?batch=" + batchId, "?commit=1&batch=" + batchId} {
+		body = bytes.NewBufferString(`[{"id":"b2","payload":"x"}]`)
+		resp = requestheaders("POST", url+query, body, header, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, query)
+	}
+
+	// nothing was written, the expired batch is left for TidyUp to purge
+	cId, _ := db.GetCollectionId("col")
+	id, _ := batchIdInt(batchId)
+	found, err := db.BatchExists(id, cId, 0)
+	if assert.NoError(err) {
+		assert.True(found)
+	}
+
+	resp = request("GET", url, nil, handler)
+	assert.Equal("[]", resp.Body.String())
+}
+
+func TestSyncUserHandlerBatchCommitTwice(t *testing.T) {
+	assert := assert.New(t)
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	uid := "123456"
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+
+	url := syncurl(uid, "storage/col")
+	body := bytes.NewBufferString(`[{"id":"b0","payload":"x"}]`)
+	resp := requestheaders("POST", url+"?batch=true", body, header, handler)
+	if !assert.Equal(http.StatusAccepted, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	var createResults PostResults
+	if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &createResults)) {
+		return
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := bytes.NewBufferString(`[{"id":"b1","payload":"x"}]`)
+			results[i] = requestheaders("POST", url+"?commit=1&batch="+createResults.Batch, body, header, handler)
+		}(i)
+	}
+	wg.Wait()
+
+	var committed *httptest.ResponseRecorder
+	codes := []int{}
+	for _, resp := range results {
+		codes = append(codes, resp.Code)
+		if resp.Code == http.StatusOK {
+			committed = resp
+		}
+	}
+	assert.Contains(codes, http.StatusOK)
+	assert.Contains(codes, http.StatusConflict)
+	if committed == nil {
+		return
+	}
+
+	var commitResults PostResults
+	if !assert.NoError(json.Unmarshal(committed.Body.Bytes(), &commitResults)) {
+		return
+	}
+
+	// the BSOs were written once, by the successful commit
+	cId, _ := db.GetCollectionId("col")
+	modified, err := db.GetCollectionModified(cId)
+	if assert.NoError(err) {
+		assert.Equal(commitResults.Modified, modified)
+	}
+
+	resp = request("GET", url+"?sort=oldest", nil, handler)
+	assert.Equal(`["b0","b1"]`, resp.Body.String())
+
+	// batches that never existed are still a bad request
+	body = bytes.NewBufferString(`[]`)
+	resp = requestheaders("POST", url+"?commit=1&batch=b999", body, header, handler)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+}
+
+func TestSyncUserHandlerPOSTLimitHints(t *testing.T) {
+	assert := assert.New(t)
+	uid := "123456"
+
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+
+	newHandler := func() *SyncUserHandler {
+		db, _ := syncstorage.NewDB(":memory:", nil)
+		handler := NewSyncUserHandler(uid, db, nil)
+		handler.config.MaxPOSTRecords = 2
+		handler.config.MaxPOSTBytes = 100
+		handler.config.MaxTotalRecords = 3
+		handler.config.MaxTotalBytes = 1000
+		return handler
+	}
+
+	checkHints := func(resp *httptest.ResponseRecorder, status int, limit string) {
+		if !assert.Equal(status, resp.Code, resp.Body.String()) {
+			return
+		}
+		if status == http.StatusBadRequest {
+			assert.Equal(WEAVE_SIZE_LIMIT_EXCEEDED, resp.Body.String())
+		}
+		assert.Equal(limit, resp.Header().Get("X-Weave-Limit-Exceeded"))
+		assert.Equal("2", resp.Header().Get("X-Weave-Records"))
+		assert.Equal("100", resp.Header().Get("X-Weave-Bytes"))
+		assert.Equal("3", resp.Header().Get("X-Weave-Total-Records"))
+		assert.Equal("1000", resp.Header().Get("X-Weave-Total-Bytes"))
+	}
+
+	threeBSOs := `[{"id":"b0","payload":"x"},{"id":"b1","payload":"x"},{"id":"b2","payload":"x"}]`
+	bigBSO := `[{"id":"b0","payload":"` + strings.Repeat("x", 100) + `"}]`
+
+	for _, url := range []string{syncurl(uid, "storage/col"), syncurl(uid, "storage/col?batch=true")} {
+		{ // too many records
+			body := bytes.NewBufferString(threeBSOs)
+			resp := requestheaders("POST", url, body, header, newHandler())
+			checkHints(resp, http.StatusRequestEntityTooLarge, "max_post_records")
+		}
+
+		{ // too many bytes
+			body := bytes.NewBufferString(bigBSO)
+			resp := requestheaders("POST", url, body, header, newHandler())
+			checkHints(resp, http.StatusBadRequest, "max_post_bytes")
+		}
+	}
+
+	{ // limits from the client's batch headers
+		url := syncurl(uid, "storage/col?batch=true")
+		tests := map[string]string{
+			"X-Weave-Records":       "max_post_records",
+			"X-Weave-Bytes":         "max_post_bytes",
+			"X-Weave-Total-Records": "max_total_records",
+			"X-Weave-Total-Bytes":   "max_total_bytes",
+		}
+		for headerName, limit := range tests {
+			header := make(http.Header)
+			header.Add("Content-Type", "application/json")
+			header.Add(headerName, "10000")
+			body := bytes.NewBufferString(`[{"id":"b0","payload":"x"}]`)
+			resp := requestheaders("POST", url, body, header, newHandler())
+			checkHints(resp, http.StatusBadRequest, limit)
+		}
+	}
+
+	{ // too many records in the batch when it is committed
+		handler := newHandler()
+		url := syncurl(uid, "storage/col?batch=true")
+		body := bytes.NewBufferString(`[{"id":"b0","payload":"x"},{"id":"b1","payload":"x"}]`)
+		resp := requestheaders("POST", url, body, header, handler)
+		if !assert.Equal(http.StatusAccepted, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		url = syncurl(uid, "storage/col?commit=1&batch="+batchIdString(1))
+		body = bytes.NewBufferString(`[{"id":"b2","payload":"x"},{"id":"b3","payload":"x"}]`)
+		resp = requestheaders("POST", url, body, header, handler)
+		checkHints(resp, http.StatusBadRequest, "max_total_records")
+	}
+
+	{ // too many bytes in the batch when it is committed
+		handler := newHandler()
+		handler.config.MaxTotalBytes = 10
+		url := syncurl(uid, "storage/col?batch=true&commit=1")
+		body := bytes.NewBufferString(`[{"id":"b0","payload":"` + strings.Repeat("x", 20) + `"}]`)
+		resp := requestheaders("POST", url, body, header, handler)
+		if assert.Equal(http.StatusBadRequest, resp.Code, resp.Body.String()) {
+			assert.Equal("max_total_bytes", resp.Header().Get("X-Weave-Limit-Exceeded"))
+			assert.Equal("10", resp.Header().Get("X-Weave-Total-Bytes"))
+		}
+	}
+}
+
 func TestSyncUserHandlerPUT(t *testing.T) {
 	t.Parallel()
 	assert := assert.New(t)
@@ -711,6 +1260,8 @@ func TestSyncUserHandlerPUT(t *testing.T) {
 		if !assert.Equal(http.StatusUnsupportedMediaType, resp.Code) {
 			return
 		}
+		assert.Equal("application/json", resp.Header().Get("Content-Type"))
+		assert.Equal(WEAVE_ILLEGAL_METH, resp.Body.String())
 	}
 
 	var badCrypto = `{"id":"keys", "payload":"{\"ciphertext\":\"IDontKnowWhatImDoing\",\"IV\":\"AAAAAAAAAAAAAAAAAAAAAA==\"}"}`
@@ -731,13 +1282,150 @@ func TestSyncUserHandlerPUT(t *testing.T) {
 
 }
 
-func TestSyncUserHandlerTidyUp(t *testing.T) {
+func TestSyncUserHandlerPUTFields(t *testing.T) {
 	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
 
-	{ // test skipping of purging works
-		db, _ := syncstorage.NewDB(":memory:", nil)
-		config := NewDefaultSyncUserHandlerConfig()
-		config.MaxBatchTTL = 1
+	put := func(bId, body string) *httptest.ResponseRecorder {
+		return jsonrequest("PUT", syncurl(uid, "storage/col/"+bId),
+			bytes.NewBufferString(body), handler)
+	}
+
+	{ // id in the body must match the URL
+		resp := put("b0", `{"id":"b1", "payload":"x"}`)
+		assert.Equal(http.StatusBadRequest, resp.Code)
+		assert.Equal(WEAVE_INVALID_WBO, resp.Body.String())
+
+		resp = put("b0", `{"id":"b0", "payload":"x"}`)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	}
+
+	cId, _ := db.GetCollectionId("col")
+
+	{ // missing payload on an existing BSO changes nothing
+		before, _ := db.GetBSO(cId, "b0")
+		resp := put("b0", `{"id":"b0"}`)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.Equal(syncstorage.ModifiedToString(before.Modified), resp.Header().Get("X-Last-Modified"))
+
+		after, _ := db.GetBSO(cId, "b0")
+		assert.Equal(before, after)
+	}
+
+	{ // missing payload on a new BSO creates it with an empty payload
+		resp := put("b2", `{}`)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+		bso, err := db.GetBSO(cId, "b2")
+		if assert.NoError(err) {
+			assert.Equal("", bso.Payload)
+		}
+	}
+
+	{ // missing payload but other fields
+		resp := put("b0", `{"sortindex": 3}`)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+		bso, _ := db.GetBSO(cId, "b0")
+		assert.Equal("x", bso.Payload)
+		assert.Equal(3, bso.SortIndex)
+	}
+}
+
+func TestSyncUserHandlerPUTIfNoneMatch(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	header.Set("If-None-Match", "*")
+
+	url := syncurl(uid, "storage/col/b0")
+
+	resp := requestheaders("PUT", url, bytes.NewBufferString(`{"payload":"first"}`), header, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+	created := resp.Header().Get("X-Last-Modified")
+
+	resp = requestheaders("PUT", url, bytes.NewBufferString(`{"payload":"second"}`), header, handler)
+	if assert.Equal(http.StatusPreconditionFailed, resp.Code, resp.Body.String()) {
+		assert.Equal(created, resp.Header().Get("X-Last-Modified"))
+	}
+
+	cId, _ := db.GetCollectionId("col")
+	bso, err := db.GetBSO(cId, "b0")
+	if assert.NoError(err) {
+		assert.Equal("first", bso.Payload)
+	}
+
+	// without the header PUT still overwrites
+	resp = jsonrequest("PUT", url, bytes.NewBufferString(`{"payload":"third"}`), handler)
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+}
+
+func TestSyncUserHandlerPUTReplace(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	put := func(path, body string) *httptest.ResponseRecorder {
+		return jsonrequest("PUT", syncurl(uid, path), bytes.NewBufferString(body), handler)
+	}
+
+	resp := put("storage/col/b0", `{"payload":"x","sortindex":10,"ttl":3600}`)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+	cId, _ := db.GetCollectionId("col")
+
+	{ // a regular PUT keeps the sortindex
+		resp := put("storage/col/b0", `{"payload":"y"}`)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		bso, _ := db.GetBSO(cId, "b0")
+		assert.Equal(10, bso.SortIndex)
+	}
+
+	resp = put("storage/col/b0?replace=1", `{"payload":"z"}`)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	bso, err := db.GetBSO(cId, "b0")
+	if assert.NoError(err) {
+		assert.Equal("z", bso.Payload)
+		assert.Equal(0, bso.SortIndex)
+		assert.Equal(resp.Header().Get("X-Last-Modified"), syncstorage.ModifiedToString(bso.Modified))
+	}
+
+	ttl, err := db.GetBSOTTL(cId, "b0")
+	if assert.NoError(err) {
+		assert.Equal(syncstorage.NoTTL, ttl)
+	}
+
+	{ // an empty body resets everything
+		put("storage/col/b0", `{"sortindex":4}`)
+		resp := put("storage/col/b0?replace=1", `{}`)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+		bso, _ := db.GetBSO(cId, "b0")
+		assert.Equal("", bso.Payload)
+		assert.Equal(0, bso.SortIndex)
+	}
+}
+
+func TestSyncUserHandlerTidyUp(t *testing.T) {
+	assert := assert.New(t)
+
+	{ // test skipping of purging works
+		db, _ := syncstorage.NewDB(":memory:", nil)
+		config := NewDefaultSyncUserHandlerConfig()
+		config.MaxBatchTTL = 1
 		handler := NewSyncUserHandler(uniqueUID(), db, config)
 
 		// no purge value in db will always skip, pointless doing a purge
@@ -807,7 +1495,7 @@ func TestSyncUserHandlerTidyUp(t *testing.T) {
 		}
 
 		// make sure the batch was purged
-		exists, err := db.BatchExists(batchId, cId)
+		exists, err := db.BatchExists(batchId, cId, 0)
 		if !assert.NoError(err) && !assert.False(exists) {
 			return
 		}
@@ -822,6 +1510,75 @@ func TestSyncUserHandlerTidyUp(t *testing.T) {
 	}
 }
 
+func TestSyncUserHandlerTidyUpCollectionPurge(t *testing.T) {
+	assert := assert.New(t)
+
+	// an expired and a live BSO in tabs and bookmarks
+	setup := func(intervals map[string]time.Duration) (*syncstorage.DB, *SyncUserHandler) {
+		db, _ := syncstorage.NewDB(":memory:", nil)
+		config := NewDefaultSyncUserHandlerConfig()
+		config.CollectionPurgeIntervals = intervals
+		handler := NewSyncUserHandler(uniqueUID(), db, config)
+
+		for _, cId := range []int{7, 9} {
+			_, err := db.PostBSOs(cId, syncstorage.PostBSOInput{
+				syncstorage.NewPutBSOInput("b0", syncstorage.String("x"), nil, syncstorage.Int(1)),
+				syncstorage.NewPutBSOInput("b1", syncstorage.String("x"), nil, nil),
+			})
+			assert.NoError(err)
+		}
+
+		// timestamps have 10ms resolution
+		time.Sleep(20 * time.Millisecond)
+		return db, handler
+	}
+
+	{ // tabs is purged on its shorter schedule while the rest waits
+		db, handler := setup(map[string]time.Duration{"tabs": 10 * time.Millisecond})
+
+		// schedules the first purges
+		skipped, _, err := handler.TidyUp(time.Hour, time.Hour, 0)
+		assert.NoError(err)
+		assert.True(skipped)
+
+		time.Sleep(15 * time.Millisecond)
+		skipped, _, err = handler.TidyUp(time.Hour, time.Hour, 0)
+		assert.NoError(err)
+		assert.True(skipped, "regular purge should not be due yet")
+
+		purged, err := db.PurgeExpiredCollection(9)
+		if assert.NoError(err) {
+			assert.Equal(0, purged, "tabs should already be purged")
+		}
+		purged, err = db.PurgeExpiredCollection(7)
+		if assert.NoError(err) {
+			assert.Equal(1, purged, "bookmarks should still be waiting")
+		}
+	}
+
+	{ // the regular purge skips collections with a longer schedule
+		db, handler := setup(map[string]time.Duration{"bookmarks": time.Hour})
+
+		handler.TidyUp(time.Nanosecond, time.Nanosecond, 0)
+		skipped, _, err := handler.TidyUp(time.Nanosecond, time.Nanosecond, 0)
+		assert.NoError(err)
+		assert.False(skipped)
+
+		purged, err := db.PurgeExpiredCollection(9)
+		if assert.NoError(err) {
+			assert.Equal(0, purged, "tabs should be purged with everything else")
+		}
+		purged, err = db.PurgeExpiredCollection(7)
+		if assert.NoError(err) {
+			assert.Equal(1, purged, "bookmarks should be waiting for its own schedule")
+		}
+
+		for _, cId := range []int{7, 9} {
+			_, err := db.GetBSO(cId, "b1")
+			assert.NoError(err)
+		}
+	}
+}
 func TestSyncUserHandlerCollectionGET(t *testing.T) {
 
 	assert := assert.New(t)
@@ -856,6 +1613,25 @@ func TestSyncUserHandlerCollectionGET(t *testing.T) {
 		assert.NotEqual("", resp.Header().Get("X-Last-Modified"))
 	}
 
+	{ // sort=modified is the same as newest
+		resp := request("GET", syncurl(uid, "storage/test?sort=modified"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.Equal(`["b5","b4","b3","b2","b1"]`, resp.Body.String())
+
+		resp = request("GET", syncurl(uid, "storage/test?sort=modified&full=1&limit=1"), nil, handler)
+		var results jsResult
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results), resp.Body.String()) && assert.Len(results, 1) {
+			assert.Equal("b5", results[0].Id)
+		}
+	}
+
+	{ // other values are rejected
+		for _, v := range []string{"bad", "Newest", "modified_desc"} {
+			resp := request("GET", syncurl(uid, "storage/test?sort="+v), nil, handler)
+			assert.Equal(http.StatusBadRequest, resp.Code, v)
+		}
+	}
+
 	{ // sort=oldest
 		resp := request("GET", syncurl(uid, "storage/test?sort=oldest"), nil, handler)
 		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
@@ -884,6 +1660,19 @@ func TestSyncUserHandlerCollectionGET(t *testing.T) {
 		assert.True(results[1].Modified > results[0].Modified)
 	}
 
+	{ // any value turns on full, even 0 or false. Only an empty value does not
+		for _, v := range []string{"0", "false", "1"} {
+			resp := request("GET", syncurl(uid, "storage/test?sort=oldest&ids=b1&full="+v), nil, handler)
+			var results jsResult
+			if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results), resp.Body.String()) && assert.Len(results, 1) {
+				assert.Equal("-", results[0].Payload, "full="+v)
+			}
+		}
+
+		resp := request("GET", syncurl(uid, "storage/test?sort=oldest&ids=b1&full="), nil, handler)
+		assert.Equal(`["b1"]`, resp.Body.String())
+	}
+
 	{ // test newer parameter
 		resp := request("GET", syncurl(uid, "storage/test?full=y&ids=b3"), nil, handler)
 		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
@@ -920,6 +1709,151 @@ func TestSyncUserHandlerCollectionGET(t *testing.T) {
 	}
 }
 
+func TestSyncUserHandlerCollectionGETNoNextOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	resp := jsonrequest("POST", syncurl(uid, "storage/test"),
+		bytes.NewBufferString(`[{"id":"b0", "payload":"-"}, {"id":"b1", "payload":"-"},
+			{"id":"b2", "payload":"-"}, {"id":"b3", "payload":"-"}]`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	for _, full := range []string{"", "&full=1"} {
+		for _, query := range []string{
+			"limit=2&offset=2", // the page ends exactly at the last record
+			"limit=4",          // the limit is the size of the collection
+			"limit=10",
+			"offset=1",
+			"",
+		} {
+			url := syncurl(uid, "storage/test?"+query+full)
+			resp := request("GET", url, nil, handler)
+			if assert.Equal(http.StatusOK, resp.Code, url) {
+				_, found := resp.Header()["X-Weave-Next-Offset"]
+				assert.False(found, url)
+			}
+		}
+
+		// a page with more after it still has the header
+		url := syncurl(uid, "storage/test?limit=3"+full)
+		resp := request("GET", url, nil, handler)
+		assert.Equal("3", resp.Header().Get("X-Weave-Next-Offset"), url)
+	}
+}
+
+func TestSyncUserHandlerCollectionGETMaxBSOGetLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.MaxBSOGetLimit = 3
+	handler := NewSyncUserHandler(uid, db, config)
+
+	resp := jsonrequest("POST", syncurl(uid, "storage/test"),
+		bytes.NewBufferString(`[{"id":"b0", "payload":"-"}, {"id":"b1", "payload":"-"},
+			{"id":"b2", "payload":"-"}, {"id":"b3", "payload":"-"}, {"id":"b4", "payload":"-"}]`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	for _, full := range []string{"", "&full=1"} {
+		for query, expected := range map[string]struct {
+			records int
+			next    string
+		}{
+			"sort=index":          {3, "3"},
+			"sort=index&limit=10": {3, "3"},
+			"sort=index&limit=2":  {2, "2"}, // smaller limits are kept
+			"sort=index&offset=3": {2, ""},
+			"sort=index&offset=1": {3, "4"},
+		} {
+			url := syncurl(uid, "storage/test?"+query+full)
+			resp := request("GET", url, nil, handler)
+			if !assert.Equal(http.StatusOK, resp.Code, url) {
+				continue
+			}
+
+			var results []json.RawMessage
+			if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results), url) {
+				assert.Len(results, expected.records, url)
+			}
+			assert.Equal(strconv.Itoa(expected.records), resp.Header().Get("X-Weave-Records"), url)
+			assert.Equal(expected.next, resp.Header().Get("X-Weave-Next-Offset"), url)
+		}
+	}
+}
+
+func TestSyncUserHandlerReadsDoNotCreateCollections(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	for _, req := range []struct{ method, path string }{
+		{"GET", "info/collections"},
+		{"GET", "info/collection_usage"},
+		{"GET", "info/collection_counts"},
+		{"GET", "storage/unknown"},
+		{"GET", "storage/unknown?full=1"},
+		{"HEAD", "storage/unknown"},
+		{"GET", "storage/unknown/b0"},
+		{"DELETE", "storage/unknown"},
+		{"DELETE", "storage/unknown/b0"},
+	} {
+		resp := request(req.method, syncurl(uid, req.path), nil, handler)
+		assert.True(resp.Code < 500, req.method+" "+req.path)
+
+		_, err := db.GetCollectionId("unknown")
+		assert.Equal(syncstorage.ErrNotFound, err, req.method+" "+req.path)
+	}
+
+	info, err := db.InfoCollections()
+	if assert.NoError(err) {
+		assert.NotContains(info, "unknown")
+	}
+
+	// writes still create it
+	resp := jsonrequest("PUT", syncurl(uid, "storage/unknown/b0"), bytes.NewBufferString(`{"payload":"-"}`), handler)
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	_, err = db.GetCollectionId("unknown")
+	assert.NoError(err)
+}
+
+func TestSyncUserHandlerServerTiming(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+
+	resp := request("GET", syncurl(uid, "info/collections"), nil, NewSyncUserHandler(uid, db, nil))
+	assert.Equal("", resp.Header().Get("Server-Timing"))
+
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.ServerTiming = true
+	handler := NewSyncUserHandler(uid, db, conf)
+
+	for _, method := range []string{"GET", "DELETE"} {
+		resp := request(method, syncurl(uid, "storage/bookmarks"), nil, handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		var lock, dur float64
+		n, err := fmt.Sscanf(resp.Header().Get("Server-Timing"), "lock;dur=%f, db;dur=%f", &lock, &dur)
+		if assert.NoError(err, resp.Header().Get("Server-Timing")) && assert.Equal(2, n) {
+			assert.True(lock >= 0 && lock < 1000)
+			assert.True(dur >= 0 && dur < 1000)
+		}
+	}
+}
+
 func TestSyncUserHandlerBsoGET(t *testing.T) {
 
 	assert := assert.New(t)
@@ -953,7 +1887,161 @@ func TestSyncUserHandlerBsoGET(t *testing.T) {
 		assert.Equal("b0", result.Id)
 		assert.Equal("-", result.Payload)
 		assert.Equal(9, result.SortIndex)
+		assert.Equal("1", resp.Header().Get("X-Weave-Payload-Size"))
+	}
+
+	{ // payload size is in bytes, not characters
+		header := make(http.Header)
+		header.Add("Content-Type", "application/json")
+		resp := requestheaders("PUT", syncurl(uid, "storage/test/b1"),
+			bytes.NewBufferString(`{"payload":"h\u00e9llo"}`), header, handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		cId, _ := db.GetCollectionId("test")
+		bso, err := db.GetBSO(cId, "b1")
+		if !assert.NoError(err) {
+			return
+		}
+
+		resp = request("GET", syncurl(uid, "storage/test/b1"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.Equal(strconv.Itoa(len(bso.Payload)), resp.Header().Get("X-Weave-Payload-Size"))
+		assert.Equal("6", resp.Header().Get("X-Weave-Payload-Size"))
+	}
+
+	{ // not sent for collection listings
+		resp := request("GET", syncurl(uid, "storage/test"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.Equal("", resp.Header().Get("X-Weave-Payload-Size"))
+	}
+}
+
+func TestSyncUserHandlerBsoGETRaw(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	payload := `{"ciphertext":"abc","IV":"def"}`
+	body, _ := json.Marshal(map[string]string{"payload": payload})
+	respPUT := jsonrequest("PUT", syncurl(uid, "storage/test/b0"), bytes.NewReader(body), handler)
+	if !assert.Equal(http.StatusOK, respPUT.Code, respPUT.Body.String()) {
+		return
+	}
+
+	{
+		header := make(http.Header)
+		header.Set("Accept", "*/*")
+		resp := requestheaders("GET", syncurl(uid, "storage/test/b0?raw=1"), nil, header, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.Equal(payload, resp.Body.String())
+		assert.Equal("application/octet-stream", resp.Header().Get("Content-Type"))
+		assert.Equal(respPUT.Header().Get("X-Last-Modified"), resp.Header().Get("X-Last-Modified"))
+	}
+
+	{ // configurable content type, Accept header is ignored
+		conf := NewDefaultSyncUserHandlerConfig()
+		conf.RawContentType = "text/plain"
+		handler := NewSyncUserHandler(uid, db, conf)
+
+		header := make(http.Header)
+		header.Set("Accept", "image/png")
+		resp := requestheaders("GET", syncurl(uid, "storage/test/b0?raw=true"), nil, header, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.Equal(payload, resp.Body.String())
+		assert.Equal("text/plain", resp.Header().Get("Content-Type"))
+	}
+
+	{ // missing BSO is still a JSON error
+		resp := request("GET", syncurl(uid, "storage/test/nope?raw=1"), nil, handler)
+		assert.Equal(http.StatusNotFound, resp.Code, resp.Body.String())
+	}
+}
+
+func TestSyncUserHandlerPayloadRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", &syncstorage.Config{DedupPayloads: true})
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.MaxRecordPayloadBytes = 1024
+	handler := NewSyncUserHandler(uid, db, conf)
+
+	payloads := map[string]string{
+		"empty":   "",
+		"max":     strings.Repeat("x", conf.MaxRecordPayloadBytes),
+		"escaped": "quote \" slash \\ newline \n tab \t <html> & \u2028",
+	}
+
+	for id, payload := range payloads {
+		body, _ := json.Marshal(map[string]string{"payload": payload})
+		resp := jsonrequest("PUT", syncurl(uid, "storage/test/"+id), bytes.NewReader(body), handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+	}
+
+	{ // one byte over the limit is refused
+		body, _ := json.Marshal(map[string]string{"payload": payloads["max"] + "x"})
+		resp := jsonrequest("PUT", syncurl(uid, "storage/test/over"), bytes.NewReader(body), handler)
+		assert.Equal(http.StatusRequestEntityTooLarge, resp.Code, resp.Body.String())
+	}
+
+	for id, payload := range payloads {
+		resp := request("GET", syncurl(uid, "storage/test/"+id), nil, handler)
+		var bso jsonBSO
+		if assert.Equal(http.StatusOK, resp.Code) && assert.NoError(json.Unmarshal(resp.Body.Bytes(), &bso)) {
+			assert.True(payload == bso.Payload, id)
+		}
+
+		header := make(http.Header)
+		header.Set("Accept", "*/*")
+		resp = requestheaders("GET", syncurl(uid, "storage/test/"+id+"?raw=1"), nil, header, handler)
+		assert.True(payload == resp.Body.String(), id)
+	}
+
+	resp := request("GET", syncurl(uid, "storage/test?full=1"), nil, handler)
+	var bsos jsResult
+	if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &bsos)) && assert.Len(bsos, len(payloads)) {
+		for _, bso := range bsos {
+			assert.True(payloads[bso.Id] == bso.Payload, bso.Id)
+		}
+	}
+}
+
+func TestSyncUserHandlerInvalidUTF8Payload(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	{ // POST fails only the BSO with the bad payload
+		body := bytes.NewBufferString("[{\"id\":\"good\", \"payload\":\"ok\"}, {\"id\":\"bad\", \"payload\":\"\xc3\x28\"}]")
+		resp := jsonrequest("POST", syncurl(uid, "storage/test"), body, handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		var results PostResults
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+			assert.Equal([]string{"good"}, results.Success)
+			assert.Equal([]string{"invalid payload"}, results.Failed["bad"])
+		}
+	}
+
+	{ // PUT is refused
+		body := bytes.NewBufferString("{\"payload\":\"\xff\"}")
+		resp := jsonrequest("PUT", syncurl(uid, "storage/test/bad"), body, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, resp.Body.String())
 	}
+
+	// nothing was stored for it
+	resp := request("GET", syncurl(uid, "storage/test/bad"), nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+
+	resp = request("GET", syncurl(uid, "storage/test/good"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
 }
 
 func TestSyncUserHandlerBsoDELETE(t *testing.T) {
@@ -1080,15 +2168,112 @@ func TestSyncUserHandlerCollectionDelete(t *testing.T) {
 		}
 	}
 
-	{ // test limit of deleting ids
-		// modifies the handler's config so do this last to avoid sidefeccts
-		handler.config.MaxPOSTRecords = 1
-		respDEL := request("DELETE", syncurl(uid, "storage/col?ids=a,b,c"), nil, handler)
-		assert.Equal(http.StatusBadRequest, respDEL.Code, respDEL.Body.String())
-	}
-}
-
-func TestSyncUserHandlerDeleteEverything(t *testing.T) {
+	{ // ids are validated like a GET's
+		resp := jsonrequest("POST", syncurl(uid, "storage/ids"),
+			bytes.NewBufferString(`[{"id":"b1","payload":"-"},{"id":"b2","payload":"-"}]`), handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		for _, ids := range []string{"b1,%09b2", "b1%09", "b1,,b2", "b1," + strings.Repeat("x", 65)} {
+			resp := request("DELETE", syncurl(uid, "storage/ids?ids="+ids), nil, handler)
+			assert.Equal(http.StatusBadRequest, resp.Code, ids)
+		}
+
+		resp = jsonrequest("DELETE", syncurl(uid, "storage/ids?ids_in_body=1"),
+			bytes.NewBufferString(`["b1","b2\t"]`), handler)
+		assert.Equal(http.StatusBadRequest, resp.Code)
+
+		// nothing was deleted by the bad requests, spaces are trimmed
+		resp = request("GET", syncurl(uid, "storage/ids?sort=oldest"), nil, handler)
+		assert.Equal(`["b1","b2"]`, resp.Body.String())
+
+		resp = request("DELETE", syncurl(uid, "storage/ids?ids=b1,%20b2"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.NotEqual("", resp.Header().Get("X-Last-Modified"))
+
+		resp = request("GET", syncurl(uid, "storage/ids"), nil, handler)
+		assert.Equal(`[]`, resp.Body.String())
+	}
+
+	{ // test limit of deleting ids
+		// modifies the handler's config so do this last to avoid sidefeccts
+		handler.config.MaxIdsPerRequest = 1
+		respDEL := request("DELETE", syncurl(uid, "storage/col?ids=a,b,c"), nil, handler)
+		if assert.Equal(http.StatusBadRequest, respDEL.Code, respDEL.Body.String()) {
+			assert.Equal(WEAVE_SIZE_LIMIT_EXCEEDED, respDEL.Body.String())
+		}
+	}
+}
+
+func TestSyncUserHandlerCollectionDeleteIdsInBody(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	// more ids than fit in a sensible URL
+	var bsos, deleted []string
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("%064d", i)
+		bsos = append(bsos, fmt.Sprintf(`{"id":"%s", "payload":"-"}`, id))
+		if i%2 == 0 {
+			deleted = append(deleted, id)
+		}
+	}
+
+	resp := jsonrequest("POST", syncurl(uid, "storage/col"),
+		bytes.NewBufferString("["+strings.Join(bsos, ",")+"]"), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	body, _ := json.Marshal(deleted)
+	resp = jsonrequest("DELETE", syncurl(uid, "storage/col?ids_in_body=1"), bytes.NewReader(body), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+	assert.NotEqual("", resp.Header().Get("X-Last-Modified"))
+
+	{ // only the ids in the body are gone
+		resp := request("GET", syncurl(uid, "storage/col"), nil, handler)
+		var ids []string
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &ids)) && assert.Len(ids, 50) {
+			for _, id := range ids {
+				assert.NotContains(deleted, id)
+			}
+		}
+	}
+
+	for _, test := range []struct {
+		query, contentType, body string
+		code                     int
+	}{
+		{"ids_in_body=1", "application/json", `[]`, http.StatusBadRequest},
+		{"ids_in_body=1", "application/json", `{"ids":["a"]}`, http.StatusBadRequest},
+		{"ids_in_body=1", "text/plain", `["a"]`, http.StatusUnsupportedMediaType},
+		{"ids_in_body=1&ids=a", "application/json", `["a"]`, http.StatusBadRequest},
+	} {
+		header := make(http.Header)
+		header.Set("Content-Type", test.contentType)
+		resp := requestheaders("DELETE", syncurl(uid, "storage/col?"+test.query),
+			bytes.NewBufferString(test.body), header, handler)
+		assert.Equal(test.code, resp.Code, test.body)
+	}
+
+	{ // the same limit as ids= applies
+		handler.config.MaxIdsPerRequest = 1
+		resp := jsonrequest("DELETE", syncurl(uid, "storage/col?ids_in_body=1"),
+			bytes.NewBufferString(`["a","b"]`), handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, resp.Body.String())
+	}
+
+	// nothing else was removed by the failed requests
+	counts, _ := db.InfoCollectionCounts()
+	assert.Equal(50, counts["col"])
+}
+
+func TestSyncUserHandlerDeleteEverything(t *testing.T) {
 	assert := assert.New(t)
 
 	uid := uniqueUID()
@@ -1121,3 +2306,1477 @@ func TestSyncUserHandlerDeleteEverything(t *testing.T) {
 		assert.Equal(http.StatusNotFound, resp.Code)
 	}
 }
+
+// TestSyncUserHandlerCollectionGETEmpty makes sure a collection that exists
+// but has had all its BSOs removed is distinguishable from one that
+// was never created
+func TestSyncUserHandlerCollectionGETEmpty(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+	body := bytes.NewBufferString(`[
+		{"id":"b1", "payload": "-"},
+		{"id":"b2", "payload": "-"}
+	]`)
+	respPOST := requestheaders("POST", syncurl(uid, "storage/col"), body, header, handler)
+	if !assert.Equal(http.StatusOK, respPOST.Code, respPOST.Body.String()) {
+		return
+	}
+
+	respDEL := request("DELETE", syncurl(uid, "storage/col?ids=b1,b2"), nil, handler)
+	if !assert.Equal(http.StatusOK, respDEL.Code, respDEL.Body.String()) {
+		return
+	}
+
+	{ // existing, but empty, collection
+		resp := request("GET", syncurl(uid, "storage/col"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.Equal("[]", resp.Body.String())
+		assert.Equal(respDEL.Header().Get("X-Last-Modified"), resp.Header().Get("X-Last-Modified"))
+		assert.NotEqual("0.00", resp.Header().Get("X-Last-Modified"))
+	}
+
+	{ // a collection that never existed has no last modified
+		resp := request("GET", syncurl(uid, "storage/nope"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.Equal("[]", resp.Body.String())
+		assert.Equal("", resp.Header().Get("X-Last-Modified"))
+	}
+}
+
+func TestSyncUserHandlerDisableAutoCreate(t *testing.T) {
+	assert := assert.New(t)
+
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+
+	{ // default creates collections on demand
+		uid := uniqueUID()
+		db, _ := syncstorage.NewDB(":memory:", nil)
+		handler := NewSyncUserHandler(uid, db, nil)
+
+		resp := requestheaders("POST", syncurl(uid, "storage/col1"),
+			bytes.NewBufferString(`[{"id":"b0", "payload":"-"}]`), header, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+		resp = requestheaders("PUT", syncurl(uid, "storage/col2/b0"),
+			bytes.NewBufferString(`{"payload":"-"}`), header, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+		_, err := db.GetCollectionId("col1")
+		assert.NoError(err)
+		_, err = db.GetCollectionId("col2")
+		assert.NoError(err)
+	}
+
+	{ // unknown collections are rejected
+		uid := uniqueUID()
+		db, _ := syncstorage.NewDB(":memory:", nil)
+		conf := NewDefaultSyncUserHandlerConfig()
+		conf.DisableAutoCreate = true
+		handler := NewSyncUserHandler(uid, db, conf)
+
+		resp := requestheaders("POST", syncurl(uid, "storage/col1"),
+			bytes.NewBufferString(`[{"id":"b0", "payload":"-"}]`), header, handler)
+		assert.Equal(http.StatusNotFound, resp.Code, resp.Body.String())
+
+		resp = requestheaders("PUT", syncurl(uid, "storage/col2/b0"),
+			bytes.NewBufferString(`{"payload":"-"}`), header, handler)
+		assert.Equal(http.StatusNotFound, resp.Code, resp.Body.String())
+
+		_, err := db.GetCollectionId("col1")
+		assert.Equal(syncstorage.ErrNotFound, err)
+		_, err = db.GetCollectionId("col2")
+		assert.Equal(syncstorage.ErrNotFound, err)
+
+		// pre-provisioned collections still work
+		_, err = db.CreateCollection("col3")
+		if !assert.NoError(err) {
+			return
+		}
+		resp = requestheaders("PUT", syncurl(uid, "storage/col3/b0"),
+			bytes.NewBufferString(`{"payload":"-"}`), header, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+		resp = requestheaders("POST", syncurl(uid, "storage/bookmarks"),
+			bytes.NewBufferString(`[{"id":"b0", "payload":"-"}]`), header, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	}
+}
+
+func TestSyncUserHandlerLockTimeout(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.LockTimeout = 50 * time.Millisecond
+	handler := NewSyncUserHandler(uid, db, conf)
+
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+
+	// simulate another writer holding the lock
+	handler.lock(0)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- requestheaders("PUT", syncurl(uid, "storage/col/b0"),
+			bytes.NewBufferString(`{"payload":"-"}`), header, handler)
+	}()
+
+	select {
+	case resp := <-done:
+		assert.Equal(http.StatusServiceUnavailable, resp.Code, resp.Body.String())
+		assert.NotEqual("", resp.Header().Get("X-Weave-Backoff"))
+		assert.NotEqual("", resp.Header().Get("Retry-After"))
+	case <-time.After(5 * time.Second):
+		assert.Fail("PUT did not time out")
+		return
+	}
+
+	// once released requests work again
+	handler.unlock()
+	resp := requestheaders("PUT", syncurl(uid, "storage/col/b0"),
+		bytes.NewBufferString(`{"payload":"-"}`), header, handler)
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+}
+
+func TestSyncUserHandlerConcurrentCollectionCreate(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+
+	// requests to one handler are serialized by its lock. Handlers sharing
+	// the database can interleave looking up and creating the collection
+	const numRequests = 40
+	var handlers []*SyncUserHandler
+	for i := 0; i < numRequests; i++ {
+		handlers = append(handlers, NewSyncUserHandler(uid, db, nil))
+	}
+
+	start := make(chan struct{})
+	done := make(chan *httptest.ResponseRecorder, numRequests)
+	for i := 0; i < numRequests; i++ {
+		go func(i int) {
+			body := bytes.NewBufferString(fmt.Sprintf(`[{"id":"b%d","payload":"-"}]`, i))
+			<-start
+			done <- jsonrequest("POST", syncurl(uid, "storage/brandnew"), body, handlers[i])
+		}(i)
+	}
+	close(start)
+
+	for i := 0; i < numRequests; i++ {
+		resp := <-done
+		if assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			var results PostResults
+			if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+				assert.Len(results.Failed, 0)
+			}
+		}
+	}
+
+	// every BSO ended up in the same collection
+	cId, err := db.GetCollectionId("brandnew")
+	if assert.NoError(err) {
+		results, err := db.GetBSOs(cId, nil, syncstorage.MaxTimestamp, 0, 0, syncstorage.SORT_NEWEST, -1, 0)
+		if assert.NoError(err) {
+			assert.Len(results.BSOs, numRequests)
+		}
+	}
+}
+
+func TestSyncUserHandlerMaxConcurrentRequests(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.MaxConcurrentRequests = 2
+	handler := NewSyncUserHandler(uid, db, conf)
+
+	// hold the lock so every request stays in flight
+	handler.lock(0)
+
+	const numRequests = 6
+	done := make(chan *httptest.ResponseRecorder, numRequests)
+	for i := 0; i < numRequests; i++ {
+		go func() {
+			done <- request("GET", syncurl(uid, "info/collections"), nil, handler)
+		}()
+	}
+
+	// requests over the limit fail right away
+	for i := 0; i < numRequests-conf.MaxConcurrentRequests; i++ {
+		select {
+		case resp := <-done:
+			assert.Equal(http.StatusTooManyRequests, resp.Code, resp.Body.String())
+			assert.Equal(strconv.Itoa(concurrencyBackoff), resp.Header().Get("Retry-After"))
+		case <-time.After(5 * time.Second):
+			assert.Fail("requests over the limit were not rejected")
+			handler.unlock()
+			return
+		}
+	}
+
+	// the rest were queued and finish once the lock is released
+	handler.unlock()
+	for i := 0; i < conf.MaxConcurrentRequests; i++ {
+		select {
+		case resp := <-done:
+			assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		case <-time.After(5 * time.Second):
+			assert.Fail("queued requests did not finish")
+			return
+		}
+	}
+
+	// the slots are freed
+	resp := request("GET", syncurl(uid, "info/collections"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+}
+
+func TestSyncUserHandlerPOSTOverQuota(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.QuotaBytes = 3000
+	handler := NewSyncUserHandler(uid, db, conf)
+
+	payload := strings.Repeat("x", 1024)
+	body := bytes.NewBufferString("[")
+	for i := 0; i < 5; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(body, `{"id":"b%d", "payload":"%s"}`, i, payload)
+	}
+	body.WriteString("]")
+
+	resp := jsonrequest("POST", syncurl(uid, "storage/col"), body, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	var results PostResults
+	if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+		return
+	}
+
+	assert.Equal([]string{"b0", "b1"}, results.Success)
+	assert.Len(results.Failed, 3)
+	for _, bId := range []string{"b2", "b3", "b4"} {
+		assert.Equal([]string{syncstorage.ErrOverQuota.Error()}, results.Failed[bId])
+	}
+	assert.Equal("0", resp.Header().Get("X-Weave-Quota-Remaining"))
+
+	{ // nothing fits, the POST is refused
+		resp := jsonrequest("POST", syncurl(uid, "storage/col"),
+			bytes.NewBufferString(fmt.Sprintf(`[{"id":"b2", "payload":"%s"}]`, payload)), handler)
+		assert.Equal(http.StatusForbidden, resp.Code)
+		assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+		assert.Equal("0", resp.Header().Get("X-Weave-Quota-Remaining"))
+
+		resp = request("GET", syncurl(uid, "info/collection_counts"), nil, handler)
+		assert.Equal(`{"col":2}`, resp.Body.String())
+	}
+
+	{ // also when the batch is committed
+		resp := jsonrequest("POST", syncurl(uid, "storage/col?batch=true&commit=true"),
+			bytes.NewBufferString(fmt.Sprintf(`[{"id":"b2", "payload":"%s"}]`, payload)), handler)
+		assert.Equal(http.StatusForbidden, resp.Code)
+		assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+	}
+
+	{ // header is not sent when quotas are disabled
+		handler := NewSyncUserHandler(uid, db, nil)
+		resp := jsonrequest("POST", syncurl(uid, "storage/col"),
+			bytes.NewBufferString(`[{"id":"b5", "payload":"-"}]`), handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.Equal("", resp.Header().Get("X-Weave-Quota-Remaining"))
+	}
+}
+
+func TestSyncUserHandlerPOSTQuotaExactLimit(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.QuotaBytes = 2048
+	handler := NewSyncUserHandler(uid, db, conf)
+
+	post := func(body string) (*PostResults, *httptest.ResponseRecorder) {
+		resp := jsonrequest("POST", syncurl(uid, "storage/col"), bytes.NewBufferString(body), handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return nil, resp
+		}
+
+		var results PostResults
+		if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+			return nil, resp
+		}
+		return &results, resp
+	}
+
+	payload := strings.Repeat("x", 1024)
+	results, resp := post(fmt.Sprintf(`[{"id":"b0","payload":"%s"},{"id":"b1","payload":"%s"}]`, payload, payload))
+	if assert.NotNil(results) {
+		assert.Equal([]string{"b0", "b1"}, results.Success)
+		assert.Len(results.Failed, 0)
+		assert.Equal("0", resp.Header().Get("X-Weave-Quota-Remaining"))
+	}
+
+	{ // usage is reported exactly
+		resp := request("GET", syncurl(uid, "info/quota"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("[2.00000000,0.00000000]", resp.Body.String())
+	}
+
+	resp = jsonrequest("POST", syncurl(uid, "storage/col"), bytes.NewBufferString(`[{"id":"b2","payload":"x"}]`), handler)
+	assert.Equal(http.StatusForbidden, resp.Code)
+	assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+	assert.Equal("0", resp.Header().Get("X-Weave-Quota-Remaining"))
+}
+
+func TestSyncUserHandlerPUTOverQuota(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.QuotaBytes = 3072
+	handler := NewSyncUserHandler(uid, db, conf)
+
+	put := func(bId string, size int) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"payload":"%s"}`, strings.Repeat("x", size))
+		return jsonrequest("PUT", syncurl(uid, "storage/col/"+bId), bytes.NewBufferString(body), handler)
+	}
+
+	resp := put("b0", 2048)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+	assert.Equal("1", resp.Header().Get("X-Weave-Quota-Remaining"))
+
+	resp = request("GET", syncurl(uid, "info/quota"), nil, handler)
+	assert.Equal("[2.00000000,1.00000000]", resp.Body.String())
+
+	// failed PUTs do not report usage, nothing was written
+	resp = put("b1", 2048)
+	assert.Equal(http.StatusForbidden, resp.Code)
+	assert.Equal(WEAVE_OVER_QUOTA, resp.Body.String())
+	assert.Equal("", resp.Header().Get("X-Weave-Quota-Remaining"))
+
+	resp = jsonrequest("PUT", syncurl(uid, "storage/col/b1"),
+		bytes.NewBufferString(`{"payload":"x", "sortindex":1000000000}`), handler)
+	assert.Equal(http.StatusBadRequest, resp.Code, resp.Body.String())
+	assert.Equal("", resp.Header().Get("X-Weave-Quota-Remaining"))
+
+	resp = request("GET", syncurl(uid, "storage/col/b1"), nil, handler)
+	assert.Equal(http.StatusNotFound, resp.Code)
+
+	// growing an existing BSO only counts the difference
+	resp = put("b0", 3072)
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	assert.Equal("0", resp.Header().Get("X-Weave-Quota-Remaining"))
+}
+
+func TestSyncUserHandlerCollectionGETCount(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	cId, _ := db.CreateCollection("test")
+	for i := 0; i < 10; i++ {
+		_, err := db.PutBSO(cId, fmt.Sprintf("b%d", i), syncstorage.String("data"), nil, nil)
+		if !assert.NoError(err) {
+			return
+		}
+	}
+
+	{ // not sent unless asked for
+		resp := request("GET", syncurl(uid, "storage/test?limit=3"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("", resp.Header().Get("X-Weave-Total-Records"))
+	}
+
+	for _, full := range []string{"", "&full=1"} {
+		resp := request("GET", syncurl(uid, "storage/test?limit=3&offset=3&count=1"+full), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("3", resp.Header().Get("X-Weave-Records"))
+		assert.Equal("10", resp.Header().Get("X-Weave-Total-Records"))
+	}
+
+	{ // counts only the matching records
+		resp := request("GET", syncurl(uid, "storage/test?ids=b1,b2,nope&limit=1&count=true"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("2", resp.Header().Get("X-Weave-Total-Records"))
+	}
+}
+
+func TestSyncUserHandlerCollectionGETOffsetAndAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	resp := jsonrequest("POST", syncurl(uid, "storage/test"),
+		bytes.NewBufferString(`[{"id":"b0", "payload":"-"}, {"id":"b1", "payload":"-"}]`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	resp = request("GET", syncurl(uid, "storage/test?limit=1&offset=1&after=b0"), nil, handler)
+	assert.Equal(http.StatusBadRequest, resp.Code)
+	assert.Contains(resp.Body.String(), "offset and after")
+
+	resp = request("GET", syncurl(uid, "storage/test?limit=1&offset=1"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+}
+
+func TestSyncUserHandlerCollectionGETExpiring(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+
+	// ttls are in seconds
+	for i, ttl := range []int{10, 100, 10000, 50} {
+		body := fmt.Sprintf(`{"payload":"-","sortindex":%d,"ttl":%d}`, i, ttl)
+		resp := requestheaders("PUT", syncurl(uid, fmt.Sprintf("storage/test/b%d", i)), bytes.NewBufferString(body), header, handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+	}
+
+	{ // no expiry limit
+		resp := request("GET", syncurl(uid, "storage/test?sort=index"), nil, handler)
+		assert.Equal(`["b3","b2","b1","b0"]`, resp.Body.String())
+	}
+
+	{
+		resp := request("GET", syncurl(uid, "storage/test?sort=index&expiring_within=200"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal(`["b3","b1","b0"]`, resp.Body.String())
+	}
+
+	{ // composes with limit and count
+		resp := request("GET", syncurl(uid, "storage/test?sort=index&expiring_within=200&limit=2&count=1&full=1"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("3", resp.Header().Get("X-Weave-Total-Records"))
+
+		var results jsResult
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) && assert.Len(results, 2) {
+			assert.Equal("b3", results[0].Id)
+			assert.Equal("b1", results[1].Id)
+		}
+	}
+
+	for _, bad := range []string{"-1", "soon"} {
+		resp := request("GET", syncurl(uid, "storage/test?expiring_within="+bad), nil, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, bad)
+	}
+}
+
+func TestSyncUserHandlerCollectionGETWithTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	for bId, body := range map[string]string{
+		"b0": `{"payload":"-","sortindex":2,"ttl":3600}`,
+		"b1": `{"payload":"-","sortindex":1}`,
+	} {
+		resp := jsonrequest("PUT", syncurl(uid, "storage/test/"+bId), bytes.NewBufferString(body), handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+	}
+
+	{ // not included unless asked for
+		resp := request("GET", syncurl(uid, "storage/test?full=1&sort=index"), nil, handler)
+		assert.NotContains(resp.Body.String(), "ttl")
+	}
+
+	resp := request("GET", syncurl(uid, "storage/test?full=1&sort=index&ttl=1"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code) {
+		return
+	}
+
+	var results jsResult
+	if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) && assert.Len(results, 2) {
+		assert.Equal("b0", results[0].Id)
+		if assert.NotNil(results[0].TTL) {
+			assert.True(*results[0].TTL > 3590 && *results[0].TTL <= 3600, "got %d", *results[0].TTL)
+		}
+
+		// never expires so there is no ttl
+		assert.Equal("b1", results[1].Id)
+		assert.Nil(results[1].TTL)
+	}
+
+	cId, _ := db.GetCollectionId("test")
+	ttl, err := db.GetBSOTTL(cId, "b0")
+	if assert.NoError(err) && assert.NotNil(results[0].TTL) {
+		assert.True(ttl-*results[0].TTL <= 1)
+	}
+}
+
+func TestSyncUserHandlerNormalizeCollectionNames(t *testing.T) {
+	assert := assert.New(t)
+
+	header := make(http.Header)
+	header.Add("Content-Type", "application/json")
+
+	{ // names are exact by default
+		uid := uniqueUID()
+		db, _ := syncstorage.NewDB(":memory:", nil)
+		handler := NewSyncUserHandler(uid, db, nil)
+
+		resp := requestheaders("PUT", syncurl(uid, "storage/Bookmarks/b0"), bytes.NewBufferString(`{"payload":"hi"}`), header, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+		resp = request("GET", syncurl(uid, "storage/bookmarks/b0"), nil, handler)
+		assert.Equal(http.StatusNotFound, resp.Code)
+	}
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	config := NewDefaultSyncUserHandlerConfig()
+	config.NormalizeCollectionNames = true
+	handler := NewSyncUserHandler(uid, db, config)
+
+	resp := requestheaders("PUT", syncurl(uid, "storage/Bookmarks/b0"), bytes.NewBufferString(`{"payload":"hi"}`), header, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	resp = request("GET", syncurl(uid, "storage/bookmarks/b0"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	resp = request("GET", syncurl(uid, "storage/BOOKMARKS?full=1"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	var results jsResult
+	if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) && assert.Len(results, 1) {
+		assert.Equal("b0", results[0].Id)
+	}
+
+	cId, err := db.GetCollectionId("bookmarks")
+	if assert.NoError(err) {
+		assert.Equal(7, cId)
+	}
+	_, err = db.GetCollectionId("Bookmarks")
+	assert.Equal(syncstorage.ErrNotFound, err)
+}
+
+func TestSyncUserHandlerOPTIONS(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	resp := request("OPTIONS", syncurl(uid, "storage/bookmarks"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("GET, HEAD, POST, DELETE", resp.Header().Get("Allow"))
+
+	resp = request("OPTIONS", syncurl(uid, "storage/bookmarks/b0"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	assert.Equal("GET, PUT, DELETE", resp.Header().Get("Allow"))
+
+	// OPTIONS does not create the collection
+	resp = request("OPTIONS", syncurl(uid, "storage/custom"), nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+	_, err := db.GetCollectionId("custom")
+	assert.Equal(syncstorage.ErrNotFound, err)
+}
+
+func TestSyncUserHandlerCollectionHEAD(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	{ // a missing collection is empty
+		resp := request("HEAD", syncurl(uid, "storage/col"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("0.00", resp.Header().Get("X-Last-Modified"))
+		assert.Equal("0", resp.Header().Get("X-Weave-Records"))
+		assert.Equal(0, resp.Body.Len())
+	}
+
+	resp := jsonrequest("POST", syncurl(uid, "storage/col"),
+		bytes.NewBufferString(`[{"id":"b0", "payload":"-"}, {"id":"b1", "payload":"-"}]`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+	modified := resp.Header().Get("X-Last-Modified")
+
+	{
+		resp := request("HEAD", syncurl(uid, "storage/col"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal(modified, resp.Header().Get("X-Last-Modified"))
+		assert.Equal("2", resp.Header().Get("X-Weave-Records"))
+		assert.Equal("0", resp.Header().Get("Content-Length"))
+		assert.Equal(0, resp.Body.Len())
+	}
+
+	{ // conditional requests are supported
+		header := make(http.Header)
+		header.Set("X-If-Modified-Since", modified)
+		resp := requestheaders("HEAD", syncurl(uid, "storage/col"), nil, header, handler)
+		assert.Equal(http.StatusNotModified, resp.Code)
+	}
+}
+
+func TestSyncUserHandlerCollectionGETConditional(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	resp := jsonrequest("POST", syncurl(uid, "storage/col"),
+		bytes.NewBufferString(`[{"id":"b0", "payload":"-"}]`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	modified := resp.Header().Get("X-Last-Modified")
+	ts, _ := ConvertTimestamp(modified)
+	before := syncstorage.ModifiedToString(ts - 1000)
+	after := syncstorage.ModifiedToString(ts + 1000)
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		h := make(http.Header)
+		h.Set("Accept", "application/json")
+		h.Set(header, value)
+		return requestheaders("GET", syncurl(uid, "storage/col"), nil, h, handler)
+	}
+
+	{ // not changed since
+		resp := get("X-If-Modified-Since", after)
+		assert.Equal(http.StatusNotModified, resp.Code, resp.Body.String())
+		assert.Equal(modified, resp.Header().Get("X-Last-Modified"))
+	}
+
+	{ // changed since
+		resp := get("X-If-Modified-Since", before)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.Equal(`["b0"]`, resp.Body.String())
+	}
+
+	{ // modified after the precondition
+		resp := get("X-If-Unmodified-Since", before)
+		assert.Equal(http.StatusPreconditionFailed, resp.Code, resp.Body.String())
+		assert.Equal(modified, resp.Header().Get("X-Last-Modified"))
+	}
+
+	{ // precondition is met
+		resp := get("X-If-Unmodified-Since", after)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	}
+
+	{ // other formats of the same timestamp compare equal
+		for _, value := range []string{
+			modified,
+			strings.TrimRight(strings.TrimRight(modified, "0"), "."),
+			modified + "0",
+			modified + "0001",
+		} {
+			resp := get("X-If-Modified-Since", value)
+			assert.Equal(http.StatusNotModified, resp.Code, value)
+
+			resp = get("X-If-Unmodified-Since", value)
+			assert.Equal(http.StatusOK, resp.Code, value)
+		}
+	}
+
+	{ // malformed values
+		for _, header := range []string{"X-If-Modified-Since", "X-If-Unmodified-Since"} {
+			for _, value := range []string{"abc", "-1"} {
+				resp := get(header, value)
+				assert.Equal(http.StatusBadRequest, resp.Code, header+": "+value)
+			}
+		}
+	}
+
+	{ // both headers is malformed
+		h := make(http.Header)
+		h.Set("Accept", "application/json")
+		h.Set("X-If-Modified-Since", after)
+		h.Set("X-If-Unmodified-Since", after)
+		resp := requestheaders("GET", syncurl(uid, "storage/col"), nil, h, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, resp.Body.String())
+	}
+}
+
+func TestSyncUserHandlerInfoConditional(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	resp := jsonrequest("POST", syncurl(uid, "storage/col"),
+		bytes.NewBufferString(`[{"id":"b0", "payload":"-"}]`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	modified := resp.Header().Get("X-Last-Modified")
+	ts, _ := ConvertTimestamp(modified)
+	before := syncstorage.ModifiedToString(ts - 1000)
+	after := syncstorage.ModifiedToString(ts + 1000)
+
+	for _, endpoint := range []string{"info/collections", "info/collection_usage", "info/collection_counts", "info/all"} {
+		get := func(header, value string) *httptest.ResponseRecorder {
+			h := make(http.Header)
+			h.Set("Accept", "application/json")
+			h.Set(header, value)
+			return requestheaders("GET", syncurl(uid, endpoint), nil, h, handler)
+		}
+
+		{ // not changed since
+			resp := get("X-If-Modified-Since", after)
+			assert.Equal(http.StatusNotModified, resp.Code, endpoint)
+			assert.Equal(modified, resp.Header().Get("X-Last-Modified"), endpoint)
+		}
+
+		{ // changed since
+			resp := get("X-If-Modified-Since", before)
+			assert.Equal(http.StatusOK, resp.Code, endpoint)
+			assert.Contains(resp.Body.String(), `"col"`, endpoint)
+		}
+
+		{ // modified after the precondition
+			resp := get("X-If-Unmodified-Since", before)
+			assert.Equal(http.StatusPreconditionFailed, resp.Code, endpoint)
+			assert.Equal(modified, resp.Header().Get("X-Last-Modified"), endpoint)
+		}
+
+		{ // precondition is met
+			resp := get("X-If-Unmodified-Since", after)
+			assert.Equal(http.StatusOK, resp.Code, endpoint)
+		}
+
+		{ // malformed values
+			for _, header := range []string{"X-If-Modified-Since", "X-If-Unmodified-Since"} {
+				resp := get(header, "abc")
+				assert.Equal(http.StatusBadRequest, resp.Code, endpoint+" "+header)
+			}
+		}
+	}
+}
+
+func TestSyncUserHandlerOffsetAlert(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	body := bytes.NewBufferString(`[{"id":"b0","payload":"x"},{"id":"b1","payload":"x"},{"id":"b2","payload":"x"}]`)
+	resp := jsonrequest("POST", syncurl(uid, "storage/col"), body, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	url := syncurl(uid, "storage/col?sort=oldest&offset=2")
+
+	{ // off by default
+		resp := request("GET", url, nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("", resp.Header().Get("X-Weave-Alert"))
+	}
+
+	handler.config.OffsetAlertThreshold = 2
+
+	{ // still served with the alert
+		resp := request("GET", url, nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal(`["b2"]`, resp.Body.String())
+		assert.Equal(offsetAlert, resp.Header().Get("X-Weave-Alert"))
+	}
+
+	for _, query := range []string{"?offset=1", ""} {
+		resp := request("GET", syncurl(uid, "storage/col"+query), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("", resp.Header().Get("X-Weave-Alert"), query)
+	}
+}
+
+func TestSyncUserHandlerMaxIdsPerRequest(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+	handler.config.MaxIdsPerRequest = 10
+
+	resp := jsonrequest("POST", syncurl(uid, "storage/col"), bytes.NewBufferString(`[{"id":"b0","payload":"x"}]`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	ids := func(num int) string {
+		list := make([]string, num)
+		for i := range list {
+			list[i] = fmt.Sprintf("b%d", i)
+		}
+		return strings.Join(list, ",")
+	}
+
+	{ // at the limit is fine
+		resp := request("GET", syncurl(uid, "storage/col?ids="+ids(10)), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.Equal(`["b0"]`, resp.Body.String())
+	}
+
+	for _, test := range []struct{ method, path string }{
+		{"GET", "storage/col?ids=" + ids(11)},
+		{"GET", "storage?ids=col/" + strings.Replace(ids(11), ",", ",col/", -1)},
+		{"DELETE", "storage/col?ids=" + ids(11)},
+	} {
+		resp := request(test.method, syncurl(uid, test.path), nil, handler)
+		if assert.Equal(http.StatusBadRequest, resp.Code, test.method+" "+test.path) {
+			assert.Equal(WEAVE_SIZE_LIMIT_EXCEEDED, resp.Body.String())
+		}
+	}
+
+	{ // 0 is unlimited
+		handler.config.MaxIdsPerRequest = 0
+		resp := request("GET", syncurl(uid, "storage/col?ids="+ids(500)), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+		assert.Equal(`["b0"]`, resp.Body.String())
+	}
+
+	// nothing was deleted
+	resp = request("GET", syncurl(uid, "storage/col"), nil, handler)
+	assert.Equal(`["b0"]`, resp.Body.String())
+}
+
+func TestSyncUserHandlerStorageGET(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	for _, path := range []string{"meta/global", "meta/other", "crypto/keys", "tabs/t0"} {
+		body := bytes.NewBufferString(`{"payload":"` + path + `"}`)
+		resp := jsonrequest("PUT", syncurl(uid, "storage/"+path), body, handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+	}
+
+	resp := request("GET", syncurl(uid, "storage?ids=meta/global,crypto/keys,crypto/missing,nope/b0"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+	assert.NotEqual("", resp.Header().Get("X-Last-Modified"))
+
+	var results map[string]jsResult
+	if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results), resp.Body.String()) {
+		return
+	}
+
+	assert.Len(results, 3)
+	if assert.Len(results["meta"], 1) {
+		assert.Equal("global", results["meta"][0].Id)
+		assert.Equal("meta/global", results["meta"][0].Payload)
+	}
+	if assert.Len(results["crypto"], 1) {
+		assert.Equal("keys", results["crypto"][0].Id)
+		assert.Equal("crypto/keys", results["crypto"][0].Payload)
+	}
+	assert.Len(results["nope"], 0)
+
+	for _, query := range []string{
+		"",
+		"?ids=meta",
+		"?ids=meta/bad%09id",
+		"?ids=bad%09name/global",
+		"?ids=" + strings.Repeat("meta/global,", 100) + "meta/global",
+	} {
+		resp := request("GET", syncurl(uid, "storage"+query), nil, handler)
+		assert.Equal(http.StatusBadRequest, resp.Code, query)
+	}
+}
+
+func TestSyncUserHandlerInfoAll(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	resp := jsonrequest("POST", syncurl(uid, "storage/col"),
+		bytes.NewBufferString(`[{"id":"b0", "payload":"1234"}, {"id":"b1", "payload":"5678"}]`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	var info struct {
+		Collections      map[string]float64 `json:"collections"`
+		CollectionUsage  map[string]float64 `json:"collection_usage"`
+		CollectionCounts map[string]int     `json:"collection_counts"`
+	}
+
+	resp = request("GET", syncurl(uid, "info/all"), nil, handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	modified := resp.Header().Get("X-Last-Modified")
+	if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &info)) {
+		ts, _ := ConvertTimestamp(modified)
+		assert.Equal(float64(ts)/1000, info.Collections["col"])
+		assert.Equal(8.0/1024, info.CollectionUsage["col"])
+		assert.Equal(2, info.CollectionCounts["col"])
+	}
+
+	header := make(http.Header)
+	header.Set("X-If-Modified-Since", modified)
+
+	{ // nothing changed
+		resp := requestheaders("GET", syncurl(uid, "info/all"), nil, header, handler)
+		assert.Equal(http.StatusNotModified, resp.Code)
+		assert.Equal(modified, resp.Header().Get("X-Last-Modified"))
+	}
+
+	resp = jsonrequest("PUT", syncurl(uid, "storage/other/b0"), bytes.NewBufferString(`{"payload":"-"}`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	{ // a write makes it fetch again
+		resp := requestheaders("GET", syncurl(uid, "info/all"), nil, header, handler)
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Contains(resp.Body.String(), `"other"`)
+	}
+}
+
+func TestSyncUserHandlerInfoEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	// a brand new user gets empty objects, not null, from every endpoint
+	uid := uniqueUID()
+	pool := NewSyncPoolHandler(testSyncPoolConfig(), nil)
+	handler := NewCacheHandler(pool, DefaultCacheHandlerConfig)
+
+	for _, path := range []string{"info/collections", "info/collection_usage", "info/collection_counts"} {
+		for i := 0; i < 2; i++ { // the second info/collections is cached
+			resp := request("GET", syncurl(uid, path), nil, handler)
+			if assert.Equal(http.StatusOK, resp.Code, path) {
+				assert.Equal("{}", strings.TrimSpace(resp.Body.String()), path)
+			}
+		}
+	}
+
+	resp := request("GET", syncurl(uid, "info/all"), nil, handler)
+	if assert.Equal(http.StatusOK, resp.Code) {
+		var info map[string]json.RawMessage
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &info)) {
+			for _, key := range []string{"collections", "collection_usage", "collection_counts"} {
+				assert.Equal("{}", string(info[key]), key)
+			}
+		}
+	}
+}
+
+func TestSyncUserHandlerTrailingSlash(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	// writes work with or without the slash
+	resp := jsonrequest("PUT", syncurl(uid, "storage/col/b0/"), bytes.NewBufferString(`{"payload":"0"}`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+	resp = jsonrequest("POST", syncurl(uid, "storage/col/"), bytes.NewBufferString(`[{"id":"b1","payload":"1"}]`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	for _, path := range []string{
+		"storage?ids=col/b0,col/b1",
+		"storage/col?full=1",
+		"storage/col/b0",
+		"info/collections",
+		"info/collection_counts",
+	} {
+		without := request("GET", syncurl(uid, path), nil, handler)
+		if !assert.Equal(http.StatusOK, without.Code, path) {
+			continue
+		}
+
+		slashed := strings.Replace(path, "?", "/?", 1)
+		if slashed == path {
+			slashed += "/"
+		}
+
+		with := request("GET", syncurl(uid, slashed), nil, handler)
+		assert.Equal(http.StatusOK, with.Code, slashed)
+		assert.Equal(without.Body.String(), with.Body.String(), slashed)
+		assert.Equal(without.Header().Get("X-Last-Modified"), with.Header().Get("X-Last-Modified"), slashed)
+	}
+
+	{ // redirected when configured
+		conf := NewDefaultSyncUserHandlerConfig()
+		conf.RedirectTrailingSlash = true
+		handler := NewSyncUserHandler(uid, db, conf)
+
+		for _, method := range []string{"GET", "HEAD"} {
+			resp := request(method, syncurl(uid, "storage/col/?full=1"), nil, handler)
+			assert.Equal(http.StatusMovedPermanently, resp.Code, method)
+			assert.Equal("/1.5/"+uid+"/storage/col?full=1", resp.Header().Get("Location"), method)
+		}
+
+		// writes are not redirected, clients may not resend the body
+		resp := jsonrequest("PUT", syncurl(uid, "storage/col/b2/"), bytes.NewBufferString(`{"payload":"2"}`), handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+		resp = request("DELETE", syncurl(uid, "storage/"), nil, handler)
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+
+		resp = request("GET", syncurl(uid, "info/collection_counts"), nil, handler)
+		assert.Equal("{}", resp.Body.String())
+	}
+}
+
+func TestSyncUserHandlerDisabledRoutes(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	conf := NewDefaultSyncUserHandlerConfig()
+	handler := NewSyncUserHandler(uid, db, conf)
+
+	url := syncurl(uid, "info/quota")
+	assert.Equal(http.StatusOK, request("GET", url, nil, handler).Code)
+
+	conf.DisabledRoutes = map[string]int{"info_quota": http.StatusNotImplemented}
+	assert.Equal(http.StatusNotImplemented, request("GET", url, nil, handler).Code)
+
+	conf.DisabledRoutes["info_quota"] = http.StatusServiceUnavailable
+	assert.Equal(http.StatusServiceUnavailable, request("GET", url, nil, handler).Code)
+
+	// other routes are not affected
+	assert.Equal(http.StatusOK, request("GET", syncurl(uid, "info/collections"), nil, handler).Code)
+
+	delete(conf.DisabledRoutes, "info_quota")
+	assert.Equal(http.StatusOK, request("GET", url, nil, handler).Code)
+}
+
+func TestSyncUserHandlerCollectionWriteLimits(t *testing.T) {
+	assert := assert.New(t)
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.CollectionWriteLimits = map[string]RateLimit{
+		"tabs": {PerSecond: 0.1, Burst: 3},
+	}
+	handler := NewSyncUserHandler(uid, db, conf)
+
+	put := func(collection string) *httptest.ResponseRecorder {
+		return jsonrequest("PUT", syncurl(uid, "storage/"+collection+"/b0"),
+			bytes.NewBufferString(`{"payload":"-"}`), handler)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp := put("tabs")
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	}
+
+	{
+		resp := put("tabs")
+		assert.Equal(http.StatusTooManyRequests, resp.Code, resp.Body.String())
+		assert.Equal("10", resp.Header().Get("Retry-After"))
+
+		resp = jsonrequest("POST", syncurl(uid, "storage/tabs"),
+			bytes.NewBufferString(`[{"id":"b1", "payload":"-"}]`), handler)
+		assert.Equal(http.StatusTooManyRequests, resp.Code, resp.Body.String())
+	}
+
+	// reads are not limited
+	assert.Equal(http.StatusOK, request("GET", syncurl(uid, "storage/tabs"), nil, handler).Code)
+
+	// other collections for the same user are unaffected
+	for i := 0; i < 10; i++ {
+		resp := put("bookmarks")
+		assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	}
+}
+
+func TestSyncUserHandlerCollectionGETStreamed(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	resp := jsonrequest("POST", syncurl(uid, "storage/test"),
+		bytes.NewBufferString(`[
+			{"id":"b0", "payload":"0", "sortindex":3},
+			{"id":"b1", "payload":"1", "sortindex":2},
+			{"id":"b2", "payload":"2", "sortindex":1}
+		]`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	get := func(query, accept string) *httptest.ResponseRecorder {
+		header := make(http.Header)
+		header.Set("Accept", accept)
+		return requestheaders("GET", syncurl(uid, "storage/test?full=1&sort=index"+query), nil, header, handler)
+	}
+
+	{ // json array
+		resp := get("&limit=2", "application/json")
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("application/json", resp.Header().Get("Content-Type"))
+		assert.Equal("2", resp.Header().Get("X-Weave-Records"))
+		assert.Equal("2", resp.Header().Get("X-Weave-Next-Offset"))
+
+		var results jsResult
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) && assert.Len(results, 2) {
+			assert.Equal("b0", results[0].Id)
+			assert.Equal("b1", results[1].Id)
+		}
+	}
+
+	{ // newlines, last page
+		resp := get("&limit=2&offset=2", "application/newlines")
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("application/newlines", resp.Header().Get("Content-Type"))
+		assert.Equal("1", resp.Header().Get("X-Weave-Records"))
+		assert.Equal("", resp.Header().Get("X-Weave-Next-Offset"))
+
+		lines := strings.Split(strings.TrimSpace(resp.Body.String()), "\n")
+		if assert.Len(lines, 1) {
+			assert.Contains(lines[0], `"id":"b2"`)
+		}
+	}
+
+	{ // past the end
+		resp := get("&offset=10", "application/json")
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("0", resp.Header().Get("X-Weave-Records"))
+		assert.Equal("[]", resp.Body.String())
+	}
+
+	{ // more than one page is read from the database
+		cId, err := db.GetCollectionId("test")
+		if !assert.NoError(err) {
+			return
+		}
+		for i := 0; i < streamPageSize; i++ {
+			_, err := db.PutBSO(cId, "p"+strconv.Itoa(i), syncstorage.String("p"), syncstorage.Int(0), nil)
+			if !assert.NoError(err) {
+				return
+			}
+		}
+
+		total := streamPageSize + 3
+		resp := get("", "application/json")
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal(strconv.Itoa(total), resp.Header().Get("X-Weave-Records"))
+
+		var results jsResult
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) && assert.Len(results, total) {
+			assert.Equal("b0", results[0].Id)
+		}
+	}
+}
+
+func TestSyncUserHandlerCollectionGETVary(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	resp := jsonrequest("PUT", syncurl(uid, "storage/test/b0"), bytes.NewBufferString(`{"payload":"0"}`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	for _, accept := range []string{"application/json", "application/newlines", "*/*"} {
+		header := make(http.Header)
+		header.Set("Accept", accept)
+		header.Set("Accept-Encoding", "gzip")
+
+		resp := requestheaders("GET", syncurl(uid, "storage/test?full=1"), nil, header, handler)
+		assert.Equal(http.StatusOK, resp.Code, accept)
+		assert.Equal("Accept, Accept-Encoding", resp.Header().Get("Vary"), accept)
+	}
+
+	// also when the collection does not exist or the request is refused
+	for _, path := range []string{"storage/missing", "storage/test?format=xml"} {
+		resp := request("GET", syncurl(uid, path), nil, handler)
+		assert.Equal("Accept, Accept-Encoding", resp.Header().Get("Vary"), path)
+	}
+}
+
+func TestSyncUserHandlerExplicitSortIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, explicit := range []bool{false, true} {
+		uid := uniqueUID()
+		db, _ := syncstorage.NewDB(":memory:", nil)
+		conf := NewDefaultSyncUserHandlerConfig()
+		conf.ExplicitSortIndex = explicit
+		handler := NewSyncUserHandler(uid, db, conf)
+
+		body := bytes.NewBufferString(`[{"id":"set","payload":"0","sortindex":0},{"id":"unset","payload":"0"}]`)
+		resp := jsonrequest("POST", syncurl(uid, "storage/test"), body, handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+
+		// only BSOs written with a sortindex have one when it is explicit
+		for _, bId := range []string{"set", "unset"} {
+			resp := request("GET", syncurl(uid, "storage/test/"+bId), nil, handler)
+			var bso map[string]interface{}
+			if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &bso), resp.Body.String()) {
+				_, found := bso["sortindex"]
+				assert.Equal(explicit && bId == "set", found, "explicit=%t, %s", explicit, bId)
+			}
+		}
+
+		resp = request("GET", syncurl(uid, "storage/test?full=1&sort=oldest"), nil, handler)
+		var bsos []map[string]interface{}
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &bsos), resp.Body.String()) && assert.Len(bsos, 2) {
+			for _, bso := range bsos {
+				_, found := bso["sortindex"]
+				assert.Equal(explicit && bso["id"] == "set", found, "explicit=%t, %s", explicit, bso["id"])
+			}
+		}
+
+		// replacing without a sortindex does not set one
+		for _, bId := range []string{"set", "new"} {
+			url := syncurl(uid, "storage/test/"+bId+"?replace=1")
+			resp := jsonrequest("PUT", url, bytes.NewBufferString(`{"payload":"1"}`), handler)
+			if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+				return
+			}
+
+			resp = request("GET", syncurl(uid, "storage/test/"+bId), nil, handler)
+			var bso map[string]interface{}
+			if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &bso), resp.Body.String()) {
+				_, found := bso["sortindex"]
+				assert.False(found, "explicit=%t, %s", explicit, bId)
+			}
+		}
+	}
+}
+
+func TestSyncUserHandlerCollectionGETFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	resp := jsonrequest("POST", syncurl(uid, "storage/test"),
+		bytes.NewBufferString(`[{"id":"b0", "payload":"0"}, {"id":"b1", "payload":"1"}]`), handler)
+	if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+		return
+	}
+
+	get := func(query, accept string) *httptest.ResponseRecorder {
+		header := make(http.Header)
+		if accept != "" {
+			header.Set("Accept", accept)
+		}
+		return requestheaders("GET", syncurl(uid, "storage/test?full=1&sort=oldest"+query), nil, header, handler)
+	}
+
+	// format overrides the Accept header, even one that is not supported
+	for _, accept := range []string{"", "application/json", "text/html"} {
+		resp := get("&format=newlines", accept)
+		if !assert.Equal(http.StatusOK, resp.Code, accept) {
+			continue
+		}
+
+		assert.Equal("application/newlines", resp.Header().Get("Content-Type"))
+		lines := strings.Split(strings.TrimSpace(resp.Body.String()), "\n")
+		if assert.Len(lines, 2, accept) {
+			assert.Contains(lines[0], `"id":"b0"`)
+			assert.Contains(lines[1], `"id":"b1"`)
+		}
+	}
+
+	{
+		resp := get("&format=json", "application/newlines")
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.Equal("application/json", resp.Header().Get("Content-Type"))
+
+		var results jsResult
+		if assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+			assert.Len(results, 2)
+		}
+	}
+
+	for _, format := range []string{"xml", "", "NEWLINES"} {
+		resp := get("&format="+format, "application/json")
+		assert.Equal(http.StatusBadRequest, resp.Code, format)
+	}
+}
+
+func TestSyncUserHandlerMaxResponseBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	conf := NewDefaultSyncUserHandlerConfig()
+	conf.MaxResponseBytes = 35 * 1024
+	handler := NewSyncUserHandler(uid, db, conf)
+
+	// 10 BSOs with 10KB payloads, 3 fit in a response
+	payload := strings.Repeat("1234567890", 1024)
+	for i := 0; i < 10; i++ {
+		body := bytes.NewBufferString(fmt.Sprintf(`{"payload":"%s","sortindex":%d}`, payload, 10-i))
+		resp := jsonrequest("PUT", syncurl(uid, fmt.Sprintf("storage/test/b%d", i)), body, handler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+	}
+
+	get := func(query, accept string) *httptest.ResponseRecorder {
+		header := make(http.Header)
+		header.Set("Accept", accept)
+		return requestheaders("GET", syncurl(uid, "storage/test?full=1&sort=index"+query), nil, header, handler)
+	}
+
+	{ // page through all of them
+		var seen []string
+		offset := ""
+		for pages := 0; pages < 10; pages++ {
+			query := ""
+			if offset != "" {
+				query = "&offset=" + offset
+			}
+
+			resp := get(query, "application/json")
+			if !assert.Equal(http.StatusOK, resp.Code) {
+				return
+			}
+			assert.True(resp.Body.Len() <= conf.MaxResponseBytes, "%d bytes", resp.Body.Len())
+			assert.Equal(strconv.Itoa(resp.Body.Len()), resp.Header().Get("Content-Length"))
+
+			var results jsResult
+			if !assert.NoError(json.Unmarshal(resp.Body.Bytes(), &results)) {
+				return
+			}
+			assert.Equal(strconv.Itoa(len(results)), resp.Header().Get("X-Weave-Records"))
+
+			for _, bso := range results {
+				seen = append(seen, bso.Id)
+			}
+
+			offset = resp.Header().Get("X-Weave-Next-Offset")
+			if offset == "" {
+				break
+			}
+			assert.Len(results, 3)
+		}
+
+		assert.Equal([]string{"b0", "b1", "b2", "b3", "b4", "b5", "b6", "b7", "b8", "b9"}, seen)
+	}
+
+	{ // newlines are bounded too
+		resp := get("&offset=3", "application/newlines")
+		assert.Equal(http.StatusOK, resp.Code)
+		assert.True(resp.Body.Len() <= conf.MaxResponseBytes, "%d bytes", resp.Body.Len())
+		assert.Equal("3", resp.Header().Get("X-Weave-Records"))
+		assert.Equal("6", resp.Header().Get("X-Weave-Next-Offset"))
+		assert.Len(strings.Split(strings.TrimSpace(resp.Body.String()), "\n"), 3)
+	}
+
+	{ // the limit still applies
+		resp := get("&limit=2", "application/json")
+		assert.Equal("2", resp.Header().Get("X-Weave-Records"))
+		assert.Equal("2", resp.Header().Get("X-Weave-Next-Offset"))
+
+		// and there is no next page at the end
+		resp = get("&limit=2&offset=8", "application/json")
+		assert.Equal("2", resp.Header().Get("X-Weave-Records"))
+		assert.Equal("", resp.Header().Get("X-Weave-Next-Offset"))
+	}
+
+	{ // a BSO larger than the limit is still returned so clients make progress
+		conf.MaxResponseBytes = 1024
+		resp := get("", "application/json")
+		assert.Equal("1", resp.Header().Get("X-Weave-Records"))
+		assert.Equal("1", resp.Header().Get("X-Weave-Next-Offset"))
+	}
+
+	{ // ids only responses are not affected
+		resp := request("GET", syncurl(uid, "storage/test"), nil, handler)
+		assert.Equal("10", resp.Header().Get("X-Weave-Records"))
+	}
+}
+
+// firstByteRecorder stops the benchmark timer on the first write so
+// only the time to first byte is measured
+type firstByteRecorder struct {
+	*httptest.ResponseRecorder
+	b     *testing.B
+	wrote bool
+}
+
+func (f *firstByteRecorder) Write(p []byte) (int, error) {
+	if !f.wrote {
+		f.b.StopTimer()
+		f.wrote = true
+	}
+	return f.ResponseRecorder.Write(p)
+}
+
+func BenchmarkCollectionGETFirstByte(b *testing.B) {
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	handler := NewSyncUserHandler(uid, db, nil)
+
+	payload := strings.Repeat("x", 16*1024)
+	for i := 0; i < 10; i++ {
+		var body bytes.Buffer
+		body.WriteString("[")
+		for j := 0; j < 100; j++ {
+			if j > 0 {
+				body.WriteString(",")
+			}
+			fmt.Fprintf(&body, `{"id":"b%d","payload":"%s"}`, i*100+j, payload)
+		}
+		body.WriteString("]")
+
+		resp := jsonrequest("POST", syncurl(uid, "storage/test"), &body, handler)
+		if resp.Code != http.StatusOK {
+			b.Fatal(resp.Body.String())
+		}
+	}
+
+	url := syncurl(uid, "storage/test?full=1")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest("GET", url, nil)
+		w := &firstByteRecorder{ResponseRecorder: httptest.NewRecorder(), b: b}
+
+		b.StartTimer()
+		handler.ServeHTTP(w, req)
+		b.StopTimer()
+
+		if w.Code != http.StatusOK {
+			b.Fatal(w.Body.String())
+		}
+	}
+}
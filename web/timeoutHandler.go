@@ -0,0 +1,89 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var streamedRoute = regexp.MustCompile(`/1\.5/[0-9]+/storage/[^/]+$`)
+
+// NewTimeoutHandler returns a http.Handler that stops waiting for h after dt
+// and sends a 503 with a weave error instead. Responses from h are buffered
+// until it returns, later writes by h fail with http.ErrHandlerTimeout and
+// its request context is cancelled.
+//
+// Full collection GETs are not buffered since they are streamed a page at
+// a time. They only get a context deadline, the handler checks it between
+// pages and sends the 503 when nothing has been written yet or aborts the
+// response when it has.
+func NewTimeoutHandler(h http.Handler, dt time.Duration) http.Handler {
+	return &TimeoutHandler{
+		handler: http.TimeoutHandler(h, dt, WEAVE_UNKNOWN_ERROR),
+		stream:  h,
+		timeout: dt,
+	}
+}
+
+type TimeoutHandler struct {
+	handler http.Handler
+	stream  http.Handler
+	timeout time.Duration
+}
+
+func (h *TimeoutHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if streamed(req) {
+		ctx, cancel := context.WithTimeout(req.Context(), h.timeout)
+		defer cancel()
+		h.stream.ServeHTTP(w, req.WithContext(ctx))
+		return
+	}
+
+	h.handler.ServeHTTP(&timeoutWriter{ResponseWriter: w, req: req, timeout: h.timeout}, req)
+}
+
+// streamed checks if req is a full collection GET, see streamBSOs
+func streamed(req *http.Request) bool {
+	return req.Method == "GET" &&
+		req.URL.Query().Get("full") != "" &&
+		streamedRoute.MatchString(req.URL.Path)
+}
+
+// sendTimeout sends the same 503 as TimeoutHandler for requests that
+// found their deadline had passed before writing anything
+func sendTimeout(w http.ResponseWriter, req *http.Request, reason error) {
+	setTimeoutHeaders(w, req, reason)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(WEAVE_UNKNOWN_ERROR))
+}
+
+func setTimeoutHeaders(w http.ResponseWriter, req *http.Request, reason error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", "10")
+	ensureWeaveTimestamp(w.Header())
+
+	if session, ok := SessionFromContext(req.Context()); ok {
+		session.ErrorResult = reason
+	}
+}
+
+// timeoutWriter adds the headers http.TimeoutHandler leaves out
+// when it sends its 503
+type timeoutWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	timeout time.Duration
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	// responses from the handler have their headers copied in before
+	// this is called, a 503 without any is from http.TimeoutHandler
+	if code == http.StatusServiceUnavailable && w.Header().Get("Content-Type") == "" {
+		setTimeoutHeaders(w, w.req, errors.Errorf("Request took longer than %s", w.timeout))
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,122 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla-services/go-syncstorage/syncstorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// starts writing a response before running out of time
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("partial"))
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+
+	handler := NewTimeoutHandler(slow, 10*time.Millisecond)
+	resp := request("GET", "/1.5/12345/storage/bookmarks", nil, handler)
+	assert.Equal(http.StatusServiceUnavailable, resp.Code)
+	assert.Equal("application/json", resp.Header().Get("Content-Type"))
+	assert.NotEqual("", resp.Header().Get("Retry-After"))
+	assert.NotEqual("", resp.Header().Get("X-Weave-Timestamp"))
+	assert.Equal(WEAVE_UNKNOWN_ERROR, resp.Body.String())
+
+	// fast handlers are passed through untouched, including their own 503s
+	handler = NewTimeoutHandler(EchoHandler, time.Second)
+	resp = request("GET", "/1.5/12345/storage/bookmarks", nil, handler)
+	assert.Equal(http.StatusOK, resp.Code)
+
+	unavailable := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		JSONError(w, "busy", http.StatusServiceUnavailable)
+	})
+	handler = NewTimeoutHandler(unavailable, time.Second)
+	resp = request("GET", "/1.5/12345/storage/bookmarks", nil, handler)
+	assert.Equal(http.StatusServiceUnavailable, resp.Code)
+	assert.Equal("", resp.Header().Get("Retry-After"))
+	assert.Contains(resp.Body.String(), "busy")
+}
+
+// slowWriter makes each write take a while so a streamed response
+// runs out of time part way through
+type slowWriter struct {
+	http.ResponseWriter
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseWriter.Write(b)
+}
+
+func TestTimeoutHandlerStreamed(t *testing.T) {
+	assert := assert.New(t)
+
+	uid := uniqueUID()
+	db, _ := syncstorage.NewDB(":memory:", nil)
+	userHandler := NewSyncUserHandler(uid, db, nil)
+
+	// a couple of pages, in POSTs small enough to be accepted
+	for p := 0; p < 2; p++ {
+		body := bytes.NewBufferString("[")
+		for i := 0; i < streamPageSize; i++ {
+			if i > 0 {
+				body.WriteString(",")
+			}
+			fmt.Fprintf(body, `{"id":"p%d-%d", "payload":"-"}`, p, i)
+		}
+		body.WriteString("]")
+
+		resp := jsonrequest("POST", syncurl(uid, "storage/col"), body, userHandler)
+		if !assert.Equal(http.StatusOK, resp.Code, resp.Body.String()) {
+			return
+		}
+	}
+
+	{ // out of time before anything is written
+		handler := NewTimeoutHandler(userHandler, time.Nanosecond)
+		resp := request("GET", syncurl(uid, "storage/col?full=1"), nil, handler)
+		assert.Equal(http.StatusServiceUnavailable, resp.Code)
+		assert.NotEqual("", resp.Header().Get("Retry-After"))
+		assert.Equal(WEAVE_UNKNOWN_ERROR, resp.Body.String())
+	}
+
+	{ // out of time part way through, the response is aborted
+		var written *httptest.ResponseRecorder
+		slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the response is not buffered, it goes straight to the recorder
+			written, _ = w.(*httptest.ResponseRecorder)
+			userHandler.ServeHTTP(&slowWriter{ResponseWriter: w, delay: time.Millisecond}, r)
+		})
+		handler := NewTimeoutHandler(slow, 50*time.Millisecond)
+
+		aborted := func() (rec interface{}) {
+			defer func() { rec = recover() }()
+			request("GET", syncurl(uid, "storage/col?full=1"), nil, handler)
+			return
+		}()
+
+		assert.Equal(http.ErrAbortHandler, aborted)
+		if assert.NotNil(written) {
+			assert.Equal(http.StatusOK, written.Code)
+			assert.True(strings.HasPrefix(written.Body.String(), "["))
+			assert.False(strings.HasSuffix(written.Body.String(), "]"))
+		}
+	}
+}
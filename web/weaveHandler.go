@@ -1,6 +1,8 @@
 package web
 
 import (
+	"io"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/mozilla-services/go-syncstorage/syncstorage"
@@ -17,6 +19,7 @@ const (
 
 	WEAVE_UNKNOWN_ERROR       = "0"
 	WEAVE_ILLEGAL_METH        = "1"  // Illegal method/protocol
+	WEAVE_INVALID_USER        = "3"  // Invalid/missing username
 	WEAVE_MALFORMED_JSON      = "6"  // Json parse failure
 	WEAVE_INVALID_WBO         = "8"  // Invalid Weave Basic Object
 	WEAVE_OVER_QUOTA          = "14" // User over quota
@@ -41,6 +44,54 @@ func WeaveSizeLimitExceeded(w http.ResponseWriter, r *http.Request, reason error
 	w.Write([]byte(WEAVE_SIZE_LIMIT_EXCEEDED))
 }
 
+// WeaveOverQuota is sent when a write would take a user over their
+// storage quota
+func WeaveOverQuota(w http.ResponseWriter, r *http.Request, reason error) {
+	if session, ok := SessionFromContext(r.Context()); ok {
+		session.ErrorResult = reason
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(WEAVE_OVER_QUOTA))
+}
+
+// WeaveInvalidUser is sent when a request does not have a uid. Hawk
+// authentication normally makes sure there is one
+func WeaveInvalidUser(w http.ResponseWriter, r *http.Request, reason error) {
+	if session, ok := SessionFromContext(r.Context()); ok {
+		session.ErrorResult = reason
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(WEAVE_INVALID_USER))
+}
+
+// WeaveMethodNotAllowed is sent when a resource does not support the
+// request's method. allow lists the methods it does
+func WeaveMethodNotAllowed(w http.ResponseWriter, r *http.Request, allow string) {
+	w.Header().Set("Allow", allow)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	w.Write([]byte(WEAVE_ILLEGAL_METH))
+}
+
+// WeaveUnsupportedMediaType is sent when a write has a Content-Type
+// the server does not understand
+func WeaveUnsupportedMediaType(w http.ResponseWriter, r *http.Request, reason error) {
+	// the body is never read, drain it like sendRequestProblem does
+	if r.Body != nil {
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+	}
+
+	if session, ok := SessionFromContext(r.Context()); ok {
+		session.ErrorResult = reason
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnsupportedMediaType)
+	w.Write([]byte(WEAVE_ILLEGAL_METH))
+}
+
 // WeaveHandler is a convenient and messy place to capture
 // sync 1.5, and legacy weave specific functionality.
 // TODO will have to implement http.Hijack()
@@ -77,14 +128,27 @@ func (w *weaveWriter) addXWeaveTimestamp() {
 		return
 	}
 
-	if lm := w.w.Header().Get("X-Last-Modified"); lm != "" {
-		w.w.Header().Set("X-Weave-Timestamp", lm)
+	setWeaveTimestamp(w.w.Header())
+	w.wroteTS = true
+}
+
+// setWeaveTimestamp sets X-Weave-Timestamp to X-Last-Modified when there
+// is one, otherwise the current time
+func setWeaveTimestamp(h http.Header) {
+	if lm := h.Get("X-Last-Modified"); lm != "" {
+		h.Set("X-Weave-Timestamp", lm)
 	} else {
-		w.w.Header().Set("X-Weave-Timestamp",
-			syncstorage.ModifiedToString(syncstorage.Now()))
+		h.Set("X-Weave-Timestamp", syncstorage.ModifiedToString(syncstorage.Now()))
 	}
+}
 
-	w.wroteTS = true
+// ensureWeaveTimestamp sets X-Weave-Timestamp if it is missing. Error
+// responses written outside of WeaveHandler, like Hawk's 401s, use it
+// so clients always get a timestamp back
+func ensureWeaveTimestamp(h http.Header) {
+	if h.Get("X-Weave-Timestamp") == "" {
+		setWeaveTimestamp(h)
+	}
 }
 
 // implement http.ResponseWriter